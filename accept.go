@@ -0,0 +1,65 @@
+package smux
+
+import "errors"
+
+// filterAccept authenticates a stream taken from the accept backlog
+// and runs the AcceptFilters on it, it resets the stream and returns
+// false when it is refused. Filters run in the accepting goroutine,
+// so that a slow one does not hold up recvLoop.
+func (s *Session) filterAccept(stream *Stream) bool {
+	if !s.authenticate(stream) {
+		return false
+	}
+	for _, filter := range s.config.AcceptFilters {
+		err := filter(stream)
+		if err == nil {
+			continue
+		}
+		s.log(LevelDebug, "stream refused by accept filter", "sid", stream.id, "err", err)
+		s.refuseStream(stream, err, ResetRefused, err.Error())
+		return false
+	}
+	return true
+}
+
+// refuseStream resets a stream refused with err, with code and msg
+// unless err is a *StreamError
+func (s *Session) refuseStream(stream *Stream, err error, code uint32, msg string) {
+	var se *StreamError
+	if errors.As(err, &se) {
+		code, msg = se.Code, se.Message
+	}
+	stream.reset(code, msg)
+}
+
+// StopAccepting quiesces the session: the streams the peer opens from
+// now on are reset with ResetRefused, as are those waiting in the
+// accept backlog, and AcceptStream returns ErrNotAccepting. The open
+// streams keep working, and so does OpenStream. Unlike Shutdown, the
+// peer is not told to stop opening streams.
+func (s *Session) StopAccepting() {
+	s.stopAcceptOnce.Do(func() { close(s.chStopAccept) })
+	s.refuseBacklog()
+}
+
+// acceptStopped reports whether StopAccepting was called
+func (s *Session) acceptStopped() bool {
+	select {
+	case <-s.chStopAccept:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuseBacklog resets the streams waiting to be accepted
+func (s *Session) refuseBacklog() {
+	for {
+		select {
+		case stream := <-s.chAccepts:
+			stream.reset(ResetRefused, ErrNotAccepting.Error())
+		default:
+			return
+		}
+	}
+}
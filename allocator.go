@@ -0,0 +1,45 @@
+package smux
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+// ErrStreamIDExhausted is returned by OpenStream once every local
+// stream identifier was used, identifiers are never reused since the
+// peer may still know them. Such a session should be replaced by a
+// new one, Shutdown lets its streams finish.
+var ErrStreamIDExhausted = errors.New("stream identifiers exhausted")
+
+// StreamIDAllocator hands out identifiers for streams opened locally.
+// Identifiers must be odd on the client side and even on the server
+// side, OpenStream rejects any other value.
+type StreamIDAllocator interface {
+	NextStreamID() (uint32, error)
+}
+
+// sequentialAllocator is the default allocator, counting up by two
+type sequentialAllocator struct {
+	next uint32
+}
+
+func newSequentialAllocator(client bool) *sequentialAllocator {
+	if client {
+		return &sequentialAllocator{next: 1}
+	}
+	return &sequentialAllocator{next: 2}
+}
+
+func (a *sequentialAllocator) NextStreamID() (uint32, error) {
+	for {
+		next := atomic.LoadUint32(&a.next)
+		if next > math.MaxUint32-2 {
+			// adding two would wrap into the identifiers of the peer
+			return 0, ErrStreamIDExhausted
+		}
+		if atomic.CompareAndSwapUint32(&a.next, next, next+2) {
+			return next + 2, nil
+		}
+	}
+}
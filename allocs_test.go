@@ -0,0 +1,35 @@
+//go:build !race
+
+// the race detector allocates on its own, the counts only hold
+// without it
+
+package smux
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteAllocs(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	session, _ := Client(c1, nil)
+	defer session.Close()
+	stream, _ := session.OpenStream()
+
+	msg := make([]byte, 3*4096+100)
+	stream.Write(msg)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := stream.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs >= 1 {
+		t.Fatal("steady-state writes allocate", allocs)
+	}
+}
@@ -0,0 +1,131 @@
+package smux
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+)
+
+// ErrAuthTokenTooLarge is returned by OpenStreamContext for an auth
+// token longer than 255 bytes, or 227 bytes once sealed
+var ErrAuthTokenTooLarge = errors.New("auth token too large")
+
+// ErrAuthTokenInsecure is returned by OpenStreamContext for an auth
+// token on a session that could not keep it secret
+var ErrAuthTokenInsecure = errors.New("auth token needs an encrypted session or a TLS connection")
+
+type authTokenKey struct{}
+
+// WithAuthToken returns a copy of ctx carrying a credential, which
+// OpenStreamContext sends to the peer along with the stream for its
+// Config.StreamAuthenticator to check. Once the key exchange of an
+// encrypted session chose an AEAD cipher, the token is sealed with
+// it, bound to its stream and session, and may be up to 227 bytes.
+// A sealed token is opened once, replays are dropped. Other sessions
+// only send tokens of up to 255 bytes in the clear over TLS
+// connections, OpenStreamContext fails with ErrAuthTokenInsecure
+// otherwise.
+func WithAuthToken(ctx context.Context, token []byte) context.Context {
+	return context.WithValue(ctx, authTokenKey{}, token)
+}
+
+// authOpen returns the SYN metadata carrying the auth token of ctx
+// for stream sid, first so that it always finds room. A token to seal
+// is followed by room for the overhead, sendLoop seals it in place.
+func (s *Session) authOpen(ctx context.Context, sid uint32) ([]byte, error) {
+	token, _ := ctx.Value(authTokenKey{}).([]byte)
+	if token == nil {
+		return nil, nil
+	}
+	if s.upstream() || s.config.Yamux {
+		return nil, errors.New("auth tokens are not supported by the protocol spoken")
+	}
+	if c := s.frameCipher(); c != nil && c.aead != nil {
+		if len(token)+c.overhead() > 255 {
+			return nil, ErrAuthTokenTooLarge
+		}
+		room := append(token[:len(token):len(token)], make([]byte, c.overhead())...)
+		return appendMeta(nil, metaSealedAuth, room), nil
+	}
+	if !s.overTLS() {
+		return nil, ErrAuthTokenInsecure
+	}
+	if len(token) > 255 {
+		return nil, ErrAuthTokenTooLarge
+	}
+	return appendMeta(nil, metaAuthToken, token), nil
+}
+
+// sealAuthToken seals in place the auth token of a SYN about to be
+// sent
+func (s *Session) sealAuthToken(f Frame) {
+	room := findMeta(f.data, metaSealedAuth)
+	c := s.frameCipher()
+	if room == nil || c == nil || c.aead == nil {
+		return
+	}
+	token := room[:len(room)-c.overhead()]
+	c.sealAEAD(room[:0:len(room)], token, c.authTokenAD(f.sid))
+}
+
+// authTokenAD is the additional data of a sealed auth token, binding
+// it to its stream and to the key exchange of its session so that it
+// cannot be replayed with another
+func (c *frameCipher) authTokenAD(sid uint32) []byte {
+	ad := frameAD(cmdSYN, sid)
+	return append(ad[:], c.kxKey...)
+}
+
+// overTLS reports whether the session runs over a TLS connection
+func (s *Session) overTLS() bool {
+	_, ok := s.currentConn().(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	return ok
+}
+
+// authAccept keeps the auth token sent by the opener of stream until
+// it is checked. A sealed token that does not open is dropped, as
+// though the stream had none.
+func (s *Session) authAccept(stream *Stream, meta []byte) {
+	if token := findMeta(meta, metaAuthToken); token != nil {
+		stream.authToken = append([]byte{}, token...)
+		return
+	}
+	sealed := findMeta(meta, metaSealedAuth)
+	if sealed == nil {
+		return
+	}
+	if c := s.frameCipher(); c != nil && c.aead != nil {
+		// the nonce is taken once the token opened, a forged one
+		// must not hold back the data following
+		counter, err := c.peerNonce(sealed)
+		if err == nil {
+			var token []byte
+			if token, err = c.openAEAD(append([]byte{}, sealed...), c.authTokenAD(stream.id)); err == nil {
+				c.received = counter
+				stream.authToken = token
+				return
+			}
+		}
+	}
+	s.log(LevelDebug, "sealed auth token dropped", "sid", stream.id)
+}
+
+// authenticate runs the StreamAuthenticator on a stream taken from the
+// accept backlog, it resets the stream with ResetUnauthorized, or the
+// code of a *StreamError, and returns false when the token is refused
+func (s *Session) authenticate(stream *Stream) bool {
+	token := stream.authToken
+	stream.authToken = nil // not kept past the check
+	auth := s.config.StreamAuthenticator
+	if auth == nil {
+		return true
+	}
+	if err := auth(stream, token); err != nil {
+		s.log(LevelDebug, "stream refused by authenticator", "sid", stream.id, "err", err)
+		s.refuseStream(stream, err, ResetUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,254 @@
+package smux
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// cipher names reported by EncryptionState
+const (
+	cipherAESOFB           = "aes-256-ofb"
+	cipherAESGCM           = "aes-256-gcm"
+	cipherChaCha20Poly1305 = "chacha20-poly1305"
+	cipherPlaintext        = "none"
+)
+
+// cipher suites negotiated during the key exchange: the client lists
+// the suites it supports next to the shared key sealed in KXR and the
+// server appends its choice to the KXS reply. Peers unaware of suites
+// neither send nor expect them and fall back to AES-OFB.
+const (
+	suiteAESOFB byte = iota
+	suiteAESGCM
+	suiteChaCha20Poly1305
+
+	// suitePlaintext is never offered, it is the KXS of servers
+	// declining the key exchange with Config.EncryptionOptional,
+	// and the suite of sessions falling back to plaintext
+	suitePlaintext byte = 0xff
+)
+
+// maxCipherOverhead is the largest size a suite adds to a frame,
+// a 16 bytes tag and a 12 bytes nonce
+const maxCipherOverhead = 28
+
+// hasAESHardware reports whether AES-GCM is accelerated on this CPU
+var hasAESHardware = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+	cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+	cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+
+// preferredSuites lists the suites offered and accepted, the
+// fastest on this CPU first
+var preferredSuites = func() []byte {
+	if hasAESHardware {
+		return []byte{suiteAESGCM, suiteChaCha20Poly1305}
+	}
+	return []byte{suiteChaCha20Poly1305, suiteAESGCM}
+}
+
+// selectSuite picks the first preferred suite the peer offered
+func selectSuite(offered []byte) byte {
+	for _, suite := range preferredSuites() {
+		if bytes.IndexByte(offered, suite) >= 0 {
+			return suite
+		}
+	}
+	return suiteAESOFB
+}
+
+// frameCipher encrypts the stream data of a session. Both ends share
+// the key, so the nonces of the AEAD suites carry the side that
+// sealed the frame ahead of a counter, and travel after the sealed
+// data. Frames are sealed in the order they are sent, and opened only
+// from the side of the peer with a counter above the last one
+// accepted, so that frames cannot be replayed or reflected. The
+// command and stream of a frame are sealed with it.
+type frameCipher struct {
+	suite    byte
+	key      *[32]byte
+	aead     cipher.AEAD // nil for AES-OFB
+	side     uint32      // nonce prefix of this end
+	counter  uint64      // frames sealed so far
+	received uint64      // counter of the last nonce accepted from the peer
+	kxKey    []byte      // key of the exchange, binding auth tokens to the session
+}
+
+func newFrameCipher(suite byte, key *[32]byte, kxKey []byte, client bool) (*frameCipher, error) {
+	c := &frameCipher{suite: suite, key: key, kxKey: append([]byte{}, kxKey...)}
+	if client {
+		c.side = 1
+	}
+
+	var err error
+	switch suite {
+	case suiteAESOFB, suitePlaintext:
+	case suiteAESGCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key[:]); err == nil {
+			c.aead, err = cipher.NewGCM(block)
+		}
+	case suiteChaCha20Poly1305:
+		c.aead, err = chacha20poly1305.New(key[:])
+	default:
+		err = errors.New(errBadKeyExchange)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// name returns the cipher name of the suite
+func (c *frameCipher) name() string {
+	return suiteName(c.suite)
+}
+
+// suiteName returns the cipher name of a suite
+func suiteName(suite byte) string {
+	switch suite {
+	case suiteAESGCM:
+		return cipherAESGCM
+	case suiteChaCha20Poly1305:
+		return cipherChaCha20Poly1305
+	case suitePlaintext:
+		return cipherPlaintext
+	}
+	return cipherAESOFB
+}
+
+// overhead is the number of bytes seal adds to a frame
+func (c *frameCipher) overhead() int {
+	if c.aead == nil {
+		return 0
+	}
+	return c.aead.Overhead() + c.aead.NonceSize()
+}
+
+// seal encrypts the plaintext of frame cmd of stream sid into dst,
+// which must not overlap it and must have room for the overhead
+func (c *frameCipher) seal(dst, plaintext []byte, cmd byte, sid uint32) ([]byte, error) {
+	if c.suite == suitePlaintext {
+		return append(dst[:0], plaintext...), nil
+	}
+	if c.aead == nil {
+		stream, err := newCipherStream(c.key)
+		if err != nil {
+			return nil, err
+		}
+		dst = dst[:len(plaintext)]
+		stream.XORKeyStream(dst, plaintext)
+		return dst, nil
+	}
+
+	ad := frameAD(cmd, sid)
+	return c.sealAEAD(dst, plaintext, ad[:]), nil
+}
+
+// sealAEAD seals plaintext bound to the additional data ad with an
+// AEAD suite, the nonce following the sealed data
+func (c *frameCipher) sealAEAD(dst, plaintext, ad []byte) []byte {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint32(nonce[:], c.side)
+	binary.LittleEndian.PutUint64(nonce[4:], atomic.AddUint64(&c.counter, 1))
+	dst = c.aead.Seal(dst[:0], nonce[:], plaintext, ad)
+	return append(dst, nonce[:]...)
+}
+
+// frameAD is the additional data of the stream data of a frame
+func frameAD(cmd byte, sid uint32) [5]byte {
+	var ad [5]byte
+	ad[0] = cmd
+	binary.LittleEndian.PutUint32(ad[1:], sid)
+	return ad
+}
+
+// peerNonce checks data was sealed by the peer after the data last
+// accepted, and returns the counter of its nonce. It must be called
+// in the order the frames were received.
+func (c *frameCipher) peerNonce(data []byte) (uint64, error) {
+	n := len(data) - c.aead.NonceSize()
+	if n < c.aead.Overhead() {
+		return 0, errors.New(errBadFrame)
+	}
+	if binary.LittleEndian.Uint32(data[n:]) != c.side^1 {
+		return 0, errors.New("nonce of the wrong side")
+	}
+	counter := binary.LittleEndian.Uint64(data[n+4:])
+	if counter <= c.received {
+		return 0, errors.New("nonce replayed")
+	}
+	return counter, nil
+}
+
+// acceptNonce checks the nonce of the stream data of a frame received
+// and takes it as the last one accepted, before the data is opened.
+// Data failing to open closes the session.
+func (c *frameCipher) acceptNonce(data []byte) error {
+	if c.aead == nil {
+		return nil
+	}
+	counter, err := c.peerNonce(data)
+	if err != nil {
+		return err
+	}
+	c.received = counter
+	return nil
+}
+
+// open decrypts in place the stream data of frame cmd of stream sid,
+// whose nonce was accepted, and returns the plaintext
+func (c *frameCipher) open(data []byte, cmd byte, sid uint32) ([]byte, error) {
+	if c.suite == suitePlaintext {
+		return data, nil
+	}
+	if c.aead == nil {
+		stream, err := newCipherStream(c.key)
+		if err != nil {
+			return nil, err
+		}
+		stream.XORKeyStream(data, data)
+		return data, nil
+	}
+
+	ad := frameAD(cmd, sid)
+	return c.openAEAD(data, ad[:])
+}
+
+// openAEAD opens in place data sealed by sealAEAD with ad
+func (c *frameCipher) openAEAD(data, ad []byte) ([]byte, error) {
+	n := len(data) - c.aead.NonceSize()
+	if n < c.aead.Overhead() {
+		return nil, errors.New(errBadFrame)
+	}
+	var nonce [12]byte
+	copy(nonce[:], data[n:])
+	return c.aead.Open(data[:0], nonce[:], data[:n], ad)
+}
+
+func newCipherStream(key *[32]byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// If the key is unique for each ciphertext, then it's ok to use a zero IV.
+	var iv [aes.BlockSize]byte
+	return cipher.NewOFB(block, iv[:]), nil
+}
+
+// decrypt opens in place the stream data of f, whose nonce was
+// accepted
+func decrypt(s *Session, f Frame) ([]byte, error) {
+	c := s.frameCipher()
+	if c == nil {
+		return nil, errors.New(errNoEncryptionKey)
+	}
+	return c.open(f.data, f.cmd, f.sid)
+}
@@ -0,0 +1,394 @@
+// Command smux runs either end of a smux tunnel. The client listens
+// locally and forwards each connection to a stream of a session with
+// the server, which forwards the stream to its target:
+//
+//	smux keygen
+//	smux server -listen :7000 -target 127.0.0.1:80 -private-key <hex>
+//	smux client -listen :8080 -server host:7000 -public-key <hex>
+//
+// Without keys the session is not encrypted. -yamux, -compat and
+// -version select the protocol to test against other
+// implementations, and load drives a server forwarding to an echo
+// service, such as its built-in -target echo:
+//
+//	smux load -server host:7000 -public-key <hex> -streams 16
+//
+// conform plays the conformance vectors against servers echoing their
+// streams, see package conformance:
+//
+//	smux conform -server host:7000 -encrypted-server host:7001
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/superfly/smux"
+	"github.com/superfly/smux/conformance"
+	"github.com/superfly/smux/smuxtunnel"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: smux keygen|server|client|load|conform [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "keygen":
+		keygen()
+	case "server":
+		server(args)
+	case "client":
+		client(args)
+	case "load":
+		load(args)
+	case "conform":
+		conform(args)
+	default:
+		usage()
+	}
+}
+
+// sessionFlags are the settings of the session shared by the commands
+type sessionFlags struct {
+	publicKey  *string
+	privateKey *string
+	yamux      *bool
+	compat     *bool
+	version    *int
+	keepAlive  *time.Duration
+	sendRate   *int64
+	keyLog     *string
+	verbose    *bool
+}
+
+func addSessionFlags(fs *flag.FlagSet, server bool) *sessionFlags {
+	f := &sessionFlags{
+		yamux:     fs.Bool("yamux", false, "speak the hashicorp/yamux protocol"),
+		compat:    fs.Bool("compat", false, "speak the protocol of stock xtaci/smux v1"),
+		version:   fs.Int("version", 1, "protocol version, 1 or 2"),
+		keepAlive: fs.Duration("keepalive", 10*time.Second, "keep-alive interval, 0 disables it"),
+		sendRate:  fs.Int64("max-send-rate", 0, "bytes per second written to the connection, 0 for no limit"),
+		keyLog:    fs.String("keylog", "", "file to append the session keys to, for smuxdump"),
+		verbose:   fs.Bool("v", false, "log the events of the sessions"),
+	}
+	if server {
+		f.privateKey = fs.String("private-key", "", "hex private key of the server, enables encryption")
+	} else {
+		f.publicKey = fs.String("public-key", "", "hex public key of the server, enables encryption")
+	}
+	return f
+}
+
+// options returns the session options set by the flags
+func (f *sessionFlags) options() []smux.Option {
+	opts := []smux.Option{smux.WithProtocolVersion(*f.version), smux.WithMaxSendRate(*f.sendRate)}
+	if *f.keepAlive > 0 {
+		opts = append(opts, smux.WithKeepAlive(*f.keepAlive, 3**f.keepAlive))
+	} else {
+		opts = append(opts, smux.WithoutKeepAlive())
+	}
+	if *f.yamux {
+		opts = append(opts, smux.WithYamux())
+	}
+	if *f.compat {
+		opts = append(opts, smux.WithUpstreamCompat())
+	}
+	if *f.verbose {
+		opts = append(opts, smux.WithLogger(smux.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), smux.LevelDebug)))
+	}
+	if f.publicKey != nil && *f.publicKey != "" {
+		opts = append(opts, smux.WithEncryption(parseKey(*f.publicKey), nil))
+	}
+	if f.privateKey != nil && *f.privateKey != "" {
+		opts = append(opts, smux.WithEncryption(nil, parseKey(*f.privateKey)))
+	}
+	if *f.keyLog != "" {
+		w, err := os.OpenFile(*f.keyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, smux.WithKeyLogWriter(w))
+	}
+	return opts
+}
+
+func parseKey(s string) *[32]byte {
+	var key [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		log.Fatalf("invalid key %q", s)
+	}
+	copy(key[:], b)
+	return &key
+}
+
+func keygen() {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("public-key  %x\nprivate-key %x\n", pub[:], priv[:])
+}
+
+func server(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	listen := fs.String("listen", ":7000", "address to accept sessions on")
+	target := fs.String("target", "", "address to forward the streams to, echo to echo them")
+	sf := addSessionFlags(fs, true)
+	fs.Parse(args)
+	if *target == "" {
+		log.Fatal("-target is required")
+	}
+	opts := sf.options()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("accepting sessions on %v, forwarding to %s", ln.Addr(), *target)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		session, err := smux.Server(conn, opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveSession(session, *target)
+	}
+}
+
+func serveSession(session *smux.Session, target string) {
+	defer session.Close()
+	log.Printf("session from %v", session.RemoteAddr())
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			log.Printf("session from %v: %v", session.RemoteAddr(), err)
+			return
+		}
+		go func() {
+			if target == "echo" {
+				io.Copy(stream, stream)
+				stream.Close()
+				return
+			}
+			conn, err := net.Dial("tcp", target)
+			if err != nil {
+				log.Print(err)
+				stream.Close()
+				return
+			}
+			join(conn, stream)
+		}()
+	}
+}
+
+// join copies between a and b until either ends, then closes both
+func join(a, b io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	io.Copy(b, a)
+	once.Do(closeBoth)
+}
+
+// dial connects to the server, retrying until it answers
+func dial(addr string, opts []smux.Option) *smux.Session {
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			session, err := smux.Client(conn, opts...)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return session
+		}
+		log.Print(err)
+		time.Sleep(time.Second)
+	}
+}
+
+func client(args []string) {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "address to accept connections on")
+	serverAddr := fs.String("server", "", "address of the server")
+	sf := addSessionFlags(fs, false)
+	fs.Parse(args)
+	if *serverAddr == "" {
+		log.Fatal("-server is required")
+	}
+	opts := sf.options()
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("forwarding %v to %s", ln.Addr(), *serverAddr)
+	for {
+		// a session lost is dialed again
+		session := dial(*serverAddr, opts)
+		err := smuxtunnel.Forward(ln, session)
+		if !session.IsClosed() {
+			log.Fatal(err)
+		}
+		log.Printf("session lost: %v", err)
+	}
+}
+
+func load(args []string) {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	serverAddr := fs.String("server", "", "address of a server forwarding to an echo service")
+	streams := fs.Int("streams", 16, "concurrent streams")
+	size := fs.Int("bytes", 16<<20, "bytes echoed by each stream")
+	sf := addSessionFlags(fs, false)
+	fs.Parse(args)
+	if *serverAddr == "" {
+		log.Fatal("-server is required")
+	}
+
+	conn, err := net.Dial("tcp", *serverAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	session, err := smux.Client(conn, sf.options()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	var total int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for k := 0; k < *streams; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := echo(session, *size)
+			atomic.AddInt64(&total, n)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	fmt.Printf("%d streams echoed %d bytes in %v, %.1f MB/s\n",
+		*streams, total, elapsed, float64(total)/elapsed.Seconds()/(1<<20))
+}
+
+// echo sends size bytes over a new stream and checks they come back
+func echo(session *smux.Session, size int) (int64, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	msg := make([]byte, 32768)
+	rand.Read(msg)
+	go func() {
+		for sent := 0; sent < size; sent += len(msg) {
+			n := len(msg)
+			if size-sent < n {
+				n = size - sent
+			}
+			if _, err := stream.Write(msg[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, len(msg))
+	var n int64
+	for n < int64(size) {
+		chunk := len(msg)
+		if int64(size)-n < int64(chunk) {
+			chunk = int(int64(size) - n)
+		}
+		if _, err := io.ReadFull(stream, buf[:chunk]); err != nil {
+			return n, err
+		}
+		if !bytes.Equal(buf[:chunk], msg[:chunk]) {
+			return n, fmt.Errorf("stream %d: corrupted echo", stream.ID())
+		}
+		n += int64(chunk)
+	}
+	return n, nil
+}
+
+func conform(args []string) {
+	fs := flag.NewFlagSet("conform", flag.ExitOnError)
+	serverAddr := fs.String("server", "", "address of a server echoing its streams")
+	encryptedAddr := fs.String("encrypted-server", "", "address of a server echoing its streams with the private key of the vectors")
+	vectors := fs.String("vectors", "", "JSON file of the vectors, those built in by default")
+	fs.Parse(args)
+	if *serverAddr == "" && *encryptedAddr == "" {
+		log.Fatal("-server or -encrypted-server is required")
+	}
+
+	suite := conformance.Vectors()
+	if *vectors != "" {
+		f, err := os.Open(*vectors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		suite, err = conformance.Load(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var passed, failed, skipped int
+	for _, v := range suite.Vectors {
+		addr := *serverAddr
+		if v.Encrypted {
+			addr = *encryptedAddr
+		}
+		if addr == "" {
+			skipped++
+			continue
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := conformance.Run(conn, v); err != nil {
+			fmt.Printf("FAIL %v\n", err)
+			failed++
+		} else {
+			fmt.Printf("ok   %s\n", v.Name)
+			passed++
+		}
+		conn.Close()
+	}
+	fmt.Printf("%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
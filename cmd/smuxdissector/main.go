@@ -0,0 +1,241 @@
+// Command smuxdissector writes a Wireshark dissector of the smux wire
+// protocol in Lua, built from the constants of package frame so that
+// it follows the protocol as it changes:
+//
+//	smuxdissector -o ~/.local/lib/wireshark/plugins/smux.lua
+//
+// The dissector decodes the sessions on TCP port 7000 by default, a
+// preference of the protocol, or on any port with Decode As. smux.lua
+// is the dissector of this version, a test keeps it up to date.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/template"
+
+	"github.com/superfly/smux/frame"
+)
+
+func main() {
+	out := flag.String("o", "", "file to write the dissector to, standard output by default")
+	flag.Parse()
+
+	var buf bytes.Buffer
+	if err := generate(&buf); err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// command is a command of the protocol in the dissector
+type command struct {
+	Value byte
+	Name  string
+}
+
+// generate writes the dissector to w
+func generate(w io.Writer) error {
+	var cmds []command
+	for cmd := frame.CmdSYN; cmd <= frame.CmdGOA; cmd++ {
+		cmds = append(cmds, command{cmd, frame.CmdName(frame.Version1, cmd)})
+	}
+	return dissector.Execute(w, map[string]interface{}{
+		"HeaderSize":     frame.HeaderSize,
+		"Version1":       frame.Version1,
+		"Version2":       frame.Version2,
+		"Cmds":           cmds,
+		"UPD":            command{frame.CmdUPD, frame.CmdName(frame.Version2, frame.CmdUPD)},
+		"SYN":            frame.CmdSYN,
+		"RST":            frame.CmdRST,
+		"PSH":            frame.CmdPSH,
+		"NOP":            frame.CmdNOP,
+		"BYE":            frame.CmdBYE,
+		"NOPPing":        frame.NOPPing,
+		"NOPPong":        frame.NOPPong,
+		"NOPPayloadSize": frame.NOPPayloadSize,
+		"UpdateSize":     frame.UpdateSize,
+		"MetaProtocol":   frame.MetaProtocol,
+		"MetaServerName": frame.MetaServerName,
+	})
+}
+
+var dissector = template.Must(template.New("smux.lua").Parse(`-- Code generated by smuxdissector. DO NOT EDIT.
+--
+-- Wireshark dissector of the smux wire protocol, copy it to the Lua
+-- plugins directory of Wireshark.
+
+local smux = Proto("smux", "smux stream multiplexing")
+
+local HEADER_SIZE = {{.HeaderSize}}
+
+local versions = {
+	[{{.Version1}}] = "1",
+	[{{.Version2}}] = "2, per-stream flow control",
+}
+
+local cmd_names = {
+{{- range .Cmds}}
+	[{{.Value}}] = "{{.Name}}",
+{{- end}}
+}
+
+-- commands of version 2 reusing the values of version 1
+local v2_cmd_names = {
+	[{{.UPD.Value}}] = "{{.UPD.Name}}",
+}
+
+local nop_kinds = {
+	[{{.NOPPing}}] = "ping",
+	[{{.NOPPong}}] = "pong",
+}
+
+local f_version = ProtoField.uint8("smux.version", "Version", base.DEC, versions)
+local f_cmd = ProtoField.uint8("smux.cmd", "Command", base.DEC)
+local f_cmd_name = ProtoField.string("smux.cmd_name", "Command name")
+local f_length = ProtoField.uint16("smux.length", "Length", base.DEC)
+local f_sid = ProtoField.uint32("smux.sid", "Stream ID", base.DEC)
+local f_data = ProtoField.bytes("smux.data", "Data")
+local f_meta_type = ProtoField.uint8("smux.meta.type", "Metadata type", base.DEC)
+local f_meta_value = ProtoField.bytes("smux.meta.value", "Metadata value")
+local f_protocol = ProtoField.string("smux.protocol", "Protocol")
+local f_server_name = ProtoField.string("smux.server_name", "Server name")
+local f_code = ProtoField.uint32("smux.code", "Code", base.DEC)
+local f_reason = ProtoField.string("smux.reason", "Reason")
+local f_nop_kind = ProtoField.uint8("smux.nop.kind", "Kind", base.DEC, nop_kinds)
+local f_nop_seq = ProtoField.uint32("smux.nop.seq", "Sequence", base.DEC)
+local f_consumed = ProtoField.uint32("smux.upd.consumed", "Consumed", base.DEC)
+local f_window = ProtoField.uint32("smux.upd.window", "Window", base.DEC)
+
+smux.fields = {
+	f_version, f_cmd, f_cmd_name, f_length, f_sid, f_data,
+	f_meta_type, f_meta_value, f_protocol, f_server_name,
+	f_code, f_reason, f_nop_kind, f_nop_seq, f_consumed, f_window,
+}
+
+local function cmd_name(version, cmd)
+	if version == {{.Version2}} and v2_cmd_names[cmd] then
+		return v2_cmd_names[cmd]
+	end
+	return cmd_names[cmd] or ("CMD(" .. cmd .. ")")
+end
+
+-- dissect_payload adds the fields of the payload of a frame to tree
+local function dissect_payload(payload, version, cmd, tree)
+	local n = payload:len()
+	if version == {{.Version2}} and cmd == {{.UPD.Value}} then
+		if n == {{.UpdateSize}} then
+			tree:add_le(f_consumed, payload(0, 4))
+			tree:add_le(f_window, payload(4, 4))
+		end
+	elseif cmd == {{.SYN}} then
+		local offset = 0
+		while offset + 2 <= n do
+			local typ = payload(offset, 1):uint()
+			local size = payload(offset + 1, 1):uint()
+			if offset + 2 + size > n then
+				break
+			end
+			tree:add(f_meta_type, payload(offset, 1))
+			if size > 0 then
+				local value = payload(offset + 2, size)
+				if typ == {{.MetaProtocol}} then
+					tree:add(f_protocol, value)
+				elseif typ == {{.MetaServerName}} then
+					tree:add(f_server_name, value)
+				else
+					tree:add(f_meta_value, value)
+				end
+			end
+			offset = offset + 2 + size
+		end
+	elseif cmd == {{.RST}} or cmd == {{.BYE}} then
+		if n >= 4 then
+			tree:add_le(f_code, payload(0, 4))
+			if n > 4 then
+				tree:add(f_reason, payload(4, n - 4))
+			end
+		end
+	elseif cmd == {{.NOP}} then
+		if n >= {{.NOPPayloadSize}} then
+			tree:add(f_nop_kind, payload(0, 1))
+			tree:add_le(f_nop_seq, payload(1, 4))
+			if n > {{.NOPPayloadSize}} then
+				tree:add(f_data, payload({{.NOPPayloadSize}}, n - {{.NOPPayloadSize}}))
+			end
+		end
+	elseif n > 0 then
+		tree:add(f_data, payload)
+	end
+end
+
+function smux.dissector(buf, pinfo, tree)
+	local len = buf:len()
+	local offset = 0
+	local names = {}
+	while offset < len do
+		if len - offset < HEADER_SIZE then
+			pinfo.desegment_offset = offset
+			pinfo.desegment_len = DESEGMENT_ONE_MORE_SEGMENT
+			break
+		end
+		local length = buf(offset + 2, 2):le_uint()
+		if len - offset < HEADER_SIZE + length then
+			pinfo.desegment_offset = offset
+			pinfo.desegment_len = HEADER_SIZE + length - (len - offset)
+			break
+		end
+
+		local version = buf(offset, 1):uint()
+		local cmd = buf(offset + 1, 1):uint()
+		local sid = buf(offset + 4, 4):le_uint()
+		local name = cmd_name(version, cmd)
+		local subtree = tree:add(smux, buf(offset, HEADER_SIZE + length),
+			"smux " .. name .. ", stream " .. sid .. ", " .. length .. " bytes")
+		subtree:add(f_version, buf(offset, 1))
+		subtree:add(f_cmd, buf(offset + 1, 1))
+		subtree:add(f_cmd_name, name):set_generated()
+		subtree:add_le(f_length, buf(offset + 2, 2))
+		subtree:add_le(f_sid, buf(offset + 4, 4))
+		if length > 0 then
+			dissect_payload(buf(offset + HEADER_SIZE, length), version, cmd, subtree)
+		end
+		if cmd ~= {{.PSH}} or #names == 0 or names[#names] ~= name then
+			names[#names + 1] = name
+		end
+		offset = offset + HEADER_SIZE + length
+	end
+	if offset > 0 then
+		pinfo.cols.protocol = "SMUX"
+		pinfo.cols.info = table.concat(names, ", ")
+	end
+	return len
+end
+
+smux.prefs.port = Pref.uint("TCP port", 7000, "TCP port of the smux sessions, 0 for none")
+
+local tcp_port = DissectorTable.get("tcp.port")
+local port = 0
+
+function smux.prefs_changed()
+	if port ~= 0 then
+		tcp_port:remove(port, smux)
+	end
+	port = smux.prefs.port
+	if port ~= 0 then
+		tcp_port:add(port, smux)
+	end
+end
+
+smux.prefs_changed()
+`))
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite smux.lua")
+
+func TestDissectorFile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := generate(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`[2] = "PSH",`, `[4] = "UPD",`, `[7] = "GOA",`, "local HEADER_SIZE = 8"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("dissector lacks %q", s)
+		}
+	}
+	if *update {
+		if err := ioutil.WriteFile("smux.lua", buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile("smux.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, buf.Bytes()) {
+		t.Fatal("smux.lua is out of date, run go test -update")
+	}
+}
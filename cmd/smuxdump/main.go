@@ -0,0 +1,288 @@
+// Command smuxdump decodes a captured smux byte stream, one direction
+// of a connection as written to the wire, and prints its frames one
+// per line:
+//
+//	smuxdump capture.bin
+//	smuxdump - < capture.bin
+//
+// The stream data of encrypted sessions is decrypted with the keys
+// their sessions wrote with smux.WithKeyLogWriter, or the -keylog flag
+// of the smux command, found by the public key of their key exchange:
+//
+//	smuxdump -keylog keys.log capture.bin
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/superfly/smux/frame"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func main() {
+	keyLog := flag.String("keylog", "", "file of session keys written by smux.WithKeyLogWriter")
+	hexDump := flag.Bool("x", false, "hex dump stream data rather than quoting it")
+	maxData := flag.Int("max", 64, "bytes of stream data printed per frame, 0 for all")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: smuxdump [flags] [file|-]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in := io.Reader(os.Stdin)
+	if name := flag.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	d := &dumper{out: bufio.NewWriter(os.Stdout), hexDump: *hexDump, maxData: *maxData}
+	if *keyLog != "" {
+		keys, err := loadKeyLog(*keyLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.keys = keys
+	}
+	err := d.dump(bufio.NewReader(in))
+	d.out.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// sessionKey is a key of the key log
+type sessionKey struct {
+	cipher string
+	key    [32]byte
+}
+
+// loadKeyLog reads the key log at path, the keys by the hex public
+// key of their key exchange
+func loadKeyLog(path string) (map[string]sessionKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]sessionKey)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 4 || fields[0] != "SMUX_SESSION_KEY" {
+			return nil, fmt.Errorf("%s:%d: not a session key", path, line)
+		}
+		b, err := hex.DecodeString(fields[3])
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s:%d: bad key", path, line)
+		}
+		var k sessionKey
+		k.cipher = fields[2]
+		copy(k.key[:], b)
+		keys[strings.ToLower(fields[1])] = k
+	}
+	return keys, scanner.Err()
+}
+
+// dumper prints the frames of a byte stream
+type dumper struct {
+	out     *bufio.Writer
+	hexDump bool
+	maxData int
+	keys    map[string]sessionKey
+
+	encrypted bool        // a key exchange was seen
+	aead      cipher.AEAD // cipher of the stream data, once known
+	ofbKey    *[32]byte   // key of AES-OFB, which has no AEAD
+}
+
+func (d *dumper) dump(r io.Reader) error {
+	var offset int64
+	for {
+		f, err := frame.Read(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("truncated frame at offset %d", offset)
+			}
+			return err
+		}
+		fmt.Fprintf(d.out, "%010d %s v%d sid=%d len=%d", offset, f.Header().CmdName(), f.Version, f.StreamID, len(f.Data))
+		d.payload(f)
+		d.out.WriteByte('\n')
+		offset += int64(frame.HeaderSize + len(f.Data))
+	}
+}
+
+// payload prints the decoded payload of f
+func (d *dumper) payload(f frame.Frame) {
+	if f.Version == frame.Version2 && f.Cmd == frame.CmdUPD {
+		if consumed, window, ok := frame.ParseUpdate(f.Data); ok {
+			fmt.Fprintf(d.out, " consumed=%d window=%d", consumed, window)
+		}
+		return
+	}
+	switch f.Cmd {
+	case frame.CmdSYN:
+		d.meta(f.Data)
+	case frame.CmdRST, frame.CmdBYE:
+		if code, msg, ok := frame.ParseReason(f.Data); ok {
+			fmt.Fprintf(d.out, " code=%d reason=%q", code, msg)
+		}
+	case frame.CmdNOP:
+		kind, seq, payload, ok := frame.ParseNOP(f.Data)
+		switch {
+		case !ok:
+		case kind == frame.NOPPing:
+			fmt.Fprintf(d.out, " ping seq=%d", seq)
+			if len(payload) > 0 {
+				fmt.Fprintf(d.out, " payload=%x", payload)
+			}
+		case kind == frame.NOPPong:
+			fmt.Fprintf(d.out, " pong seq=%d", seq)
+		}
+	case frame.CmdKXR, frame.CmdKXS:
+		d.keyExchange(f.Data)
+	case frame.CmdPSH:
+		d.data(f)
+	}
+}
+
+// meta prints the metadata of a SYN frame
+func (d *dumper) meta(data []byte) {
+	names := []struct {
+		typ  byte
+		name string
+	}{
+		{frame.MetaProtocol, "protocol"},
+		{frame.MetaPeerAddr, "peer"},
+		{frame.MetaServerName, "server-name"},
+		{frame.MetaTrace, "trace"},
+		{frame.MetaAuthToken, "token"},
+		{frame.MetaSealedAuth, "sealed-token"},
+	}
+	for _, n := range names {
+		value := frame.FindMeta(data, n.typ)
+		switch {
+		case value == nil:
+		case n.typ == frame.MetaProtocol || n.typ == frame.MetaServerName:
+			fmt.Fprintf(d.out, " %s=%q", n.name, value)
+		case n.typ == frame.MetaAuthToken || n.typ == frame.MetaSealedAuth:
+			fmt.Fprintf(d.out, " %s=(%d bytes)", n.name, len(value))
+		default:
+			fmt.Fprintf(d.out, " %s=%x", n.name, value)
+		}
+	}
+}
+
+// keyExchange prints the public key opening a key exchange and sets
+// up the decryption of the stream data with its key, if logged. A
+// server declining the exchange sends a single byte.
+func (d *dumper) keyExchange(data []byte) {
+	if len(data) < 32 {
+		fmt.Fprintf(d.out, " declined")
+		return
+	}
+	d.encrypted = true
+	pub := hex.EncodeToString(data[:32])
+	fmt.Fprintf(d.out, " key=%s", pub)
+	k, ok := d.keys[pub]
+	if !ok {
+		return
+	}
+	var err error
+	switch k.cipher {
+	case "aes-256-gcm":
+		var block cipher.Block
+		if block, err = aes.NewCipher(k.key[:]); err == nil {
+			d.aead, err = cipher.NewGCM(block)
+		}
+	case "chacha20-poly1305":
+		d.aead, err = chacha20poly1305.New(k.key[:])
+	case "aes-256-ofb":
+		d.ofbKey = &k.key
+	default:
+		err = errors.New("unknown cipher " + k.cipher)
+	}
+	if err != nil {
+		fmt.Fprintf(d.out, " (%v)", err)
+		return
+	}
+	fmt.Fprintf(d.out, " cipher=%s", k.cipher)
+}
+
+// data prints the stream data of a PSH frame, decrypted if possible
+func (d *dumper) data(f frame.Frame) {
+	data := f.Data
+	if len(data) == 0 {
+		return
+	}
+	if d.encrypted {
+		plain, err := d.decrypt(f)
+		if err != nil {
+			fmt.Fprintf(d.out, " (%v)", err)
+			return
+		}
+		data = plain
+	}
+	if d.maxData > 0 && len(data) > d.maxData {
+		data = data[:d.maxData]
+	}
+	if d.hexDump {
+		d.out.WriteByte('\n')
+		d.out.WriteString(strings.TrimSuffix(hex.Dump(data), "\n"))
+		return
+	}
+	fmt.Fprintf(d.out, " %q", data)
+}
+
+// decrypt opens the stream data of an encrypted session, the nonces
+// of the AEAD ciphers follow the sealed data, sealed with the command
+// and stream of the frame
+func (d *dumper) decrypt(f frame.Frame) ([]byte, error) {
+	data := f.Data
+	switch {
+	case d.aead != nil:
+		n := len(data) - d.aead.NonceSize()
+		if n < d.aead.Overhead() {
+			return nil, errors.New("frame too short")
+		}
+		ad := make([]byte, 5)
+		ad[0] = f.Cmd
+		binary.LittleEndian.PutUint32(ad[1:], f.StreamID)
+		return d.aead.Open(nil, data[n:], data[:n], ad)
+	case d.ofbKey != nil:
+		block, err := aes.NewCipher(d.ofbKey[:])
+		if err != nil {
+			return nil, err
+		}
+		var iv [aes.BlockSize]byte
+		plain := make([]byte, len(data))
+		cipher.NewOFB(block, iv[:]).XORKeyStream(plain, data)
+		return plain, nil
+	}
+	return nil, errors.New("encrypted, no key")
+}
@@ -0,0 +1,81 @@
+// Command smuxperf measures smux sessions over loopback TCP across a
+// matrix of configurations.
+//
+//	smuxperf -streams 1,16 -frame-sizes 4096,32768 -modes plain,encrypted
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/superfly/smux/perf"
+)
+
+func main() {
+	def := perf.DefaultOptions()
+	streams := flag.String("streams", "1,16", "comma separated stream counts")
+	frameSizes := flag.String("frame-sizes", "4096,32768", "comma separated max frame sizes")
+	modes := flag.String("modes", "plain,encrypted", "comma separated modes, plain or encrypted")
+	bytes := flag.Int64("bytes", def.Bytes, "bytes sent by each stream")
+	rounds := flag.Int("rounds", def.Rounds, "latency round trips of each stream")
+	msgSize := flag.Int("msg-size", def.MessageSize, "size of the latency messages")
+	flag.Parse()
+
+	streamCounts, err := parseInts(*streams)
+	if err != nil {
+		log.Fatalf("-streams: %v", err)
+	}
+	sizes, err := parseInts(*frameSizes)
+	if err != nil {
+		log.Fatalf("-frame-sizes: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "mode\tstreams\tframe\tgoodput MB/s\tframes/s\tp50\tp99\tmax\t")
+	for _, mode := range strings.Split(*modes, ",") {
+		if mode != "plain" && mode != "encrypted" {
+			log.Fatalf("-modes: unknown mode %q", mode)
+		}
+		for _, n := range streamCounts {
+			for _, size := range sizes {
+				res, err := perf.Run(perf.Options{
+					Streams:     n,
+					FrameSize:   size,
+					Encrypted:   mode == "encrypted",
+					Bytes:       *bytes,
+					Rounds:      *rounds,
+					MessageSize: *msgSize,
+				})
+				if err != nil {
+					log.Fatalf("%s, %d streams, frame %d: %v", mode, n, size, err)
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%.0f\t%v\t%v\t%v\t\n",
+					mode, n, size, res.Goodput/(1<<20), res.FramesPerSec,
+					round(res.Latency.P50), round(res.Latency.P99), round(res.Latency.Max))
+			}
+		}
+	}
+	w.Flush()
+}
+
+func parseInts(s string) ([]int, error) {
+	var values []int
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func round(d time.Duration) time.Duration {
+	return d - d%time.Microsecond
+}
@@ -0,0 +1,124 @@
+// Package conformance holds test vectors of the smux wire protocol
+// and a runner playing them against an implementation, so that other
+// implementations, and future versions of the protocol, can check
+// they speak it as this package does.
+//
+// A vector is a conversation with a server: the frames the runner
+// sends and those the server must write back, or the connection it
+// must close. The server under test runs with the default settings,
+// a max frame size of 4096 bytes, and keep-alive disabled. It echoes
+// the data of every stream it accepts and closes the stream once the
+// peer closed it. Encrypted vectors expect it to hold the private key
+// of the suite. The smux command serves this package that way:
+//
+//	smux server -listen :7000 -target echo -keepalive 0
+//	smux server -listen :7001 -target echo -keepalive 0 -private-key <key of the suite>
+//	smux conform -server 127.0.0.1:7000 -encrypted-server 127.0.0.1:7001
+//
+// vectors.json is the suite returned by Vectors in JSON.
+package conformance
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Timeout bounds the wait for each frame expected from the server
+// and for the connection to close
+var Timeout = 5 * time.Second
+
+// Suite is a set of vectors and the server key of the encrypted ones
+type Suite struct {
+	ServerPublicKey  string   `json:"server_public_key"`  // hex
+	ServerPrivateKey string   `json:"server_private_key"` // hex
+	Vectors          []Vector `json:"vectors"`
+}
+
+// Vector is a conversation with a server, each played over a new
+// connection
+type Vector struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Encrypted   bool   `json:"encrypted"` // the server holds the private key of the suite
+	Steps       []Step `json:"steps"`
+}
+
+// Step sends frames to the server, then checks what it did about
+// them. Frames are hex encoded.
+type Step struct {
+	Send   string `json:"send,omitempty"`   // frames written to the server
+	Expect string `json:"expect,omitempty"` // frames the server must write next
+	Closed bool   `json:"closed,omitempty"` // the server must close the connection
+}
+
+// Load reads a suite in JSON
+func Load(r io.Reader) (*Suite, error) {
+	suite := new(Suite)
+	if err := json.NewDecoder(r).Decode(suite); err != nil {
+		return nil, err
+	}
+	return suite, nil
+}
+
+// Write writes the suite in JSON
+func (s *Suite) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Run plays v over conn, a new connection to the server under test,
+// it returns the first step the server failed
+func Run(conn net.Conn, v Vector) error {
+	for k, step := range v.Steps {
+		if err := runStep(conn, step); err != nil {
+			return fmt.Errorf("%s: step %d: %v", v.Name, k, err)
+		}
+	}
+	return nil
+}
+
+func runStep(conn net.Conn, step Step) error {
+	send, err := hex.DecodeString(step.Send)
+	if err != nil {
+		return fmt.Errorf("bad send: %v", err)
+	}
+	expect, err := hex.DecodeString(step.Expect)
+	if err != nil {
+		return fmt.Errorf("bad expect: %v", err)
+	}
+	if len(send) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(Timeout))
+		if _, err := conn.Write(send); err != nil {
+			return fmt.Errorf("send: %v", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(Timeout))
+	if len(expect) > 0 {
+		got := make([]byte, len(expect))
+		n, err := io.ReadFull(conn, got)
+		if !bytes.Equal(got[:n], expect[:n]) || err != nil {
+			return fmt.Errorf("expected %x, got %x (%v)", expect, got[:n], err)
+		}
+	}
+	if step.Closed {
+		var b [1]byte
+		n, err := conn.Read(b[:])
+		if n > 0 {
+			return fmt.Errorf("expected the connection closed, got %x", b[:n])
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("connection not closed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/superfly/smux"
+)
+
+var update = flag.Bool("update", false, "rewrite vectors.json")
+
+func TestVectorsFile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Vectors().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile("vectors.json", buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open("vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	suite, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded bytes.Buffer
+	suite.Write(&loaded)
+	if !bytes.Equal(loaded.Bytes(), buf.Bytes()) {
+		t.Fatal("vectors.json is out of date, run go test -update")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	suite := Vectors()
+	var key [32]byte
+	b, _ := hex.DecodeString(suite.ServerPrivateKey)
+	copy(key[:], b)
+
+	for _, v := range suite.Vectors {
+		c1, c2 := smux.NewPipeConn(0)
+		opts := []smux.Option{smux.WithoutKeepAlive()}
+		if v.Encrypted {
+			opts = append(opts, smux.WithEncryption(nil, &key))
+		}
+		server, err := smux.Server(c2, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go echo(server)
+		if err := Run(c1, v); err != nil {
+			t.Error(err)
+		}
+		c1.Close()
+		server.Close()
+	}
+}
+
+// echo serves the streams of session as the vectors expect
+func echo(session *smux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+	}
+}
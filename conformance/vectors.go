@@ -0,0 +1,205 @@
+package conformance
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// frame commands of protocol version 1
+const (
+	cmdSYN byte = iota
+	cmdRST
+	cmdPSH
+	cmdNOP
+	cmdKXS
+	cmdKXR
+	cmdBYE
+	cmdGOA
+)
+
+// cipher suites offered in the key exchange
+const (
+	suiteAESOFB byte = iota
+	suiteAESGCM
+	suiteChaCha20Poly1305
+)
+
+// reset codes carried by RST frames
+const (
+	resetProtocolError uint32 = 1
+)
+
+// Vectors returns the suite of this package. Its keys and nonces are
+// fixed so that the encrypted conversations can be replayed.
+func Vectors() *Suite {
+	serverPub, serverPriv := fixedKey(1)
+	suite := &Suite{
+		ServerPublicKey:  hex.EncodeToString(serverPub[:]),
+		ServerPrivateKey: hex.EncodeToString(serverPriv[:]),
+	}
+	hello := []byte("hello")
+
+	add := func(name, desc string, encrypted bool, steps ...Step) {
+		suite.Vectors = append(suite.Vectors, Vector{
+			Name:        name,
+			Description: desc,
+			Encrypted:   encrypted,
+			Steps:       steps,
+		})
+	}
+
+	// frames
+	add("echo", "a stream opened by SYN is echoed, closing it with RST closes the echo", false,
+		Step{Send: frames(frame(cmdSYN, 1, nil), frame(cmdPSH, 1, hello)), Expect: frames(frame(cmdPSH, 1, hello))},
+		Step{Send: frames(frame(cmdRST, 1, nil)), Expect: frames(frame(cmdRST, 1, nil))})
+	add("streams", "streams are independent, the client opens odd identifiers", false,
+		Step{Send: frames(frame(cmdSYN, 1, nil), frame(cmdSYN, 3, nil), frame(cmdPSH, 3, []byte("three"))),
+			Expect: frames(frame(cmdPSH, 3, []byte("three")))},
+		Step{Send: frames(frame(cmdPSH, 1, []byte("one"))), Expect: frames(frame(cmdPSH, 1, []byte("one")))})
+	add("empty push", "a PSH without data carries nothing", false,
+		Step{Send: frames(frame(cmdSYN, 1, nil), frame(cmdPSH, 1, nil), frame(cmdPSH, 1, hello)), Expect: frames(frame(cmdPSH, 1, hello))})
+	add("metadata", "the SYN payload carries metadata entries of a type, a length and a value, the unknown ones are skipped", false,
+		Step{Send: frames(frame(cmdSYN, 1, []byte{4, 4, 'e', 'c', 'h', 'o', 0x7f, 1, 0}), frame(cmdPSH, 1, hello)), Expect: frames(frame(cmdPSH, 1, hello))})
+	add("ping", "a NOP carrying a ping (1) is answered by a NOP carrying a pong (2) with the same sequence number", false,
+		Step{Send: frames(frame(cmdNOP, 0, []byte{1, 0x2a, 0, 0, 0})), Expect: frames(frame(cmdNOP, 0, []byte{2, 0x2a, 0, 0, 0}))})
+	add("bare nop", "a NOP without payload is ignored", false,
+		Step{Send: frames(frame(cmdNOP, 0, nil), frame(cmdSYN, 1, nil), frame(cmdPSH, 1, hello)), Expect: frames(frame(cmdPSH, 1, hello))})
+	add("go away", "GOA stops the peer opening streams, it keeps serving those open", false,
+		Step{Send: frames(frame(cmdSYN, 1, nil), frame(cmdGOA, 0, nil), frame(cmdPSH, 1, hello)), Expect: frames(frame(cmdPSH, 1, hello))})
+
+	// error cases
+	add("wrong parity", "a SYN with an identifier of the server parity is reset with a protocol error", false,
+		Step{Send: frames(frame(cmdSYN, 2, nil)), Expect: frames(frame(cmdRST, 2, resetPayload(resetProtocolError, "stream id of the wrong parity")))})
+	add("data before syn", "data on a stream not opened yet is reset with a protocol error", false,
+		Step{Send: frames(frame(cmdPSH, 5, hello)), Expect: frames(frame(cmdRST, 5, resetPayload(resetProtocolError, "data before SYN")))})
+	add("bad version", "a frame of an unknown version closes the connection", false,
+		Step{Send: frames(rawFrame(9, cmdNOP, 0, 0, nil)), Closed: true})
+	add("unknown command", "a frame of an unknown command closes the connection", false,
+		Step{Send: frames(rawFrame(1, 0x20, 0, 0, nil)), Closed: true})
+	add("frame too large", "a PSH larger than the max frame size closes the connection", false,
+		Step{Send: frames(frame(cmdSYN, 1, nil), rawFrame(1, cmdPSH, 4097, 1, nil)), Closed: true})
+	add("close", "BYE closes the session with a code and a reason", false,
+		Step{Send: frames(frame(cmdBYE, 0, resetPayload(0, "bye"))), Closed: true})
+	add("unexpected key exchange", "a KXR sent to a server without encryption closes the connection", false,
+		Step{Send: frames(frame(cmdKXR, 0, make([]byte, 88))), Closed: true})
+
+	// handshakes
+	clientPub, clientPriv := fixedKey(2)
+	var nonce [24]byte
+	copy(nonce[:], bytes.Repeat([]byte{3}, len(nonce)))
+	secret := new([32]byte)
+	box.Precompute(secret, serverPub, clientPriv)
+
+	kxr := keyExchange(clientPub, &nonce, secret, []byte{suiteChaCha20Poly1305})
+	kxs := append(kxr[:len(kxr):len(kxr)], suiteChaCha20Poly1305)
+	aead, _ := chacha20poly1305.New(secret[:])
+	add("handshake", "the client sends its key and the suites it supports in KXR, the server answers with KXS adding its choice, the client confirms with KXS, then stream data is sealed with its command and stream", true,
+		Step{Send: frames(frame(cmdKXR, 0, kxr)), Expect: frames(frame(cmdKXS, 0, kxs))},
+		Step{Send: frames(frame(cmdKXS, 0, kxs), frame(cmdSYN, 1, nil), frame(cmdPSH, 1, seal(aead, 1, 1, 1, hello))),
+			Expect: frames(frame(cmdPSH, 1, seal(aead, 0, 1, 1, hello)))},
+		Step{Send: frames(frame(cmdPSH, 1, seal(aead, 1, 3, 1, []byte("again")))),
+			Expect: frames(frame(cmdPSH, 1, seal(aead, 0, 2, 1, []byte("again"))))})
+
+	legacy := keyExchange(clientPub, &nonce, secret, nil)
+	add("legacy handshake", "a client offering no suite gets its KXR echoed and AES-256-OFB with a zero IV encrypts each frame", true,
+		Step{Send: frames(frame(cmdKXR, 0, legacy)), Expect: frames(frame(cmdKXS, 0, legacy))},
+		Step{Send: frames(frame(cmdKXS, 0, legacy), frame(cmdSYN, 1, nil), frame(cmdPSH, 1, xorOFB(secret, hello))),
+			Expect: frames(frame(cmdPSH, 1, xorOFB(secret, hello)))})
+
+	add("key exchange first", "a KXS before the KXR of the client closes the connection", true,
+		Step{Send: frames(frame(cmdKXS, 0, kxs)), Closed: true})
+	bad := append([]byte(nil), kxr...)
+	bad[len(bad)-1] ^= 1
+	add("bad key exchange", "a KXR failing authentication closes the connection", true,
+		Step{Send: frames(frame(cmdKXR, 0, bad)), Closed: true})
+	forged := seal(aead, 1, 1, 1, hello)
+	forged[0] ^= 1
+	add("bad seal", "stream data failing authentication closes the connection", true,
+		Step{Send: frames(frame(cmdKXR, 0, kxr)), Expect: frames(frame(cmdKXS, 0, kxs))},
+		Step{Send: frames(frame(cmdKXS, 0, kxs), frame(cmdSYN, 1, nil), frame(cmdPSH, 1, forged)), Closed: true})
+	add("moved seal", "stream data sealed for another stream closes the connection", true,
+		Step{Send: frames(frame(cmdKXR, 0, kxr)), Expect: frames(frame(cmdKXS, 0, kxs))},
+		Step{Send: frames(frame(cmdKXS, 0, kxs), frame(cmdSYN, 1, nil), frame(cmdSYN, 3, nil), frame(cmdPSH, 3, seal(aead, 1, 1, 1, hello))), Closed: true})
+	add("replayed seal", "stream data whose nonce counter does not increase closes the connection", true,
+		Step{Send: frames(frame(cmdKXR, 0, kxr)), Expect: frames(frame(cmdKXS, 0, kxs))},
+		Step{Send: frames(frame(cmdKXS, 0, kxs), frame(cmdSYN, 1, nil), frame(cmdPSH, 1, seal(aead, 1, 1, 1, hello))),
+			Expect: frames(frame(cmdPSH, 1, seal(aead, 0, 1, 1, hello)))},
+		Step{Send: frames(frame(cmdPSH, 1, seal(aead, 1, 1, 1, hello))), Closed: true})
+	add("reflected seal", "stream data sealed by the server itself closes the connection", true,
+		Step{Send: frames(frame(cmdKXR, 0, kxr)), Expect: frames(frame(cmdKXS, 0, kxs))},
+		Step{Send: frames(frame(cmdKXS, 0, kxs), frame(cmdSYN, 1, nil), frame(cmdPSH, 1, seal(aead, 0, 1, 1, hello))), Closed: true})
+	return suite
+}
+
+// fixedKey returns the key pair of a private key filled with b
+func fixedKey(b byte) (publicKey, privateKey *[32]byte) {
+	publicKey, privateKey, err := box.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+	if err != nil {
+		panic(err)
+	}
+	return publicKey, privateKey
+}
+
+// frame encodes a version 1 frame
+func frame(cmd byte, sid uint32, data []byte) []byte {
+	return rawFrame(1, cmd, len(data), sid, data)
+}
+
+// rawFrame encodes a frame whose length field may lie
+func rawFrame(ver, cmd byte, length int, sid uint32, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	b[0], b[1] = ver, cmd
+	binary.LittleEndian.PutUint16(b[2:], uint16(length))
+	binary.LittleEndian.PutUint32(b[4:], sid)
+	return append(b, data...)
+}
+
+func frames(f ...[]byte) string {
+	return hex.EncodeToString(bytes.Join(f, nil))
+}
+
+// resetPayload encodes the code and reason of RST and BYE frames
+func resetPayload(code uint32, msg string) []byte {
+	b := make([]byte, 4, 4+len(msg))
+	binary.LittleEndian.PutUint32(b, code)
+	return append(b, msg...)
+}
+
+// keyExchange builds a KXR payload: the public key of the client, the
+// nonce and the shared key followed by the suites offered, sealed
+// with the shared key
+func keyExchange(publicKey *[32]byte, nonce *[24]byte, secret *[32]byte, suites []byte) []byte {
+	msg := append(publicKey[:len(publicKey):len(publicKey)], nonce[:]...)
+	return box.SealAfterPrecomputation(msg, append(secret[:len(secret):len(secret)], suites...), nonce, secret)
+}
+
+// seal seals the stream data of a PSH frame of stream sid with an
+// AEAD suite, the nonce is the side, 1 for the client, and a counter
+// increasing with each frame sealed by that side. The additional data
+// is the command and the stream.
+func seal(aead cipher.AEAD, side uint32, counter uint64, sid uint32, data []byte) []byte {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint32(nonce[:], side)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	ad := make([]byte, 5)
+	ad[0] = cmdPSH
+	binary.LittleEndian.PutUint32(ad[1:], sid)
+	return append(aead.Seal(nil, nonce[:], data, ad), nonce[:]...)
+}
+
+// xorOFB encrypts stream data with AES-256-OFB
+func xorOFB(key *[32]byte, data []byte) []byte {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(data))
+	cipher.NewOFB(block, make([]byte, aes.BlockSize)).XORKeyStream(out, data)
+	return out
+}
@@ -0,0 +1,226 @@
+package smux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// DiagnosticProtocol is the protocol of the streams opened by
+// OpenDiagnostic, reserved: the peer answers them itself when set up
+// with Config.Diagnostics, and refuses them otherwise, they never
+// reach AcceptStream
+const DiagnosticProtocol = "smux/diagnostic"
+
+// ErrDiagnosticsUnsupported is returned by OpenDiagnostic on sessions
+// whose protocol cannot tag streams, with Config.UpstreamCompat,
+// protocol version 2 or Config.Yamux
+var ErrDiagnosticsUnsupported = errors.New("diagnostics not supported by the protocol")
+
+// diagnostic requests, a command byte and a uint32 argument
+const (
+	diagEcho     = 'E' // echo the argument bytes following
+	diagTime     = 'T' // send the clock, 8 bytes of Unix nanoseconds
+	diagUpload   = 'U' // discard the argument bytes following, then send the argument back
+	diagDownload = 'D' // send argument bytes
+
+	diagHeaderSize    = 5
+	maxDiagnosticEcho = 65536
+)
+
+// diagChunk is the size of the data written at once by throughput
+// probes
+const diagChunk = 32768
+
+// Diagnostic is a stream answered by the library of the peer, to
+// check a session end to end without help from the application
+type Diagnostic struct {
+	stream *Stream
+	hdr    [diagHeaderSize]byte
+}
+
+// OpenDiagnostic opens a diagnostic stream, the peer must be set up
+// with Config.Diagnostics to answer it. The stream is refused with
+// ResetRefused otherwise, on the first request, as it is by the
+// StreamAuthenticator and AcceptFilters of the peer.
+func (s *Session) OpenDiagnostic(ctx context.Context) (*Diagnostic, error) {
+	if s.upstream() || s.config.Yamux {
+		return nil, ErrDiagnosticsUnsupported
+	}
+	stream, err := s.OpenStreamContext(WithProtocol(ctx, DiagnosticProtocol))
+	if err != nil {
+		return nil, err
+	}
+	return &Diagnostic{stream: stream}, nil
+}
+
+func (d *Diagnostic) request(cmd byte, arg uint32) error {
+	d.hdr[0] = cmd
+	binary.LittleEndian.PutUint32(d.hdr[1:], arg)
+	_, err := d.stream.Write(d.hdr[:])
+	return err
+}
+
+// Echo sends payload, of 64KiB at most, and checks the peer sends it
+// back unchanged. It returns the round trip time.
+func (d *Diagnostic) Echo(payload []byte) (time.Duration, error) {
+	if len(payload) > maxDiagnosticEcho {
+		return 0, errors.New("echo payload too large")
+	}
+	start := time.Now()
+	if err := d.request(diagEcho, uint32(len(payload))); err != nil {
+		return 0, err
+	}
+	if _, err := d.stream.Write(payload); err != nil {
+		return 0, err
+	}
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(d.stream, echo); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	if string(echo) != string(payload) {
+		return rtt, errors.New("echo corrupted")
+	}
+	return rtt, nil
+}
+
+// Time returns the clock of the peer, read about halfway through the
+// round trip time also returned
+func (d *Diagnostic) Time() (time.Time, time.Duration, error) {
+	start := time.Now()
+	if err := d.request(diagTime, 0); err != nil {
+		return time.Time{}, 0, err
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(d.stream, buf[:]); err != nil {
+		return time.Time{}, 0, err
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(buf[:]))), time.Since(start), nil
+}
+
+// Throughput sends n bytes to the peer then has it send n bytes back,
+// it returns the rates of both ways in bytes per second. The peer
+// resets the stream when n is over its Config.MaxDiagnosticSize.
+func (d *Diagnostic) Throughput(n uint32) (send, recv float64, err error) {
+	start := time.Now()
+	if err := d.request(diagUpload, n); err != nil {
+		return 0, 0, err
+	}
+	chunk := make([]byte, diagChunk)
+	for left := n; left > 0; {
+		m := left
+		if m > diagChunk {
+			m = diagChunk
+		}
+		if _, err := d.stream.Write(chunk[:m]); err != nil {
+			return 0, 0, err
+		}
+		left -= m
+	}
+	var ack [4]byte
+	if _, err := io.ReadFull(d.stream, ack[:]); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(ack[:]) != n {
+		return 0, 0, errors.New("upload not acknowledged")
+	}
+	send = bytesPerSecond(n, time.Since(start))
+
+	start = time.Now()
+	if err := d.request(diagDownload, n); err != nil {
+		return 0, 0, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, d.stream, int64(n)); err != nil {
+		return 0, 0, err
+	}
+	return send, bytesPerSecond(n, time.Since(start)), nil
+}
+
+func bytesPerSecond(n uint32, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / elapsed.Seconds()
+}
+
+// SetDeadline bounds the requests made on the diagnostic stream
+func (d *Diagnostic) SetDeadline(t time.Time) error {
+	return d.stream.SetDeadline(t)
+}
+
+// Close closes the diagnostic stream
+func (d *Diagnostic) Close() error {
+	return d.stream.Close()
+}
+
+// acceptDiagnostic answers a diagnostic stream opened by the peer once
+// it passes the checks of AcceptStream, or refuses it without
+// Config.Diagnostics
+func (s *Session) acceptDiagnostic(stream *Stream) {
+	if !s.config.Diagnostics {
+		stream.reset(ResetRefused, "diagnostics disabled")
+		return
+	}
+	go func() {
+		if s.filterAccept(stream) {
+			s.serveDiagnostic(stream)
+		}
+	}()
+}
+
+// serveDiagnostic answers the requests of a diagnostic stream until
+// the peer closes it
+func (s *Session) serveDiagnostic(stream *Stream) {
+	var hdr [diagHeaderSize]byte
+	buf := make([]byte, diagChunk)
+	for {
+		if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+			stream.Close()
+			return
+		}
+		arg := binary.LittleEndian.Uint32(hdr[1:])
+		if int64(arg) > int64(s.config.MaxDiagnosticSize) {
+			s.log(LevelDebug, "diagnostic request too large", "sid", stream.id, "cmd", hdr[0], "size", arg)
+			stream.reset(ResetProtocolError, "diagnostic request too large")
+			return
+		}
+		var err error
+		switch hdr[0] {
+		case diagEcho:
+			if arg > maxDiagnosticEcho {
+				stream.reset(ResetProtocolError, "echo payload too large")
+				return
+			}
+			_, err = io.CopyN(stream, stream, int64(arg))
+		case diagTime:
+			var now [8]byte
+			binary.LittleEndian.PutUint64(now[:], uint64(time.Now().UnixNano()))
+			_, err = stream.Write(now[:])
+		case diagUpload:
+			if _, err = io.CopyN(ioutil.Discard, stream, int64(arg)); err == nil {
+				_, err = stream.Write(hdr[1:])
+			}
+		case diagDownload:
+			for left := arg; left > 0 && err == nil; {
+				m := left
+				if m > diagChunk {
+					m = diagChunk
+				}
+				_, err = stream.Write(buf[:m])
+				left -= m
+			}
+		default:
+			s.log(LevelDebug, "unknown diagnostic request", "sid", stream.id, "cmd", hdr[0])
+			stream.reset(ResetProtocolError, "unknown diagnostic request")
+			return
+		}
+		if err != nil {
+			stream.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package smux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiagnostics(t *testing.T) {
+	client, server, err := Pipe(0, WithDiagnostics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	accepted := make(chan *Stream, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+
+	d, err := client.OpenDiagnostic(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("ping"), 1000)
+	if rtt, err := d.Echo(payload); err != nil || rtt <= 0 {
+		t.Fatal("echo failed", rtt, err)
+	}
+	before := time.Now()
+	peer, rtt, err := d.Time()
+	if err != nil || rtt <= 0 || peer.Before(before) || peer.After(time.Now()) {
+		t.Fatal("unexpected peer time", peer, before, rtt, err)
+	}
+	send, recv, err := d.Throughput(1 << 20)
+	if err != nil || send <= 0 || recv <= 0 {
+		t.Fatal("throughput probe failed", send, recv, err)
+	}
+	d.Close()
+
+	// either side may probe the other
+	d, err = server.OpenDiagnostic(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Echo(nil); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	select {
+	case stream := <-accepted:
+		t.Fatal("diagnostic stream accepted by the application", stream.ID())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDiagnosticsDisabled(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	d, err := client.OpenDiagnostic(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Echo([]byte("ping"))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused {
+		t.Fatal("diagnostic stream not refused", err)
+	}
+
+	compat, compatServer, err := Pipe(0, WithUpstreamCompat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compat.Close()
+	defer compatServer.Close()
+	if _, err := compat.OpenDiagnostic(context.Background()); err != ErrDiagnosticsUnsupported {
+		t.Fatal("expected ErrDiagnosticsUnsupported, got", err)
+	}
+}
+
+func TestDiagnosticsLimits(t *testing.T) {
+	client, server, err := Pipe(0, WithDiagnostics(), WithMaxDiagnosticSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	d, err := client.OpenDiagnostic(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Throughput(4096); err != nil {
+		t.Fatal(err)
+	}
+	// a few bytes must not have the peer send gigabytes
+	if err := d.request(diagDownload, 1<<32-1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.stream.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetProtocolError {
+		t.Fatal("oversized request not refused", err)
+	}
+
+	if _, _, err := Pipe(0, WithMaxDiagnosticSize(-1)); err == nil {
+		t.Fatal("negative max diagnostic size accepted")
+	}
+}
+
+func TestDiagnosticsAuthenticated(t *testing.T) {
+	refused := errors.New("refused")
+	for name, opt := range map[string]Option{
+		"authenticator": WithStreamAuthenticator(func(stream *Stream, token []byte) error {
+			return refused
+		}),
+		"filter": WithAcceptFilters(func(stream *Stream) error {
+			return refused
+		}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, server, err := Pipe(0, WithDiagnostics(), opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			defer server.Close()
+
+			d, err := client.OpenDiagnostic(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = d.Echo([]byte("ping"))
+			if _, ok := err.(*StreamError); !ok {
+				t.Fatal("diagnostic stream not refused", err)
+			}
+		})
+	}
+}
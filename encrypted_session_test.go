@@ -1,10 +1,13 @@
 package smux
 
 import (
+	"bytes"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
@@ -976,3 +979,436 @@ func getEncryptedSmuxStreamPair() (*Stream, *Stream, error) {
 
 	return cs, ss, nil
 }
+
+func TestWaitForHandshake(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	client, err := newTestClient(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer never answers the key exchange
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.WaitForHandshake(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected the deadline of the context, got", err)
+	}
+	if _, err := client.OpenStreamContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("open not bounded by its context", err)
+	}
+	client.Close()
+	if err := client.WaitForHandshake(context.Background()); err != ErrSessionClosed {
+		t.Fatal("expected the session closed, got", err)
+	}
+
+	plain, _ := Client(&buffer{}, nil)
+	defer plain.Close()
+	if err := plain.WaitForHandshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLazyKeyExchange(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := EncryptedClient(c1, WithEncryption(testServerPubKey, nil),
+		WithLazyKeyExchange(), WithKeyHandshakeTimeout(100*time.Millisecond))
+	defer client.Close()
+	server, _ := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey),
+		WithLazyKeyExchange(), WithKeyHandshakeTimeout(100*time.Millisecond))
+	defer server.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := server.AcceptStream()
+		accepted <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if client.EncryptionState().HandshakeComplete || server.EncryptionState().HandshakeComplete {
+		t.Fatal("keys exchanged before the first stream")
+	}
+	select {
+	case err := <-accepted:
+		t.Fatal("accept gave up on the lazy key exchange", err)
+	default:
+	}
+
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	if !client.EncryptionState().HandshakeComplete {
+		t.Fatal("keys not exchanged")
+	}
+}
+
+func TestOptionalEncryption(t *testing.T) {
+	keys := WithEncryption(testServerPubKey, testServerPrivKey)
+	roundTrip := func(client, server *Session) error {
+		defer client.Close()
+		defer server.Close()
+		stream, err := client.OpenStream()
+		if err != nil {
+			return err
+		}
+		stream.Write([]byte("hello"))
+		accepted, err := server.AcceptStream()
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+			return fmt.Errorf("unexpected data %q: %v", buf, err)
+		}
+		return nil
+	}
+
+	// a plain server declines
+	c1, c2 := NewPipeConn(0)
+	client, _ := EncryptedClient(c1, keys, WithOptionalEncryption())
+	server, _ := Server(c2, WithOptionalEncryption())
+	if err := roundTrip(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if st := client.EncryptionState(); !st.Plaintext || st.Cipher != cipherPlaintext || !st.HandshakeComplete {
+		t.Fatal("unexpected client state", st)
+	}
+
+	// a plain client skips the key exchange
+	c1, c2 = NewPipeConn(0)
+	client, _ = Client(c1)
+	server, _ = EncryptedServer(c2, keys, WithOptionalEncryption())
+	if err := roundTrip(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if st := server.EncryptionState(); !st.Plaintext || !st.HandshakeComplete {
+		t.Fatal("unexpected server state", st)
+	}
+
+	// both encrypt when they can
+	c1, c2 = NewPipeConn(0)
+	client, _ = EncryptedClient(c1, keys, WithOptionalEncryption())
+	server, _ = EncryptedServer(c2, keys, WithOptionalEncryption())
+	if err := roundTrip(client, server); err != nil {
+		t.Fatal(err)
+	}
+	if st := server.EncryptionState(); st.Plaintext || st.Cipher == cipherPlaintext {
+		t.Fatal("encryption negotiated away", st)
+	}
+
+	// clients requiring encryption refuse to be declined
+	c1, c2 = NewPipeConn(0)
+	client, _ = EncryptedClient(c1, keys, WithKeyHandshakeTimeout(time.Second))
+	server, _ = Server(c2, WithOptionalEncryption())
+	if err := roundTrip(client, server); err == nil {
+		t.Fatal("client accepted plaintext")
+	}
+}
+
+func TestEncryptionState(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newTestServer(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := newTestClient(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	go server.AcceptStream()
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	st := client.EncryptionState()
+	if !st.Enabled || !st.HandshakeComplete || st.Cipher == "" {
+		t.Fatal("unexpected client state", st)
+	}
+	if st.PeerPublicKey != *testServerPubKey {
+		t.Fatal("client does not report the server key")
+	}
+	if st.KeyAge() <= 0 {
+		t.Fatal("key age not tracked")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.WaitForHandshake(ctx); err != nil {
+		t.Fatal("server handshake did not complete", err)
+	}
+	if st := server.EncryptionState(); !st.HandshakeComplete || st.PeerPublicKey == [32]byte{} {
+		t.Fatal("unexpected server state", st)
+	}
+
+	plain, _ := Client(&buffer{}, nil)
+	defer plain.Close()
+	if st := plain.EncryptionState(); st.Enabled || st.HandshakeComplete {
+		t.Fatal("plaintext session reports encryption", st)
+	}
+}
+
+func TestEncryptedCryptoWorkers(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := EncryptedClient(c1, WithEncryption(testServerPubKey, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey), WithCryptoWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	const streams = 8
+	data := make([]byte, 256*1024)
+	crand.Read(data)
+	for i := 0; i < streams; i++ {
+		go func() {
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			stream.Write(data)
+			stream.Close()
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the reset travels behind the data, so the stream
+			// reads everything before EOF
+			received, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Error("data mismatch", len(received))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCipherNegotiation(t *testing.T) {
+	defer func(f func() []byte) { preferredSuites = f }(preferredSuites)
+	tests := []struct {
+		suites []byte
+		cipher string
+	}{
+		{[]byte{suiteAESGCM}, cipherAESGCM},
+		{[]byte{suiteChaCha20Poly1305}, cipherChaCha20Poly1305},
+		{nil, cipherAESOFB}, // peers unaware of suites
+	}
+	for _, tt := range tests {
+		suites := tt.suites
+		preferredSuites = func() []byte { return suites }
+
+		c1, c2, err := getTCPConnectionPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, _ := newTestServer(c2)
+		client, _ := newTestClient(c1)
+		go func() {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			io.Copy(stream, stream)
+		}()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 3*4096+100)
+		crand.Read(data)
+		go stream.Write(data)
+		received := make([]byte, len(data))
+		if _, err := io.ReadFull(stream, received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatal("data mismatch with", tt.cipher)
+		}
+		if st := client.EncryptionState(); st.Cipher != tt.cipher {
+			t.Fatal("client negotiated", st.Cipher, "want", tt.cipher)
+		}
+		if st := server.EncryptionState(); st.Cipher != tt.cipher {
+			t.Fatal("server negotiated", st.Cipher, "want", tt.cipher)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestFrameCipherTampering(t *testing.T) {
+	var key [32]byte
+	crand.Read(key[:])
+	for _, suite := range []byte{suiteAESGCM, suiteChaCha20Poly1305} {
+		sender, _ := newFrameCipher(suite, &key, nil, true)
+		receiver, _ := newFrameCipher(suite, &key, nil, false)
+		sealed, err := sender.seal(make([]byte, 0, 64), []byte("hello"), cmdPSH, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed) != 5+sender.overhead() {
+			t.Fatal("unexpected sealed size", len(sealed))
+		}
+		opens := func(data []byte, cmd byte, sid uint32) bool {
+			_, err := receiver.open(append([]byte{}, data...), cmd, sid)
+			return err == nil
+		}
+		tampered := append([]byte{}, sealed...)
+		tampered[0] ^= 1
+		if opens(tampered, cmdPSH, 1) {
+			t.Fatal("tampered frame accepted")
+		}
+		if opens(sealed, cmdPSH, 3) || opens(sealed, cmdSYN, 1) {
+			t.Fatal("frame moved to another stream or command accepted")
+		}
+		if err := receiver.acceptNonce(sealed); err != nil || !opens(sealed, cmdPSH, 1) {
+			t.Fatal("frame refused", err)
+		}
+		if err := receiver.acceptNonce(sealed); err == nil {
+			t.Fatal("replayed frame accepted")
+		}
+		reflected, _ := receiver.seal(make([]byte, 0, 64), []byte("hello"), cmdPSH, 1)
+		if err := receiver.acceptNonce(reflected); err == nil {
+			t.Fatal("reflected frame accepted")
+		}
+		later, _ := sender.seal(make([]byte, 0, 64), []byte("again"), cmdPSH, 1)
+		if err := receiver.acceptNonce(later); err != nil || !opens(later, cmdPSH, 1) {
+			t.Fatal("frame refused after a replay", err)
+		}
+	}
+}
+
+func TestEncryptedTracer(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := &testTracer{}
+	client, _ := EncryptedClient(c1, WithEncryption(testServerPubKey, nil), WithTracer(tracer))
+	server, _ := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey))
+	defer server.Close()
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	handshake := tracer.spans[0]
+	if handshake.name != spanHandshake || !handshake.ended || handshake.err != nil {
+		t.Fatal("unexpected handshake span", handshake)
+	}
+	if len(handshake.events) != 1 || handshake.events[0] != "key established" {
+		t.Fatal("unexpected handshake events", handshake.events)
+	}
+	if stream := tracer.spans[1]; !stream.ended || stream.err == nil {
+		t.Fatal("stream span not ended by the session close", stream)
+	}
+}
+
+func TestEncryptedFrameTap(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type tapped struct {
+		dir Direction
+		f   FrameInfo
+	}
+	frames := make(chan tapped, 64)
+	tap := func(dir Direction, f FrameInfo) {
+		f.Data = append([]byte(nil), f.Data...)
+		frames <- tapped{dir, f}
+	}
+	client, _ := EncryptedClient(c1, WithEncryption(testServerPubKey, nil), WithFrameTap(tap))
+	server, _ := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey), WithFrameTap(tap))
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent, received bool
+	for !sent || !received {
+		select {
+		case tf := <-frames:
+			if tf.f.CmdName() != "PSH" {
+				continue
+			}
+			if string(tf.f.Data) != "hello" || tf.f.Length <= len("hello") {
+				t.Fatal("unexpected tapped frame", tf.dir, tf.f)
+			}
+			sent = sent || tf.dir == Outbound
+			received = received || tf.dir == Inbound
+		case <-time.After(5 * time.Second):
+			t.Fatal("frames not tapped")
+		}
+	}
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	var clientLog, serverLog bytes.Buffer
+	c1, c2 := NewPipeConn(0)
+	server, err := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey), WithKeyLogWriter(&serverLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := EncryptedClient(c1, WithEncryption(testServerPubKey, nil), WithKeyLogWriter(&clientLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.WaitForHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WaitForHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(clientLog.String())
+	if len(fields) != 4 || fields[0] != "SMUX_SESSION_KEY" || fields[2] != client.EncryptionState().Cipher || len(fields[3]) != 64 {
+		t.Fatalf("unexpected key log %q", clientLog.String())
+	}
+	if serverLog.String() != clientLog.String() {
+		t.Fatalf("server logged %q, client %q", serverLog.String(), clientLog.String())
+	}
+}
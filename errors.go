@@ -0,0 +1,129 @@
+package smux
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/superfly/smux/frame"
+)
+
+// ErrPeerStalled closes a session whose connection accepted no data
+// for Config.WriteTimeout, the peer stopped reading
+var ErrPeerStalled = errors.New("peer stalled")
+
+// ErrTooManyStreams is returned by OpenStream when Config.MaxOpenStreams
+// streams are open, the session stays usable, and by the OpenStream of
+// a SessionPool whose sessions all reached MaxStreamsPerSession
+var ErrTooManyStreams = errors.New("too many open streams")
+
+// ErrSessionClosed is returned by the calls blocked on a session when
+// it was closed with Close, and by those made after
+var ErrSessionClosed = errors.New("session closed")
+
+// ErrNotAccepting is returned by AcceptStream once StopAccepting was
+// called
+var ErrNotAccepting = errors.New("session not accepting streams")
+
+// ErrConnReplaced is returned by the writes cut short by ReplaceConn
+// on the previous connection, their data was lost with it
+var ErrConnReplaced = errors.New("connection replaced")
+
+// ErrKeepAliveTimeout closes a session which received nothing for
+// the keep-alive timeout
+var ErrKeepAliveTimeout = errors.New("keep-alive timeout")
+
+// ReadError closes a session whose connection failed a read, such as
+// with io.EOF once the peer closed it
+type ReadError struct {
+	Err error // error of the connection
+}
+
+func (e *ReadError) Error() string {
+	return "connection read failed: " + e.Err.Error()
+}
+
+// Cause returns the error of the connection
+func (e *ReadError) Cause() error { return e.Err }
+
+// Unwrap returns the error of the connection
+func (e *ReadError) Unwrap() error { return e.Err }
+
+// WriteError closes a session whose connection failed a write, it
+// is returned by the calls blocked on the session and those made
+// after, rather than waiting for the keep-alive to notice
+type WriteError struct {
+	Err error // error of the connection
+}
+
+func (e *WriteError) Error() string {
+	return "connection write failed: " + e.Err.Error()
+}
+
+// Cause returns the error of the connection
+func (e *WriteError) Cause() error { return e.Err }
+
+// Unwrap returns the error of the connection
+func (e *WriteError) Unwrap() error { return e.Err }
+
+// reset codes carried by the RST frames of streams
+const (
+	ResetProtocolError  uint32 = 1 // the stream broke the protocol
+	ResetRefused        uint32 = 2 // the stream could not be accepted
+	ResetBufferExceeded uint32 = 3 // the stream was sent more than its receiver buffers
+	ResetIdleTimeout    uint32 = 4 // the stream was neither read nor written for too long
+	ResetUnauthorized   uint32 = 5 // the auth token of the stream was refused
+	ResetInternalError  uint32 = 6 // the handler of the stream failed
+)
+
+// StreamError is the reason a stream was reset, reads return it
+// once the data received before the reset was read
+type StreamError struct {
+	Code    uint32
+	Message string
+	Remote  bool // the peer reset the stream
+}
+
+func (e *StreamError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("stream reset by peer: %s (code %d)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("stream reset: %s (code %d)", e.Message, e.Code)
+}
+
+// ProtocolError closes a session whose peer broke the protocol, such
+// as with a frame larger than allowed
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol violation: " + e.Reason
+}
+
+// SessionError is the reason given to CloseWithError, it is returned
+// by the calls blocked on the closed session on both ends
+type SessionError struct {
+	Code    uint32
+	Message string
+	Remote  bool // the peer closed the session
+}
+
+func (e *SessionError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("session closed by peer: %s (code %d)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("session closed: %s (code %d)", e.Message, e.Code)
+}
+
+// encodeSessionError builds the payload of a BYE frame, the message
+// is truncated so that the payload fits in maxSize
+func encodeSessionError(code uint32, msg string, maxSize int) []byte {
+	return frame.AppendReason(nil, code, msg, maxSize)
+}
+
+// decodeSessionError parses the payload of a BYE frame
+func decodeSessionError(data []byte) *SessionError {
+	e := &SessionError{Remote: true}
+	e.Code, e.Message, _ = frame.ParseReason(data)
+	return e
+}
@@ -0,0 +1,135 @@
+package smux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults are the failures a FaultConn injects. Byte offsets count
+// from the creation of the connection.
+type Faults struct {
+	// ReadError fails the reads once ReadErrorAfter bytes were read
+	ReadError      error
+	ReadErrorAfter int64
+
+	// WriteError fails the writes once WriteErrorAfter bytes were
+	// written, the write crossing the offset is partial
+	WriteError      error
+	WriteErrorAfter int64
+
+	// MaxWrite cuts writes short after that many bytes without an
+	// error, as broken writers do, zero writes whole
+	MaxWrite int
+
+	// ReadDelay and WriteDelay are waited before each read and write
+	ReadDelay  time.Duration
+	WriteDelay time.Duration
+
+	// DisconnectAfter closes the connection once that many bytes
+	// were written, zero never does
+	DisconnectAfter int64
+}
+
+// FaultConn wraps a connection to inject failures, to test sessions
+// and the code built on them under broken transports:
+//
+//	c1, c2 := smux.NewPipeConn(0)
+//	conn := smux.NewFaultConn(c1, smux.Faults{DisconnectAfter: 1 << 20})
+//	client, _ := smux.Client(conn)
+type FaultConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	faults  Faults
+	read    int64 // bytes read so far
+	written int64 // bytes written so far
+}
+
+// NewFaultConn returns conn injecting faults
+func NewFaultConn(conn net.Conn, faults Faults) *FaultConn {
+	return &FaultConn{Conn: conn, faults: faults}
+}
+
+// SetFaults replaces the faults injected from now on
+func (c *FaultConn) SetFaults(faults Faults) {
+	c.mu.Lock()
+	c.faults = faults
+	c.mu.Unlock()
+}
+
+// Disconnect closes the connection under the session, as a broken
+// link would
+func (c *FaultConn) Disconnect() error {
+	return c.Conn.Close()
+}
+
+// Read implements net.Conn
+func (c *FaultConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	f, read := c.faults, c.read
+	c.mu.Unlock()
+
+	if f.ReadDelay > 0 {
+		time.Sleep(f.ReadDelay)
+	}
+	if f.ReadError != nil {
+		left := f.ReadErrorAfter - read
+		if left <= 0 {
+			return 0, f.ReadError
+		}
+		if int64(len(b)) > left {
+			b = b[:left]
+		}
+	}
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *FaultConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	f, written := c.faults, c.written
+	c.mu.Unlock()
+
+	if f.WriteDelay > 0 {
+		time.Sleep(f.WriteDelay)
+	}
+	var err error
+	if f.WriteError != nil {
+		if left := f.WriteErrorAfter - written; int64(len(b)) > left {
+			if left < 0 {
+				left = 0
+			}
+			b, err = b[:left], f.WriteError
+		}
+	}
+	if f.MaxWrite > 0 && len(b) > f.MaxWrite {
+		b, err = b[:f.MaxWrite], nil
+	}
+	disconnect := false
+	if f.DisconnectAfter > 0 {
+		if left := f.DisconnectAfter - written; int64(len(b)) >= left {
+			if left < 0 {
+				left = 0
+			}
+			b, err, disconnect = b[:left], io.ErrClosedPipe, true
+		}
+	}
+
+	n, werr := c.Conn.Write(b)
+	c.mu.Lock()
+	c.written += int64(n)
+	c.mu.Unlock()
+	if disconnect {
+		c.Conn.Close()
+	}
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
@@ -0,0 +1,190 @@
+package smux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFaultConn(t *testing.T) {
+	c1, c2 := NewPipeConn(0)
+	conn := NewFaultConn(c1, Faults{MaxWrite: 5, WriteError: errors.New("link down"), WriteErrorAfter: 12})
+
+	// short writes, then a partial one failing
+	if n, err := conn.Write([]byte("0123456789")); n != 5 || err != nil {
+		t.Fatal("expected a short write, got", n, err)
+	}
+	if n, err := conn.Write([]byte("56789")); n != 5 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := conn.Write([]byte("abcd")); n != 2 || err == nil || err.Error() != "link down" {
+		t.Fatal("expected a partial failing write, got", n, err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(c2, buf); err != nil || string(buf) != "0123456789ab" {
+		t.Fatal("unexpected data", string(buf), err)
+	}
+
+	// reads fail past their offset
+	conn.SetFaults(Faults{ReadError: io.ErrUnexpectedEOF, ReadErrorAfter: 3, ReadDelay: 10 * time.Millisecond})
+	c2.Write([]byte("hello"))
+	start := time.Now()
+	if n, err := conn.Read(buf); n != 3 || err != nil {
+		t.Fatal("expected a read cut at the offset, got", n, err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("read not delayed")
+	}
+	if _, err := conn.Read(buf); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected the read error, got", err)
+	}
+}
+
+func TestFaultConnDisconnect(t *testing.T) {
+	c1, c2 := NewPipeConn(0)
+	conn := NewFaultConn(c1, Faults{DisconnectAfter: 32 << 10})
+	client, _ := Client(conn, WithoutKeepAlive())
+	defer client.Close()
+	server, _ := Server(c2, WithoutKeepAlive())
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stream.Write(bytes.Repeat([]byte("x"), 64<<10))
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the link breaks half way, both ends learn it
+	n, err := io.Copy(ioutil.Discard, accepted)
+	if err == nil || n >= 32<<10 {
+		t.Fatal("expected the stream cut short, got", n, err)
+	}
+	if _, ok := server.dieError().(*ReadError); !ok {
+		t.Fatal("expected the server closed by a read error, got", server.dieError())
+	}
+	if !client.IsClosed() {
+		t.Fatal("client open after the disconnect")
+	}
+}
+
+func TestFrameFaults(t *testing.T) {
+	// window updates held back, the writer waits for them
+	client, server, err := Pipe(0, WithProtocolVersion(2), WithMaxStreamBuffer(32<<10),
+		WithFrameFaults(FrameFault{Dir: Inbound, Cmd: "UPD", Every: 3, Delay: 20 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := client.OpenStream()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+	go stream.Write(data)
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(accepted, received); err != nil || !bytes.Equal(received, data) {
+		t.Fatal("data mismatch", err)
+	}
+	client.Close()
+	server.Close()
+
+	// the first SYN lost, the stream never shows up
+	client, server, err = Pipe(0, WithFrameFaults(FrameFault{Dir: Outbound, Cmd: "SYN", Limit: 1, Drop: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.OpenStream()
+	second, _ := client.OpenStream()
+	accepted, err = server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.ID() != second.ID() {
+		t.Fatal("expected the second stream, got", accepted.ID())
+	}
+	client.Close()
+	server.Close()
+
+	for _, dir := range []Direction{Outbound, Inbound} {
+		// a frame of stream data as large as the window lost, the
+		// window it took is given back and the stream goes on
+		client, server, err = Pipe(0, WithProtocolVersion(2), WithMaxStreamBuffer(32<<10), WithMaxFrameSize(32<<10),
+			WithFrameFaults(FrameFault{Dir: dir, Cmd: "PSH", Limit: 1, Drop: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, _ = client.OpenStream()
+		if n, err := stream.Write(make([]byte, stream.frameSize)); err != nil || n != stream.frameSize {
+			t.Fatal("dropped data not reported sent", n, err)
+		}
+		go stream.Write(data)
+		accepted, err = server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(accepted, received); err != nil || !bytes.Equal(received, data) {
+			t.Fatal("data mismatch after a lost frame", dir, err)
+		}
+		client.Close()
+		server.Close()
+
+		// window updates lost, the writer probes the window
+		client, server, err = Pipe(0, WithProtocolVersion(2), WithMaxStreamBuffer(32<<10),
+			WithFrameFaults(FrameFault{Dir: dir, Cmd: "UPD", Every: 3, Drop: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, _ = client.OpenStream()
+		go stream.Write(data)
+		accepted, err = server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for k := 0; k < len(received); k += 1000 {
+			// reads of a size that leaves the window short of
+			// the next update once one is lost
+			end := k + 1000
+			if end > len(received) {
+				end = len(received)
+			}
+			if _, err := io.ReadFull(accepted, received[k:end]); err != nil {
+				t.Fatal("stream wedged by a lost window update", dir, err)
+			}
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatal("data mismatch after lost window updates", dir)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// pings lost, the keep-alive times out
+	c1, c2 := NewPipeConn(0)
+	client, _ = Client(c1, WithKeepAlive(20*time.Millisecond, 100*time.Millisecond))
+	server, _ = Server(c2, WithFrameFaults(FrameFault{Dir: Outbound, Cmd: "NOP", Drop: true}))
+	defer server.Close()
+	select {
+	case <-client.Done():
+		if err := client.CloseErr(); err != ErrKeepAliveTimeout {
+			t.Fatal("expected ErrKeepAliveTimeout, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keep-alive did not time out")
+	}
+
+	if _, err := Client(c1, WithFrameFaults(FrameFault{Every: -1})); err == nil {
+		t.Fatal("negative fault period accepted")
+	}
+	if _, err := Client(c1, WithYamux(), WithFrameFaults(FrameFault{Cmd: "WND", Drop: true})); err == nil {
+		t.Fatal("dropped yamux window updates accepted")
+	}
+}
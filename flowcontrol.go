@@ -0,0 +1,36 @@
+package smux
+
+// FlowControl decides how much received data a session buffers for
+// its streams, in place of the MaxReceiveBuffer bucket. recvLoop
+// reads the next frame from the connection once Wait returns, so a
+// policy holds back the whole session, the peer being slowed down by
+// the transport. Receive and Release account the data of each stream,
+// letting a policy keep budgets per tenant, per protocol or give
+// priority streams more credit. A policy may be shared by the
+// sessions of a listener to bound them together.
+//
+// Receive and Release are called on the receive and read paths with
+// locks held, they must not block nor call into the session.
+// MaxStreamReceiveBuffer and the stream windows of protocol version 2
+// still apply on top of the policy.
+type FlowControl interface {
+	// Wait blocks until the session may read another frame, or
+	// until done is closed as the session closes
+	Wait(done <-chan struct{})
+
+	// Receive is called before n bytes are buffered for stream,
+	// returning false drops them and resets the stream with
+	// ResetBufferExceeded
+	Receive(stream *Stream, n int) bool
+
+	// Release is called as n bytes received leave the buffer of
+	// stream, read by the application or dropped when it closed
+	Release(stream *Stream, n int)
+}
+
+// waitFlowControl blocks recvLoop on the policy of the session, it
+// returns false once the session is closed
+func (s *Session) waitFlowControl(fc FlowControl) bool {
+	fc.Wait(s.die)
+	return !s.IsClosed()
+}
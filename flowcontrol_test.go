@@ -0,0 +1,143 @@
+package smux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// budgetPolicy bounds the data buffered by all its sessions, and
+// refuses the data of one stream
+type budgetPolicy struct {
+	mu     sync.Mutex
+	limit  int
+	used   int
+	peak   int
+	refuse uint32
+	freed  chan struct{} // closed when data is released
+}
+
+func newBudgetPolicy(limit int) *budgetPolicy {
+	return &budgetPolicy{limit: limit, freed: make(chan struct{})}
+}
+
+func (p *budgetPolicy) Wait(done <-chan struct{}) {
+	for {
+		p.mu.Lock()
+		if p.used < p.limit {
+			p.mu.Unlock()
+			return
+		}
+		freed := p.freed
+		p.mu.Unlock()
+		select {
+		case <-freed:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *budgetPolicy) Receive(stream *Stream, n int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stream.ID() == p.refuse {
+		return false
+	}
+	p.used += n
+	if p.used > p.peak {
+		p.peak = p.used
+	}
+	return true
+}
+
+func (p *budgetPolicy) Release(stream *Stream, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used -= n
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+func (p *budgetPolicy) state() (used, peak int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.used, p.peak
+}
+
+func TestFlowControl(t *testing.T) {
+	policy := newBudgetPolicy(65536)
+	client, server, err := Pipe(0, WithFlowControl(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	msg := make([]byte, 1<<20)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	stream, _ := client.OpenStream()
+	go stream.Write(msg)
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the session stops reading once the budget is spent
+	deadline := time.Now().Add(5 * time.Second)
+	for used, _ := policy.state(); used < policy.limit; used, _ = policy.state() {
+		if time.Now().After(deadline) {
+			t.Fatal("budget not spent, used", used)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, peak := policy.state(); peak >= policy.limit+server.config.MaxFrameSize {
+		t.Fatal("budget exceeded, peak", peak)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(accepted, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatal("unexpected data", err)
+	}
+	if used, _ := policy.state(); used != 0 {
+		t.Fatal("data read not released", used)
+	}
+
+	// refused data resets its stream
+	refused, _ := client.OpenStream()
+	policy.mu.Lock()
+	policy.refuse = refused.ID()
+	policy.mu.Unlock()
+	refused.Write([]byte("hello"))
+	_, err = refused.Read(buf)
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetBufferExceeded || !se.Remote {
+		t.Fatal("expected a reset stream, got", err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unread data is released as the stream closes
+	unread, _ := client.OpenStream()
+	unread.Write([]byte("hello"))
+	accepted, err = server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for accepted.buffered() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	accepted.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for used, _ := policy.state(); used != 0; used, _ = policy.state() {
+		if time.Now().After(deadline) {
+			t.Fatal("data of a closed stream not released", used)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
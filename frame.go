@@ -3,28 +3,33 @@ package smux
 import (
 	"encoding/binary"
 	"fmt"
+
+	"github.com/superfly/smux/frame"
 )
 
 const (
 	version = 1
 )
 
+// the wire constants are those of the frame package, shared with the
+// tools decoding smux traffic
 const ( // cmds
-	cmdSYN byte = iota // stream open
-	cmdRST             // stream close
-	cmdPSH             // data push
-	cmdNOP             // no operation
-	cmdKXS             // key exchange sent
-	cmdKXR             // key exchange received
+	cmdSYN = frame.CmdSYN // stream open
+	cmdRST = frame.CmdRST // stream close
+	cmdPSH = frame.CmdPSH // data push
+	cmdNOP = frame.CmdNOP // no operation
+	cmdKXS = frame.CmdKXS // key exchange sent
+	cmdKXR = frame.CmdKXR // key exchange received
+	cmdBYE = frame.CmdBYE // session close with a reason
+	cmdGOA = frame.CmdGOA // go away, no new streams
 )
 
-const (
-	sizeOfVer    = 1
-	sizeOfCmd    = 1
-	sizeOfLength = 2
-	sizeOfSid    = 4
-	headerSize   = sizeOfVer + sizeOfCmd + sizeOfSid + sizeOfLength
-)
+const headerSize = frame.HeaderSize
+
+// maxControlSize bounds the payload of frames other than PSH, such as
+// key exchanges and close reasons, they are accepted whatever the
+// MaxFrameSize of the receiver
+const maxControlSize = frame.MaxControlSize
 
 // Frame defines a packet from or to be multiplexed into a single connection
 type Frame struct {
@@ -60,3 +65,46 @@ func (h rawHeader) String() string {
 	return fmt.Sprintf("Version:%d Cmd:%d StreamID:%d Length:%d",
 		h.Version(), h.Cmd(), h.StreamID(), h.Length())
 }
+
+// metadata of a stream travels in the payload of its SYN frame as
+// entries of a type byte, a length byte and the value. Types unknown
+// to the receiver are skipped, older peers ignore the payload.
+const (
+	metaTrace      = frame.MetaTrace      // trace context of the opener
+	metaPeerAddr   = frame.MetaPeerAddr   // port and IP of the original client
+	metaServerName = frame.MetaServerName // TLS server name asked by the original client
+	metaProtocol   = frame.MetaProtocol   // application protocol of the stream
+	metaAuthToken  = frame.MetaAuthToken  // credential of the opener
+	metaSealedAuth = frame.MetaSealedAuth // credential of the opener, sealed with the session cipher
+)
+
+// appendMeta encodes a metadata entry at the end of buf, value must
+// not be longer than 255 bytes
+func appendMeta(buf []byte, typ byte, value []byte) []byte {
+	return frame.AppendMeta(buf, typ, value)
+}
+
+// findMeta returns the value of the first entry of type typ in the
+// metadata, nil if there is none
+func findMeta(data []byte, typ byte) []byte {
+	return frame.FindMeta(data, typ)
+}
+
+// cmdNames are the names of the commands, indexed by value
+var cmdNames = [...]string{"SYN", "RST", "PSH", "NOP", "KXS", "KXR", "BYE", "GOA"}
+
+// cmdName returns the name of a command
+func cmdName(cmd byte) string {
+	if int(cmd) < len(cmdNames) {
+		return cmdNames[cmd]
+	}
+	switch cmd {
+	case cmdACK:
+		return "ACK"
+	case cmdWND:
+		return "WND"
+	case cmdFIN:
+		return "FIN"
+	}
+	return fmt.Sprintf("CMD(%d)", cmd)
+}
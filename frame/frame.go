@@ -0,0 +1,279 @@
+// Package frame encodes and decodes the frames of the smux wire
+// protocol, for tools working on smux traffic outside of a session:
+// log decoders, replay tools and other implementations.
+//
+// A frame is an 8 byte header followed by its payload:
+//
+//	VERSION(1B) | CMD(1B) | LENGTH(2B) | STREAMID(4B) | DATA(LENGTH)
+//
+// Integers are little endian. The payload of PSH frames is stream
+// data, encrypted once an encrypted session finished its key
+// exchange, the payloads of the other commands are described with
+// their parsers.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// protocol versions
+const (
+	Version1 byte = 1 // xtaci/smux v1, with the extensions of this fork
+	Version2 byte = 2 // xtaci/smux v2, with per-stream flow control
+)
+
+// frame commands
+const (
+	CmdSYN byte = iota // stream open, with the metadata of the stream
+	CmdRST             // stream close, with an optional reason
+	CmdPSH             // stream data
+	CmdNOP             // keep-alive, with an optional ping or pong
+	CmdKXS             // key exchange of the server
+	CmdKXR             // key exchange of the client
+	CmdBYE             // session close, with a reason
+	CmdGOA             // go away, no new streams
+
+	// CmdUPD is the window update of version 2, which has no key
+	// exchange and reuses the value of CmdKXS
+	CmdUPD byte = 4
+)
+
+// sizes of the protocol
+const (
+	HeaderSize     = 8     // version, command, length and stream id
+	MaxPayloadSize = 65535 // largest payload LENGTH can tell
+	MaxControlSize = 256   // largest payload of frames other than PSH
+)
+
+// ErrPayloadTooLarge is returned when encoding a payload longer than
+// MaxPayloadSize
+var ErrPayloadTooLarge = errors.New("frame payload too large")
+
+var cmdNames = [...]string{"SYN", "RST", "PSH", "NOP", "KXS", "KXR", "BYE", "GOA"}
+
+// CmdName returns the name of a command of protocol version ver, such
+// as "PSH"
+func CmdName(ver, cmd byte) string {
+	if ver == Version2 && cmd == CmdUPD {
+		return "UPD"
+	}
+	if int(cmd) < len(cmdNames) {
+		return cmdNames[cmd]
+	}
+	return fmt.Sprintf("CMD(%d)", cmd)
+}
+
+// Header is the header of a frame
+type Header struct {
+	Version  byte
+	Cmd      byte
+	Length   uint16 // size of the payload following
+	StreamID uint32
+}
+
+// ParseHeader decodes the header at the start of b, it returns
+// io.ErrUnexpectedEOF when b is shorter than HeaderSize
+func ParseHeader(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, io.ErrUnexpectedEOF
+	}
+	return Header{
+		Version:  b[0],
+		Cmd:      b[1],
+		Length:   binary.LittleEndian.Uint16(b[2:]),
+		StreamID: binary.LittleEndian.Uint32(b[4:]),
+	}, nil
+}
+
+// Append appends the encoding of h to buf
+func (h Header) Append(buf []byte) []byte {
+	var b [HeaderSize]byte
+	b[0] = h.Version
+	b[1] = h.Cmd
+	binary.LittleEndian.PutUint16(b[2:], h.Length)
+	binary.LittleEndian.PutUint32(b[4:], h.StreamID)
+	return append(buf, b[:]...)
+}
+
+// CmdName returns the name of the command of h
+func (h Header) CmdName() string {
+	return CmdName(h.Version, h.Cmd)
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("Version:%d Cmd:%s StreamID:%d Length:%d",
+		h.Version, h.CmdName(), h.StreamID, h.Length)
+}
+
+// Frame is a frame of the protocol
+type Frame struct {
+	Version  byte
+	Cmd      byte
+	StreamID uint32
+	Data     []byte
+}
+
+// Header returns the header of f
+func (f Frame) Header() Header {
+	return Header{Version: f.Version, Cmd: f.Cmd, Length: uint16(len(f.Data)), StreamID: f.StreamID}
+}
+
+// Append appends the encoding of f to buf
+func (f Frame) Append(buf []byte) ([]byte, error) {
+	if len(f.Data) > MaxPayloadSize {
+		return buf, ErrPayloadTooLarge
+	}
+	return append(f.Header().Append(buf), f.Data...), nil
+}
+
+// Decode decodes the frame at the start of b and returns its size,
+// its Data points into b. It returns io.ErrUnexpectedEOF when b
+// holds a part of the frame only.
+func Decode(b []byte) (Frame, int, error) {
+	h, err := ParseHeader(b)
+	if err != nil {
+		return Frame{}, 0, err
+	}
+	n := HeaderSize + int(h.Length)
+	if len(b) < n {
+		return Frame{}, 0, io.ErrUnexpectedEOF
+	}
+	return Frame{Version: h.Version, Cmd: h.Cmd, StreamID: h.StreamID, Data: b[HeaderSize:n]}, n, nil
+}
+
+// Read reads the next frame of r, it returns io.EOF at the end of r
+// and io.ErrUnexpectedEOF when r ends within a frame
+func Read(r io.Reader) (Frame, error) {
+	var b [HeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Frame{}, err
+	}
+	h, _ := ParseHeader(b[:])
+	f := Frame{Version: h.Version, Cmd: h.Cmd, StreamID: h.StreamID}
+	if h.Length > 0 {
+		f.Data = make([]byte, h.Length)
+		if _, err := io.ReadFull(r, f.Data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Frame{}, err
+		}
+	}
+	return f, nil
+}
+
+// the metadata of a stream travels in the payload of its SYN frame as
+// entries of a type byte, a length byte and the value. Types unknown
+// to the receiver are skipped.
+const (
+	MetaTrace      byte = 1 // trace context of the opener
+	MetaPeerAddr   byte = 2 // port and IP of the original client
+	MetaServerName byte = 3 // TLS server name asked by the original client
+	MetaProtocol   byte = 4 // application protocol of the stream
+	MetaAuthToken  byte = 5 // credential of the opener
+	MetaSealedAuth byte = 6 // credential of the opener, sealed with the session cipher
+)
+
+// AppendMeta appends a metadata entry to buf, value must not be longer
+// than 255 bytes
+func AppendMeta(buf []byte, typ byte, value []byte) []byte {
+	buf = append(buf, typ, byte(len(value)))
+	return append(buf, value...)
+}
+
+// FindMeta returns the value of the first entry of type typ in the
+// metadata, nil if there is none
+func FindMeta(data []byte, typ byte) []byte {
+	for len(data) >= 2 {
+		n := int(data[1])
+		if len(data) < 2+n {
+			return nil
+		}
+		if data[0] == typ {
+			return data[2 : 2+n]
+		}
+		data = data[2+n:]
+	}
+	return nil
+}
+
+// NOP frames may carry a ping, which the peer answers with a pong
+// echoing its sequence number: the kind, the sequence number and, for
+// pings, an application payload. Bare NOPs are the pings of stock
+// peers.
+const (
+	NOPPing byte = 1
+	NOPPong byte = 2
+
+	NOPPayloadSize = 5 // kind and sequence number
+)
+
+// ParseNOP decodes the payload of a NOP frame, ok is false for bare
+// NOPs
+func ParseNOP(data []byte) (kind byte, seq uint32, payload []byte, ok bool) {
+	if len(data) < NOPPayloadSize {
+		return 0, 0, nil, false
+	}
+	return data[0], binary.LittleEndian.Uint32(data[1:]), data[NOPPayloadSize:], true
+}
+
+// AppendNOP appends the payload of a ping or pong to buf
+func AppendNOP(buf []byte, kind byte, seq uint32, payload []byte) []byte {
+	var b [NOPPayloadSize]byte
+	b[0] = kind
+	binary.LittleEndian.PutUint32(b[1:], seq)
+	return append(append(buf, b[:]...), payload...)
+}
+
+// AppendReason appends the reason of a RST or BYE frame to buf, a code
+// and a message, truncated on a character boundary so that the reason
+// fits in maxSize. The code is always appended.
+func AppendReason(buf []byte, code uint32, msg string, maxSize int) []byte {
+	limit := maxSize - 4
+	if limit < 0 {
+		limit = 0
+	}
+	if len(msg) > limit {
+		for limit > 0 && !utf8.RuneStart(msg[limit]) {
+			limit--
+		}
+		msg = msg[:limit]
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], code)
+	return append(append(buf, b[:]...), msg...)
+}
+
+// ParseReason decodes the reason of a RST or BYE frame, ok is false
+// when the frame has none
+func ParseReason(data []byte) (code uint32, msg string, ok bool) {
+	if len(data) < 4 {
+		return 0, "", false
+	}
+	return binary.LittleEndian.Uint32(data), string(data[4:]), true
+}
+
+// UpdateSize is the size of the payload of an UPD frame
+const UpdateSize = 8
+
+// AppendUpdate appends the payload of an UPD frame to buf: the bytes
+// of the stream read so far, and the size of the window of the
+// receiver
+func AppendUpdate(buf []byte, consumed, window uint32) []byte {
+	var b [UpdateSize]byte
+	binary.LittleEndian.PutUint32(b[:], consumed)
+	binary.LittleEndian.PutUint32(b[4:], window)
+	return append(buf, b[:]...)
+}
+
+// ParseUpdate decodes the payload of an UPD frame
+func ParseUpdate(data []byte) (consumed, window uint32, ok bool) {
+	if len(data) != UpdateSize {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[4:]), true
+}
@@ -0,0 +1,82 @@
+package frame
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	var meta []byte
+	meta = AppendMeta(meta, MetaProtocol, []byte("ssh"))
+	meta = AppendMeta(meta, MetaAuthToken, []byte("secret"))
+	frames := []Frame{
+		{Version: Version1, Cmd: CmdSYN, StreamID: 3, Data: meta},
+		{Version: Version1, Cmd: CmdPSH, StreamID: 3, Data: []byte("hello")},
+		{Version: Version2, Cmd: CmdUPD, StreamID: 3, Data: AppendUpdate(nil, 5, 65536)},
+		{Version: Version1, Cmd: CmdNOP, Data: AppendNOP(nil, NOPPing, 7, []byte("app"))},
+		{Version: Version1, Cmd: CmdRST, StreamID: 3},
+		{Version: Version1, Cmd: CmdBYE, Data: AppendReason(nil, 6, "going down", MaxControlSize)},
+	}
+	var buf []byte
+	for _, f := range frames {
+		var err error
+		if buf, err = f.Append(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// decoded from a buffer and read from a stream alike
+	b := buf
+	r := bytes.NewReader(buf)
+	for _, want := range frames {
+		f, n, err := Decode(b)
+		if err != nil || f.Cmd != want.Cmd || f.StreamID != want.StreamID || !bytes.Equal(f.Data, want.Data) {
+			t.Fatalf("unexpected frame %v: %v", f.Header(), err)
+		}
+		b = b[n:]
+		if f, err = Read(r); err != nil || f.Header() != want.Header() || !bytes.Equal(f.Data, want.Data) {
+			t.Fatalf("unexpected frame read %v: %v", f.Header(), err)
+		}
+	}
+	if _, err := Read(r); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+	if _, _, err := Decode(buf[:HeaderSize+2]); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	if _, err := Read(bytes.NewReader(buf[:HeaderSize+2])); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	if _, err := (Frame{Data: make([]byte, MaxPayloadSize+1)}).Append(nil); err != ErrPayloadTooLarge {
+		t.Fatal("expected ErrPayloadTooLarge, got", err)
+	}
+
+	if string(FindMeta(meta, MetaAuthToken)) != "secret" || FindMeta(meta, MetaTrace) != nil {
+		t.Fatal("unexpected metadata")
+	}
+	if consumed, window, ok := ParseUpdate(frames[2].Data); !ok || consumed != 5 || window != 65536 {
+		t.Fatal("unexpected update", consumed, window)
+	}
+	if kind, seq, payload, ok := ParseNOP(frames[3].Data); !ok || kind != NOPPing || seq != 7 || string(payload) != "app" {
+		t.Fatal("unexpected ping", kind, seq, payload)
+	}
+	if _, _, ok := ParseReason(nil); ok {
+		t.Fatal("reason found in an empty payload")
+	}
+	if code, msg, ok := ParseReason(frames[5].Data); !ok || code != 6 || msg != "going down" {
+		t.Fatal("unexpected reason", code, msg)
+	}
+	for maxSize, want := range map[int]string{-1: "", 0: "", 4: "", 5: "h", 6: "h", 7: "hé", 9: "hé", 10: "hé€"} {
+		if code, msg, _ := ParseReason(AppendReason(nil, 6, "hé€", maxSize)); code != 6 || msg != want {
+			t.Fatal("unexpected truncated reason", maxSize, code, msg)
+		}
+	}
+
+	names := map[string]Header{"UPD": frames[2].Header(), "KXS": {Version: Version1, Cmd: CmdKXS}, "CMD(9)": {Cmd: 9}}
+	for name, h := range names {
+		if h.CmdName() != name {
+			t.Fatal("unexpected name", h.CmdName(), "for", name)
+		}
+	}
+}
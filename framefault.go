@@ -0,0 +1,153 @@
+package smux
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// FrameFault drops or delays frames of a session, set with
+// Config.FrameFaults, to test how the protocol recovers from lost or
+// late frames deterministically, unlike the faults of a connection:
+//
+//	// drop every third window update received
+//	smux.WithFrameFaults(smux.FrameFault{Dir: smux.Inbound, Cmd: "UPD", Every: 3, Drop: true})
+type FrameFault struct {
+	// Dir is whether frames sent or received are hit
+	Dir Direction
+
+	// Cmd is the name of the command of the frames hit, as
+	// FrameInfo.CmdName returns it, empty for every command
+	Cmd string
+
+	// Every hits every Every-th frame matching Dir and Cmd, each
+	// one when zero or one
+	Every int
+
+	// Limit is the number of frames hit at most, zero is no limit
+	Limit int
+
+	// Drop discards the frames hit, as though lost on the way. The
+	// frames dropped on sending are reported sent, the window of
+	// dropped PSH frames is given back on both ends. A write waiting
+	// for a dropped UPD probes the window again, so streams survive
+	// unless every UPD is dropped. The window updates of yamux are
+	// deltas no probe recovers, they may not be dropped.
+	Drop bool
+
+	// Delay holds back the frames hit, and those following them
+	// in the same direction, as a stalled link would
+	Delay time.Duration
+}
+
+func (ff FrameFault) validate() error {
+	if ff.Every < 0 {
+		return errors.New("frame fault period must not be negative")
+	}
+	if ff.Limit < 0 {
+		return errors.New("frame fault limit must not be negative")
+	}
+	if ff.Delay < 0 {
+		return errors.New("frame fault delay must not be negative")
+	}
+	return nil
+}
+
+// frameFaults injects the FrameFaults of a session, counting the
+// frames each one matched
+type frameFaults struct {
+	mu      sync.Mutex
+	faults  []FrameFault
+	matched []int
+	hits    []int
+}
+
+func newFrameFaults(faults []FrameFault) *frameFaults {
+	if len(faults) == 0 {
+		return nil
+	}
+	return &frameFaults{
+		faults:  faults,
+		matched: make([]int, len(faults)),
+		hits:    make([]int, len(faults)),
+	}
+}
+
+// check returns whether the frame must be dropped and how long it is
+// held back before
+func (ff *frameFaults) check(dir Direction, f Frame) (drop bool, delay time.Duration) {
+	name := FrameInfo{Version: f.ver, Cmd: f.cmd}.CmdName()
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	for k, fault := range ff.faults {
+		if fault.Dir != dir || (fault.Cmd != "" && fault.Cmd != name) {
+			continue
+		}
+		ff.matched[k]++
+		if fault.Every > 1 && ff.matched[k]%fault.Every != 0 {
+			continue
+		}
+		if fault.Limit > 0 && ff.hits[k] >= fault.Limit {
+			continue
+		}
+		ff.hits[k]++
+		drop = drop || fault.Drop
+		delay += fault.Delay
+	}
+	return drop, delay
+}
+
+// injectFault applies the FrameFaults to a frame, it waits for their
+// delay and returns true when the frame must be dropped
+func (s *Session) injectFault(dir Direction, f Frame) bool {
+	if s.faults == nil {
+		return false
+	}
+	drop, delay := s.faults.check(dir, f)
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.die:
+			timer.Stop()
+		}
+	}
+	if drop {
+		s.log(LevelDebug, "frame dropped by fault", "dir", dir, "cmd", cmdName(f.cmd), "sid", f.sid)
+	}
+	return drop
+}
+
+// injectSendFaults applies the FrameFaults to a batch of frames to
+// send, the dropped ones are reported sent and left out of the
+// batch returned, their data taking no send window
+func (s *Session) injectSendFaults(batch []*writeRequest, ver byte) []*writeRequest {
+	kept := batch[:0]
+	for _, req := range batch {
+		req.frame.ver = ver
+		if !s.injectFault(Outbound, req.frame) {
+			kept = append(kept, req)
+			continue
+		}
+		s.finish(req, writeResult{n: len(req.plain), dropped: true})
+	}
+	for k := len(kept); k < len(batch); k++ {
+		batch[k] = nil
+	}
+	return kept
+}
+
+// creditDropped counts the data of a PSH frame dropped on receipt as
+// read, so that the window the peer spent on it comes back
+func (s *Session) creditDropped(f Frame) {
+	stream, ok := s.streams.get(f.sid)
+	if !ok {
+		return
+	}
+	stream.bufferLock.Lock()
+	upd, update := stream.accountRead(len(f.data))
+	stream.bufferLock.Unlock()
+	if update {
+		stream.sendWindowUpdate(upd)
+	}
+}
@@ -0,0 +1,8 @@
+// Package fuzz holds the fuzz targets of smux, feeding arbitrary bytes
+// to the receiving side of sessions:
+//
+//	go test -fuzz FuzzRecv ./fuzz
+//	go test -fuzz FuzzKeyExchange ./fuzz
+//
+// The seed corpus runs with the other tests.
+package fuzz
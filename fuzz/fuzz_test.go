@@ -0,0 +1,125 @@
+package fuzz
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/superfly/smux"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// replayConn receives the fuzzed bytes and discards what is sent
+type replayConn struct {
+	r *bytes.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *replayConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *replayConn) Close() error                { return nil }
+
+// frame encodes a frame of version 1
+func frame(cmd byte, sid uint32, data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data))
+	buf[0] = 1
+	buf[1] = cmd
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:], sid)
+	return append(buf, data...)
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// command values of the protocol
+const (
+	cmdSYN byte = iota
+	cmdRST
+	cmdPSH
+	cmdNOP
+	cmdKXS
+	cmdKXR
+	cmdBYE
+	cmdGOA
+)
+
+var serverPublicKey, serverPrivateKey, _ = box.GenerateKey(rand.Reader)
+
+// modes are the sessions the fuzzed bytes are fed to
+var modes = [][]smux.Option{
+	nil,
+	{smux.WithProtocolVersion(2)},
+	{smux.WithYamux()},
+	{smux.WithUpstreamCompat()},
+	{smux.WithPipelinedReceive()},
+	{smux.WithMaxFrameSize(512), smux.WithMaxReceiveBuffer(4096)},
+}
+
+// run feeds data to a session until it closed, and reads what its
+// streams received
+func run(t *testing.T, data []byte, client bool, opts ...smux.Option) {
+	opts = append([]smux.Option{smux.WithoutKeepAlive(), smux.WithKeyHandshakeTimeout(100 * time.Millisecond)}, opts...)
+	conn := &replayConn{r: bytes.NewReader(data)}
+	var session *smux.Session
+	var err error
+	if client {
+		session, err = smux.Client(conn, opts...)
+	} else {
+		session, err = smux.Server(conn, opts...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	session.SetDeadline(time.Now().Add(time.Second))
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		io.Copy(ioutil.Discard, stream)
+		stream.Close()
+	}
+	for deadline := time.Now().Add(time.Second); !session.IsClosed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("session still open at the end of its input")
+		}
+	}
+}
+
+func FuzzRecv(f *testing.F) {
+	f.Add(byte(0), concat(frame(cmdSYN, 3, nil), frame(cmdPSH, 3, []byte("hello")), frame(cmdRST, 3, nil)))
+	f.Add(byte(1), concat(frame(cmdSYN, 5, []byte{4, 3, 'h', '2', 'c'}), frame(cmdPSH, 5, make([]byte, 600))))
+	f.Add(byte(2), concat(frame(cmdNOP, 0, []byte{1, 0, 0, 0, 1}), frame(cmdGOA, 0, nil), frame(cmdBYE, 0, []byte{1, 0, 0, 0, 'x'})))
+	f.Add(byte(3), concat(frame(cmdSYN, 3, nil), frame(cmdSYN, 3, nil), frame(cmdPSH, 7, []byte("early"))))
+	f.Add(byte(4), []byte{1, cmdPSH, 0xff, 0xff, 3, 0, 0, 0})
+	f.Add(byte(5), concat(frame(cmdSYN, 2, nil), frame(cmdKXS, 0, make([]byte, 89))))
+	f.Add(byte(6), []byte{0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, mode byte, data []byte) {
+		opts := modes[int(mode>>1)%len(modes)]
+		run(t, data, mode&1 == 1, opts...)
+	})
+}
+
+func FuzzKeyExchange(f *testing.F) {
+	f.Add(false, cmdKXR, make([]byte, 88))
+	f.Add(false, cmdKXR, make([]byte, 89))
+	f.Add(false, cmdKXS, make([]byte, 89))
+	f.Add(true, cmdKXS, make([]byte, 89))
+	f.Add(true, cmdKXS, []byte{})
+	f.Add(true, cmdKXR, make([]byte, 200))
+	f.Fuzz(func(t *testing.T, client bool, cmd byte, payload []byte) {
+		if len(payload) > 65535 {
+			return
+		}
+		data := concat(frame(cmd, 0, payload), frame(cmdSYN, 3, nil), frame(cmdPSH, 3, make([]byte, 40)))
+		run(t, data, client, smux.WithEncryption(serverPublicKey, serverPrivateKey))
+	})
+}
@@ -0,0 +1,57 @@
+package smux
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+)
+
+// A client with Config.ClientIdentity proves it in the sealed part of
+// its KXR: after the suites offered come identityTag, the public key
+// of the identity and its signature of the key of the exchange. The
+// key of the exchange is made for each session while the identity
+// lasts, so servers revoke and account clients by their identity.
+// Servers unaware of identities take the proof for suites they do
+// not know.
+const (
+	identityTag       byte = 0xfe
+	identityProofSize      = ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+// identityContext is signed ahead of the key of the exchange, so
+// that the signature proves nothing else
+var identityContext = []byte("smux client identity\x00")
+
+// errBadIdentity is the key exchange failure of a client identity
+// whose signature does not check
+var errBadIdentity = errors.New("bad client identity")
+
+// appendIdentity appends to the suites offered the proof of identity
+// for the key of the exchange kxKey
+func appendIdentity(suites []byte, identity ed25519.PrivateKey, kxKey []byte) []byte {
+	msg := append(identityContext[:len(identityContext):len(identityContext)], kxKey...)
+	suites = append(suites[:len(suites):len(suites)], identityTag)
+	suites = append(suites, identity.Public().(ed25519.PublicKey)...)
+	return append(suites, ed25519.Sign(identity, msg)...)
+}
+
+// parseIdentity splits the proof of identity off the suites offered
+// by a client and checks it signs kxKey. The identity is zero when
+// the client presented none.
+func parseIdentity(offered, kxKey []byte) (suites []byte, identity [32]byte, err error) {
+	k := bytes.IndexByte(offered, identityTag)
+	if k < 0 {
+		return offered, identity, nil
+	}
+	proof := offered[k+1:]
+	if len(proof) != identityProofSize {
+		return nil, identity, errBadIdentity
+	}
+	pub := ed25519.PublicKey(proof[:ed25519.PublicKeySize])
+	msg := append(identityContext[:len(identityContext):len(identityContext)], kxKey...)
+	if !ed25519.Verify(pub, msg, proof[ed25519.PublicKeySize:]) {
+		return nil, identity, errBadIdentity
+	}
+	copy(identity[:], pub)
+	return offered[:k], identity, nil
+}
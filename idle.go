@@ -0,0 +1,57 @@
+package smux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleReaper resets the streams left idle for StreamIdleTimeout,
+// sampled from sendLoop
+type idleReaper struct {
+	ticker *time.Ticker
+}
+
+// channel returns the ticker channel of the checks, nil when idle
+// streams are kept
+func (r *idleReaper) channel(timeout time.Duration) <-chan time.Time {
+	if timeout <= 0 {
+		return nil
+	}
+	if r.ticker == nil {
+		r.ticker = time.NewTicker(timeout / 4)
+	}
+	return r.ticker.C
+}
+
+func (r *idleReaper) stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+}
+
+// touch records activity on the stream
+func (s *Stream) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// reapIdle resets the streams neither read from nor written to for
+// StreamIdleTimeout
+func (s *Session) reapIdle() {
+	deadline := time.Now().Add(-s.config.StreamIdleTimeout).UnixNano()
+	var idle []*Stream
+	s.streams.each(func(stream *Stream) {
+		if atomic.LoadInt64(&stream.lastActive) < deadline {
+			idle = append(idle, stream)
+		}
+	})
+	if len(idle) == 0 {
+		return
+	}
+	// the resets are sent by sendLoop, which runs the reaper
+	go func() {
+		for _, stream := range idle {
+			s.log(LevelDebug, "stream idle", "sid", stream.id, "timeout", s.config.StreamIdleTimeout)
+			stream.reset(ResetIdleTimeout, "idle timeout")
+		}
+	}()
+}
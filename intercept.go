@@ -0,0 +1,70 @@
+package smux
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Interceptor wraps the reads and writes of the streams of a session,
+// to compress, meter or scan their data without wrapping each stream
+// where it is used. next reads and writes the stream, through the
+// interceptors registered after this one, the ReadWriter returned
+// takes its place for Stream.Read and Stream.Write. Those that are
+// io.Closers too are closed as the stream closes, before the stream,
+// to flush the data they hold.
+//
+// The interceptors of a stream are set up once it is opened or
+// accepted, with its protocol and peer info known. They must not
+// block, the streams of the peer are set up by the receive loop.
+type Interceptor func(stream *Stream, next io.ReadWriter) io.ReadWriter
+
+// Intercept registers an interceptor for the streams opened and
+// accepted from now on. The interceptors of Config.Interceptors come
+// first, they see the data of the application first.
+func (s *Session) Intercept(i Interceptor) {
+	if i == nil {
+		return
+	}
+	s.interceptLock.Lock()
+	s.interceptors = append(s.interceptors[:len(s.interceptors):len(s.interceptors)], i)
+	s.interceptLock.Unlock()
+}
+
+// intercept sets up the interceptors of a stream, the first one
+// registered outermost
+func (s *Session) intercept(stream *Stream) {
+	s.interceptLock.Lock()
+	interceptors := s.interceptors
+	s.interceptLock.Unlock()
+	if len(interceptors) == 0 {
+		return
+	}
+	var rw io.ReadWriter = streamIO{stream}
+	var closers []io.Closer
+	for k := len(interceptors) - 1; k >= 0; k-- {
+		rw = interceptors[k](stream, rw)
+		if c, ok := rw.(io.Closer); ok {
+			closers = append([]io.Closer{c}, closers...)
+		}
+	}
+	stream.rw, stream.rwClosers = rw, closers
+}
+
+// streamIO reads and writes a stream under its interceptors
+type streamIO struct {
+	s *Stream
+}
+
+func (sio streamIO) Read(b []byte) (int, error)  { return sio.s.read(b) }
+func (sio streamIO) Write(b []byte) (int, error) { return sio.s.send(b) }
+
+// closeInterceptors closes the interceptors of the stream once, the
+// outermost first. An interceptor may close the stream meanwhile.
+func (s *Stream) closeInterceptors() {
+	if len(s.rwClosers) == 0 || !atomic.CompareAndSwapInt32(&s.rwClosed, 0, 1) {
+		return
+	}
+	for _, c := range s.rwClosers {
+		c.Close()
+	}
+}
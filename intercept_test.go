@@ -0,0 +1,110 @@
+package smux
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+// xorRW scrambles the data read and written
+type xorRW struct {
+	next io.ReadWriter
+}
+
+func (x xorRW) Read(b []byte) (int, error) {
+	n, err := x.next.Read(b)
+	for i := range b[:n] {
+		b[i] ^= 0x55
+	}
+	return n, err
+}
+
+func (x xorRW) Write(b []byte) (int, error) {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ 0x55
+	}
+	return x.next.Write(out)
+}
+
+// meter counts the bytes written and the closes
+type meter struct {
+	next    io.ReadWriter
+	written *int64
+	closed  *int64
+}
+
+func (m meter) Read(b []byte) (int, error) { return m.next.Read(b) }
+
+func (m meter) Write(b []byte) (int, error) {
+	n, err := m.next.Write(b)
+	atomic.AddInt64(m.written, int64(n))
+	return n, err
+}
+
+func (m meter) Close() error {
+	atomic.AddInt64(m.closed, 1)
+	return nil
+}
+
+func TestInterceptors(t *testing.T) {
+	var written, closed int64
+	metering := func(stream *Stream, next io.ReadWriter) io.ReadWriter {
+		return meter{next: next, written: &written, closed: &closed}
+	}
+	client, server, err := Pipe(0, WithInterceptors(metering))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	client.Intercept(func(stream *Stream, next io.ReadWriter) io.ReadWriter {
+		return xorRW{next}
+	})
+
+	msg := []byte("hello")
+	stream, _ := client.OpenStream()
+	if _, err := stream.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := range buf {
+		buf[i] ^= 0x55
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("data not scrambled by the client interceptor")
+	}
+
+	// io.Copy goes through them too
+	done := make(chan struct{})
+	go func() {
+		io.Copy(accepted, accepted)
+		accepted.Close()
+		close(done)
+	}()
+	big := bytes.Repeat(msg, 10000)
+	go stream.ReadFrom(bytes.NewReader(big))
+	var echoed bytes.Buffer
+	if _, err := io.Copy(&echoed, io.LimitReader(stream, int64(len(big)))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed.Bytes(), big) {
+		t.Fatal("unexpected echo")
+	}
+	stream.Close()
+	<-done
+	if n := atomic.LoadInt64(&written); n != int64(2*len(big)+len(msg)) {
+		t.Fatal("unexpected bytes metered", n)
+	}
+	if n := atomic.LoadInt64(&closed); n != 2 {
+		t.Fatal("interceptors not closed once per stream", n)
+	}
+}
@@ -0,0 +1,29 @@
+package smux
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// keyLogLabel starts the lines written to Config.KeyLogWriter
+const keyLogLabel = "SMUX_SESSION_KEY"
+
+// keyLogLock serializes the lines of sessions sharing a writer
+var keyLogLock sync.Mutex
+
+// logKey writes the key of the session to the KeyLogWriter, named by
+// kxKey, the public key opening the key exchange, which starts the
+// payloads of KXR and KXS alike
+func (s *Session) logKey(kxKey []byte, suite byte, key *[32]byte) {
+	w := s.config.KeyLogWriter
+	if w == nil || key == nil {
+		return
+	}
+	line := fmt.Sprintf("%s %x %s %x\n", keyLogLabel, kxKey, suiteName(suite), key[:])
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+	if _, err := io.WriteString(w, line); err != nil {
+		s.log(LevelWarn, "key log write failed", "err", err)
+	}
+}
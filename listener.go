@@ -0,0 +1,98 @@
+package smux
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const errListenerClosed = "listener closed"
+
+// DialContext opens a stream, it has the signature expected by
+// grpc.WithContextDialer so that a gRPC client runs over the session:
+//
+//	grpc.Dial("smux", grpc.WithContextDialer(session.DialContext), ...)
+//
+// addr is ignored, every stream goes to the peer of the session. ctx
+// bounds the opening of the stream only.
+func (s *Session) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	stream, err := s.OpenStreamContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Listener hands out the streams opened by the peer as connections,
+// for servers written against net.Listener such as grpc.Server:
+//
+//	grpcServer.Serve(session.Listen())
+//
+// Streams are full net.Conns: deadlines apply to the calls already
+// blocked, and Close delivers the data written before it, the peer
+// reads io.EOF after it. Streams have no half-close, which gRPC does
+// not use, a stream is closed in both directions at once.
+type Listener struct {
+	session *Session
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// Listen returns a Listener accepting the streams of the session.
+// Only one should be in use at a time, they share the accept queue.
+func (s *Session) Listen() *Listener {
+	return &Listener{session: s, die: make(chan struct{})}
+}
+
+// Accept waits for the next stream opened by the peer and let
+// through Config.AcceptFilters
+func (l *Listener) Accept() (net.Conn, error) {
+	s := l.session
+	if err := s.requireEncryption(context.Background()); err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case stream := <-s.chAccepts:
+			if s.acceptStopped() {
+				stream.reset(ResetRefused, ErrNotAccepting.Error())
+				continue
+			}
+			if s.filterAccept(stream) {
+				return stream, nil
+			}
+		case <-s.chStopAccept:
+			s.refuseBacklog()
+			return nil, ErrNotAccepting
+		case <-l.die:
+			return nil, errors.New(errListenerClosed)
+		case <-s.die:
+			return nil, s.dieError()
+		}
+	}
+}
+
+// Close stops accepting streams, the session and its streams are
+// left open
+func (l *Listener) Close() error {
+	l.dieOnce.Do(func() { close(l.die) })
+	return nil
+}
+
+// Addr returns the local address of the session
+func (l *Listener) Addr() net.Addr {
+	if addr := l.session.LocalAddr(); addr != nil {
+		return addr
+	}
+	return sessionAddr{}
+}
+
+// sessionAddr stands for the address of a session over a connection
+// that has none
+type sessionAddr struct{}
+
+func (sessionAddr) Network() string { return "smux" }
+func (sessionAddr) String() string  { return "smux" }
@@ -0,0 +1,75 @@
+package smux
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel int
+
+// log levels, from the most verbose
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Logger receives the events of a session worth a trace: failed
+// handshakes, protocol violations and the reason of forced closes.
+// keyvals alternates keys, which are strings, and their values.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts an ordinary function to Logger
+type LoggerFunc func(level LogLevel, msg string, keyvals ...interface{})
+
+// Log calls f
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+// NewStdLogger returns a Logger printing the entries at or above
+// min to l, as the message followed by key=value pairs
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	return LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		if level < min {
+			return
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "smux %s: %s", level, msg)
+		for k := 0; k < len(keyvals); k += 2 {
+			buf.WriteByte(' ')
+			if k+1 < len(keyvals) {
+				fmt.Fprintf(&buf, "%v=%v", keyvals[k], keyvals[k+1])
+			} else {
+				fmt.Fprintf(&buf, "%v=?", keyvals[k])
+			}
+		}
+		l.Print(buf.String())
+	})
+}
+
+// log passes an entry to the configured logger, if any
+func (s *Session) log(level LogLevel, msg string, keyvals ...interface{}) {
+	if s.config.Logger != nil {
+		s.config.Logger.Log(level, msg, keyvals...)
+	}
+}
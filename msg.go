@@ -0,0 +1,79 @@
+package smux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrMessageTooLarge is returned by WriteMsg and ReadMsg for messages
+// larger than Config.MaxMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+// msgHeaderSize is the size of the length prefixing each message
+const msgHeaderSize = 4
+
+// WriteMsg sends msg as one message, read whole by the ReadMsg of the
+// peer. Messages are the data prefixed by their length in 4 bytes,
+// little endian, a stream carrying them should not be written with
+// Write too. Concurrent calls send their messages one after the
+// other. A message may be cut by an error, such as a timeout, the
+// stream should then be closed.
+func (s *Stream) WriteMsg(msg []byte) error {
+	if len(msg) > s.sess.config.MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	buf := make([]byte, msgHeaderSize+len(msg))
+	binary.LittleEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[msgHeaderSize:], msg)
+
+	s.msgWriteLock.Lock()
+	defer s.msgWriteLock.Unlock()
+	_, err := s.Write(buf)
+	return err
+}
+
+// ReadMsg returns the next message sent by WriteMsg. A read timeout
+// leaves the message half read, the next call goes on with it. A
+// message larger than Config.MaxMessageSize resets the stream with
+// ResetProtocolError. io.EOF is only returned between messages, and
+// io.ErrUnexpectedEOF in the middle of one.
+func (s *Stream) ReadMsg() ([]byte, error) {
+	s.msgReadLock.Lock()
+	defer s.msgReadLock.Unlock()
+
+	if s.msgBuf == nil {
+		if err := s.readMsgPart(s.msgHdr[:], &s.msgHdrN); err != nil {
+			return nil, err
+		}
+		size := binary.LittleEndian.Uint32(s.msgHdr[:])
+		if int64(size) > int64(s.sess.config.MaxMessageSize) {
+			s.reset(ResetProtocolError, "message too large")
+			return nil, ErrMessageTooLarge
+		}
+		s.msgBuf, s.msgN = make([]byte, size), 0
+	}
+	if err := s.readMsgPart(s.msgBuf, &s.msgN); err != nil {
+		return nil, err
+	}
+	msg := s.msgBuf
+	s.msgBuf, s.msgHdrN = nil, 0
+	return msg, nil
+}
+
+// readMsgPart fills buf from *off on, keeping in *off how far it got
+// when the read fails
+func (s *Stream) readMsgPart(buf []byte, off *int) error {
+	for *off < len(buf) {
+		n, err := s.Read(buf[*off:])
+		*off += n
+		if err == nil || *off == len(buf) {
+			continue
+		}
+		if err == io.EOF && (s.msgBuf != nil || *off > 0) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
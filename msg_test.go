@@ -0,0 +1,78 @@
+package smux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	client, server, err := Pipe(0, WithMaxMessageSize(65536))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.OpenStream()
+	if err := stream.WriteMsg(nil); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent messages larger than frames keep their boundaries
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream.WriteMsg(bytes.Repeat([]byte{byte(i)}, 10000+i))
+		}(i)
+	}
+	msg, err := accepted.ReadMsg()
+	if err != nil || msg == nil || len(msg) != 0 {
+		t.Fatal("unexpected empty message", msg, err)
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < 8; i++ {
+		msg, err := accepted.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := msg[0]
+		if len(msg) != 10000+int(k) || !bytes.Equal(msg, bytes.Repeat([]byte{k}, len(msg))) || seen[k] {
+			t.Fatal("message mixed up", k, len(msg))
+		}
+		seen[k] = true
+	}
+	wg.Wait()
+
+	// a read timeout resumes with the message half read
+	hello := []byte("\x05\x00\x00\x00hel")
+	stream.Write(hello)
+	accepted.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := accepted.ReadMsg(); err == nil {
+		t.Fatal("read a message half sent")
+	}
+	accepted.SetReadDeadline(time.Time{})
+	stream.Write([]byte("lo"))
+	if msg, err := accepted.ReadMsg(); err != nil || string(msg) != "hello" {
+		t.Fatal("unexpected message", string(msg), err)
+	}
+
+	if err := stream.WriteMsg(make([]byte, 65537)); err != ErrMessageTooLarge {
+		t.Fatal("expected ErrMessageTooLarge, got", err)
+	}
+	stream.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := accepted.ReadMsg(); err != ErrMessageTooLarge {
+		t.Fatal("expected ErrMessageTooLarge, got", err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatal("stream sending a large message not reset", err)
+	}
+}
@@ -0,0 +1,334 @@
+package smux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// records of a bond on each of its paths: TYPE(1B) | LENGTH(2B) |
+// SEQ(8B) | DATA(LENGTH), little-endian like frames
+const (
+	bondData byte = iota // a chunk of the byte stream
+	bondAck              // every chunk before SEQ was read
+
+	bondHeaderSize = 11
+	bondChunkSize  = 16384   // largest chunk of data in a record
+	bondWindow     = 1048576 // bytes sent and not yet acknowledged
+	bondAckEvery   = 16      // chunks read between acknowledgements
+)
+
+const errNoPath = "no path left"
+
+// Bond bonds several connections, or paths, into a single reliable
+// byte stream a session runs over:
+//
+//	session, err := smux.Client(smux.NewBond(conn1, conn2), opts...)
+//
+// Writes are cut into sequenced chunks sent over the path with the
+// least data queued, so that faster paths carry more, and the peer
+// puts them back in order. Chunks are kept until the peer read them:
+// when a path fails those it carried are sent again over the others,
+// and the bond only fails with its last path.
+//
+// Both ends must bond the same connections, pairing them is left to
+// the application, for example with one listener per path.
+type Bond struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // signals acknowledgements, received chunks and closes
+	paths []*bondPath
+	err   error // set once closed or out of paths
+
+	// sending
+	sendSeq      uint64
+	unacked      []bondChunk // in sequence order
+	unackedBytes int
+
+	// receiving
+	recvNext uint64            // sequence of the next chunk to read
+	readOff  int               // bytes read of that chunk
+	chunks   map[uint64][]byte // chunks received ahead of reading
+	ackSent  uint64            // recvNext last acknowledged
+}
+
+// bondChunk is a chunk waiting for its acknowledgement
+type bondChunk struct {
+	seq  uint64
+	data []byte
+	path *bondPath // path the chunk was last sent over
+}
+
+// bondPath is a connection of a bond with the records queued for it
+type bondPath struct {
+	conn    io.ReadWriteCloser
+	pending [][]byte // records to write, guarded by the bond mu
+	queued  int      // bytes of pending
+	notify  chan struct{}
+	dead    bool
+}
+
+// NewBond bonds conns, more can be added with AddPath
+func NewBond(conns ...io.ReadWriteCloser) *Bond {
+	b := &Bond{chunks: make(map[uint64][]byte)}
+	b.cond = sync.NewCond(&b.mu)
+	for _, conn := range conns {
+		b.AddPath(conn)
+	}
+	return b
+}
+
+// AddPath adds a connection to the bond, the peer must add its end
+func (b *Bond) AddPath(conn io.ReadWriteCloser) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		conn.Close()
+		return b.err
+	}
+	p := &bondPath{conn: conn, notify: make(chan struct{}, 1)}
+	b.paths = append(b.paths, p)
+	go b.sendLoop(p)
+	go b.recvLoop(p)
+	return nil
+}
+
+// Paths returns the number of paths still working
+func (b *Bond) Paths() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.paths)
+}
+
+// Write queues b for sending, blocking while the peer has too much
+// data left to read
+func (b *Bond) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(p) > 0 {
+		for b.err == nil && b.unackedBytes >= bondWindow {
+			b.cond.Wait()
+		}
+		if b.err != nil {
+			return n, b.err
+		}
+
+		size := len(p)
+		if size > bondChunkSize {
+			size = bondChunkSize
+		}
+		chunk := bondChunk{seq: b.sendSeq, data: make([]byte, size)}
+		copy(chunk.data, p)
+		b.sendSeq++
+		b.sendChunk(&chunk)
+		b.unacked = append(b.unacked, chunk)
+		b.unackedBytes += size
+		p = p[size:]
+		n += size
+	}
+	return n, nil
+}
+
+// Read reads the byte stream in order
+func (b *Bond) Read(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if data, ok := b.chunks[b.recvNext]; ok {
+			n = copy(p, data[b.readOff:])
+			b.readOff += n
+			if b.readOff == len(data) {
+				delete(b.chunks, b.recvNext)
+				b.recvNext++
+				b.readOff = 0
+				_, more := b.chunks[b.recvNext]
+				if !more || b.recvNext-b.ackSent >= bondAckEvery {
+					b.sendAck()
+				}
+			}
+			return n, nil
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.cond.Wait()
+	}
+}
+
+// Close closes the bond and all its paths
+func (b *Bond) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == io.ErrClosedPipe {
+		return errors.New(errBrokenPipe)
+	}
+	b.err = io.ErrClosedPipe
+	for _, p := range b.paths {
+		p.dead = true
+		p.conn.Close()
+		close(p.notify)
+	}
+	b.paths = nil
+	b.cond.Broadcast()
+	return nil
+}
+
+// pickPath returns the working path with the least data queued,
+// b.mu must be held
+func (b *Bond) pickPath() *bondPath {
+	var best *bondPath
+	for _, p := range b.paths {
+		if best == nil || p.queued < best.queued {
+			best = p
+		}
+	}
+	return best
+}
+
+// enqueue queues a record for the sendLoop of p, b.mu must be held
+func (p *bondPath) enqueue(rec []byte) {
+	p.pending = append(p.pending, rec)
+	p.queued += len(rec)
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// sendChunk queues chunk on a path, b.mu must be held
+func (b *Bond) sendChunk(chunk *bondChunk) {
+	p := b.pickPath()
+	if p == nil {
+		return
+	}
+	chunk.path = p
+	rec := make([]byte, bondHeaderSize+len(chunk.data))
+	putBondHeader(rec, bondData, len(chunk.data), chunk.seq)
+	copy(rec[bondHeaderSize:], chunk.data)
+	p.enqueue(rec)
+}
+
+// sendAck acknowledges the chunks read, b.mu must be held
+func (b *Bond) sendAck() {
+	p := b.pickPath()
+	if p == nil {
+		return
+	}
+	b.ackSent = b.recvNext
+	rec := make([]byte, bondHeaderSize)
+	putBondHeader(rec, bondAck, 0, b.recvNext)
+	p.enqueue(rec)
+}
+
+func putBondHeader(rec []byte, typ byte, length int, seq uint64) {
+	rec[0] = typ
+	binary.LittleEndian.PutUint16(rec[1:], uint16(length))
+	binary.LittleEndian.PutUint64(rec[3:], seq)
+}
+
+// sendLoop writes the records queued for p
+func (b *Bond) sendLoop(p *bondPath) {
+	var buf []byte
+	for range p.notify {
+		b.mu.Lock()
+		if p.dead {
+			b.mu.Unlock()
+			return
+		}
+		buf = buf[:0]
+		for _, rec := range p.pending {
+			buf = append(buf, rec...)
+		}
+		p.pending = p.pending[:0]
+		b.mu.Unlock()
+
+		_, err := p.conn.Write(buf)
+
+		b.mu.Lock()
+		p.queued -= len(buf)
+		b.mu.Unlock()
+		if err != nil {
+			b.pathFailed(p, err)
+			return
+		}
+	}
+}
+
+// recvLoop reads the records arriving on p
+func (b *Bond) recvLoop(p *bondPath) {
+	var hdr [bondHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(p.conn, hdr[:]); err != nil {
+			b.pathFailed(p, err)
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(hdr[1:]))
+		seq := binary.LittleEndian.Uint64(hdr[3:])
+
+		switch hdr[0] {
+		case bondData:
+			data := make([]byte, length)
+			if _, err := io.ReadFull(p.conn, data); err != nil {
+				b.pathFailed(p, err)
+				return
+			}
+			b.mu.Lock()
+			// chunks sent again after a failover may be duplicates
+			if _, dup := b.chunks[seq]; !dup && seq >= b.recvNext && length > 0 {
+				b.chunks[seq] = data
+				b.cond.Broadcast()
+			}
+			b.mu.Unlock()
+		case bondAck:
+			b.mu.Lock()
+			k := 0
+			for k < len(b.unacked) && b.unacked[k].seq < seq {
+				b.unackedBytes -= len(b.unacked[k].data)
+				k++
+			}
+			if k > 0 {
+				b.unacked = b.unacked[k:]
+				b.cond.Broadcast()
+			}
+			b.mu.Unlock()
+		default:
+			b.pathFailed(p, errors.New(errBadFrame))
+			return
+		}
+	}
+}
+
+// pathFailed drops p from the bond, the chunks it carried are sent
+// again over the remaining paths
+func (b *Bond) pathFailed(p *bondPath, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p.dead {
+		return
+	}
+	p.dead = true
+	p.conn.Close()
+	close(p.notify)
+	for k := range b.paths {
+		if b.paths[k] == p {
+			b.paths = append(b.paths[:k], b.paths[k+1:]...)
+			break
+		}
+	}
+	if len(b.paths) == 0 {
+		if b.err == nil {
+			b.err = errors.Wrap(err, errNoPath)
+		}
+		b.cond.Broadcast()
+		return
+	}
+
+	for k := range b.unacked {
+		if b.unacked[k].path == p {
+			b.sendChunk(&b.unacked[k])
+		}
+	}
+	// the acknowledgement may have been lost with the path
+	b.sendAck()
+}
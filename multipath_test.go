@@ -0,0 +1,117 @@
+package smux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+func getBondPair(paths int) (*Bond, *Bond, []*countingConn, error) {
+	var local, remote []io.ReadWriteCloser
+	var counted []*countingConn
+	for k := 0; k < paths; k++ {
+		c1, c2, err := getTCPConnectionPair()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c := &countingConn{Conn: c1}
+		counted = append(counted, c)
+		local = append(local, c)
+		remote = append(remote, c2)
+	}
+	return NewBond(local...), NewBond(remote...), counted, nil
+}
+
+func TestBond(t *testing.T) {
+	b1, b2, paths, err := getBondPair(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(b1, nil)
+	defer client.Close()
+	server, _ := Server(b2, nil)
+	defer server.Close()
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 4<<20)
+	rand.Read(msg)
+	go stream.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("corrupted echo")
+	}
+	for k, p := range paths {
+		if atomic.LoadInt32(&p.writes) == 0 {
+			t.Fatal("path unused", k)
+		}
+	}
+}
+
+func TestBondFailover(t *testing.T) {
+	b1, b2, paths, err := getBondPair(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(b1, nil)
+	defer client.Close()
+	server, _ := Server(b2, nil)
+	defer server.Close()
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 4<<20)
+	rand.Read(msg)
+	go stream.Write(msg)
+
+	// paths fail in the middle of the transfer
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, buf[:1<<20]); err != nil {
+		t.Fatal(err)
+	}
+	paths[0].Close()
+	if _, err := io.ReadFull(stream, buf[1<<20:2<<20]); err != nil {
+		t.Fatal(err)
+	}
+	paths[2].Close()
+	if _, err := io.ReadFull(stream, buf[2<<20:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("corrupted echo")
+	}
+	if n := b1.Paths(); n != 1 {
+		t.Fatal("unexpected paths left", n)
+	}
+
+	// the bond fails with its last path
+	paths[1].Close()
+	if _, err := stream.Read(buf); err == nil {
+		t.Fatal("read from a bond without paths")
+	}
+}
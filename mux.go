@@ -1,8 +1,10 @@
 package smux
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
+	"math"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,12 +19,47 @@ type Config struct {
 	// will be closed if no data has arrived
 	KeepAliveTimeout time.Duration
 
+	// KeepAliveMaxMissed closes the session once that many pings in a
+	// row went unanswered, each given KeepAliveInterval for its pong,
+	// any frame received counting as an answer. Zero derives it from
+	// KeepAliveTimeout.
+	KeepAliveMaxMissed int
+
+	// KeepAliveDisabled turns keep-alive off, for transports
+	// with their own liveness checks
+	KeepAliveDisabled bool
+
+	// KeepAlivePayload returns the data attached to each ping sent,
+	// such as load or health hints, of 251 bytes at most.
+	// OnKeepAlivePayload receives the data attached to the pings of
+	// the peer; it runs on the receive loop so must not block.
+	// Peers unaware of payloads ignore them.
+	KeepAlivePayload   func() []byte
+	OnKeepAlivePayload func(payload []byte)
+
 	// KeyHandshakeTimeout is the max time allowed for
 	// encryption key exchange to happen
 	KeyHandshakeTimeout time.Duration
 
+	// EncryptionOptional negotiates plaintext with peers that do
+	// not encrypt, for staged rollouts of encryption: encrypted
+	// clients accept a server declining the key exchange, plain
+	// servers decline it rather than failing, and encrypted servers
+	// serve the clients opening streams without one in plaintext.
+	// EncryptionState tells the outcome. Anyone on the path may
+	// force plaintext, so turn it off once the rollout is over.
+	EncryptionOptional bool
+
+	// LazyKeyExchange defers the key exchange of an encrypted
+	// client to its first OpenStream, so that idle sessions cost
+	// no handshake. KeyHandshakeTimeout runs from then on. Until
+	// the exchange starts, AcceptStream waits for it however long
+	// it takes, so the servers of such clients should set it too.
+	LazyKeyExchange bool
+
 	// MaxFrameSize is used to control the maximum
-	// frame size to sent to the remote
+	// frame size to sent to the remote, larger frames
+	// received are a protocol error, so both ends should agree
 	MaxFrameSize int
 
 	// MaxReceiveBuffer is used to control the maximum
@@ -36,6 +73,631 @@ type Config struct {
 	// ServerPublicKey is used by the client to encrypt the shared key
 	// sent during the initial key exchange
 	ServerPublicKey [32]byte
+
+	// EnableEncryption turns on the key exchange and encryption
+	// of stream data
+	EnableEncryption bool
+
+	// ClientIdentity is the long-lived Ed25519 key of an encrypted
+	// client, which signs the key made for each key exchange so that
+	// servers tell the client apart across its sessions, for
+	// KeyRevoked and Quotas. Nil presents no identity.
+	ClientIdentity ed25519.PrivateKey
+
+	// KeyLogWriter receives the keys of the encrypted sessions, a
+	// line "SMUX_SESSION_KEY <public key> <cipher> <key>" each,
+	// keys in hex, so that captures of their traffic can be
+	// decrypted, such as by smuxdump. The public key is the one
+	// starting the key exchange frames. It defeats the encryption,
+	// for debugging only.
+	KeyLogWriter io.Writer
+
+	// WriteCoalesceDelay enables buffered writes on streams: small
+	// writes are coalesced into one frame until Flush is called, a
+	// full frame is collected or the delay elapsed. Zero disables it.
+	WriteCoalesceDelay time.Duration
+
+	// CloseLinger is how long Stream.Close waits for writes in
+	// progress on other goroutines before resetting the stream
+	CloseLinger time.Duration
+
+	// PropagateDeadline makes Session.SetDeadline set the deadline
+	// of the streams open too, so that one call bounds all the reads
+	// and writes pending, such as while shutting down. Closing the
+	// session ends them either way.
+	PropagateDeadline bool
+
+	// StreamIDAllocator creates the allocator of local stream
+	// identifiers for each session, nil for the sequential default
+	StreamIDAllocator func(client bool) StreamIDAllocator
+
+	// PipelinedReceive reads the next frame on its own goroutine
+	// while the previous one is decrypted and delivered, trading a
+	// goroutine per session for throughput on fast links
+	PipelinedReceive bool
+
+	// CryptoWorkers is the number of goroutines decrypting the data
+	// received by an encrypted session, data of a stream is still
+	// delivered in order. Zero decrypts on the receiving goroutine.
+	CryptoWorkers int
+
+	// WriteTimeout is the longest a write to the connection may
+	// block before the session is closed with ErrPeerStalled.
+	// Zero waits forever.
+	WriteTimeout time.Duration
+
+	// ReadBufferSize is the size of the buffer frames are read
+	// through, so that small frames do not cost a read each.
+	// Zero reads the connection directly.
+	ReadBufferSize int
+
+	// TargetSegmentSize is the packet size of datagram based
+	// transports such as KCP or DTLS, frames and the writes
+	// batching them are kept within it. Zero leaves them unbounded.
+	TargetSegmentSize int
+
+	// MaxSendRate caps the bytes per second written to the
+	// connection, frame headers included, to shape the traffic of a
+	// session without help from the network. Keep-alive frames are
+	// not held back. Zero is no limit, Session.SetMaxSendRate
+	// changes it while the session runs.
+	MaxSendRate int64
+
+	// QoSClasses are the classes streams can be put in with
+	// Stream.SetQoSClass, each guaranteed a share of the bandwidth
+	// while the others send, and optionally capped. The data of
+	// streams is then sent in the order of the class shares rather
+	// than first come, first served. Nil sends streams as they come.
+	QoSClasses []QoSClass
+
+	// Logger receives the handshake failures, protocol violations
+	// and forced closes of the session, nil discards them
+	Logger Logger
+
+	// Tracer starts spans for the key exchange and the streams of
+	// the session, nil disables tracing
+	Tracer Tracer
+
+	// FrameTap is called with every frame sent or received, stream
+	// data in clear, to observe the traffic of the session. It runs
+	// on the goroutines moving frames, so it must be quick, and may be
+	// called concurrently when CryptoWorkers is set.
+	FrameTap func(dir Direction, f FrameInfo)
+
+	// FrameFaults drop or delay the frames sent or received that
+	// they match, for tests of the protocol, nil injects none
+	FrameFaults []FrameFault
+
+	// StallTimeout is how long the receive buffer may stay exhausted,
+	// or a stream keep more than StallThreshold bytes unread, before
+	// the stall is logged and passed to OnStall. Zero disables it.
+	StallTimeout time.Duration
+
+	// StallThreshold is the unread data past which a stream counts
+	// as stalled, zero only watches the receive buffer
+	StallThreshold int
+
+	// OnStall is called once for each stall, from the goroutine
+	// writing to the connection, so it must not block
+	OnStall func(ev StallEvent)
+
+	// StreamIdleTimeout resets the streams neither read from nor
+	// written to for that long, with ResetIdleTimeout, to free the
+	// streams an application forgot to close. Zero keeps them.
+	StreamIdleTimeout time.Duration
+
+	// UpstreamCompat speaks the exact protocol of xtaci/smux v1, to
+	// talk to stock peers during migrations: no encryption, no close
+	// reasons or go away, no stream metadata and no pings. Sessions
+	// only learn the peer is gone from keep-alive timeouts.
+	UpstreamCompat bool
+
+	// Version is the protocol version, 1 or 2. Version 2 is the
+	// protocol of xtaci/smux v2, adding per-stream flow control. Like
+	// UpstreamCompat, it leaves out the extensions of this fork:
+	// encryption, close reasons or go away, stream metadata and
+	// pings. A server set to version 2 speaks the version of its
+	// client, so it accepts both.
+	Version int
+
+	// MaxStreamBuffer is the receive window of each stream with
+	// protocol version 2
+	MaxStreamBuffer int
+
+	// MaxStreamReceiveBuffer caps the data buffered for each stream
+	// without flow control, protocol version 1. A stream whose
+	// reader falls that far behind is reset with ResetBufferExceeded
+	// rather than take all of MaxReceiveBuffer and stall the other
+	// streams. Zero is no cap.
+	MaxStreamReceiveBuffer int
+
+	// FlowControl replaces the MaxReceiveBuffer bucket with a policy
+	// of its own deciding when the session reads more data, such as
+	// budgets per tenant. Nil keeps the bucket.
+	FlowControl FlowControl
+
+	// Yamux speaks the framing of hashicorp/yamux instead of smux,
+	// for services migrating from yamux: the Session and Stream API
+	// stay the same. Encryption and protocol version 2 do not apply.
+	Yamux bool
+
+	// MaxIDViolations closes the session with a *ProtocolError once
+	// the peer opened that many streams with identifiers of our
+	// parity or already in use, or sent data on streams it did not
+	// open yet, zero never closes it. Each of these streams is reset
+	// either way.
+	MaxIDViolations int
+
+	// AcceptBacklog is how many streams opened by the peer may wait
+	// for AcceptStream, BacklogPolicy tells what happens to the
+	// streams coming when it is full
+	AcceptBacklog int
+	BacklogPolicy BacklogPolicy
+
+	// MaxOpenStreams limits the streams open at once on the session,
+	// both ways, zero is no limit. OpenStream returns
+	// ErrTooManyStreams past it, streams opened by the peer are reset
+	// with ResetRefused.
+	MaxOpenStreams int
+
+	// AcceptFilters run in order on each stream opened by the peer
+	// before AcceptStream returns it, to authenticate, rate limit or
+	// route it. A filter may tag the stream, such as with
+	// Stream.SetQoSClass, and read its Protocol and PeerInfo. The
+	// first error refuses the stream, which is reset with
+	// ResetRefused, or the code of a *StreamError, and never
+	// returned. Filters run in the goroutine calling AcceptStream.
+	AcceptFilters []func(*Stream) error
+
+	// StreamAuthenticator checks the token each stream opened by the
+	// peer carries, attached with WithAuthToken, nil when it has
+	// none, before the AcceptFilters. An error refuses the stream,
+	// reset with ResetUnauthorized or the code of a *StreamError.
+	// Nil accepts streams with or without tokens.
+	StreamAuthenticator func(stream *Stream, token []byte) error
+
+	// Quotas keeps the quotas of the clients of server sessions,
+	// shared by the sessions of each client. Nil sets no quota,
+	// clients ignore it.
+	Quotas *Quotas
+
+	// KeyRevoked reports whether the identity key of a client, the
+	// public key of its Config.ClientIdentity, was revoked, such as
+	// RevocationList.Revoked. Encrypted servers check the identity at
+	// the key exchange and every RevocationCheckInterval after, the
+	// session of a client whose identity is revoked is closed with a
+	// *SessionError of code ResetUnauthorized. Clients presenting no
+	// identity, or skipping the key exchange, are refused alike, as
+	// they cannot be told apart. Nil revokes no client.
+	KeyRevoked              func(key [32]byte) bool
+	RevocationCheckInterval time.Duration
+
+	// Interceptors wrap the reads and writes of every stream of the
+	// session, the first outermost, ahead of those registered with
+	// Session.Intercept
+	Interceptors []Interceptor
+
+	// MaxMessageSize is the size of the largest message sent by
+	// Stream.WriteMsg and accepted by Stream.ReadMsg
+	MaxMessageSize int
+
+	// Diagnostics answers the diagnostic streams the peer opens with
+	// Session.OpenDiagnostic: echoes, clock readings and throughput
+	// probes, to check a tunnel end to end without the application.
+	// Without it they are refused. They never reach AcceptStream, but
+	// go through StreamAuthenticator and AcceptFilters like the
+	// streams that do.
+	Diagnostics bool
+
+	// MaxDiagnosticSize is the most bytes a diagnostic request of the
+	// peer may have the session receive or send, larger requests reset
+	// the diagnostic stream with ResetProtocolError
+	MaxDiagnosticSize int
+}
+
+// BacklogPolicy is what happens to a stream opened by the peer when
+// the accept backlog is full
+type BacklogPolicy int
+
+// backlog policies
+const (
+	// BacklogBlock stops reading from the connection until a stream
+	// is accepted, stalling every stream of the session
+	BacklogBlock BacklogPolicy = iota
+	// BacklogReset resets the new stream
+	BacklogReset
+	// BacklogDropOldest resets the stream waiting the longest to make
+	// room for the new one
+	BacklogDropOldest
+)
+
+// apply lets a *Config be passed wherever an Option is expected,
+// replacing every setting accumulated so far
+func (c *Config) apply(dst *Config) {
+	if c != nil {
+		*dst = *c
+	}
+}
+
+// Option configures a session created by Client or Server.
+// A *Config is itself an Option.
+type Option interface {
+	apply(*Config)
+}
+
+type optionFunc func(*Config)
+
+func (f optionFunc) apply(c *Config) { f(c) }
+
+// WithKeepAlive sets the keep-alive interval and timeout
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.KeepAliveInterval = interval
+		c.KeepAliveTimeout = timeout
+	})
+}
+
+// WithKeepAliveMaxMissed closes sessions once n pings in a row went
+// unanswered
+func WithKeepAliveMaxMissed(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.KeepAliveMaxMissed = n
+	})
+}
+
+// WithKeepAlivePayload attaches the data of send to the pings sent and
+// hands the data attached to the pings of the peer to receive, either
+// may be nil
+func WithKeepAlivePayload(send func() []byte, receive func(payload []byte)) Option {
+	return optionFunc(func(c *Config) {
+		c.KeepAlivePayload = send
+		c.OnKeepAlivePayload = receive
+	})
+}
+
+// WithoutKeepAlive disables keep-alive
+func WithoutKeepAlive() Option {
+	return optionFunc(func(c *Config) {
+		c.KeepAliveDisabled = true
+	})
+}
+
+// WithKeyHandshakeTimeout sets the max time allowed for the key exchange
+func WithKeyHandshakeTimeout(timeout time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.KeyHandshakeTimeout = timeout
+	})
+}
+
+// WithOptionalEncryption lets encryption be negotiated away, see
+// Config.EncryptionOptional
+func WithOptionalEncryption() Option {
+	return optionFunc(func(c *Config) {
+		c.EncryptionOptional = true
+	})
+}
+
+// WithLazyKeyExchange defers the key exchange to the first OpenStream
+func WithLazyKeyExchange() Option {
+	return optionFunc(func(c *Config) {
+		c.LazyKeyExchange = true
+	})
+}
+
+// WithMaxFrameSize sets the maximum frame size sent to the remote
+func WithMaxFrameSize(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxFrameSize = size
+	})
+}
+
+// WithMaxReceiveBuffer sets the size of the session-wide receive buffer
+func WithMaxReceiveBuffer(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxReceiveBuffer = size
+	})
+}
+
+// WithEncryption enables encryption with the server key pair.
+// Clients only need the public key, servers need the private key,
+// either may be nil.
+func WithEncryption(serverPublicKey, serverPrivateKey *[32]byte) Option {
+	return optionFunc(func(c *Config) {
+		c.EnableEncryption = true
+		if serverPublicKey != nil {
+			c.ServerPublicKey = *serverPublicKey
+		}
+		if serverPrivateKey != nil {
+			c.ServerPrivateKey = *serverPrivateKey
+		}
+	})
+}
+
+// WithClientIdentity presents identity in the key exchanges of an
+// encrypted client
+func WithClientIdentity(identity ed25519.PrivateKey) Option {
+	return optionFunc(func(c *Config) {
+		c.ClientIdentity = identity
+	})
+}
+
+// WithKeyLogWriter writes the keys of the sessions to w, see
+// Config.KeyLogWriter
+func WithKeyLogWriter(w io.Writer) Option {
+	return optionFunc(func(c *Config) {
+		c.KeyLogWriter = w
+	})
+}
+
+// WithWriteCoalesce enables buffered writes flushed after delay
+func WithWriteCoalesce(delay time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.WriteCoalesceDelay = delay
+	})
+}
+
+// WithCloseLinger sets how long Stream.Close waits for writes in progress
+func WithCloseLinger(linger time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.CloseLinger = linger
+	})
+}
+
+// WithDeadlinePropagation makes the session deadline apply to its
+// streams
+func WithDeadlinePropagation() Option {
+	return optionFunc(func(c *Config) {
+		c.PropagateDeadline = true
+	})
+}
+
+// WithStreamIDAllocator sets the factory of local stream identifier allocators
+func WithStreamIDAllocator(factory func(client bool) StreamIDAllocator) Option {
+	return optionFunc(func(c *Config) {
+		c.StreamIDAllocator = factory
+	})
+}
+
+// WithPipelinedReceive reads frames ahead of their dispatch
+func WithPipelinedReceive() Option {
+	return optionFunc(func(c *Config) {
+		c.PipelinedReceive = true
+	})
+}
+
+// WithCryptoWorkers decrypts received data on n goroutines
+func WithCryptoWorkers(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.CryptoWorkers = n
+	})
+}
+
+// WithWriteTimeout closes sessions whose peer stops reading
+func WithWriteTimeout(timeout time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.WriteTimeout = timeout
+	})
+}
+
+// WithReadBufferSize sets the size of the connection read buffer
+func WithReadBufferSize(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.ReadBufferSize = size
+	})
+}
+
+// WithTargetSegmentSize fits frames and writes to the packet size
+// of the transport
+func WithTargetSegmentSize(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.TargetSegmentSize = size
+	})
+}
+
+// WithMaxSendRate caps the bytes per second written to the connection
+func WithMaxSendRate(bytesPerSecond int64) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxSendRate = bytesPerSecond
+	})
+}
+
+// WithQoSClasses sets the QoS classes streams can be put in
+func WithQoSClasses(classes ...QoSClass) Option {
+	return optionFunc(func(c *Config) {
+		c.QoSClasses = classes
+	})
+}
+
+// WithLogger sets the logger of session events
+func WithLogger(logger Logger) Option {
+	return optionFunc(func(c *Config) {
+		c.Logger = logger
+	})
+}
+
+// WithTracer traces sessions and their streams with tracer
+func WithTracer(tracer Tracer) Option {
+	return optionFunc(func(c *Config) {
+		c.Tracer = tracer
+	})
+}
+
+// WithFrameTap passes every frame sent or received to tap
+func WithFrameTap(tap func(dir Direction, f FrameInfo)) Option {
+	return optionFunc(func(c *Config) {
+		c.FrameTap = tap
+	})
+}
+
+// WithFrameFaults injects faults in the frames of the session, see
+// FrameFault
+func WithFrameFaults(faults ...FrameFault) Option {
+	return optionFunc(func(c *Config) {
+		c.FrameFaults = faults
+	})
+}
+
+// WithStallDetection reports streams keeping more than threshold
+// bytes unread, and a receive buffer exhausted, for longer than timeout
+func WithStallDetection(timeout time.Duration, threshold int, onStall func(ev StallEvent)) Option {
+	return optionFunc(func(c *Config) {
+		c.StallTimeout = timeout
+		c.StallThreshold = threshold
+		c.OnStall = onStall
+	})
+}
+
+// WithUpstreamCompat restricts sessions to the protocol of xtaci/smux v1
+func WithUpstreamCompat() Option {
+	return optionFunc(func(c *Config) {
+		c.UpstreamCompat = true
+	})
+}
+
+// WithProtocolVersion sets the protocol version, 1 or 2
+func WithProtocolVersion(version int) Option {
+	return optionFunc(func(c *Config) {
+		c.Version = version
+	})
+}
+
+// WithMaxStreamBuffer sets the receive window of each stream, used
+// by protocol version 2
+func WithMaxStreamBuffer(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxStreamBuffer = size
+	})
+}
+
+// WithStreamIdleTimeout resets streams left idle for timeout
+func WithStreamIdleTimeout(timeout time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.StreamIdleTimeout = timeout
+	})
+}
+
+// WithMaxStreamReceiveBuffer caps the data buffered for each stream
+// with protocol version 1
+func WithMaxStreamReceiveBuffer(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxStreamReceiveBuffer = size
+	})
+}
+
+// WithFlowControl sets the policy buffering the data received
+func WithFlowControl(fc FlowControl) Option {
+	return optionFunc(func(c *Config) {
+		c.FlowControl = fc
+	})
+}
+
+// WithMaxIDViolations closes sessions whose peer misused stream
+// identifiers n times
+func WithMaxIDViolations(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxIDViolations = n
+	})
+}
+
+// WithAcceptBacklog sets the number of streams waiting to be
+// accepted and what happens to new ones past it
+func WithAcceptBacklog(n int, policy BacklogPolicy) Option {
+	return optionFunc(func(c *Config) {
+		c.AcceptBacklog = n
+		c.BacklogPolicy = policy
+	})
+}
+
+// WithMaxOpenStreams limits the streams open at once to n
+func WithMaxOpenStreams(n int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxOpenStreams = n
+	})
+}
+
+// WithAcceptFilters adds filters run on the streams opened by the
+// peer before they are accepted
+func WithAcceptFilters(filters ...func(*Stream) error) Option {
+	return optionFunc(func(c *Config) {
+		c.AcceptFilters = append(c.AcceptFilters[:len(c.AcceptFilters):len(c.AcceptFilters)], filters...)
+	})
+}
+
+// WithStreamAuthenticator sets the check of the auth tokens of the
+// streams opened by the peer
+func WithStreamAuthenticator(auth func(stream *Stream, token []byte) error) Option {
+	return optionFunc(func(c *Config) {
+		c.StreamAuthenticator = auth
+	})
+}
+
+// WithQuotas sets the quotas of the clients
+func WithQuotas(quotas *Quotas) Option {
+	return optionFunc(func(c *Config) {
+		c.Quotas = quotas
+	})
+}
+
+// WithKeyRevocation sets the check of revoked client identities, run
+// at the key exchange and every interval after
+func WithKeyRevocation(revoked func(key [32]byte) bool, interval time.Duration) Option {
+	return optionFunc(func(c *Config) {
+		c.KeyRevoked = revoked
+		c.RevocationCheckInterval = interval
+	})
+}
+
+// WithInterceptors adds interceptors wrapping the I/O of every stream
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return optionFunc(func(c *Config) {
+		c.Interceptors = append(c.Interceptors[:len(c.Interceptors):len(c.Interceptors)], interceptors...)
+	})
+}
+
+// WithMaxMessageSize sets the size of the largest message of
+// Stream.WriteMsg and Stream.ReadMsg
+func WithMaxMessageSize(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxMessageSize = size
+	})
+}
+
+// WithDiagnostics answers the diagnostic streams of the peer, see
+// Config.Diagnostics
+func WithDiagnostics() Option {
+	return optionFunc(func(c *Config) {
+		c.Diagnostics = true
+	})
+}
+
+// WithMaxDiagnosticSize sets the most bytes a diagnostic request of
+// the peer may move, see Config.MaxDiagnosticSize
+func WithMaxDiagnosticSize(size int) Option {
+	return optionFunc(func(c *Config) {
+		c.MaxDiagnosticSize = size
+	})
+}
+
+// WithYamux makes sessions speak the hashicorp/yamux protocol
+func WithYamux() Option {
+	return optionFunc(func(c *Config) {
+		c.Yamux = true
+	})
+}
+
+// minSegmentSize leaves room for a frame header, the cipher overhead
+// and some data in a segment
+const minSegmentSize = headerSize + maxCipherOverhead + 64
+
+// newConfig applies opts on top of DefaultConfig
+func newConfig(opts []Option) *Config {
+	config := DefaultConfig()
+	for _, opt := range opts {
+		if opt != nil {
+			opt.apply(config)
+		}
+	}
+	return config
 }
 
 // DefaultConfig is used to return a default configuration
@@ -46,69 +708,247 @@ func DefaultConfig() *Config {
 		KeyHandshakeTimeout: 10 * time.Second,
 		MaxFrameSize:        4096,
 		MaxReceiveBuffer:    4194304,
+		Version:             1,
+		MaxStreamBuffer:     65536,
+		ReadBufferSize:      4096,
+		AcceptBacklog:       1024,
+		MaxMessageSize:      1048576,
+		MaxDiagnosticSize:   16777216,
+
+		RevocationCheckInterval: 10 * time.Second,
 	}
 }
 
-// VerifyConfig is used to verify the sanity of configuration
-func VerifyConfig(config *Config) error {
-	if config.KeepAliveInterval == 0 {
-		return errors.New("keep-alive interval must be positive")
+// Validate checks the sanity of the configuration and fills
+// optional fields left unset with their default values
+func (c *Config) Validate() error {
+	defaults := DefaultConfig()
+	if c.KeyHandshakeTimeout == 0 {
+		c.KeyHandshakeTimeout = defaults.KeyHandshakeTimeout
+	}
+	if c.Version == 0 {
+		c.Version = defaults.Version
+	}
+	if c.MaxStreamBuffer == 0 {
+		c.MaxStreamBuffer = defaults.MaxStreamBuffer
+	}
+	if c.AcceptBacklog == 0 {
+		c.AcceptBacklog = defaults.AcceptBacklog
 	}
-	if config.KeepAliveTimeout < config.KeepAliveInterval {
-		return fmt.Errorf("keep-alive timeout must be larger than keep-alive interval")
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = defaults.MaxMessageSize
 	}
-	if config.MaxFrameSize <= 0 {
+	if c.MaxDiagnosticSize == 0 {
+		c.MaxDiagnosticSize = defaults.MaxDiagnosticSize
+	}
+	if c.RevocationCheckInterval == 0 {
+		c.RevocationCheckInterval = defaults.RevocationCheckInterval
+	}
+
+	if !c.KeepAliveDisabled {
+		if c.KeepAliveInterval <= 0 {
+			return errors.New("keep-alive interval must be positive")
+		}
+		if c.KeepAliveTimeout <= c.KeepAliveInterval {
+			return fmt.Errorf("keep-alive timeout (%v) must be larger than keep-alive interval (%v)",
+				c.KeepAliveTimeout, c.KeepAliveInterval)
+		}
+		if c.KeepAliveMaxMissed < 0 {
+			return errors.New("keep-alive max missed pings must not be negative")
+		}
+	}
+	if c.KeyHandshakeTimeout < 0 {
+		return errors.New("key handshake timeout must not be negative")
+	}
+	if c.MaxFrameSize <= 0 {
 		return errors.New("max frame size must be positive")
 	}
-	if config.MaxFrameSize > 65535 {
-		return errors.New("max frame size must not be larger than 65535")
+	if c.MaxFrameSize > 65535 {
+		return fmt.Errorf("max frame size must not be larger than 65535, got %d", c.MaxFrameSize)
 	}
-	if config.MaxReceiveBuffer <= 0 {
+	if c.MaxReceiveBuffer <= 0 {
 		return errors.New("max receive buffer must be positive")
 	}
+	if c.CloseLinger < 0 {
+		return errors.New("close linger must not be negative")
+	}
+	if c.WriteCoalesceDelay < 0 {
+		return errors.New("write coalesce delay must not be negative")
+	}
+	if c.CryptoWorkers < 0 {
+		return errors.New("crypto workers must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		return errors.New("write timeout must not be negative")
+	}
+	if c.ReadBufferSize < 0 {
+		return errors.New("read buffer size must not be negative")
+	}
+	if c.MaxSendRate < 0 {
+		return errors.New("max send rate must not be negative")
+	}
+	for _, filter := range c.AcceptFilters {
+		if filter == nil {
+			return errors.New("accept filter must not be nil")
+		}
+	}
+	if c.RevocationCheckInterval < 0 {
+		return errors.New("revocation check interval must not be negative")
+	}
+	if c.MaxMessageSize < 0 || int64(c.MaxMessageSize) > math.MaxUint32 {
+		return errors.New("max message size must fit 32 bits")
+	}
+	if c.MaxDiagnosticSize < 0 || int64(c.MaxDiagnosticSize) > math.MaxUint32 {
+		return errors.New("max diagnostic size must fit 32 bits")
+	}
+	for _, fault := range c.FrameFaults {
+		if err := fault.validate(); err != nil {
+			return err
+		}
+		if c.Yamux && fault.Drop && (fault.Cmd == "" || fault.Cmd == "WND") {
+			return errors.New("yamux window updates cannot be dropped")
+		}
+	}
+	for _, i := range c.Interceptors {
+		if i == nil {
+			return errors.New("interceptor must not be nil")
+		}
+	}
+	for k, class := range c.QoSClasses {
+		if class.Name == "" {
+			return errors.New("QoS class name must not be empty")
+		}
+		if class.Weight < 0 || class.MaxRate < 0 {
+			return fmt.Errorf("QoS class %q: weight and max rate must not be negative", class.Name)
+		}
+		for _, other := range c.QoSClasses[:k] {
+			if other.Name == class.Name {
+				return fmt.Errorf("duplicate QoS class %q", class.Name)
+			}
+		}
+	}
+	if c.AcceptBacklog < 0 {
+		return errors.New("accept backlog must not be negative")
+	}
+	if c.BacklogPolicy < BacklogBlock || c.BacklogPolicy > BacklogDropOldest {
+		return fmt.Errorf("unknown backlog policy %d", c.BacklogPolicy)
+	}
+	if c.MaxIDViolations < 0 {
+		return errors.New("max id violations must not be negative")
+	}
+	if c.MaxStreamReceiveBuffer < 0 || c.MaxStreamReceiveBuffer > c.MaxReceiveBuffer {
+		return errors.New("max stream receive buffer must not be negative nor exceed max receive buffer")
+	}
+	if c.StreamIdleTimeout < 0 {
+		return errors.New("stream idle timeout must not be negative")
+	}
+	if c.MaxOpenStreams < 0 {
+		return errors.New("max open streams must not be negative")
+	}
+	if c.StallTimeout < 0 || c.StallThreshold < 0 {
+		return errors.New("stall timeout and threshold must not be negative")
+	}
+	if c.TargetSegmentSize < 0 || c.TargetSegmentSize > 0 && c.TargetSegmentSize <= minSegmentSize {
+		return fmt.Errorf("target segment size must be zero or larger than %d, got %d", minSegmentSize, c.TargetSegmentSize)
+	}
+	if c.Version != 1 && c.Version != 2 {
+		return fmt.Errorf("unsupported protocol version %d", c.Version)
+	}
+	if c.Version == 2 {
+		if c.MaxStreamBuffer <= 0 || c.MaxStreamBuffer > c.MaxReceiveBuffer {
+			return errors.New("max stream buffer must be positive and within max receive buffer")
+		}
+		if c.EnableEncryption {
+			return errors.New("encryption requires protocol version 1")
+		}
+	}
+	if c.Yamux && (c.EnableEncryption || c.Version != 1 || c.UpstreamCompat) {
+		return errors.New("yamux mode excludes encryption, protocol version 2 and upstream compatibility")
+	}
+	if c.EnableEncryption && c.UpstreamCompat {
+		return errors.New("encryption is not supported in upstream compatibility mode")
+	}
+	if c.ClientIdentity != nil && len(c.ClientIdentity) != ed25519.PrivateKeySize {
+		return errors.New("client identity must be an Ed25519 private key")
+	}
+	if c.EnableEncryption && c.ServerPublicKey == zeroKey && c.ServerPrivateKey == zeroKey {
+		return errors.New("encryption enabled without server keys")
+	}
 	return nil
 }
 
-// Server is used to initialize a new server-side connection.
-func Server(conn io.ReadWriteCloser, config *Config) (*Session, error) {
-	if config == nil {
-		config = DefaultConfig()
+// validateRole checks the settings that depend on the side of the session
+func (c *Config) validateRole(client bool) error {
+	if !c.EnableEncryption {
+		return nil
 	}
-	if err := VerifyConfig(config); err != nil {
-		return nil, err
+	if c.MaxFrameSize <= maxCipherOverhead {
+		return fmt.Errorf("max frame size must be larger than %d with encryption", maxCipherOverhead)
+	}
+	if client && c.ServerPublicKey == zeroKey {
+		return errors.New("encrypted client requires the server public key")
+	}
+	if !client && c.ServerPrivateKey == zeroKey {
+		return errors.New("encrypted server requires the server private key")
 	}
-	return newSession(config, conn, false, false), nil
+	return nil
 }
 
-func EncryptedServer(conn io.ReadWriteCloser, config *Config) (*Session, error) {
-	if config == nil {
-		config = DefaultConfig()
+var zeroKey [32]byte
+
+// VerifyConfig is used to verify the sanity of configuration,
+// the configuration itself is left untouched
+func VerifyConfig(config *Config) error {
+	c := *config
+	return c.Validate()
+}
+
+// newValidConfig builds the configuration of a session from opts
+func newValidConfig(opts []Option, encrypted, client bool) (*Config, error) {
+	config := newConfig(opts)
+	if encrypted {
+		config.EnableEncryption = true
 	}
-	if err := VerifyConfig(config); err != nil {
+	if err := config.Validate(); err != nil {
 		return nil, err
 	}
-	return newSession(config, conn, true, false), nil
+	if err := config.validateRole(client); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
-// Client is used to initialize a new client-side connection.
-func Client(conn io.ReadWriteCloser, config *Config) (*Session, error) {
-	if config == nil {
-		config = DefaultConfig()
+// Server is used to initialize a new server-side connection.
+func Server(conn io.ReadWriteCloser, opts ...Option) (*Session, error) {
+	config, err := newValidConfig(opts, false, false)
+	if err != nil {
+		return nil, err
 	}
+	return newSession(config, conn, config.EnableEncryption, false), nil
+}
 
-	if err := VerifyConfig(config); err != nil {
+// EncryptedServer is used to initialize a new encrypted server-side connection.
+func EncryptedServer(conn io.ReadWriteCloser, opts ...Option) (*Session, error) {
+	config, err := newValidConfig(opts, true, false)
+	if err != nil {
 		return nil, err
 	}
-	return newSession(config, conn, false, true), nil
+	return newSession(config, conn, true, false), nil
 }
 
 // Client is used to initialize a new client-side connection.
-func EncryptedClient(conn io.ReadWriteCloser, config *Config) (*Session, error) {
-	if config == nil {
-		config = DefaultConfig()
+func Client(conn io.ReadWriteCloser, opts ...Option) (*Session, error) {
+	config, err := newValidConfig(opts, false, true)
+	if err != nil {
+		return nil, err
 	}
+	return newSession(config, conn, config.EnableEncryption, true), nil
+}
 
-	if err := VerifyConfig(config); err != nil {
+// EncryptedClient is used to initialize a new encrypted client-side connection.
+func EncryptedClient(conn io.ReadWriteCloser, opts ...Option) (*Session, error) {
+	config, err := newValidConfig(opts, true, true)
+	if err != nil {
 		return nil, err
 	}
 	return newSession(config, conn, true, true), nil
@@ -3,6 +3,7 @@ package smux
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 type buffer struct {
@@ -67,3 +68,102 @@ func TestConfig(t *testing.T) {
 		t.Fatal("client started with wrong config")
 	}
 }
+
+func TestOptions(t *testing.T) {
+	config := newConfig([]Option{
+		WithKeepAlive(time.Second, 5*time.Second),
+		WithMaxFrameSize(1024),
+		WithMaxReceiveBuffer(65536),
+	})
+	if config.KeepAliveInterval != time.Second || config.KeepAliveTimeout != 5*time.Second {
+		t.Fatal("keep-alive option not applied")
+	}
+	if config.MaxFrameSize != 1024 || config.MaxReceiveBuffer != 65536 {
+		t.Fatal("buffer options not applied")
+	}
+
+	base := DefaultConfig()
+	base.MaxFrameSize = 2048
+	config = newConfig([]Option{WithMaxReceiveBuffer(1), base, WithKeyHandshakeTimeout(time.Second)})
+	if config.MaxFrameSize != 2048 || config.MaxReceiveBuffer != base.MaxReceiveBuffer {
+		t.Fatal("config option did not replace previous settings")
+	}
+	if config.KeyHandshakeTimeout != time.Second {
+		t.Fatal("option after config not applied")
+	}
+
+	var pub [32]byte
+	pub[0] = 1
+	config = newConfig([]Option{nil, (*Config)(nil), WithEncryption(&pub, nil)})
+	if !config.EnableEncryption || config.ServerPublicKey != pub {
+		t.Fatal("encryption option not applied")
+	}
+
+	var bts buffer
+	if _, err := Client(&bts, WithMaxFrameSize(0)); err == nil {
+		t.Fatal("client started with wrong option")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.KeyHandshakeTimeout = 0
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.KeyHandshakeTimeout != DefaultConfig().KeyHandshakeTimeout {
+		t.Fatal("unset key handshake timeout not defaulted")
+	}
+
+	config = DefaultConfig()
+	config.KeepAliveTimeout = config.KeepAliveInterval
+	err := config.Validate()
+	t.Log(err)
+	if err == nil {
+		t.Fatal("equal keep-alive interval and timeout accepted")
+	}
+
+	config = DefaultConfig()
+	config.EnableEncryption = true
+	err = config.Validate()
+	t.Log(err)
+	if err == nil {
+		t.Fatal("encryption without keys accepted")
+	}
+
+	var bts buffer
+	var key [32]byte
+	key[0] = 1
+	if _, err := EncryptedServer(&bts, WithEncryption(&key, nil)); err == nil {
+		t.Fatal("encrypted server started without private key")
+	}
+	if _, err := EncryptedClient(&bts, WithEncryption(nil, &key)); err == nil {
+		t.Fatal("encrypted client started without public key")
+	}
+}
+
+func TestPresets(t *testing.T) {
+	for _, preset := range []func() *Config{LowLatencyConfig, HighThroughputConfig, ManySessionsConfig} {
+		if err := preset().Validate(); err != nil {
+			t.Fatal(err)
+		}
+		client, server, err := Pipe(0, preset(), WithKeepAlive(time.Second, 5*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.config.KeepAliveInterval != time.Second || client.config.MaxFrameSize != preset().MaxFrameSize {
+			t.Fatal("options not applied over preset")
+		}
+		stream, _ := client.OpenStream()
+		go stream.Write(make([]byte, 100000))
+		accepted, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := accepted.Read(make([]byte, 100000)); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,196 @@
+package smux
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultPacketSize is the packet size of simulated links given none
+const defaultPacketSize = 1500
+
+// netemQueue bounds the packets in flight on a simulated link
+const netemQueue = 4096
+
+// Netem describes a direction of a simulated network link. Data is
+// cut into packets, each sent at the pace of Bandwidth and delivered
+// Delay later. The link stays reliable and ordered like TCP: a lost
+// packet is delivered after Retransmit more, holding up the ones
+// behind it.
+type Netem struct {
+	Delay      time.Duration // one-way latency
+	Jitter     time.Duration // the latency varies uniformly by up to Jitter either way
+	Loss       float64       // share of the packets lost, from 0 to 1
+	Retransmit time.Duration // extra latency of lost packets, twice Delay plus 10ms when zero
+	Bandwidth  int64         // bytes per second, zero for no limit
+	PacketSize int           // bytes a packet carries, 1500 when zero
+	Seed       int64         // seed of jitter and loss, zero seeds from the clock
+}
+
+// NewNetemPipe returns both ends of an in-memory connection with the
+// conditions of up from the first end to the second and those of
+// down back, to test sessions under WAN-like conditions:
+//
+//	c1, c2 := smux.NewNetemPipe(smux.Netem{Delay: 40 * time.Millisecond, Bandwidth: 1 << 20}, smux.Netem{Delay: 40 * time.Millisecond})
+//
+// Closing an end drops the data in flight.
+func NewNetemPipe(up, down Netem) (net.Conn, net.Conn) {
+	c1, c2 := NewPipeConn(0)
+	return newNetemConn(c1, up), newNetemConn(c2, down)
+}
+
+// netemConn delays its writes by the conditions of its link, reads
+// are those of the underlying pipe
+type netemConn struct {
+	net.Conn
+	link    Netem
+	rnd     *rand.Rand
+	packets chan netemPacket
+
+	mu   sync.Mutex // serializes writes
+	wire time.Time  // when the link is done sending
+	last time.Time  // delivery time of the last packet
+
+	writeDeadline deadline
+	die           chan struct{}
+	dieOnce       sync.Once
+}
+
+// netemPacket is a packet in flight
+type netemPacket struct {
+	data []byte
+	at   time.Time // delivery time
+}
+
+func newNetemConn(conn net.Conn, link Netem) *netemConn {
+	if link.PacketSize <= 0 {
+		link.PacketSize = defaultPacketSize
+	}
+	if link.Retransmit <= 0 {
+		link.Retransmit = 2*link.Delay + 10*time.Millisecond
+	}
+	seed := link.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c := &netemConn{
+		Conn:    conn,
+		link:    link,
+		rnd:     rand.New(rand.NewSource(seed)),
+		packets: make(chan netemPacket, netemQueue),
+		die:     make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+// Write queues b in packets, blocking for the time the link takes to
+// send them at its bandwidth
+func (c *netemConn) Write(b []byte) (n int, err error) {
+	timeout := c.writeDeadline.wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(b) > 0 {
+		size := len(b)
+		if size > c.link.PacketSize {
+			size = c.link.PacketSize
+		}
+		now := time.Now()
+		sent := now
+		if c.link.Bandwidth > 0 {
+			if c.wire.After(now) {
+				sent = c.wire
+			}
+			sent = sent.Add(time.Duration(int64(size) * int64(time.Second) / c.link.Bandwidth))
+			c.wire = sent
+		}
+		at := sent.Add(c.latency())
+		if at.Before(c.last) {
+			at = c.last // no reordering
+		}
+		c.last = at
+
+		if wait := sent.Sub(now); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.die:
+				timer.Stop()
+				return n, io.ErrClosedPipe
+			case <-timeout:
+				timer.Stop()
+				return n, errTimeout
+			}
+		}
+		p := netemPacket{data: append([]byte(nil), b[:size]...), at: at}
+		select {
+		case c.packets <- p:
+		case <-c.die:
+			return n, io.ErrClosedPipe
+		case <-timeout:
+			return n, errTimeout
+		}
+		b = b[size:]
+		n += size
+	}
+	return n, nil
+}
+
+// latency returns the delay of a packet, mu must be held
+func (c *netemConn) latency() time.Duration {
+	d := c.link.Delay
+	if c.link.Jitter > 0 {
+		d += time.Duration(c.rnd.Int63n(int64(2*c.link.Jitter))) - c.link.Jitter
+	}
+	if c.link.Loss > 0 && c.rnd.Float64() < c.link.Loss {
+		d += c.link.Retransmit
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// deliver writes the packets to the pipe once their time came
+func (c *netemConn) deliver() {
+	for {
+		select {
+		case p := <-c.packets:
+			if wait := time.Until(p.at); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-c.die:
+					timer.Stop()
+					return
+				}
+			}
+			if _, err := c.Conn.Write(p.data); err != nil {
+				return
+			}
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// Close closes both directions, dropping the data in flight
+func (c *netemConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return c.Conn.Close()
+}
+
+func (c *netemConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *netemConn) SetDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.Conn.SetReadDeadline(t)
+}
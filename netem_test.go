@@ -0,0 +1,59 @@
+package smux
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNetemPipe(t *testing.T) {
+	link := Netem{Delay: 30 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.1, Seed: 1}
+	c1, c2 := NewNetemPipe(link, link)
+	defer c1.Close()
+	defer c2.Close()
+
+	// packets stay in order despite jitter and loss
+	data := make([]byte, 256<<10)
+	crand.Read(data)
+	start := time.Now()
+	go c1.Write(data)
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(c2, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data mismatch")
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Fatal("data not delayed", elapsed)
+	}
+}
+
+func TestNetemBandwidth(t *testing.T) {
+	c1, c2 := NewNetemPipe(Netem{Bandwidth: 1 << 20}, Netem{})
+	defer c1.Close()
+	defer c2.Close()
+	client, _ := Client(c1, WithoutKeepAlive())
+	defer client.Close()
+	server, _ := Server(c2, WithoutKeepAlive())
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	go stream.Write(make([]byte, 256<<10))
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(accepted, make([]byte, 256<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("256KB sent faster than 1MB/s allows", elapsed)
+	}
+}
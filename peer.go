@@ -0,0 +1,102 @@
+package smux
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// PeerInfo describes the original client of a stream opened on its
+// behalf, such as by an edge proxy relaying the connections it
+// accepts, in the spirit of the PROXY protocol
+type PeerInfo struct {
+	IP         net.IP
+	Port       int
+	ServerName string // TLS server name indication, if any
+}
+
+func (p *PeerInfo) String() string {
+	addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+	if p.ServerName != "" {
+		return addr + " (" + p.ServerName + ")"
+	}
+	return addr
+}
+
+// NewPeerInfo returns the PeerInfo of the client of conn: its remote
+// address, and the server name it asked for if conn is a *tls.Conn
+// whose handshake completed
+func NewPeerInfo(conn net.Conn) *PeerInfo {
+	info := &PeerInfo{}
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		info.IP, info.Port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		info.IP, info.Port = addr.IP, addr.Port
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		info.ServerName = tc.ConnectionState().ServerName
+	}
+	return info
+}
+
+type peerInfoKey struct{}
+
+// WithPeerInfo returns a copy of ctx carrying info, OpenStreamContext
+// sends it to the peer with the stream
+func WithPeerInfo(ctx context.Context, info *PeerInfo) context.Context {
+	return context.WithValue(ctx, peerInfoKey{}, info)
+}
+
+// peerOpen appends the PeerInfo carried by ctx to the SYN metadata
+// of stream
+func (s *Session) peerOpen(ctx context.Context, stream *Stream, meta []byte) []byte {
+	info, _ := ctx.Value(peerInfoKey{}).(*PeerInfo)
+	if info == nil {
+		return meta
+	}
+	stream.peer = info
+	if s.upstream() || s.config.Yamux {
+		return meta // the protocol has no room for it
+	}
+
+	var addr []byte
+	if ip4 := info.IP.To4(); ip4 != nil {
+		addr = make([]byte, 2+net.IPv4len)
+		copy(addr[2:], ip4)
+	} else if len(info.IP) == net.IPv6len {
+		addr = make([]byte, 2+net.IPv6len)
+		copy(addr[2:], info.IP)
+	}
+	if addr != nil && len(meta)+2+len(addr) <= maxControlSize {
+		binary.LittleEndian.PutUint16(addr, uint16(info.Port))
+		meta = appendMeta(meta, metaPeerAddr, addr)
+	}
+	if name := info.ServerName; name != "" && len(name) <= 255 && len(meta)+2+len(name) <= maxControlSize {
+		meta = appendMeta(meta, metaServerName, []byte(name))
+	}
+	return meta
+}
+
+// peerAccept sets the PeerInfo sent by the opener of stream
+func peerAccept(stream *Stream, meta []byte) {
+	addr := findMeta(meta, metaPeerAddr)
+	name := findMeta(meta, metaServerName)
+	if addr == nil && name == nil {
+		return
+	}
+	info := &PeerInfo{ServerName: string(name)}
+	if n := len(addr) - 2; n == net.IPv4len || n == net.IPv6len {
+		info.Port = int(binary.LittleEndian.Uint16(addr))
+		info.IP = append(net.IP(nil), addr[2:]...)
+	}
+	stream.peer = info
+}
+
+// PeerInfo returns the original client the stream was opened for,
+// nil if the opener attached none with WithPeerInfo
+func (s *Stream) PeerInfo() *PeerInfo {
+	return s.peer
+}
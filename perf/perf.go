@@ -0,0 +1,369 @@
+// Package perf measures the throughput and latency of smux sessions
+// over a loopback TCP connection.
+package perf
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/superfly/smux"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Options describes one benchmark run
+type Options struct {
+	Streams     int   // concurrent streams
+	FrameSize   int   // MaxFrameSize of both sessions
+	Encrypted   bool  // use an encrypted session pair
+	Bytes       int64 // bytes sent by each stream in the throughput phase
+	Rounds      int   // round trips of each stream in the latency phase
+	MessageSize int   // size of the latency messages
+}
+
+// DefaultOptions returns the options used for unset fields
+func DefaultOptions() Options {
+	return Options{
+		Streams:     1,
+		FrameSize:   4096,
+		Bytes:       64 << 20,
+		Rounds:      1000,
+		MessageSize: 64,
+	}
+}
+
+// Result holds the measures of a run
+type Result struct {
+	Options Options
+
+	Bytes        int64         // stream data received in the throughput phase
+	Frames       int64         // frames sent in the throughput phase
+	Elapsed      time.Duration // duration of the throughput phase
+	Goodput      float64       // stream data received per second
+	FramesPerSec float64
+
+	Latency Latency // round trips of the latency phase
+}
+
+// Latency summarizes round trip times
+type Latency struct {
+	Min, Mean, P50, P99, Max time.Duration
+}
+
+// Run sets up a session pair and measures it
+func Run(opts Options) (*Result, error) {
+	def := DefaultOptions()
+	if opts.Streams <= 0 {
+		opts.Streams = def.Streams
+	}
+	if opts.FrameSize <= 0 {
+		opts.FrameSize = def.FrameSize
+	}
+	if opts.Bytes <= 0 {
+		opts.Bytes = def.Bytes
+	}
+	if opts.Rounds <= 0 {
+		opts.Rounds = def.Rounds
+	}
+	if opts.MessageSize <= 0 {
+		opts.MessageSize = def.MessageSize
+	}
+
+	p, err := newPair(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	res := &Result{Options: opts}
+	if err := p.throughput(res); err != nil {
+		return nil, err
+	}
+	if err := p.latency(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pair is a client session and its server
+type pair struct {
+	opts    Options
+	client  *smux.Session
+	server  *smux.Session
+	counter *frameCounter
+}
+
+func newPair(opts Options) (*pair, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	c2, ok := <-accepted
+	if !ok {
+		c1.Close()
+		return nil, errors.New("perf: accept failed")
+	}
+
+	counter := &frameCounter{Conn: c1}
+	config := smux.DefaultConfig()
+	config.MaxFrameSize = opts.FrameSize
+	config.MaxReceiveBuffer = 16 << 20
+
+	var client, server *smux.Session
+	if opts.Encrypted {
+		pub, priv, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig, serverConfig := *config, *config
+		clientConfig.ServerPublicKey = *pub
+		serverConfig.ServerPrivateKey = *priv
+		if server, err = smux.EncryptedServer(c2, &serverConfig); err != nil {
+			return nil, err
+		}
+		client, err = smux.EncryptedClient(counter, &clientConfig)
+	} else {
+		if server, err = smux.Server(c2, config); err != nil {
+			return nil, err
+		}
+		client, err = smux.Client(counter, config)
+	}
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	return &pair{opts: opts, client: client, server: server, counter: counter}, nil
+}
+
+func (p *pair) close() {
+	p.client.Close()
+	p.server.Close()
+}
+
+// throughput sends Bytes on every stream and waits for the server to
+// receive all of it
+func (p *pair) throughput(res *Result) error {
+	var received int64
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*p.opts.Streams+1)
+
+	wg.Add(p.opts.Streams)
+	go func() {
+		for i := 0; i < p.opts.Streams; i++ {
+			stream, err := p.server.AcceptStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go func() {
+				defer wg.Done()
+				n, err := io.Copy(ioutil.Discard, stream)
+				atomic.AddInt64(&received, n)
+				if err != nil {
+					errs <- err
+				}
+			}()
+		}
+	}()
+
+	streams := make([]*smux.Stream, p.opts.Streams)
+	for k := range streams {
+		stream, err := p.client.OpenStream()
+		if err != nil {
+			return err
+		}
+		streams[k] = stream
+	}
+
+	frames := p.counter.frames()
+	start := time.Now()
+	for _, stream := range streams {
+		go func(stream *smux.Stream) {
+			buf := make([]byte, 64<<10)
+			for left := p.opts.Bytes; left > 0; {
+				chunk := buf
+				if int64(len(chunk)) > left {
+					chunk = chunk[:left]
+				}
+				n, err := stream.Write(chunk)
+				if err != nil {
+					errs <- err
+					return
+				}
+				left -= int64(n)
+			}
+			stream.Close()
+		}(stream)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case err := <-errs:
+		return err
+	}
+
+	res.Elapsed = time.Since(start)
+	res.Bytes = atomic.LoadInt64(&received)
+	// besides the data, each stream sent a RST closing it
+	res.Frames = p.counter.frames() - frames - int64(p.opts.Streams)
+	if secs := res.Elapsed.Seconds(); secs > 0 {
+		res.Goodput = float64(res.Bytes) / secs
+		res.FramesPerSec = float64(res.Frames) / secs
+	}
+	return nil
+}
+
+// latency runs request/response round trips on every stream
+func (p *pair) latency(res *Result) error {
+	go func() {
+		for {
+			stream, err := p.server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	var mu sync.Mutex
+	var samples durations
+	var wg sync.WaitGroup
+	errs := make(chan error, p.opts.Streams)
+	for i := 0; i < p.opts.Streams; i++ {
+		stream, err := p.client.OpenStream()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+			msg := make([]byte, p.opts.MessageSize)
+			reply := make([]byte, p.opts.MessageSize)
+			rtts := make(durations, 0, p.opts.Rounds)
+			for k := 0; k < p.opts.Rounds; k++ {
+				start := time.Now()
+				if _, err := stream.Write(msg); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := io.ReadFull(stream, reply); err != nil {
+					errs <- err
+					return
+				}
+				rtts = append(rtts, time.Since(start))
+			}
+			mu.Lock()
+			samples = append(samples, rtts...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	res.Latency = samples.summary()
+	return nil
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func (d durations) summary() (l Latency) {
+	if len(d) == 0 {
+		return l
+	}
+	sort.Sort(d)
+	var total time.Duration
+	for _, v := range d {
+		total += v
+	}
+	l.Min = d[0]
+	l.Max = d[len(d)-1]
+	l.Mean = total / time.Duration(len(d))
+	l.P50 = d[len(d)/2]
+	l.P99 = d[len(d)*99/100]
+	return l
+}
+
+// frameCounter counts the frames written to a connection by
+// following the length field of each header
+type frameCounter struct {
+	net.Conn
+	mu     sync.Mutex
+	header [8]byte
+	filled int   // header bytes collected
+	skip   int   // payload bytes left in the current frame
+	count  int64 // frames seen
+}
+
+func (c *frameCounter) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.scan(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *frameCounter) scan(b []byte) {
+	for len(b) > 0 {
+		if c.skip > 0 {
+			n := c.skip
+			if n > len(b) {
+				n = len(b)
+			}
+			c.skip -= n
+			b = b[n:]
+			continue
+		}
+		n := copy(c.header[c.filled:], b)
+		c.filled += n
+		b = b[n:]
+		if c.filled == len(c.header) {
+			c.filled = 0
+			c.skip = int(binary.LittleEndian.Uint16(c.header[2:]))
+			c.count++
+		}
+	}
+}
+
+func (c *frameCounter) frames() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
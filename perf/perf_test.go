@@ -0,0 +1,47 @@
+package perf
+
+import (
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		res, err := Run(Options{
+			Streams:   4,
+			FrameSize: 4096,
+			Encrypted: encrypted,
+			Bytes:     1 << 20,
+			Rounds:    10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Bytes != 4<<20 {
+			t.Fatal("unexpected bytes received", res.Bytes)
+		}
+		// frames carry at most FrameSize bytes of data
+		if res.Frames < res.Bytes/4096 {
+			t.Fatal("frames undercounted", res.Frames)
+		}
+		if res.Latency.Min <= 0 || res.Latency.Max < res.Latency.P99 {
+			t.Fatal("unexpected latency", res.Latency)
+		}
+	}
+}
+
+func benchmarkRun(b *testing.B, opts Options) {
+	opts.Bytes = int64(b.N) * 4096
+	opts.Rounds = 1
+	b.SetBytes(4096 * int64(opts.Streams))
+	b.ReportAllocs()
+	if _, err := Run(opts); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkPlain(b *testing.B)        { benchmarkRun(b, Options{Streams: 1}) }
+func BenchmarkPlainStreams(b *testing.B) { benchmarkRun(b, Options{Streams: 16}) }
+func BenchmarkEncrypted(b *testing.B)    { benchmarkRun(b, Options{Streams: 1, Encrypted: true}) }
+func BenchmarkEncryptedLarge(b *testing.B) {
+	benchmarkRun(b, Options{Streams: 1, Encrypted: true, FrameSize: 32768})
+}
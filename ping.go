@@ -0,0 +1,238 @@
+package smux
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superfly/smux/frame"
+)
+
+// keep-alive NOP frames carry a ping that the peer answers with a
+// pong echoing its sequence number, which measures the round trip
+// time. Peers unaware of pings ignore the payload of NOP frames.
+const (
+	nopPing        = frame.NOPPing
+	nopPong        = frame.NOPPong
+	nopPayloadSize = frame.NOPPayloadSize // kind and sequence number
+)
+
+// maxKeepAlivePayload bounds the application data a ping carries
+const maxKeepAlivePayload = maxControlSize - nopPayloadSize
+
+// maxPendingPings bounds the pings waiting for their pong
+const maxPendingPings = 16
+
+// rttHistorySize is the number of round trip samples kept
+const rttHistorySize = 16
+
+// pingTracker matches the pongs received to the pings sent
+type pingTracker struct {
+	sync.Mutex
+	seq     uint32
+	pending map[uint32]pendingPing // pings in flight
+	rtt     time.Duration          // smoothed round trip time
+
+	lastSent     time.Time
+	lastReceived time.Time
+	samples      [rttHistorySize]time.Duration // ring of the last round trips
+	nsamples     int                           // samples taken, ever
+	missed       int                           // keep-alive intervals in a row that received nothing
+}
+
+// KeepAliveStats reports the keep-alive of a session, a tunnel
+// degrading shows as missed pings or round trips growing before the
+// keep-alive timeout closes it
+type KeepAliveStats struct {
+	LastPingSent     time.Time       // zero until a ping was sent
+	LastPingReceived time.Time       // zero until the peer pinged
+	RTT              time.Duration   // smoothed round trip time
+	RTTHistory       []time.Duration // last round trips measured, oldest first
+	MissedPings      int             // keep-alive intervals in a row that received nothing
+	MaxMissedPings   int             // missed pings closing the session
+}
+
+// pendingPing is a ping waiting for its pong
+type pendingPing struct {
+	sent time.Time
+	done chan struct{} // closed by the pong, if not nil
+}
+
+// newNOPFrame builds a ping or pong frame
+func newNOPFrame(kind byte, seq uint32) Frame {
+	f := newFrame(cmdNOP, 0)
+	f.data = make([]byte, nopPayloadSize)
+	f.data[0] = kind
+	binary.LittleEndian.PutUint32(f.data[1:], seq)
+	return f
+}
+
+// newPing returns a ping frame, its send time is taken now and done
+// is closed once the pong is received. Stock peers get a bare NOP.
+func (s *Session) newPing(done chan struct{}) Frame {
+	var payload []byte
+	if send := s.config.KeepAlivePayload; send != nil && !s.upstream() {
+		if payload = send(); len(payload) > maxKeepAlivePayload {
+			s.log(LevelWarn, "keep-alive payload too large", "size", len(payload), "limit", maxKeepAlivePayload)
+			payload = nil
+		}
+	}
+
+	t := &s.pings
+	t.Lock()
+	defer t.Unlock()
+	t.lastSent = time.Now()
+	if s.upstream() {
+		return newFrame(cmdNOP, 0)
+	}
+	if t.pending == nil {
+		t.pending = make(map[uint32]pendingPing)
+	}
+	if len(t.pending) >= maxPendingPings {
+		// pongs that never came, the peer may not answer pings
+		for seq, p := range t.pending {
+			if p.done == nil {
+				delete(t.pending, seq)
+			}
+		}
+	}
+	t.seq++
+	t.pending[t.seq] = pendingPing{sent: t.lastSent, done: done}
+	f := newNOPFrame(nopPing, t.seq)
+	f.data = append(f.data, payload...)
+	return f
+}
+
+// handleNOP answers pings and measures the round trip of pongs
+func (s *Session) handleNOP(data []byte) {
+	if len(data) < nopPayloadSize || data[0] != nopPong {
+		// bare NOPs are the pings of stock peers
+		s.pings.Lock()
+		s.pings.lastReceived = time.Now()
+		s.pings.Unlock()
+	}
+	if len(data) < nopPayloadSize {
+		return
+	}
+	seq := binary.LittleEndian.Uint32(data[1:])
+	switch data[0] {
+	case nopPing:
+		if receive := s.config.OnKeepAlivePayload; receive != nil && len(data) > nopPayloadSize {
+			// data is the receive buffer, reused for the next frame
+			receive(append([]byte(nil), data[nopPayloadSize:]...))
+		}
+		// answered by sendLoop, a pong is dropped rather than
+		// holding up the receive
+		select {
+		case s.chPong <- seq:
+		default:
+		}
+	case nopPong:
+		s.pongReceived(seq)
+	}
+}
+
+// pongReceived updates the round trip time with the pong of ping seq
+func (s *Session) pongReceived(seq uint32) {
+	t := &s.pings
+	t.Lock()
+	defer t.Unlock()
+	p, ok := t.pending[seq]
+	if !ok {
+		return
+	}
+	delete(t.pending, seq)
+	if p.done != nil {
+		close(p.done)
+	}
+	sample := time.Since(p.sent)
+	t.samples[t.nsamples%rttHistorySize] = sample
+	t.nsamples++
+	if t.rtt == 0 {
+		t.rtt = sample
+	} else {
+		t.rtt += (sample - t.rtt) / 8
+	}
+}
+
+// RTT returns the smoothed round trip time of keep-alive pings, zero
+// until a pong was received. Peers predating pings never answer them.
+func (s *Session) RTT() time.Duration {
+	s.pings.Lock()
+	defer s.pings.Unlock()
+	return s.pings.rtt
+}
+
+// setMissedPings records the keep-alive intervals in a row that
+// received nothing
+func (s *Session) setMissedPings(n int) {
+	s.pings.Lock()
+	s.pings.missed = n
+	s.pings.Unlock()
+}
+
+// KeepAliveStats returns a snapshot of the keep-alive of the session
+func (s *Session) KeepAliveStats() KeepAliveStats {
+	var st KeepAliveStats
+	if interval, _ := s.keepAliveSettings(); interval > 0 {
+		st.MaxMissedPings = s.maxMissedPings()
+	}
+	t := &s.pings
+	t.Lock()
+	defer t.Unlock()
+	st.LastPingSent, st.LastPingReceived = t.lastSent, t.lastReceived
+	st.RTT, st.MissedPings = t.rtt, t.missed
+	first := 0
+	if t.nsamples > rttHistorySize {
+		first = t.nsamples - rttHistorySize
+	}
+	for i := first; i < t.nsamples; i++ {
+		st.RTTHistory = append(st.RTTHistory, t.samples[i%rttHistorySize])
+	}
+	return st
+}
+
+// Healthy checks that the peer is alive, for pools deciding whether
+// to reuse the session. Data received within the keep-alive interval
+// is enough, else the peer is pinged and Healthy waits for its pong
+// until ctx is done. It returns nil for a healthy session. Peers
+// predating pings never answer them, so an idle session with such a
+// peer is reported unhealthy; with stock peers, in UpstreamCompat mode
+// or protocol version 2, only data received within the keep-alive
+// timeout tells.
+func (s *Session) Healthy(ctx context.Context) error {
+	if s.IsClosed() {
+		return s.dieError()
+	}
+	recent, timeout := s.keepAliveSettings()
+	if recent <= 0 {
+		recent = time.Second
+	}
+	if s.upstream() && timeout > 0 {
+		recent = timeout
+	}
+	if time.Since(s.recvRate.lastUpdate()) < recent {
+		return nil
+	}
+	if s.upstream() {
+		return errors.New(errNoRecentData)
+	}
+
+	done := make(chan struct{})
+	if _, err := s.writeFrameTimeout(s.newPing(done), ctx.Done()); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-s.die:
+		return s.dieError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,195 @@
+package smux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultPipeBuffer is the buffer size of pipes given none
+const defaultPipeBuffer = 65536
+
+// Pipe returns both ends of a session over an in-memory connection,
+// buffering bufferSize bytes in each direction, 0 for 64KB. It lets
+// code built on sessions be tested without sockets.
+func Pipe(bufferSize int, opts ...Option) (client, server *Session, err error) {
+	c1, c2 := NewPipeConn(bufferSize)
+	if client, err = Client(c1, opts...); err != nil {
+		return nil, nil, err
+	}
+	if server, err = Server(c2, opts...); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// NewPipeConn returns both ends of an in-memory connection, buffering
+// bufferSize bytes in each direction, 0 for 64KB. Unlike net.Pipe,
+// writes return as soon as the data fits in the buffer.
+func NewPipeConn(bufferSize int) (net.Conn, net.Conn) {
+	if bufferSize <= 0 {
+		bufferSize = defaultPipeBuffer
+	}
+	b1 := newPipeBuffer(bufferSize)
+	b2 := newPipeBuffer(bufferSize)
+	c1 := &pipeConn{r: b1, w: b2, die: make(chan struct{})}
+	c2 := &pipeConn{r: b2, w: b1, die: make(chan struct{})}
+	return c1, c2
+}
+
+// pipeBuffer carries the data of a direction of a pipe
+type pipeBuffer struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	size     int
+	closed   bool          // either end closed
+	readable chan struct{} // notify data written
+	writable chan struct{} // notify data read
+}
+
+func newPipeBuffer(size int) *pipeBuffer {
+	return &pipeBuffer{
+		size:     size,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// close ends the direction, data buffered can still be read
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	notify(b.readable)
+	notify(b.writable)
+}
+
+// pipeConn is an end of a pipe
+type pipeConn struct {
+	r, w          *pipeBuffer
+	readDeadline  deadline
+	writeDeadline deadline
+	die           chan struct{}
+	dieOnce       sync.Once
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	timeout := c.readDeadline.wait()
+	for {
+		select {
+		case <-c.die:
+			return 0, io.ErrClosedPipe
+		case <-timeout:
+			return 0, errTimeout
+		default:
+		}
+
+		c.r.mu.Lock()
+		if c.r.buf.Len() > 0 {
+			n, _ := c.r.buf.Read(p)
+			c.r.mu.Unlock()
+			notify(c.r.writable)
+			return n, nil
+		}
+		closed := c.r.closed
+		c.r.mu.Unlock()
+		if closed {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-c.r.readable:
+		case <-c.die:
+			return 0, io.ErrClosedPipe
+		case <-timeout:
+			return 0, errTimeout
+		}
+	}
+}
+
+func (c *pipeConn) Write(p []byte) (n int, err error) {
+	timeout := c.writeDeadline.wait()
+	for len(p) > 0 {
+		select {
+		case <-c.die:
+			return n, io.ErrClosedPipe
+		case <-timeout:
+			return n, errTimeout
+		default:
+		}
+
+		c.w.mu.Lock()
+		if c.w.closed {
+			c.w.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		room := c.w.size - c.w.buf.Len()
+		if room > len(p) {
+			room = len(p)
+		}
+		if room > 0 {
+			c.w.buf.Write(p[:room])
+			p = p[room:]
+			n += room
+		}
+		c.w.mu.Unlock()
+		if room > 0 {
+			notify(c.w.readable)
+			continue
+		}
+
+		select {
+		case <-c.w.writable:
+		case <-c.die:
+			return n, io.ErrClosedPipe
+		case <-timeout:
+			return n, errTimeout
+		}
+	}
+	return n, nil
+}
+
+// Close closes both directions, the peer reads the data buffered
+// before io.EOF
+func (c *pipeConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.r.close()
+		c.w.close()
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
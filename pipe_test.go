@@ -0,0 +1,79 @@
+package smux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestPipe(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	for _, bufferSize := range []int{0, 1, 1000} {
+		client, server, err := Pipe(bufferSize, WithEncryption(pub, priv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, 100000)
+		rand.Read(msg)
+		go stream.Write(msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatal("corrupted echo, buffer", bufferSize)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	c1, c2 := NewPipeConn(4)
+
+	// writes return once buffered, then wait for room
+	if n, err := c1.Write([]byte("abcd")); n != 4 || err != nil {
+		t.Fatal("unexpected write", n, err)
+	}
+	c1.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := c1.Write([]byte("ef"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || n != 0 {
+		t.Fatal("expected a timeout", n, err)
+	}
+	c1.SetWriteDeadline(time.Time{})
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8)
+	if n, err := c2.Read(buf); n != 4 || err != nil || string(buf[:n]) != "abcd" {
+		t.Fatal("unexpected read", n, err)
+	}
+
+	// the data buffered is read before io.EOF
+	c1.Write([]byte("ef"))
+	c1.Close()
+	if data, err := ioutil.ReadAll(c2); err != nil || string(data) != "ef" {
+		t.Fatal("unexpected read", string(data), err)
+	}
+	if _, err := c2.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatal("wrote to a closed pipe", err)
+	}
+}
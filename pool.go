@@ -0,0 +1,300 @@
+package smux
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolClosed is returned by the calls on a closed SessionPool
+var ErrPoolClosed = errors.New("session pool closed")
+
+const (
+	defaultPoolDialTimeout = 10 * time.Second
+	defaultPoolRedialDelay = time.Second
+	maxPoolRedialDelay     = 30 * time.Second
+
+	// poolCheckInterval is how often a pool looks for sessions whose
+	// peer is going away
+	poolCheckInterval = time.Second
+)
+
+// PoolConfig configures a SessionPool
+type PoolConfig struct {
+	// Dial opens a client session to the target, such as with
+	// Dialer.Dial, ctx is bounded by DialTimeout
+	Dial func(ctx context.Context) (*Session, error)
+
+	// Size is the number of sessions kept open, 1 when zero
+	Size int
+
+	// MaxStreamsPerSession caps the streams open on each session,
+	// OpenStream fails with ErrTooManyStreams once all of them are
+	// at the cap. Zero never caps them.
+	MaxStreamsPerSession int
+
+	// DialTimeout bounds each dial, 10s when zero
+	DialTimeout time.Duration
+
+	// RedialDelay is waited after a failed dial, doubling with each
+	// failure in a row up to 30s, 1s when zero
+	RedialDelay time.Duration
+}
+
+// SessionPool keeps Size client sessions to a target and opens each
+// stream on the least loaded of them. Sessions closed, or whose peer
+// is going away, are replaced in the background.
+//
+//	pool, err := smux.NewSessionPool(smux.PoolConfig{
+//		Size: 4,
+//		Dial: func(ctx context.Context) (*smux.Session, error) {
+//			return dialer.Dial(ctx, "host:7000")
+//		},
+//	})
+//	stream, err := pool.OpenStream()
+type SessionPool struct {
+	config PoolConfig
+
+	mu      sync.Mutex
+	slots   []*poolSlot
+	changed chan struct{} // closed when a session joins the pool
+
+	die     chan struct{}
+	dieOnce sync.Once
+	wg      sync.WaitGroup
+}
+
+// poolSlot holds one session of the pool, nil while it is dialed
+type poolSlot struct {
+	session *Session
+	opening int // streams being opened on the session
+}
+
+// NewSessionPool starts dialing the sessions of a pool, streams can
+// be opened right away and wait for the first session
+func NewSessionPool(config PoolConfig) (*SessionPool, error) {
+	if config.Dial == nil {
+		return nil, errors.New("pool dial function must be set")
+	}
+	if config.Size < 0 {
+		return nil, errors.New("pool size must not be negative")
+	}
+	if config.MaxStreamsPerSession < 0 {
+		return nil, errors.New("max streams per session must not be negative")
+	}
+	if config.Size == 0 {
+		config.Size = 1
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultPoolDialTimeout
+	}
+	if config.RedialDelay <= 0 {
+		config.RedialDelay = defaultPoolRedialDelay
+	}
+
+	p := &SessionPool{
+		config:  config,
+		slots:   make([]*poolSlot, config.Size),
+		changed: make(chan struct{}),
+		die:     make(chan struct{}),
+	}
+	for k := range p.slots {
+		p.slots[k] = new(poolSlot)
+		p.wg.Add(1)
+		go p.maintain(p.slots[k])
+	}
+	return p, nil
+}
+
+// OpenStream opens a stream on the least loaded session
+func (p *SessionPool) OpenStream() (*Stream, error) {
+	return p.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext opens a stream on the least loaded session, it
+// waits for a session to be dialed until ctx is done
+func (p *SessionPool) OpenStreamContext(ctx context.Context) (*Stream, error) {
+	for {
+		p.mu.Lock()
+		select {
+		case <-p.die:
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		default:
+		}
+		slot, full := p.pick()
+		if slot == nil {
+			changed := p.changed
+			p.mu.Unlock()
+			if full {
+				return nil, ErrTooManyStreams
+			}
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-p.die:
+				return nil, ErrPoolClosed
+			}
+		}
+		session := slot.session
+		slot.opening++
+		p.mu.Unlock()
+
+		stream, err := session.OpenStreamContext(ctx)
+		p.mu.Lock()
+		slot.opening--
+		p.mu.Unlock()
+		if err != nil && !session.acceptsStreams() && ctx.Err() == nil {
+			continue // lost meanwhile, try another session
+		}
+		return stream, err
+	}
+}
+
+// pick returns the usable slot with the fewest streams, the fastest
+// on a tie. full reports that sessions are up but all at the cap.
+// p.mu must be held.
+func (p *SessionPool) pick() (best *poolSlot, full bool) {
+	var bestLoad int
+	var bestRTT time.Duration
+	for _, slot := range p.slots {
+		if slot.session == nil || !slot.session.acceptsStreams() {
+			continue
+		}
+		load := slot.session.NumStreams() + slot.opening
+		if max := p.config.MaxStreamsPerSession; max > 0 && load >= max {
+			full = true
+			continue
+		}
+		rtt := slot.session.RTT()
+		if best == nil || load < bestLoad || load == bestLoad && rtt < bestRTT {
+			best, bestLoad, bestRTT = slot, load, rtt
+		}
+	}
+	return best, full && best == nil
+}
+
+// Sessions returns the number of sessions streams can be opened on
+func (p *SessionPool) Sessions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, slot := range p.slots {
+		if slot.session != nil && slot.session.acceptsStreams() {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes the pool and its sessions
+func (p *SessionPool) Close() error {
+	closed := false
+	p.dieOnce.Do(func() {
+		close(p.die)
+		closed = true
+	})
+	if !closed {
+		return ErrPoolClosed
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// maintain keeps a session in slot, dialing it again once it closed
+// or its peer is going away
+func (p *SessionPool) maintain(slot *poolSlot) {
+	defer p.wg.Done()
+	delay := p.config.RedialDelay
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := p.context(p.config.DialTimeout)
+		session, err := p.config.Dial(ctx)
+		cancel()
+		if err != nil {
+			select {
+			case <-time.After(delay):
+			case <-p.die:
+				return
+			}
+			if delay *= 2; delay > maxPoolRedialDelay {
+				delay = maxPoolRedialDelay
+			}
+			continue
+		}
+		delay = p.config.RedialDelay
+
+		p.mu.Lock()
+		slot.session = session
+		close(p.changed)
+		p.changed = make(chan struct{})
+		p.mu.Unlock()
+
+		if !p.watch(session, ticker.C) {
+			session.Close()
+			return
+		}
+		p.mu.Lock()
+		slot.session = nil
+		p.mu.Unlock()
+		if !session.IsClosed() {
+			// the peer is going away, the streams open may end
+			// unless the pool closes first
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				ctx, cancel := p.context(0)
+				session.Shutdown(ctx)
+				cancel()
+			}()
+		}
+	}
+}
+
+// context returns a context cancelled once the pool closes, or after
+// timeout unless zero
+func (p *SessionPool) context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	go func() {
+		select {
+		case <-p.die:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// watch waits for session to stop accepting streams, it returns
+// false once the pool is closed
+func (p *SessionPool) watch(session *Session, tick <-chan time.Time) bool {
+	for {
+		select {
+		case <-session.die:
+			return true
+		case <-tick:
+			if !session.acceptsStreams() {
+				return true
+			}
+		case <-p.die:
+			return false
+		}
+	}
+}
+
+// acceptsStreams reports whether streams can be opened on the session
+func (s *Session) acceptsStreams() bool {
+	return !s.IsClosed() && atomic.LoadInt32(&s.shutdown) == 0 && atomic.LoadInt32(&s.peerGoingAway) == 0
+}
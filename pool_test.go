@@ -0,0 +1,183 @@
+package smux
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolTarget dials sessions to echo servers over pipes
+type poolTarget struct {
+	mu       sync.Mutex
+	sessions []*Session // client sessions dialed
+	servers  []*Session
+}
+
+func (tg *poolTarget) dial(ctx context.Context) (*Session, error) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+	tg.mu.Lock()
+	tg.sessions = append(tg.sessions, client)
+	tg.servers = append(tg.servers, server)
+	tg.mu.Unlock()
+	return client, nil
+}
+
+// pair returns the k-th session dialed and its server
+func (tg *poolTarget) pair(k int) (client, server *Session) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return tg.sessions[k], tg.servers[k]
+}
+
+func (tg *poolTarget) dialed() int {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return len(tg.sessions)
+}
+
+func (tg *poolTarget) close() {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	for _, s := range tg.servers {
+		s.Close()
+	}
+}
+
+func waitPoolSessions(t *testing.T, pool *SessionPool, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Sessions() != n {
+		if time.Now().After(deadline) {
+			t.Fatal("expected", n, "sessions, got", pool.Sessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	tg := &poolTarget{}
+	defer tg.close()
+	pool, err := NewSessionPool(PoolConfig{Dial: tg.dial, Size: 3, RedialDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	waitPoolSessions(t, pool, 3)
+
+	// streams are spread evenly
+	var streams []*Stream
+	for i := 0; i < 30; i++ {
+		stream, err := pool.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	for k := 0; k < 3; k++ {
+		if client, _ := tg.pair(k); client.NumStreams() != 10 {
+			t.Fatal("unbalanced sessions, one has", client.NumStreams(), "streams")
+		}
+	}
+	msg := []byte("hello")
+	stream := streams[0]
+	stream.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("unexpected echo", string(buf), err)
+	}
+
+	// a lost session is replaced
+	client, _ := tg.pair(0)
+	client.Close()
+	waitPoolSessions(t, pool, 3)
+	if n := tg.dialed(); n != 4 {
+		t.Fatal("expected one more dial, got", n)
+	}
+
+	// so is one whose peer goes away
+	_, server := tg.pair(1)
+	go server.Shutdown(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for tg.dialed() != 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("session going away not replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitPoolSessions(t, pool, 3)
+
+	pool.Close()
+	if _, err := pool.OpenStream(); err != ErrPoolClosed {
+		t.Fatal("expected ErrPoolClosed, got", err)
+	}
+	for k := 0; k < tg.dialed(); k++ {
+		if client, _ := tg.pair(k); !client.IsClosed() {
+			t.Fatal("session left open by Close")
+		}
+	}
+}
+
+func TestSessionPoolMaxStreams(t *testing.T) {
+	tg := &poolTarget{}
+	defer tg.close()
+	pool, err := NewSessionPool(PoolConfig{Dial: tg.dial, Size: 2, MaxStreamsPerSession: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	waitPoolSessions(t, pool, 2)
+	var streams []*Stream
+	for i := 0; i < 4; i++ {
+		stream, err := pool.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	if _, err := pool.OpenStream(); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams, got", err)
+	}
+	streams[0].Close()
+	if _, err := pool.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionPoolDialFailure(t *testing.T) {
+	pool, err := NewSessionPool(PoolConfig{
+		Dial: func(ctx context.Context) (*Session, error) {
+			return nil, io.ErrUnexpectedEOF
+		},
+		RedialDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.OpenStreamContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected the deadline exceeded, got", err)
+	}
+
+	if _, err := NewSessionPool(PoolConfig{}); err == nil {
+		t.Fatal("pool without dial function accepted")
+	}
+}
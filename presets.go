@@ -0,0 +1,52 @@
+package smux
+
+import (
+	"runtime"
+	"time"
+)
+
+// LowLatencyConfig is tuned for interactive traffic, such as RPC or
+// remote shells over slow or lossy links: small frames keep a bulk
+// stream from holding back the others, writes go out at once and
+// broken links are noticed within seconds.
+func LowLatencyConfig() *Config {
+	c := DefaultConfig()
+	c.KeepAliveInterval = 2 * time.Second
+	c.KeepAliveTimeout = 6 * time.Second
+	c.MaxFrameSize = 1024
+	c.MaxReceiveBuffer = 1048576
+	c.MaxStreamBuffer = 32768
+	c.ReadBufferSize = 2048
+	c.WriteCoalesceDelay = 0
+	return c
+}
+
+// HighThroughputConfig is tuned for bulk transfers over fast links,
+// such as tunnels between data centers: large frames and buffers
+// cover the bandwidth delay product, and frames are read and
+// decrypted on goroutines of their own.
+func HighThroughputConfig() *Config {
+	c := DefaultConfig()
+	c.MaxFrameSize = 32768
+	c.MaxReceiveBuffer = 33554432
+	c.MaxStreamBuffer = 4194304
+	c.ReadBufferSize = 65536
+	c.PipelinedReceive = true
+	c.CryptoWorkers = runtime.NumCPU()
+	return c
+}
+
+// ManySessionsConfig is tuned for servers holding many mostly idle
+// sessions, such as fleets of devices: small buffers bound the memory
+// of each session and keep-alives are sparse.
+func ManySessionsConfig() *Config {
+	c := DefaultConfig()
+	c.KeepAliveInterval = 30 * time.Second
+	c.KeepAliveTimeout = 90 * time.Second
+	c.MaxFrameSize = 4096
+	c.MaxReceiveBuffer = 262144
+	c.MaxStreamBuffer = 32768
+	c.ReadBufferSize = 1024
+	c.AcceptBacklog = 64
+	return c
+}
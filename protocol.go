@@ -0,0 +1,36 @@
+package smux
+
+import "context"
+
+type protocolKey struct{}
+
+// WithProtocol returns a copy of ctx carrying the application
+// protocol of a stream, such as "http/1.1" or "ssh", which
+// OpenStreamContext sends to the peer so that it can route the
+// stream without looking at its data
+func WithProtocol(ctx context.Context, proto string) context.Context {
+	return context.WithValue(ctx, protocolKey{}, proto)
+}
+
+// protocolOpen appends the protocol carried by ctx to the SYN
+// metadata of stream
+func (s *Session) protocolOpen(ctx context.Context, stream *Stream, meta []byte) []byte {
+	proto, _ := ctx.Value(protocolKey{}).(string)
+	if proto == "" {
+		return meta
+	}
+	stream.proto = proto
+	if s.upstream() || s.config.Yamux {
+		return meta // the protocol has no room for it
+	}
+	if len(proto) <= 255 && len(meta)+2+len(proto) <= maxControlSize {
+		meta = appendMeta(meta, metaProtocol, []byte(proto))
+	}
+	return meta
+}
+
+// Protocol returns the application protocol the stream was opened
+// for with WithProtocol, empty if none
+func (s *Stream) Protocol() string {
+	return s.proto
+}
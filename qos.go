@@ -0,0 +1,223 @@
+package smux
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QoSClass is a class of streams sharing the send bandwidth of a
+// session, set with Config.QoSClasses and Stream.SetQoSClass. Streams
+// of no class are best effort, as a class of weight 1.
+type QoSClass struct {
+	Name string
+
+	// Weight is the share of the bandwidth the class is guaranteed
+	// while streams of other classes have data to send too, relative
+	// to their weights, zero counts as 1. A class alone takes it all.
+	// Shares apply to the frames waiting to be sent, and a stream
+	// waits for each of its frames to be written before the next, so
+	// classes of a single busy stream each end up alternating.
+	Weight int
+
+	// MaxRate caps the bytes per second sent by the streams of the
+	// class together, whatever the bandwidth left, zero is no cap
+	MaxRate int64
+}
+
+// qosScheduler hands the data frames of streams over to sendLoop in
+// the order of start-time fair queueing: a frame is tagged with the
+// virtual time its class would start sending it at, counting each
+// byte as 1/Weight, and the waiting frame with the lowest tag goes
+// first. Frames are handed over one at a time, so that sendLoop
+// receives them in that order.
+type qosScheduler struct {
+	mu      sync.Mutex
+	classes []qosClass // the default class first
+	vtime   float64    // tag of the last frame handed over
+	seq     uint64     // tickets issued, to break ties in order
+	waiting []*qosTicket
+	holder  *qosTicket // frame being handed over
+}
+
+// qosClass is the scheduling state of a class
+type qosClass struct {
+	QoSClass
+	finish float64 // virtual time the last frame of the class ends at
+	limit  sendLimiter
+}
+
+// qosTicket is a frame waiting for its turn
+type qosTicket struct {
+	start float64
+	seq   uint64
+	ready chan struct{} // closed once it is the frame's turn
+}
+
+// newQoSScheduler returns the scheduler of the classes, nil when
+// there are none
+func newQoSScheduler(classes []QoSClass) *qosScheduler {
+	if len(classes) == 0 {
+		return nil
+	}
+	q := &qosScheduler{classes: make([]qosClass, len(classes)+1)}
+	q.classes[0].Weight = 1
+	for k, c := range classes {
+		if c.Weight <= 0 {
+			c.Weight = 1
+		}
+		q.classes[k+1].QoSClass = c
+		q.classes[k+1].limit.setRate(c.MaxRate)
+	}
+	return q
+}
+
+// class returns the index of the class named name
+func (q *qosScheduler) class(name string) (int, bool) {
+	for k := 1; k < len(q.classes); k++ {
+		if q.classes[k].Name == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// acquire queues a frame of n bytes of class, its ready channel is
+// closed once it may be handed over
+func (q *qosScheduler) acquire(class, n int) *qosTicket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c := &q.classes[class]
+	start := c.finish
+	if start < q.vtime {
+		start = q.vtime // the class was idle
+	}
+	c.finish = start + float64(n)/float64(c.Weight)
+	q.seq++
+	t := &qosTicket{start: start, seq: q.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, t)
+	q.grant()
+	return t
+}
+
+// release ends the turn of t, or withdraws it if its turn did not
+// come, the next frame is granted
+func (q *qosScheduler) release(t *qosTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.holder == t {
+		q.holder = nil
+	} else {
+		for k, w := range q.waiting {
+			if w == t {
+				q.waiting = append(q.waiting[:k], q.waiting[k+1:]...)
+				break
+			}
+		}
+	}
+	q.grant()
+}
+
+// grant gives the turn to the waiting frame with the lowest tag, mu
+// must be held
+func (q *qosScheduler) grant() {
+	if q.holder != nil || len(q.waiting) == 0 {
+		return
+	}
+	best := 0
+	for k, t := range q.waiting {
+		if b := q.waiting[best]; t.start < b.start || t.start == b.start && t.seq < b.seq {
+			best = k
+		}
+	}
+	t := q.waiting[best]
+	q.waiting = append(q.waiting[:best], q.waiting[best+1:]...)
+	q.holder = t
+	q.vtime = t.start
+	close(t.ready)
+}
+
+// SetQoSClass puts the stream in the class of Config.QoSClasses
+// named name, an empty name makes it best effort
+func (s *Stream) SetQoSClass(name string) error {
+	q := s.sess.qos
+	if name == "" {
+		atomic.StoreInt32(&s.qosClass, 0)
+		return nil
+	}
+	if q == nil {
+		return fmt.Errorf("unknown QoS class %q", name)
+	}
+	k, ok := q.class(name)
+	if !ok {
+		return fmt.Errorf("unknown QoS class %q", name)
+	}
+	atomic.StoreInt32(&s.qosClass, int32(k))
+	return nil
+}
+
+// SetMaxSendRate caps the bytes per second of data the stream sends,
+// zero lifts the cap
+func (s *Stream) SetMaxSendRate(bytesPerSecond int64) error {
+	if bytesPerSecond < 0 {
+		return errors.New("max send rate must not be negative")
+	}
+	s.sendLimit.setRate(bytesPerSecond)
+	return nil
+}
+
+// schedule waits for the turn of a frame of n bytes, paced by the
+// rate caps of the stream and its class. The ticket returned, nil
+// without QoS classes, must be released once the frame was handed
+// over to sendLoop.
+func (s *Stream) schedule(n int, deadline <-chan struct{}) (*qosTicket, error) {
+	if err := s.pace(&s.sendLimit, n, deadline); err != nil {
+		return nil, err
+	}
+	q := s.sess.qos
+	if q == nil {
+		return nil, nil
+	}
+	class := int(atomic.LoadInt32(&s.qosClass))
+	if err := s.pace(&q.classes[class].limit, n, deadline); err != nil {
+		return nil, err
+	}
+	t := q.acquire(class, n)
+	select {
+	case <-t.ready:
+		return t, nil
+	case <-s.die:
+		q.release(t)
+		return nil, s.dieError()
+	case <-deadline:
+		q.release(t)
+		return nil, errTimeout
+	}
+}
+
+// endTurn releases the ticket of schedule
+func (s *Stream) endTurn(t *qosTicket) {
+	if t != nil {
+		s.sess.qos.release(t)
+	}
+}
+
+// pace waits until the limiter lets n bytes through
+func (s *Stream) pace(l *sendLimiter, n int, deadline <-chan struct{}) error {
+	wait := l.take(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.die:
+		return s.dieError()
+	case <-deadline:
+		return errTimeout
+	}
+}
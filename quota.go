@@ -0,0 +1,221 @@
+package smux
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota bounds what a client of server sessions may take, set by
+// Quotas for each client and shared by all its sessions. Streams over
+// the quota are reset with ResetRefused, data with
+// ResetBufferExceeded. Zero fields are no limit.
+type Quota struct {
+	// MaxStreams caps the streams the client has open at once
+	MaxStreams int
+
+	// MaxBuffered caps the bytes received for the streams of the
+	// client and not read yet, the stream whose data goes over is
+	// reset
+	MaxBuffered int
+
+	// MaxOpenRate caps the streams the client opens per second, in
+	// bursts of up to OpenBurst streams, 1 when zero
+	MaxOpenRate float64
+	OpenBurst   int
+}
+
+// Quotas keeps the quotas of the clients of server sessions, set with
+// Config.Quotas. The sessions of a client share its quota, so that
+// reconnecting does not reset it: clients are told apart by the
+// identity they proved in the key exchange, Config.ClientIdentity of
+// their side, else by the IP address of their connection, which
+// clients behind the same address share. Set the same Quotas on all
+// the servers of a listener.
+type Quotas struct {
+	// Quota returns the quota of the client of a session, once the
+	// client is known: as the session starts, or at the key exchange
+	// when encrypted. Streams the client opens before are refused.
+	// The quota returned for its latest session applies.
+	Quota func(session *Session) Quota
+
+	mu      sync.Mutex
+	clients map[string]*clientQuota
+}
+
+// clientQuota is the quota of a client and the state enforcing it
+// across its sessions
+type clientQuota struct {
+	key      string // the client in Quotas
+	mu       sync.Mutex
+	quota    Quota
+	sessions map[*Session]struct{}
+	tokens   float64   // streams that may be opened now
+	last     time.Time // when tokens was last refilled
+}
+
+// join adds session to the quota of its client, unless it is closed
+func (qs *Quotas) join(session *Session, key string, quota Quota) *clientQuota {
+	if quota.OpenBurst <= 0 {
+		quota.OpenBurst = 1
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.clients == nil {
+		qs.clients = make(map[string]*clientQuota)
+	}
+	q := qs.clients[key]
+	if q == nil {
+		q = &clientQuota{key: key, sessions: make(map[*Session]struct{}), tokens: float64(quota.OpenBurst)}
+		qs.clients[key] = q
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.quota = quota
+	if !session.IsClosed() {
+		// leave runs once the session is closed
+		q.sessions[session] = struct{}{}
+	} else if len(q.sessions) == 0 {
+		delete(qs.clients, key)
+	}
+	return q
+}
+
+// leave removes a closed session from q
+func (qs *Quotas) leave(session *Session, q *clientQuota) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q.mu.Lock()
+	delete(q.sessions, session)
+	empty := len(q.sessions) == 0
+	q.mu.Unlock()
+	if empty && qs.clients[q.key] == q {
+		delete(qs.clients, q.key)
+	}
+}
+
+// allowOpen takes a token for a stream opened now, it reports false
+// when the client opens streams too fast
+func (q *clientQuota) allowOpen() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.quota.MaxOpenRate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if !q.last.IsZero() {
+		q.tokens += now.Sub(q.last).Seconds() * q.quota.MaxOpenRate
+		if burst := float64(q.quota.OpenBurst); q.tokens > burst {
+			q.tokens = burst
+		}
+	}
+	q.last = now
+	if q.tokens < 1 {
+		return false
+	}
+	q.tokens--
+	return true
+}
+
+// overStreams reports whether the client has MaxStreams open
+func (q *clientQuota) overStreams() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.quota.MaxStreams <= 0 {
+		return false
+	}
+	streams := 0
+	for s := range q.sessions {
+		streams += int(atomic.LoadInt32(&s.peerStreams))
+	}
+	return streams >= q.quota.MaxStreams
+}
+
+// overBuffered reports whether n more bytes buffered would take the
+// client over MaxBuffered
+func (q *clientQuota) overBuffered(n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.quota.MaxBuffered <= 0 {
+		return false
+	}
+	buffered := 0
+	for s := range q.sessions {
+		buffered += s.config.MaxReceiveBuffer - int(atomic.LoadInt32(&s.bucket))
+	}
+	return buffered+n > q.quota.MaxBuffered
+}
+
+// clientKey tells the client of a server session apart for Quotas
+func (s *Session) clientKey() string {
+	s.cryptStreamLock.Lock()
+	identity := s.peerIdentity
+	s.cryptStreamLock.Unlock()
+	if identity != ([32]byte{}) {
+		return "identity " + hex.EncodeToString(identity[:])
+	}
+	addr := s.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return addr.Network() + " " + host
+	}
+	return addr.Network() + " " + addr.String()
+}
+
+// setQuota asks Config.Quotas for the quota of the client, once it is
+// known: as a server session starts, or at the key exchange when
+// encrypted
+func (s *Session) setQuota() {
+	qs := s.config.Quotas
+	if qs == nil || qs.Quota == nil || s.client {
+		return
+	}
+	key, quota := s.clientKey(), qs.Quota(s)
+	// joined under the lock closeWithError marks the session dead
+	// with: a close either comes first and the session is left out,
+	// or it comes after and finds the quota to leave
+	s.dieLock.Lock()
+	defer s.dieLock.Unlock()
+	s.quota.Store(qs.join(s, key, quota))
+}
+
+// leaveQuota removes a closed session from the quota of its client
+func (s *Session) leaveQuota() {
+	if q, _ := s.quota.Load().(*clientQuota); q != nil {
+		s.config.Quotas.leave(s, q)
+	}
+}
+
+// admitStream checks a SYN against the quota of the client, it
+// resets the stream and returns false when the stream is refused
+func (s *Session) admitStream(sid uint32) bool {
+	if s.config.Quotas == nil || s.config.Quotas.Quota == nil || s.client {
+		return true
+	}
+	q, _ := s.quota.Load().(*clientQuota)
+	reason := ""
+	switch {
+	case q == nil:
+		reason = "stream before the key exchange"
+	case q.overStreams():
+		reason = "stream quota exceeded"
+	case !q.allowOpen():
+		reason = "stream open rate exceeded"
+	default:
+		return true
+	}
+	s.log(LevelDebug, "stream refused by quota", "sid", sid, "reason", reason)
+	s.resetStream(sid, ResetRefused, reason)
+	return false
+}
+
+// overBufferQuota reports whether n more bytes buffered would take
+// the client over its quota
+func (s *Session) overBufferQuota(n int) bool {
+	q, _ := s.quota.Load().(*clientQuota)
+	return q != nil && q.overBuffered(n)
+}
@@ -0,0 +1,134 @@
+package smux
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateWindow is the time constant of the bandwidth estimates
+const rateWindow = time.Second
+
+// rateEstimator is an exponentially weighted moving average of a
+// throughput: the bytes counted decay with time instead of being
+// sampled at intervals, so no timer is needed
+type rateEstimator struct {
+	sync.Mutex
+	rate float64   // bytes per second as of last
+	last time.Time // when bytes were last counted
+}
+
+// decayed returns the estimate aged up to now, the lock must be held
+func (r *rateEstimator) decayed(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	return r.rate * math.Exp(-float64(now.Sub(r.last))/float64(rateWindow))
+}
+
+// add counts n bytes transferred now
+func (r *rateEstimator) add(n int) {
+	now := time.Now()
+	r.Lock()
+	r.rate = r.decayed(now) + float64(n)/rateWindow.Seconds()
+	r.last = now
+	r.Unlock()
+}
+
+// value returns the current estimate in bytes per second
+func (r *rateEstimator) value() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.decayed(time.Now())
+}
+
+// lastUpdate returns when bytes were last counted
+func (r *rateEstimator) lastUpdate() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return r.last
+}
+
+// Bandwidth returns the estimated throughput of the session in bytes
+// per second, frame headers included, averaged over about a second
+func (s *Session) Bandwidth() (send, recv float64) {
+	return s.sendRate.value(), s.recvRate.value()
+}
+
+// sendBurst is how long an idle send rate limiter saves up for, the
+// burst it lets through afterwards
+const sendBurst = 50 * time.Millisecond
+
+// sendLimiter is a token bucket on the bytes written by sendLoop. A
+// write may take the bucket into debt, the next one waits it out, so
+// writes larger than the burst still go through at the rate.
+type sendLimiter struct {
+	sync.Mutex
+	rate   float64   // bytes per second, zero for no limit
+	tokens float64   // bytes that may be written now, negative in debt
+	last   time.Time // when tokens were last added
+}
+
+// setRate changes the rate, forgiving the debt of the previous one
+func (l *sendLimiter) setRate(bytesPerSecond int64) {
+	l.Lock()
+	l.rate = float64(bytesPerSecond)
+	l.tokens = 0
+	l.last = time.Now()
+	l.Unlock()
+}
+
+// take removes n bytes from the bucket, it returns how long to wait
+// before writing them
+func (l *sendLimiter) take(n int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if burst := l.rate * sendBurst.Seconds(); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle waits until n bytes may be written at the send rate, it
+// returns false when the session closed meanwhile
+func (s *Session) throttle(n int) bool {
+	wait := s.sendLimit.take(n)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.chSendRate:
+		// the new rate forgave the debt
+	case <-s.die:
+		return false
+	}
+	return true
+}
+
+// SetMaxSendRate changes the bytes per second the session writes to
+// its connection, zero lifts the limit
+func (s *Session) SetMaxSendRate(bytesPerSecond int64) error {
+	if bytesPerSecond < 0 {
+		return errors.New("max send rate must not be negative")
+	}
+	s.sendLimit.setRate(bytesPerSecond)
+	select {
+	case s.chSendRate <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package smux
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigUpdate lists the settings ApplyConfig changes on a live
+// session, the nil fields are left as they are
+type ConfigUpdate struct {
+	// KeepAliveInterval and KeepAliveTimeout as in SetKeepAlive, an
+	// interval of zero disables keep-alive
+	KeepAliveInterval *time.Duration
+	KeepAliveTimeout  *time.Duration
+
+	// MaxSendRate as in SetMaxSendRate
+	MaxSendRate *int64
+
+	// MaxOpenStreams applies to the streams opened from then on,
+	// those already open over a lower limit stay open
+	MaxOpenStreams *int
+
+	// MaxStreamReceiveBuffer applies to the data received from then
+	// on, it may not exceed Config.MaxReceiveBuffer
+	MaxStreamReceiveBuffer *int
+}
+
+// ApplyConfig changes the settings of the session in update, so that
+// a new configuration reaches long-lived sessions without closing
+// them. Nothing is changed when one of them is invalid.
+func (s *Session) ApplyConfig(update ConfigUpdate) error {
+	interval, timeout := s.keepAliveSettings()
+	if update.KeepAliveInterval != nil {
+		interval = *update.KeepAliveInterval
+	}
+	if update.KeepAliveTimeout != nil {
+		timeout = *update.KeepAliveTimeout
+	}
+	if err := checkKeepAlive(interval, timeout); err != nil {
+		return err
+	}
+	if update.MaxSendRate != nil && *update.MaxSendRate < 0 {
+		return errors.New("max send rate must not be negative")
+	}
+	if update.MaxOpenStreams != nil && *update.MaxOpenStreams < 0 {
+		return errors.New("max open streams must not be negative")
+	}
+	if n := update.MaxStreamReceiveBuffer; n != nil && (*n < 0 || *n > s.config.MaxReceiveBuffer) {
+		return errors.New("max stream receive buffer must not be negative nor exceed max receive buffer")
+	}
+
+	if update.KeepAliveInterval != nil || update.KeepAliveTimeout != nil {
+		s.SetKeepAlive(interval, timeout)
+	}
+	if update.MaxSendRate != nil {
+		s.SetMaxSendRate(*update.MaxSendRate)
+	}
+	if update.MaxOpenStreams != nil {
+		atomic.StoreInt32(&s.openStreamsLimit, int32(*update.MaxOpenStreams))
+	}
+	if update.MaxStreamReceiveBuffer != nil {
+		atomic.StoreInt32(&s.streamReceiveLimit, int32(*update.MaxStreamReceiveBuffer))
+	}
+	s.log(LevelInfo, "config applied")
+	return nil
+}
+
+// maxOpenStreams returns the current Config.MaxOpenStreams
+func (s *Session) maxOpenStreams() int {
+	return int(atomic.LoadInt32(&s.openStreamsLimit))
+}
+
+// maxStreamReceiveBuffer returns the current
+// Config.MaxStreamReceiveBuffer
+func (s *Session) maxStreamReceiveBuffer() int {
+	return int(atomic.LoadInt32(&s.streamReceiveLimit))
+}
@@ -0,0 +1,96 @@
+package smux
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// newReader returns the reader frames are read through from conn
+func (s *Session) newReader(conn io.ReadWriteCloser) io.Reader {
+	if s.config.ReadBufferSize > 0 {
+		return bufio.NewReaderSize(conn, s.config.ReadBufferSize)
+	}
+	return conn
+}
+
+// currentConn returns the connection of the session
+func (s *Session) currentConn() io.ReadWriteCloser {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return s.conn
+}
+
+// ReplaceConn moves the session over to conn, for example once a NAT
+// rebinding or an interface change broke the path of the previous
+// connection. Both ends must call it with their end of the new
+// connection; frames in flight on the previous connection are lost,
+// so it is best done while the streams are idle.
+//
+// A write blocked on the previous connection, which a dead link
+// leaves hanging, is interrupted first and fails with
+// ErrConnReplaced, then writes are held while the connection is
+// swapped. The receive moves over as soon as its read of the previous
+// connection fails: a connection with read and write deadlines is
+// interrupted and left open, so that the peer does not see it fail
+// before it replaced it too, and is for the caller to close
+// afterwards; any other connection is closed. The session key is
+// kept, the key exchange is not run again.
+func (s *Session) ReplaceConn(conn io.ReadWriteCloser) error {
+	if s.IsClosed() {
+		return s.dieError()
+	}
+	s.replaceLock.Lock()
+	defer s.replaceLock.Unlock()
+
+	old := s.currentConn()
+	atomic.StoreInt32(&s.replacing, 1)
+	var closeErr error
+	closed := false
+	if wd, ok := old.(interface{ SetWriteDeadline(time.Time) error }); !ok || wd.SetWriteDeadline(time.Now()) != nil {
+		closeErr, closed = old.Close(), true
+	}
+
+	s.writeLock.Lock()
+	s.connLock.Lock()
+	s.conn = conn
+	s.connGen++
+	s.connLock.Unlock()
+	atomic.StoreInt32(&s.replacing, 0)
+	s.writeLock.Unlock()
+
+	if closed {
+		return closeErr
+	}
+	if rd, ok := old.(interface{ SetReadDeadline(time.Time) error }); ok && rd.SetReadDeadline(time.Now()) == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+// switchReader moves the receive over to the connection set by
+// ReplaceConn, it returns false if there is none. Only the goroutine
+// reading frames calls it.
+func (s *Session) switchReader() bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.readerGen == s.connGen {
+		return false
+	}
+	s.readerGen = s.connGen
+	s.reader = s.newReader(s.conn)
+	s.yamux = yamuxReader{}
+	return true
+}
+
+// nextFrame reads a frame, following the connection replacements
+func (s *Session) nextFrame(buffer []byte) (Frame, error) {
+	for {
+		f, err := s.readFrame(buffer)
+		if err == nil || s.IsClosed() || !s.switchReader() {
+			return f, err
+		}
+		s.log(LevelInfo, "connection replaced")
+	}
+}
@@ -0,0 +1,104 @@
+package smux
+
+import (
+	"sync"
+	"time"
+)
+
+// reasons given to the clients refused by Config.KeyRevoked, along
+// with ResetUnauthorized
+const (
+	keyRevokedMessage       = "key revoked"
+	identityRequiredMessage = "client identity required"
+)
+
+// RevocationList is a set of revoked client identity keys, its
+// Revoked method fits Config.KeyRevoked. The zero value is an empty
+// list.
+type RevocationList struct {
+	mu   sync.RWMutex
+	keys map[[32]byte]struct{}
+}
+
+// Revoke adds the identity key to the list, the sessions of the
+// client are closed at their next check
+func (l *RevocationList) Revoke(key [32]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.keys == nil {
+		l.keys = make(map[[32]byte]struct{})
+	}
+	l.keys[key] = struct{}{}
+}
+
+// Restore removes key from the list
+func (l *RevocationList) Restore(key [32]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+// Revoked reports whether key is on the list
+func (l *RevocationList) Revoked(key [32]byte) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.keys[key]
+	return ok
+}
+
+// revocationChecker checks the identity of the client of an
+// encrypted server against Config.KeyRevoked, from sendLoop
+type revocationChecker struct {
+	ticker *time.Ticker
+}
+
+// channel returns the ticker channel of the checks, nil when keys
+// are not checked
+func (r *revocationChecker) channel(s *Session) <-chan time.Time {
+	if s.client || !s.encrypted || s.config.KeyRevoked == nil {
+		return nil
+	}
+	if r.ticker == nil {
+		r.ticker = time.NewTicker(s.config.RevocationCheckInterval)
+	}
+	return r.ticker.C
+}
+
+func (r *revocationChecker) stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+}
+
+// identityRefused returns why Config.KeyRevoked refuses the client
+// of identity, zero when it presented none, empty when it does not
+func (s *Session) identityRefused(identity [32]byte) string {
+	switch {
+	case s.config.KeyRevoked == nil:
+		return ""
+	case identity == [32]byte{}:
+		return identityRequiredMessage
+	case s.config.KeyRevoked(identity):
+		return keyRevokedMessage
+	}
+	return ""
+}
+
+// checkRevoked closes the session once the identity of its client was
+// revoked
+func (s *Session) checkRevoked() {
+	s.cryptStreamLock.Lock()
+	key, identity := s.peerPublicKey, s.peerIdentity
+	s.cryptStreamLock.Unlock()
+	if key == [32]byte{} {
+		// the identity is not known before the key exchange
+		return
+	}
+	reason := s.identityRefused(identity)
+	if reason == "" {
+		return
+	}
+	s.log(LevelWarn, "client refused, closing the session", "reason", reason)
+	// the BYE is sent by sendLoop, which runs the check
+	go s.CloseWithError(ResetUnauthorized, reason)
+}
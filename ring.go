@@ -0,0 +1,165 @@
+package smux
+
+import (
+	"sync"
+)
+
+// segment is a pooled buffer holding received bytes in buf[off:end]
+type segment struct {
+	buf      []byte
+	off, end int
+}
+
+// segmentRing is the receive queue of a stream, data is kept in
+// pooled fixed size segments on a ring that grows by doubling,
+// so buffered data is never moved and drained segments are reused
+type segmentRing struct {
+	segs  []segment // len is zero or a power of two
+	head  int       // index of the oldest segment
+	count int       // segments in use
+	n     int       // bytes buffered
+	pool  *sync.Pool
+}
+
+func newSegmentRing(pool *sync.Pool) segmentRing {
+	return segmentRing{pool: pool}
+}
+
+// Len returns the number of bytes buffered
+func (r *segmentRing) Len() int {
+	return r.n
+}
+
+// Write appends p, filling the last segment before taking new ones
+func (r *segmentRing) Write(p []byte) {
+	r.n += len(p)
+	if r.count > 0 {
+		tail := &r.segs[(r.head+r.count-1)&(len(r.segs)-1)]
+		n := copy(tail.buf[tail.end:], p)
+		tail.end += n
+		p = p[n:]
+	}
+	for len(p) > 0 {
+		buf := r.pool.Get().([]byte)
+		buf = buf[:cap(buf)]
+		n := copy(buf, p)
+		r.push(segment{buf: buf, end: n})
+		p = p[n:]
+	}
+}
+
+// WriteSegment appends buf, a buffer of the pool, without copying it
+// unless it fits in the room left in the last segment
+func (r *segmentRing) WriteSegment(buf []byte) {
+	if r.count > 0 {
+		tail := &r.segs[(r.head+r.count-1)&(len(r.segs)-1)]
+		if len(buf) <= len(tail.buf)-tail.end {
+			r.Write(buf)
+			r.pool.Put(buf[:0])
+			return
+		}
+	}
+	r.n += len(buf)
+	r.push(segment{buf: buf[:cap(buf)], end: len(buf)})
+}
+
+// WriteRecord appends buf, a buffer of the pool, as a segment of its
+// own, so that ReadRecord keeps it apart from the others
+func (r *segmentRing) WriteRecord(buf []byte) {
+	r.n += len(buf)
+	r.push(segment{buf: buf[:cap(buf)], end: len(buf)})
+}
+
+// Read drains up to len(b) bytes in order, emptied segments
+// go back to the pool
+func (r *segmentRing) Read(b []byte) (n int) {
+	for n < len(b) && r.count > 0 {
+		seg := &r.segs[r.head]
+		m := copy(b[n:], seg.buf[seg.off:seg.end])
+		seg.off += m
+		n += m
+		if seg.off == seg.end {
+			r.pop()
+		}
+	}
+	r.n -= n
+	return n
+}
+
+// Peek copies up to len(b) bytes in order without draining them
+func (r *segmentRing) Peek(b []byte) (n int) {
+	for i := 0; n < len(b) && i < r.count; i++ {
+		seg := &r.segs[(r.head+i)&(len(r.segs)-1)]
+		n += copy(b[n:], seg.buf[seg.off:seg.end])
+	}
+	return n
+}
+
+// ReadRecord drains up to len(b) bytes of the oldest segment only
+func (r *segmentRing) ReadRecord(b []byte) (n int) {
+	if r.count == 0 {
+		return 0
+	}
+	seg := &r.segs[r.head]
+	n = copy(b, seg.buf[seg.off:seg.end])
+	seg.off += n
+	if seg.off == seg.end {
+		r.pop()
+	}
+	r.n -= n
+	return n
+}
+
+// ReadSegment detaches the oldest segment, its buffer is owned by
+// the caller until put back into the pool
+func (r *segmentRing) ReadSegment() (seg segment, ok bool) {
+	if r.count == 0 {
+		return seg, false
+	}
+	seg = r.segs[r.head]
+	r.segs[r.head] = segment{}
+	r.head = (r.head + 1) & (len(r.segs) - 1)
+	r.count--
+	r.n -= seg.end - seg.off
+	return seg, true
+}
+
+// Reset releases all segments and returns the bytes dropped
+func (r *segmentRing) Reset() (n int) {
+	n = r.n
+	for r.count > 0 {
+		r.pop()
+	}
+	r.n = 0
+	return n
+}
+
+func (r *segmentRing) push(seg segment) {
+	if r.count == len(r.segs) {
+		r.grow()
+	}
+	r.segs[(r.head+r.count)&(len(r.segs)-1)] = seg
+	r.count++
+}
+
+func (r *segmentRing) pop() {
+	seg := &r.segs[r.head]
+	r.pool.Put(seg.buf[:0])
+	*seg = segment{}
+	r.head = (r.head + 1) & (len(r.segs) - 1)
+	r.count--
+}
+
+// grow doubles the ring, unwrapping the segments in use
+func (r *segmentRing) grow() {
+	size := 2 * len(r.segs)
+	if size == 0 {
+		size = 4
+	}
+	segs := make([]segment, size)
+	for i := 0; i < r.count; i++ {
+		segs[i] = r.segs[(r.head+i)&(len(r.segs)-1)]
+	}
+	r.segs = segs
+	r.head = 0
+}
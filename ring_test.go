@@ -0,0 +1,108 @@
+package smux
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSegmentRing(t *testing.T) {
+	pool := &sync.Pool{New: func() interface{} { return make([]byte, 16) }}
+	r := newSegmentRing(pool)
+
+	var want bytes.Buffer
+	buf := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		p := make([]byte, rand.Intn(50))
+		rand.Read(p)
+		r.Write(p)
+		want.Write(p)
+
+		n := r.Read(buf[:rand.Intn(len(buf))])
+		if !bytes.Equal(buf[:n], want.Next(n)) {
+			t.Fatal("data mismatch at round", i)
+		}
+		if r.Len() != want.Len() {
+			t.Fatal("length mismatch", r.Len(), want.Len())
+		}
+	}
+	if n := r.Reset(); n != want.Len() {
+		t.Fatal("reset dropped", n, "want", want.Len())
+	}
+	if r.Len() != 0 || r.Read(buf) != 0 {
+		t.Fatal("data left after reset")
+	}
+}
+
+func BenchmarkSegmentRing(b *testing.B) {
+	pool := &sync.Pool{New: func() interface{} { return make([]byte, 4096) }}
+	r := newSegmentRing(pool)
+	frame := make([]byte, 4096)
+	buf := make([]byte, 128)
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Write(frame)
+		for r.Len() > 0 {
+			r.Read(buf)
+		}
+	}
+}
+
+func TestSegmentRingWriteSegment(t *testing.T) {
+	pool := &sync.Pool{New: func() interface{} { return make([]byte, 16) }}
+	r := newSegmentRing(pool)
+
+	seg := pool.Get().([]byte)[:10]
+	copy(seg, "0123456789")
+	r.WriteSegment(seg)
+	if r.count != 1 || &r.segs[r.head].buf[0] != &seg[0] {
+		t.Fatal("segment was copied")
+	}
+	small := pool.Get().([]byte)[:4]
+	copy(small, "abcd")
+	r.WriteSegment(small)
+	if r.count != 1 {
+		t.Fatal("small segment not merged into the tail", r.count)
+	}
+	large := pool.Get().([]byte)[:8]
+	copy(large, "ABCDEFGH")
+	r.WriteSegment(large)
+	if r.count != 2 {
+		t.Fatal("unexpected segment count", r.count)
+	}
+
+	buf := make([]byte, 32)
+	n := r.Read(buf)
+	if string(buf[:n]) != "0123456789abcdABCDEFGH" {
+		t.Fatal("unexpected data", string(buf[:n]))
+	}
+}
+
+func TestSegmentRingRecords(t *testing.T) {
+	pool := &sync.Pool{New: func() interface{} { return make([]byte, 16) }}
+	r := newSegmentRing(pool)
+	for _, rec := range []string{"abc", "defgh", "i"} {
+		seg := pool.Get().([]byte)[:len(rec)]
+		copy(seg, rec)
+		r.WriteRecord(seg)
+	}
+	if r.count != 3 || r.Len() != 9 {
+		t.Fatal("records merged", r.count, r.Len())
+	}
+
+	buf := make([]byte, 4)
+	var got []string
+	for r.Len() > 0 {
+		n := r.ReadRecord(buf)
+		got = append(got, string(buf[:n]))
+	}
+	if strings.Join(got, ",") != "abc,defg,h,i" {
+		t.Fatal("unexpected records", got)
+	}
+	if r.ReadRecord(buf) != 0 || r.count != 0 {
+		t.Fatal("records left")
+	}
+}
@@ -0,0 +1,78 @@
+package smux
+
+import (
+	"sync"
+)
+
+// Handler serves a stream accepted by a Router, the stream is closed
+// once ServeStream returns
+type Handler interface {
+	ServeStream(stream *Stream)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(stream *Stream)
+
+// ServeStream calls f(stream)
+func (f HandlerFunc) ServeStream(stream *Stream) {
+	f(stream)
+}
+
+// Router dispatches the streams of a session to the handler of their
+// service, the name the opener tagged them with through WithProtocol.
+// Streams of a service without handler go to the handler of "",
+// or are reset with ResetRefused when there is none.
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewRouter returns a router without handlers
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler of service, replacing the one
+// registered before. A nil handler removes it.
+func (r *Router) Handle(service string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h == nil {
+		delete(r.handlers, service)
+		return
+	}
+	r.handlers[service] = h
+}
+
+// HandleFunc registers f as the handler of service
+func (r *Router) HandleFunc(service string, f func(stream *Stream)) {
+	r.Handle(service, HandlerFunc(f))
+}
+
+// handler returns the handler of service, nil if none
+func (r *Router) handler(service string) Handler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if h, ok := r.handlers[service]; ok {
+		return h
+	}
+	return r.handlers[""]
+}
+
+// ServeStream hands stream over to the handler of its service and
+// closes it once served
+func (r *Router) ServeStream(stream *Stream) {
+	h := r.handler(stream.Protocol())
+	if h == nil {
+		stream.reset(ResetRefused, "unknown service")
+		return
+	}
+	defer stream.Close()
+	h.ServeStream(stream)
+}
+
+// Serve serves the streams of session with the router, as
+// Session.Serve does
+func (r *Router) Serve(session *Session) error {
+	return session.Serve(r.ServeStream)
+}
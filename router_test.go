@@ -0,0 +1,62 @@
+package smux
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	router := NewRouter()
+	router.HandleFunc("echo", func(stream *Stream) {
+		io.Copy(stream, io.LimitReader(stream, 5))
+	})
+	router.HandleFunc("hello", func(stream *Stream) {
+		stream.Write([]byte("hello"))
+	})
+	served := make(chan error, 1)
+	go func() { served <- router.Serve(server) }()
+
+	open := func(service string) *Stream {
+		t.Helper()
+		stream, err := client.OpenStreamContext(WithProtocol(context.Background(), service))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	echo := open("echo")
+	echo.Write([]byte("howdy"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(echo, buf); err != nil || string(buf) != "howdy" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+	if _, err := echo.Read(buf); err != io.EOF {
+		t.Fatal("stream not closed once served", err)
+	}
+	if _, err := io.ReadFull(open("hello"), buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected greeting %q: %v", buf, err)
+	}
+
+	_, err = open("ftp").Read(buf)
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused {
+		t.Fatal("stream of an unknown service not refused", err)
+	}
+	router.HandleFunc("", func(stream *Stream) {
+		stream.Write([]byte("other"))
+	})
+	if _, err := io.ReadFull(open("ftp"), buf); err != nil || string(buf) != "other" {
+		t.Fatalf("default handler not used %q: %v", buf, err)
+	}
+
+	server.Close()
+	if err := <-served; err == nil {
+		t.Fatal("Serve returned without error")
+	}
+}
@@ -0,0 +1,178 @@
+package smux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrServerClosed is returned by the Serve methods of a StreamServer
+// once Shutdown or Close was called
+var ErrServerClosed = errors.New("stream server closed")
+
+// Serve accepts the streams of the session and runs handler on each
+// in its own goroutine, until the session closes; it returns the
+// error of AcceptStream. A stream is closed once its handler
+// returns. A handler panicking is logged and its stream reset with
+// ResetInternalError, the session goes on serving.
+func (s *Session) Serve(handler func(stream *Stream)) error {
+	for {
+		stream, err := s.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go s.serveStream(stream, handler)
+	}
+}
+
+// serveStream runs the handler of stream, recovering its panics
+func (s *Session) serveStream(stream *Stream, handler func(stream *Stream)) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log(LevelError, "stream handler panicked", "sid", stream.id, "panic", r, "stack", string(debug.Stack()))
+			stream.reset(ResetInternalError, "handler failed")
+			return
+		}
+		stream.Close()
+	}()
+	handler(stream)
+}
+
+// StreamServer serves the streams of many sessions with one handler,
+// like http.Server does for connections: Serve makes a server
+// session of each connection accepted, and Shutdown stops them all
+// gracefully.
+type StreamServer struct {
+	// Handler serves each stream accepted, as in Session.Serve
+	Handler func(stream *Stream)
+
+	// Options configure the sessions of the connections accepted
+	Options []Option
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+}
+
+// Serve accepts the connections of ln and serves a server session on
+// each, until ln fails or the server is shut down. It closes ln.
+func (srv *StreamServer) Serve(ln net.Listener) error {
+	if !srv.track(ln, nil) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrack(ln, nil)
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		session, err := Server(conn, srv.Options...)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		go srv.ServeSession(session)
+	}
+}
+
+// ServeSession serves the streams of session until it closes or the
+// server is shut down
+func (srv *StreamServer) ServeSession(session *Session) error {
+	if !srv.track(nil, session) {
+		session.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrack(nil, session)
+
+	err := session.Serve(srv.Handler)
+	if srv.isClosed() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and shuts down every session
+// as Session.Shutdown does: it waits for their streams to be served
+// until ctx is done, then closes them
+func (srv *StreamServer) Shutdown(ctx context.Context) error {
+	sessions := srv.close()
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		wg.Add(1)
+		go func(session *Session) {
+			defer wg.Done()
+			session.Shutdown(ctx)
+		}(session)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Close stops accepting connections and closes every session at once
+func (srv *StreamServer) Close() error {
+	for _, session := range srv.close() {
+		session.Close()
+	}
+	return nil
+}
+
+// close flags the server closed, closes its listeners and returns
+// its sessions
+func (srv *StreamServer) close() []*Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for session := range srv.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (srv *StreamServer) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// track adds a listener or a session to the server, it returns false
+// once the server is closed
+func (srv *StreamServer) track(ln net.Listener, session *Session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if ln != nil {
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[ln] = struct{}{}
+	}
+	if session != nil {
+		if srv.sessions == nil {
+			srv.sessions = make(map[*Session]struct{})
+		}
+		srv.sessions[session] = struct{}{}
+	}
+	return true
+}
+
+func (srv *StreamServer) untrack(ln net.Listener, session *Session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.listeners, ln)
+	delete(srv.sessions, session)
+}
@@ -0,0 +1,88 @@
+package smux
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionServe(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(func(stream *Stream) {
+			buf := make([]byte, 5)
+			io.ReadFull(stream, buf)
+			if string(buf) == "panic" {
+				panic("boom")
+			}
+			stream.Write(buf)
+		})
+	}()
+
+	stream, _ := client.OpenStream()
+	stream.Write([]byte("panic"))
+	_, err = stream.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetInternalError {
+		t.Fatal("panicking handler did not reset its stream", err)
+	}
+	stream, _ = client.OpenStream()
+	stream.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("session not served after a panic %q: %v", buf, err)
+	}
+	if _, err := stream.Read(buf); err != io.EOF {
+		t.Fatal("stream not closed once served", err)
+	}
+	server.Close()
+	if err := <-served; err != ErrSessionClosed {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestStreamServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &StreamServer{Handler: func(stream *Stream) {
+		close(started)
+		<-release
+	}}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(conn)
+	defer client.Close()
+	stream, _ := client.OpenStream()
+	stream.Write([]byte("x"))
+	<-started
+
+	// shutting down waits for the stream being served
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatal("unexpected error", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatal("shut down before the stream was served", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
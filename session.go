@@ -1,10 +1,11 @@
 package smux
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,7 +14,8 @@ import (
 )
 
 const (
-	defaultAcceptBacklog = 1024
+	defaultCloseTimeout = 5 * time.Second // max wait for the final frame on close
+	sendBatchSize       = 1 << 16         // bytes of queued frames sent in one write
 )
 
 const (
@@ -23,51 +25,146 @@ const (
 	errBadKeyExchange     = "malformed key exchange"
 	errBadKey             = "cannot decrypt the message"
 	errInvalidProtocol    = "invalid protocol version"
+	errInvalidStreamID    = "invalid stream id"
+	errStreamIDInUse      = "stream id already in use"
+	errShuttingDown       = "session is shutting down"
+	errPeerGoingAway      = "peer is going away"
+	errFrameTooLarge      = "frame too large"
+	errBadFrame           = "malformed frame"
+	errNoRecentData       = "no recent data from the peer"
+	errPeekTooLarge       = "peek larger than the receive buffer"
+	errNegativePeek       = "negative peek size"
 )
 
 type writeRequest struct {
 	frame  Frame
+	plain  []byte // stream data before encryption
+	sealed []byte // buffer of xmitPool holding the data once sealed by sendLoop
 	result chan writeResult
 }
 
+// write requests are recycled once their result has been received,
+// so steady-state writes do not allocate
+var writeRequestPool = sync.Pool{
+	New: func() interface{} {
+		return &writeRequest{result: make(chan writeResult, 1)}
+	},
+}
+
+func newWriteRequest(f Frame) *writeRequest {
+	req := writeRequestPool.Get().(*writeRequest)
+	req.frame = f
+	return req
+}
+
+// release returns a request whose result was received to the pool,
+// abandoned requests must not be released
+func (req *writeRequest) release() {
+	req.frame = Frame{}
+	req.plain = nil
+	writeRequestPool.Put(req)
+}
+
 type writeResult struct {
-	n   int
-	err error
+	n       int
+	err     error
+	dropped bool // lost to a FrameFault, the data took no window
 }
 
 // Session defines a multiplexed connection for streams
 type Session struct {
-	conn      io.ReadWriteCloser
+	stats sessionStats // first for the alignment of its atomics
+
+	conn      io.ReadWriteCloser // written under writeLock and connLock
+	reader    io.Reader          // conn, buffered when ReadBufferSize is set
 	writeLock sync.Mutex
+	connLock  sync.Mutex
+	connGen   int // connections set by ReplaceConn, guarded by connLock
+	readerGen int // connGen of reader, only touched by the receive
 
-	config       *Config
-	nextStreamID uint32 // next stream identifier
+	replaceLock sync.Mutex // serializes ReplaceConn
+	replacing   int32      // flag ReplaceConn is interrupting the writes
 
+	config      *Config
+	idAllocator StreamIDAllocator // hands out identifiers for local streams
+
+	// the tokens of the bucket are taken by deliver for the data pushed
+	// to a stream, and given back once by returnTokens as the data
+	// leaves the stream, read or dropped when the stream closes. Data
+	// for streams not in the table is dropped without taking any.
 	bucket     int32      // token bucket
 	bucketCond *sync.Cond // used for waiting for tokens
 
-	streams    map[uint32]*Stream // all streams in this session
-	streamLock sync.Mutex         // locks streams
+	streams streamTable // all streams in this session
 
 	die       chan struct{} // flag session has died
 	dieLock   sync.Mutex
+	closeErr  error // reason of the close, set before die is closed
 	chAccepts chan *Stream
 
-	xmitPool  sync.Pool
-	dataReady int32 // flag data has arrived
+	shutdown       int32         // flag Shutdown was called, SYNs are refused
+	chStopAccept   chan struct{} // closed by StopAccepting
+	stopAcceptOnce sync.Once
+	idViolations   int32         // streams opened by the peer with identifiers it must not use
+	peerMaxSID     uint32        // highest identifier of the SYNs received
+	peerGoingAway  int32         // flag the peer asked for no new streams
+	peerStreams    int32         // streams opened by the peer and still open
+	quota          atomic.Value  // *clientQuota of the client, on servers with Config.Quotas
+	chStreamClosed chan struct{} // notify a stream was removed
+	rstStorm       resetStorm    // spots bursts of RSTs from the peer
+
+	openStreamsLimit   int32 // Config.MaxOpenStreams, changed by ApplyConfig
+	streamReceiveLimit int32 // Config.MaxStreamReceiveBuffer, changed by ApplyConfig
+
+	xmitPool    sync.Pool
+	segmentPool sync.Pool // receive segments of streams
+	dataReady   int32     // flag data has arrived
+
+	keepAliveInterval time.Duration // zero when keep-alive is disabled
+	keepAliveTimeout  time.Duration
+	keepAliveLock     sync.Mutex
+	chKeepAlive       chan struct{} // notify keep-alive settings changed
+	chPong            chan uint32   // pings to answer
+	pings             pingTracker
+
+	sendRate   rateEstimator
+	recvRate   rateEstimator
+	sendLimit  sendLimiter
+	chSendRate chan struct{} // notify the send rate limit changed
+	qos        *qosScheduler // orders the data sent, nil without QoS classes
+
+	interceptLock sync.Mutex
+	interceptors  []Interceptor // wrap the I/O of new streams
+
+	version int32       // protocol version spoken, zero until negotiated
+	yamux   yamuxReader // frames decoded ahead with Config.Yamux
 
 	deadline atomic.Value
 
-	writes chan writeRequest
+	writes chan *writeRequest
 
 	client            bool
 	encrypted         bool
 	chEncryptionReady chan struct{} // flag encryption has been established
 	encryptionReady   int32         // flag encryption has been established
+	encryptionOnce    sync.Once     // closes chEncryptionReady
+	chKeyExchange     chan struct{} // closed to start a lazy key exchange
+	keyExchangeOnce   sync.Once     // closes chKeyExchange
 
 	cryptStreamLock sync.Mutex
-	cryptStream     *cipher.Stream
+	crypt           *frameCipher // set once the cipher suite is known
 	encryptionKey   *[32]byte
+	keyEstablished  time.Time // when crypt was set
+	peerPublicKey   [32]byte  // public key the peer used in the key exchange
+	peerIdentity    [32]byte  // identity key the client proved, on servers
+	kxrSize         int       // size of the KXR payload sent by a client
+
+	cryptoWorkers []chan Frame // decrypt received data when CryptoWorkers is set
+
+	faults *frameFaults // injects Config.FrameFaults, nil without
+
+	handshakeSpan     Span // traces the key exchange when a Tracer is set
+	handshakeSpanOnce sync.Once
 }
 
 func newSession(config *Config, conn io.ReadWriteCloser, encrypted bool, client bool) *Session {
@@ -75,58 +172,130 @@ func newSession(config *Config, conn io.ReadWriteCloser, encrypted bool, client
 	s.die = make(chan struct{})
 	s.conn = conn
 	s.config = config
-	s.streams = make(map[uint32]*Stream)
-	s.chAccepts = make(chan *Stream, defaultAcceptBacklog)
+	s.reader = s.newReader(conn)
+	s.streams.init()
+	s.chAccepts = make(chan *Stream, config.AcceptBacklog)
+	s.chStreamClosed = make(chan struct{}, 1)
+	s.chStopAccept = make(chan struct{})
+	s.openStreamsLimit = int32(config.MaxOpenStreams)
+	s.streamReceiveLimit = int32(config.MaxStreamReceiveBuffer)
+	s.chKeepAlive = make(chan struct{}, 1)
+	s.chPong = make(chan uint32, 1)
+	s.chSendRate = make(chan struct{}, 1)
+	s.sendLimit.setRate(config.MaxSendRate)
+	s.qos = newQoSScheduler(config.QoSClasses)
+	s.interceptors = config.Interceptors
+	s.faults = newFrameFaults(config.FrameFaults)
+	if !config.KeepAliveDisabled {
+		s.keepAliveInterval = config.KeepAliveInterval
+		s.keepAliveTimeout = config.KeepAliveTimeout
+	}
 	s.bucket = int32(config.MaxReceiveBuffer)
 	s.bucketCond = sync.NewCond(&sync.Mutex{})
 	s.xmitPool.New = func() interface{} {
-		return make([]byte, (1<<16)+headerSize)
+		return make([]byte, s.config.MaxFrameSize)
+	}
+	s.segmentPool.New = func() interface{} {
+		return make([]byte, s.config.MaxFrameSize)
 	}
-	s.writes = make(chan writeRequest)
+	s.writes = make(chan *writeRequest)
 	s.encrypted = encrypted
 	s.chEncryptionReady = make(chan struct{})
+	s.chKeyExchange = make(chan struct{})
 	s.client = client
 	atomic.StoreInt32(&s.encryptionReady, 0)
+	if client || config.Version == 1 {
+		// only servers negotiate, following their clients
+		s.version = int32(config.Version)
+	}
 
-	if client {
-		s.nextStreamID = 1
+	if config.StreamIDAllocator != nil {
+		s.idAllocator = config.StreamIDAllocator(client)
 	} else {
-		s.nextStreamID = 2
+		s.idAllocator = newSequentialAllocator(client)
+	}
+	if encrypted && config.CryptoWorkers > 0 {
+		s.startCryptoWorkers(config.CryptoWorkers)
 	}
+	s.startHandshakeSpan()
+	if !encrypted {
+		s.setQuota()
+	}
+	trackSession(s)
 	go s.recvLoop()
 	go s.sendLoop()
-	go s.keepalive()
-	if client && encrypted {
-		go s.exchangeKeys()
-	}
 	return s
 }
 
 // OpenStream is used to create a new stream
 func (s *Session) OpenStream() (*Stream, error) {
+	return s.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext creates a new stream, ctx bounds the time spent
+// sending the SYN and, with a Tracer, carries the trace the stream
+// joins on both ends. The values of WithProtocol and WithPeerInfo
+// are sent to the peer along with the stream.
+func (s *Session) OpenStreamContext(ctx context.Context) (*Stream, error) {
 	if s.IsClosed() {
-		return nil, errors.New(errBrokenPipe)
+		return nil, s.dieError()
 	}
 
-	if !s.requireEncryption() {
-		return nil, errors.New(errEncryptionNotReady)
+	if atomic.LoadInt32(&s.shutdown) == 1 {
+		return nil, errors.New(errShuttingDown)
+	}
+	if atomic.LoadInt32(&s.peerGoingAway) == 1 {
+		return nil, errors.New(errPeerGoingAway)
 	}
 
-	sid := atomic.AddUint32(&s.nextStreamID, 2)
-	stream := newStream(sid, s.config.MaxFrameSize, s)
+	s.startKeyExchange()
+	if err := s.requireEncryption(ctx); err != nil {
+		return nil, err
+	}
 
-	if _, err := s.writeFrame(newFrame(cmdSYN, sid)); err != nil {
-		return nil, errors.Wrap(err, "writeFrame")
+	sid, err := s.idAllocator.NextStreamID()
+	if err != nil {
+		return nil, err
+	}
+	if !s.isLocalID(sid) {
+		return nil, errors.Errorf("%s: %d", errInvalidStreamID, sid)
+	}
+	meta, err := s.authOpen(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	if !s.streams.reserve(s.maxOpenStreams()) {
+		return nil, ErrTooManyStreams
+	}
+	stream := newStream(sid, s.streamFrameSize(), s)
+
+	if !s.streams.insert(stream) {
+		s.streams.release()
+		return nil, errors.Errorf("%s: %d", errStreamIDInUse, sid)
 	}
 
-	s.streamLock.Lock()
-	s.streams[sid] = stream
-	s.streamLock.Unlock()
+	f := newFrame(cmdSYN, sid)
+	f.data = s.traceOpen(ctx, stream, meta)
+	f.data = s.protocolOpen(ctx, stream, f.data)
+	f.data = s.peerOpen(ctx, stream, f.data)
+	if _, err := s.writeFrameTimeout(f, ctx.Done()); err != nil {
+		s.streams.remove(sid)
+		stream.endSpan(err)
+		return nil, errors.Wrap(err, "writeFrame")
+	}
+	s.intercept(stream)
 	return stream, nil
 }
 
+// isLocalID reports whether sid has the parity of streams opened
+// by this side, odd for clients and even for servers
+func (s *Session) isLocalID(sid uint32) bool {
+	return (sid%2 == 1) == s.client
+}
+
 // AcceptStream is used to block until the next available stream
-// is ready to be accepted.
+// is ready to be accepted. Streams refused by Config.AcceptFilters
+// are skipped.
 func (s *Session) AcceptStream() (*Stream, error) {
 	var deadline <-chan time.Time
 	if d, ok := s.deadline.Load().(time.Time); ok && !d.IsZero() {
@@ -135,22 +304,81 @@ func (s *Session) AcceptStream() (*Stream, error) {
 		deadline = timer.C
 	}
 
-	if !s.requireEncryption() {
-		return nil, errors.New(errEncryptionNotReady)
+	if err := s.requireEncryption(context.Background()); err != nil {
+		return nil, err
 	}
 
-	select {
-	case stream := <-s.chAccepts:
-		return stream, nil
-	case <-deadline:
-		return nil, errTimeout
-	case <-s.die:
-		return nil, errors.New(errBrokenPipe)
+	for {
+		select {
+		case stream := <-s.chAccepts:
+			if s.acceptStopped() {
+				stream.reset(ResetRefused, ErrNotAccepting.Error())
+				continue
+			}
+			if s.filterAccept(stream) {
+				return stream, nil
+			}
+		case <-s.chStopAccept:
+			s.refuseBacklog()
+			return nil, ErrNotAccepting
+		case <-deadline:
+			return nil, errTimeout
+		case <-s.die:
+			return nil, s.dieError()
+		}
 	}
 }
 
 // Close is used to close the session and all streams.
 func (s *Session) Close() (err error) {
+	return s.closeWithError(nil)
+}
+
+// CloseWithError closes the session after telling the peer why,
+// the peer's blocked calls return a *SessionError with code and msg.
+func (s *Session) CloseWithError(code uint32, msg string) error {
+	if s.IsClosed() {
+		return errors.New(errBrokenPipe)
+	}
+	if s.upstream() {
+		// stock peers know no close reasons
+		return s.closeWithError(&SessionError{Code: code, Message: msg})
+	}
+	f := newFrame(cmdBYE, 0)
+	f.data = encodeSessionError(code, msg, maxControlSize)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	s.writeFrameTimeout(f, ctx.Done())
+	return s.closeWithError(&SessionError{Code: code, Message: msg})
+}
+
+// Shutdown gracefully closes the session: new streams are refused,
+// the peer is told not to open any, and the session is closed once
+// all existing streams are closed or ctx is done.
+func (s *Session) Shutdown(ctx context.Context) error {
+	if s.IsClosed() {
+		return s.dieError()
+	}
+	if atomic.CompareAndSwapInt32(&s.shutdown, 0, 1) && !s.upstream() {
+		s.writeFrameTimeout(newFrame(cmdGOA, 0), ctx.Done())
+	}
+
+	for s.NumStreams() > 0 {
+		select {
+		case <-s.chStreamClosed:
+		case <-s.die:
+			return s.dieError()
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+	return s.Close()
+}
+
+// closeWithError closes the session, reason is reported to the
+// calls blocked on it instead of a broken pipe
+func (s *Session) closeWithError(reason error) error {
 	s.dieLock.Lock()
 
 	select {
@@ -158,16 +386,36 @@ func (s *Session) Close() (err error) {
 		s.dieLock.Unlock()
 		return errors.New(errBrokenPipe)
 	default:
+		s.closeErr = reason
 		close(s.die)
 		s.dieLock.Unlock()
-		s.streamLock.Lock()
-		for k := range s.streams {
-			s.streams[k].sessionClose()
+		if reason == nil {
+			s.endHandshakeSpan(errors.New(errEncryptionNotReady))
+		} else {
+			s.endHandshakeSpan(reason)
 		}
-		s.streamLock.Unlock()
+		untrackSession(s)
+		s.leaveQuota()
+		s.streams.each(func(stream *Stream) {
+			stream.sessionClose()
+		})
 		s.bucketCond.Signal()
-		return s.conn.Close()
+		return s.currentConn().Close()
+	}
+}
+
+// dieError returns the error for calls failing on a closed session,
+// the reason it closed
+func (s *Session) dieError() error {
+	select {
+	case <-s.die:
+		if s.closeErr != nil {
+			return s.closeErr
+		}
+		return ErrSessionClosed
+	default:
 	}
+	return errors.New(errBrokenPipe)
 }
 
 // IsClosed does a safe check to see if we have shutdown
@@ -180,18 +428,130 @@ func (s *Session) IsClosed() bool {
 	}
 }
 
-func (s *Session) requireEncryption() bool {
-	tickerTimeout := time.NewTicker(s.config.KeyHandshakeTimeout)
-	defer tickerTimeout.Stop()
-	if s.encrypted {
-		select {
-		case <-s.chEncryptionReady:
-			return true
-		case <-tickerTimeout.C:
-			return false
-		}
+// Done returns a channel closed when the session dies, CloseErr
+// then tells why
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// CloseErr returns the error that closed the session, such as a
+// *SessionError from the peer or ErrKeepAliveTimeout, and
+// ErrSessionClosed when Close was called. It is nil while the
+// session is open.
+func (s *Session) CloseErr() error {
+	if !s.IsClosed() {
+		return nil
+	}
+	return s.dieError()
+}
+
+// requireEncryption waits for the key exchange of an encrypted
+// session, for KeyHandshakeTimeout at most or until ctx is done
+func (s *Session) requireEncryption(ctx context.Context) error {
+	if !s.encrypted {
+		return nil
+	}
+	if s.config.LazyKeyExchange && !s.keyExchangeStarted() {
+		// the peer may take its time to start it
+		return s.WaitForHandshake(ctx)
+	}
+	hctx, cancel := context.WithTimeout(ctx, s.config.KeyHandshakeTimeout)
+	defer cancel()
+	err := s.WaitForHandshake(hctx)
+	if err != nil && err == hctx.Err() && ctx.Err() == nil {
+		s.log(LevelWarn, "key exchange timed out", "timeout", s.config.KeyHandshakeTimeout)
+		return errors.New(errEncryptionNotReady)
+	}
+	return err
+}
+
+// startKeyExchange lets a lazy client send its key exchange
+func (s *Session) startKeyExchange() {
+	if s.client && s.encrypted {
+		s.keyExchangeOnce.Do(func() { close(s.chKeyExchange) })
+	}
+}
+
+// keyExchangeStarted reports whether a lazy key exchange started:
+// clients start it, servers see it once the client key is received
+func (s *Session) keyExchangeStarted() bool {
+	if !s.client {
+		return atomic.LoadInt32(&s.encryptionReady) == 1
+	}
+	select {
+	case <-s.chKeyExchange:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForHandshake waits until the key exchange of an encrypted
+// session completed, streams may then be opened and accepted without
+// waiting. It returns ctx.Err() when ctx is done first, and the
+// reason the session closed when it dies first. Unencrypted sessions
+// return nil straight away.
+func (s *Session) WaitForHandshake(ctx context.Context) error {
+	if !s.encrypted {
+		return nil
+	}
+	select {
+	case <-s.chEncryptionReady:
+		return nil
+	default:
+	}
+	select {
+	case <-s.chEncryptionReady:
+		return nil
+	case <-s.die:
+		return s.dieError()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return true
+}
+
+// EncryptionState describes the encryption of a session
+type EncryptionState struct {
+	Enabled           bool      // the session was created with encryption
+	HandshakeComplete bool      // the key exchange finished
+	Cipher            string    // cipher protecting stream data
+	KeyEstablished    time.Time // when the session key was set
+	PeerPublicKey     [32]byte  // key of the peer in the key exchange
+	PeerIdentity      [32]byte  // identity key of the client on servers, zero when it presented none
+	Plaintext         bool      // stream data is not encrypted, negotiated with Config.EncryptionOptional
+}
+
+// KeyAge returns how long the session key has been in use
+func (st EncryptionState) KeyAge() time.Duration {
+	if st.KeyEstablished.IsZero() {
+		return 0
+	}
+	return time.Since(st.KeyEstablished)
+}
+
+// EncryptionState returns a snapshot of the session encryption.
+// The peer public key is the server key on clients, and the key
+// the client sent during the exchange on servers.
+func (s *Session) EncryptionState() EncryptionState {
+	st := EncryptionState{Enabled: s.encrypted}
+	if !s.encrypted {
+		return st
+	}
+	select {
+	case <-s.chEncryptionReady:
+		st.HandshakeComplete = true
+	default:
+	}
+	s.cryptStreamLock.Lock()
+	defer s.cryptStreamLock.Unlock()
+	if s.crypt != nil {
+		st.Cipher = s.crypt.name()
+		st.Plaintext = s.crypt.suite == suitePlaintext
+		st.KeyEstablished = s.keyEstablished
+		st.PeerPublicKey = s.peerPublicKey
+		st.PeerIdentity = s.peerIdentity
+	}
+	return st
 }
 
 // NumStreams returns the number of currently open streams
@@ -199,259 +559,1224 @@ func (s *Session) NumStreams() int {
 	if s.IsClosed() {
 		return 0
 	}
-	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
-	return len(s.streams)
+	return s.streams.len()
+}
+
+// StreamInfo describes a stream in an ActiveStreams snapshot
+type StreamInfo struct {
+	ID       uint32
+	Local    bool // opened by this side of the session
+	Buffered int  // received bytes not read yet
+	Reset    bool // the peer closed the stream
+}
+
+// ActiveStreams returns a snapshot of the currently open streams
+func (s *Session) ActiveStreams() []StreamInfo {
+	var infos []StreamInfo
+	s.streams.each(func(stream *Stream) {
+		infos = append(infos, StreamInfo{
+			ID:       stream.id,
+			Local:    s.isLocalID(stream.id),
+			Buffered: stream.buffered(),
+			Reset:    atomic.LoadInt32(&stream.rstflag) == 1,
+		})
+	})
+	return infos
+}
+
+// ResetStream closes the open stream with identifier sid
+func (s *Session) ResetStream(sid uint32) error {
+	stream, ok := s.streams.get(sid)
+	if !ok {
+		return errors.Errorf("%s: %d", errInvalidStreamID, sid)
+	}
+	return stream.Close()
 }
 
 // SetDeadline sets a deadline used by Accept* calls.
-// A zero time value disables the deadline.
+// A zero time value disables the deadline. With
+// Config.PropagateDeadline it is set on the streams open too.
 func (s *Session) SetDeadline(t time.Time) error {
 	s.deadline.Store(t)
+	if s.config.PropagateDeadline {
+		s.setStreamDeadlines(t)
+	}
+	return nil
+}
+
+// setStreamDeadlines sets the read and write deadlines of the
+// streams open
+func (s *Session) setStreamDeadlines(t time.Time) {
+	s.streams.each(func(stream *Stream) {
+		stream.SetDeadline(t)
+	})
+}
+
+// LocalAddr returns the local network address of the underlying
+// connection, or nil if it has none
+func (s *Session) LocalAddr() net.Addr {
+	if ts, ok := s.currentConn().(interface {
+		LocalAddr() net.Addr
+	}); ok {
+		return ts.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote network address of the underlying
+// connection, or nil if it has none
+func (s *Session) RemoteAddr() net.Addr {
+	if ts, ok := s.currentConn().(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		return ts.RemoteAddr()
+	}
 	return nil
 }
 
 // notify the session that a stream has closed
 func (s *Session) streamClosed(sid uint32) {
-	s.streamLock.Lock()
-	if n := s.streams[sid].recycleTokens(); n > 0 { // return remaining tokens to the bucket
-		if atomic.AddInt32(&s.bucket, int32(n)) > 0 {
-			s.bucketCond.Signal()
+	sh := s.streams.shard(sid)
+	sh.Lock()
+	if stream, ok := sh.streams[sid]; ok {
+		s.returnTokens(stream, stream.recycleTokens())
+		delete(sh.streams, sid)
+		if !s.isLocalID(sid) {
+			atomic.AddInt32(&s.peerStreams, -1)
 		}
+		s.streams.release()
+	}
+	sh.Unlock()
+
+	select {
+	case s.chStreamClosed <- struct{}{}:
+	default:
 	}
-	delete(s.streams, sid)
-	s.streamLock.Unlock()
 }
 
-// returnTokens is called by stream to return token after read
-func (s *Session) returnTokens(n int) {
-	oldvalue := atomic.LoadInt32(&s.bucket)
+// returnTokens gives back the tokens of n bytes leaving the buffer
+// of stream, and wakes recvLoop once the bucket refills
+func (s *Session) returnTokens(stream *Stream, n int) {
+	if n <= 0 {
+		return
+	}
+	if fc := s.config.FlowControl; fc != nil {
+		fc.Release(stream, n)
+	}
 	newvalue := atomic.AddInt32(&s.bucket, int32(n))
-	if oldvalue <= 0 && newvalue > 0 {
+	if newvalue > 0 && newvalue-int32(n) <= 0 {
+		// locked so that the signal cannot slip between the check
+		// of waitTokens and its wait
+		s.bucketCond.L.Lock()
 		s.bucketCond.Signal()
+		s.bucketCond.L.Unlock()
 	}
-
 }
 
 // session read a frame from underlying connection
 // it's data is pointed to the input buffer
 func (s *Session) readFrame(buffer []byte) (f Frame, err error) {
-	if _, err := io.ReadFull(s.conn, buffer[:headerSize]); err != nil {
+	if s.config.Yamux {
+		return s.readYamuxFrame()
+	}
+	if _, err := io.ReadFull(s.reader, buffer[:headerSize]); err != nil {
 		return f, errors.Wrap(err, "readFrame")
 	}
 
 	dec := rawHeader(buffer)
-	if dec.Version() != version {
-		return f, errors.New(errInvalidProtocol)
+	if !s.checkVersion(dec.Version()) {
+		atomic.AddUint64(&s.stats.badVersions, 1)
+		return f, s.protocolViolation(errInvalidProtocol, "version", dec.Version())
 	}
 
 	f.ver = dec.Version()
 	f.cmd = dec.Cmd()
 	f.sid = dec.StreamID()
 	if length := dec.Length(); length > 0 {
-		if _, err := io.ReadFull(s.conn, buffer[headerSize:headerSize+length]); err != nil {
-			return f, errors.Wrap(err, "readFrame")
+		limit := len(buffer) - headerSize
+		if f.cmd == cmdPSH {
+			limit = s.config.MaxFrameSize
 		}
-		f.data = buffer[headerSize : headerSize+length]
-		if s.encrypted && f.cmd == cmdPSH {
-			if err := decrypt(s, f.data, f.data); err != nil {
-				return f, errors.Wrap(err, "readFrame")
-			}
+		if int(length) > limit {
+			atomic.AddUint64(&s.stats.oversizedFrames, 1)
+			return f, s.protocolViolation(errFrameTooLarge,
+				"cmd", f.cmd, "sid", f.sid, "length", length, "limit", limit)
+		}
+		if f.cmd == cmdPSH {
+			// the payload is handed over to the stream
+			f.data = s.segmentPool.Get().([]byte)[:length]
+		} else {
+			f.data = buffer[headerSize : headerSize+length]
+		}
+		if _, err := io.ReadFull(s.reader, f.data); err != nil {
+			return f, errors.Wrap(err, "readFrame")
 		}
 	}
+	s.recvRate.add(headerSize + len(f.data))
 	return f, nil
 }
 
+// maxPayloadSize is the largest payload accepted from the peer
+func (s *Session) maxPayloadSize() int {
+	if s.config.MaxFrameSize < maxControlSize {
+		return maxControlSize
+	}
+	return s.config.MaxFrameSize
+}
+
 // recvLoop keeps on reading from underlying connection if tokens are available
 func (s *Session) recvLoop() {
-	buffer := make([]byte, (1<<16)+headerSize)
-	for {
-		s.bucketCond.L.Lock()
-		for atomic.LoadInt32(&s.bucket) <= 0 && !s.IsClosed() {
-			s.bucketCond.Wait()
-		}
-		s.bucketCond.L.Unlock()
-
-		if s.IsClosed() {
-			return
-		}
-
-		if f, err := s.readFrame(buffer); err == nil {
-			atomic.StoreInt32(&s.dataReady, 1)
-
-			switch f.cmd {
-			case cmdNOP:
-			case cmdSYN:
-				s.streamLock.Lock()
-				if _, ok := s.streams[f.sid]; !ok {
-					stream := newStream(f.sid, s.config.MaxFrameSize, s)
-					s.streams[f.sid] = stream
-					select {
-					case s.chAccepts <- stream:
-					case <-s.die:
-					}
-				}
-				s.streamLock.Unlock()
-			case cmdKXR:
-				// only set key once for the duration of the session
-				if !s.client && atomic.CompareAndSwapInt32(&s.encryptionReady, 0, 1) {
-					key, err := verifyKeyExchange(&s.config.ServerPrivateKey, f.data)
-					if err != nil {
-
-						s.Close()
-						return
-					}
-					s.setEncryptionStream(key)
-					s.writeFrame(newKXSFrame(f.data))
-				}
-			case cmdKXS:
-				// only set key once for the duration of the session
-				if atomic.CompareAndSwapInt32(&s.encryptionReady, 0, 1) {
-					// server accepted the encryption key
-					s.writeFrame(newKXSFrame(f.data))
-					close(s.chEncryptionReady)
-				} else {
-					// client accepted the encryption key
-					close(s.chEncryptionReady)
+	if s.config.PipelinedReceive {
+		frames := make(chan recvResult)
+		go s.readLoop(frames)
+		for {
+			select {
+			case r := <-frames:
+				if r.err != nil {
+					s.readFailed(r.err)
+					return
 				}
-			case cmdRST:
-				s.streamLock.Lock()
-				if stream, ok := s.streams[f.sid]; ok {
-					stream.markRST()
-					stream.notifyReadEvent()
+				if !s.dispatch(r.f) {
+					s.Close()
+					return
 				}
-				s.streamLock.Unlock()
-			case cmdPSH:
-				s.streamLock.Lock()
-				if stream, ok := s.streams[f.sid]; ok {
-					atomic.AddInt32(&s.bucket, -int32(len(f.data)))
-					stream.pushBytes(f.data)
-					stream.notifyReadEvent()
-				}
-				s.streamLock.Unlock()
-			default:
-				s.Close()
+			case <-s.die:
 				return
 			}
-		} else {
+		}
+	}
+
+	buffer := make([]byte, headerSize+s.maxPayloadSize())
+	for s.waitTokens() {
+		f, err := s.nextFrame(buffer)
+		if err != nil {
+			s.readFailed(err)
+			return
+		}
+		if !s.dispatch(f) {
 			s.Close()
 			return
 		}
 	}
 }
 
-func (s *Session) keepalive() {
-	tickerPing := time.NewTicker(s.config.KeepAliveInterval)
-	tickerTimeout := time.NewTicker(s.config.KeepAliveTimeout)
-	defer tickerPing.Stop()
-	defer tickerTimeout.Stop()
-	for {
+// readFailed closes the session with the error stopping recvLoop,
+// reads interrupted by the session closing are not worth an entry
+func (s *Session) readFailed(err error) {
+	if !s.IsClosed() {
+		s.log(LevelDebug, "connection read failed", "err", err)
+		s.closeWithError(&ReadError{Err: err})
+	}
+}
+
+// protocolViolation closes the session with a *ProtocolError and
+// returns it, keyvals detail the violation in the log
+func (s *Session) protocolViolation(reason string, keyvals ...interface{}) error {
+	s.log(LevelWarn, "protocol violation", append([]interface{}{"reason", reason}, keyvals...)...)
+	err := &ProtocolError{Reason: reason}
+	s.closeWithError(err)
+	return err
+}
+
+// keyExchangeFailed closes the session with the error of the key
+// exchange, keyvals detail it in the log
+func (s *Session) keyExchangeFailed(err error, keyvals ...interface{}) {
+	s.log(LevelError, "key exchange failed", append(keyvals, "err", err)...)
+	s.closeWithError(errors.Wrap(err, "key exchange"))
+}
+
+// queueAccept queues a stream opened by the peer for AcceptStream,
+// it returns false when the backlog is full and the policy refuses
+// to wait
+func (s *Session) queueAccept(stream *Stream) bool {
+	if s.config.BacklogPolicy == BacklogBlock {
+		select {
+		case s.chAccepts <- stream:
+		case <-s.die:
+		}
+		return true
+	}
+	select {
+	case s.chAccepts <- stream:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuseAccept applies the backlog policy to a stream that found the
+// accept backlog full
+func (s *Session) refuseAccept(stream *Stream) {
+	if s.config.BacklogPolicy == BacklogDropOldest {
 		select {
-		case <-tickerPing.C:
-			s.writeFrame(newFrame(cmdNOP, 0))
-			s.bucketCond.Signal() // force a signal to the recvLoop
-		case <-tickerTimeout.C:
-			if !atomic.CompareAndSwapInt32(&s.dataReady, 1, 0) {
-				s.Close()
+		case oldest := <-s.chAccepts:
+			s.log(LevelWarn, "accept backlog full", "sid", oldest.id, "dropped", "oldest")
+			oldest.reset(ResetRefused, "accept backlog full")
+			select {
+			case s.chAccepts <- stream:
+				if s.config.Yamux {
+					s.writeFrame(newFrame(cmdACK, stream.id))
+				}
 				return
+			default:
 			}
+		default:
+		}
+	}
+	s.log(LevelWarn, "accept backlog full", "sid", stream.id, "dropped", "new")
+	stream.reset(ResetRefused, "accept backlog full")
+}
+
+// resetStream sends a RST telling the peer why the stream is reset,
+// when the protocol spoken has room for it
+func (s *Session) resetStream(sid uint32, code uint32, msg string) {
+	s.writeFrame(s.resetFrame(sid, code, msg))
+}
+
+// resetFrame returns the RST frame of a stream reset with code and
+// msg, which are left out when the protocol spoken has no room
+func (s *Session) resetFrame(sid uint32, code uint32, msg string) Frame {
+	f := newFrame(cmdRST, sid)
+	if !s.upstream() && !s.config.Yamux {
+		f.data = encodeSessionError(code, msg, maxControlSize)
+	}
+	return f
+}
+
+// idViolation counts a stream opened by the peer with an identifier
+// it must not use, it returns false once MaxIDViolations is reached
+func (s *Session) idViolation(sid uint32) bool {
+	n := atomic.AddInt32(&s.idViolations, 1)
+	s.log(LevelWarn, "stream id violation", "sid", sid, "count", n)
+	if max := s.config.MaxIDViolations; max > 0 && int(n) >= max {
+		s.protocolViolation("stream id violations", "count", n)
+		return false
+	}
+	return true
+}
+
+// recvResult is a frame read ahead by readLoop
+type recvResult struct {
+	f   Frame
+	err error
+}
+
+// readLoop reads frames for recvLoop when the receive is pipelined,
+// the next frame is read into one buffer while the previous one,
+// in the other buffer, is dispatched
+func (s *Session) readLoop(frames chan<- recvResult) {
+	var buffers [2][]byte
+	for k := range buffers {
+		buffers[k] = make([]byte, headerSize+s.maxPayloadSize())
+	}
+	for k := 0; s.waitTokens(); k ^= 1 {
+		f, err := s.nextFrame(buffers[k])
+		select {
+		case frames <- recvResult{f, err}:
 		case <-s.die:
 			return
 		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitTokens blocks until the bucket has tokens, or the FlowControl
+// policy lets the session read, it returns false once the session is
+// closed
+func (s *Session) waitTokens() bool {
+	if fc := s.config.FlowControl; fc != nil {
+		return s.waitFlowControl(fc)
+	}
+	s.bucketCond.L.Lock()
+	if atomic.LoadInt32(&s.bucket) <= 0 {
+		atomic.AddUint64(&s.stats.bucketExhausted, 1)
+	}
+	for atomic.LoadInt32(&s.bucket) <= 0 && !s.IsClosed() {
+		s.bucketCond.Wait()
+	}
+	s.bucketCond.L.Unlock()
+	return !s.IsClosed()
+}
+
+// dispatch handles a frame received, it returns false when the
+// session must stop receiving
+func (s *Session) dispatch(f Frame) bool {
+	if s.injectFault(Inbound, f) {
+		if f.cmd == cmdPSH && len(f.data) > 0 {
+			s.creditDropped(f)
+			s.segmentPool.Put(f.data[:0])
+		}
+		return true
+	}
+	atomic.StoreInt32(&s.dataReady, 1)
+	s.stats.frameReceived(f.cmd)
+	if f.cmd == cmdRST && s.rstStorm.add(time.Now()) {
+		atomic.AddUint64(&s.stats.resetStorms, 1)
+		s.log(LevelWarn, "reset storm", "resets", resetStormThreshold, "window", resetStormWindow)
+	}
+
+	if f.cmd != cmdRST && f.cmd != cmdPSH {
+		// stream frames are tapped once delivered
+		s.tap(Inbound, f, f.data)
+	}
+	if f.cmd == cmdUPD && f.ver == 2 {
+		return s.windowUpdate(f)
+	}
+	if f.cmd == cmdWND && s.config.Yamux {
+		s.windowDelta(f)
+		return true
+	}
+	if f.cmd == cmdFIN && s.config.Yamux {
+		s.halfClose(f)
+		return true
+	}
+	if s.config.UpstreamCompat && f.cmd > cmdNOP {
+		atomic.AddUint64(&s.stats.unknownCommands, 1)
+		s.protocolViolation("command unknown upstream", "cmd", f.cmd, "sid", f.sid)
+		return false
+	}
+
+	switch f.cmd {
+	case cmdNOP:
+		s.handleNOP(f.data)
+	case cmdSYN:
+		if s.encrypted && !s.client && s.config.EncryptionOptional &&
+			atomic.CompareAndSwapInt32(&s.encryptionReady, 0, 1) {
+			// the client opens streams without a key exchange
+			if !s.fallBackToPlaintext("client skipped the key exchange") {
+				return false
+			}
+		}
+		if s.isLocalID(f.sid) {
+			// the peer must not use identifiers of our parity
+			s.resetStream(f.sid, ResetProtocolError, "stream id of the wrong parity")
+			return s.idViolation(f.sid)
+		}
+		// before any refusal, so that the data the peer sent after
+		// the SYN is dropped rather than taken for data before SYN
+		if f.sid > atomic.LoadUint32(&s.peerMaxSID) {
+			atomic.StoreUint32(&s.peerMaxSID, f.sid)
+		}
+		if atomic.LoadInt32(&s.shutdown) == 1 {
+			// no new streams once we are shutting down
+			s.writeFrame(newFrame(cmdRST, f.sid))
+			return true
+		}
+		if s.acceptStopped() {
+			s.resetStream(f.sid, ResetRefused, ErrNotAccepting.Error())
+			return true
+		}
+		if !s.admitStream(f.sid) {
+			return true
+		}
+		sh := s.streams.shard(f.sid)
+		sh.Lock()
+		if stream, ok := sh.streams[f.sid]; !ok {
+			if !s.streams.reserve(s.maxOpenStreams()) {
+				sh.Unlock()
+				s.resetStream(f.sid, ResetRefused, "too many streams")
+				return true
+			}
+			stream := newStream(f.sid, s.streamFrameSize(), s)
+			s.traceAccept(stream, f.data)
+			stream.proto = string(findMeta(f.data, metaProtocol))
+			peerAccept(stream, f.data)
+			s.authAccept(stream, f.data)
+			s.intercept(stream)
+			sh.streams[f.sid] = stream
+			atomic.AddInt32(&s.peerStreams, 1)
+			if stream.proto == DiagnosticProtocol {
+				sh.Unlock()
+				s.acceptDiagnostic(stream)
+				return true
+			}
+			queued := s.queueAccept(stream)
+			sh.Unlock()
+			if !queued {
+				s.refuseAccept(stream)
+			} else if s.config.Yamux {
+				s.writeFrame(newFrame(cmdACK, f.sid))
+			}
+		} else {
+			// reset both ends rather than merge two streams
+			const reason = "duplicate stream id"
+			stream.markRST(&StreamError{Code: ResetProtocolError, Message: reason})
+			stream.notifyReadEvent()
+			sh.Unlock()
+			s.resetStream(f.sid, ResetProtocolError, reason)
+			return s.idViolation(f.sid)
+		}
+	case cmdKXR:
+		if !s.encrypted && !s.client && s.config.EncryptionOptional {
+			s.log(LevelInfo, "declining the key exchange")
+			s.writeFrame(newKXSFrame([]byte{suitePlaintext}))
+			return true
+		}
+		if !s.encrypted || s.client {
+			s.protocolViolation("unexpected key exchange", "cmd", f.cmd)
+			return false
+		}
+		// only set key once for the duration of the session
+		if atomic.CompareAndSwapInt32(&s.encryptionReady, 0, 1) {
+			key, offered, err := verifyKeyExchange(&s.config.ServerPrivateKey, f.data)
+			if err != nil {
+				s.keyExchangeFailed(err)
+				return false
+			}
+			offered, identity, err := parseIdentity(offered, f.data[:32])
+			if err != nil {
+				s.keyExchangeFailed(err)
+				return false
+			}
+			if reason := s.identityRefused(identity); reason != "" {
+				s.log(LevelWarn, "client refused at the key exchange", "reason", reason)
+				s.CloseWithError(ResetUnauthorized, reason)
+				return false
+			}
+			suite := selectSuite(offered)
+			if err := s.setCipher(suite, key, f.data[:32]); err != nil {
+				s.keyExchangeFailed(err, "suite", suite)
+				return false
+			}
+			s.logKey(f.data[:32], suite, key)
+			s.setPeerPublicKey(f.data[:32])
+			s.cryptStreamLock.Lock()
+			s.peerIdentity = identity
+			s.cryptStreamLock.Unlock()
+			s.setQuota()
+			reply := f.data
+			if len(offered) > 0 {
+				// tell the client which suite was chosen
+				reply = append(f.data[:len(f.data):len(f.data)], suite)
+			}
+			s.writeFrame(newKXSFrame(reply))
+		}
+	case cmdKXS:
+		if !s.encrypted || !s.client && atomic.LoadInt32(&s.encryptionReady) == 0 {
+			// a server only gets the echo of its own reply
+			s.protocolViolation("unexpected key exchange", "cmd", f.cmd)
+			return false
+		}
+		// only set key once for the duration of the session
+		if atomic.CompareAndSwapInt32(&s.encryptionReady, 0, 1) {
+			if len(f.data) == 1 && f.data[0] == suitePlaintext && s.config.EncryptionOptional {
+				return s.fallBackToPlaintext("server declined the key exchange")
+			}
+			s.cryptStreamLock.Lock()
+			key, kxrSize := s.encryptionKey, s.kxrSize
+			s.cryptStreamLock.Unlock()
+			if kxrSize == 0 {
+				// a reply to a KXR not sent yet
+				s.protocolViolation("unexpected key exchange", "cmd", f.cmd)
+				return false
+			}
+			// server accepted the encryption key, a server
+			// unaware of suites echoes KXR unchanged
+			if len(f.data) != kxrSize && len(f.data) != kxrSize+1 {
+				s.keyExchangeFailed(errors.New(errBadKeyExchange), "length", len(f.data))
+				return false
+			}
+			suite := suiteAESOFB
+			if len(f.data) == kxrSize+1 {
+				suite = f.data[kxrSize]
+				if bytes.IndexByte(preferredSuites(), suite) < 0 {
+					s.keyExchangeFailed(errors.New("suite not offered"), "suite", suite)
+					return false
+				}
+			}
+			if err := s.setCipher(suite, key, f.data[:32]); err != nil {
+				s.keyExchangeFailed(err, "suite", suite)
+				return false
+			}
+			s.logKey(f.data[:32], suite, key)
+			s.writeFrame(newKXSFrame(f.data))
+			s.markEncryptionReady()
+		} else {
+			// client accepted the encryption key
+			s.markEncryptionReady()
+		}
+	case cmdRST, cmdPSH:
+		if !s.acceptNonce(f) {
+			return false
+		}
+		if s.cryptoWorkers != nil {
+			return s.queueCrypto(f)
+		}
+		return s.deliver(f)
+	case cmdGOA:
+		atomic.StoreInt32(&s.peerGoingAway, 1)
+	case cmdBYE:
+		e := decodeSessionError(f.data)
+		s.log(LevelInfo, "session closed by peer", "code", e.Code, "message", e.Message)
+		s.closeWithError(e)
+		return false
+	default:
+		atomic.AddUint64(&s.stats.unknownCommands, 1)
+		s.protocolViolation("unknown command", "cmd", f.cmd, "sid", f.sid)
+		return false
 	}
+	return true
 }
 
-func (s *Session) exchangeKeys() {
+// deliver hands a RST or PSH frame over to its stream, it returns
+// false when the data cannot be decrypted
+func (s *Session) deliver(f Frame) bool {
+	if f.cmd == cmdRST {
+		s.tap(Inbound, f, f.data)
+		if stream, ok := s.streams.get(f.sid); ok {
+			if stream.span != nil {
+				stream.span.AddEvent("reset by peer")
+			}
+			var reason error
+			if len(f.data) > 0 {
+				se := decodeSessionError(f.data)
+				reason = &StreamError{Code: se.Code, Message: se.Message, Remote: true}
+			}
+			stream.markRST(reason)
+			stream.notifyReadEvent()
+			stream.notifyUpdate()
+		}
+		return true
+	}
+
+	if len(f.data) == 0 {
+		s.tap(Inbound, f, nil)
+		if s.protoVersion() == 2 {
+			// a writer probing the window
+			if stream, ok := s.streams.get(f.sid); ok {
+				stream.answerProbe()
+			}
+		}
+		return true
+	}
+	if s.encrypted {
+		data, err := decrypt(s, f)
+		if err != nil {
+			s.protocolViolation("decryption failed", "sid", f.sid, "err", err)
+			return false
+		}
+		s.tap(Inbound, f, data)
+		f.data = data
+	} else {
+		s.tap(Inbound, f, f.data)
+	}
+	// the shard stays locked so that a concurrent close
+	// recycles the tokens of the pushed bytes
+	sh := s.streams.shard(f.sid)
+	sh.Lock()
+	if stream, ok := sh.streams[f.sid]; ok {
+		if limit := s.streamWindowLimit(); limit > 0 && stream.buffered()+len(f.data) > limit {
+			sh.Unlock()
+			s.segmentPool.Put(f.data[:0])
+			s.protocolViolation("stream window exceeded", "sid", f.sid, "limit", limit)
+			return false
+		}
+		if limit := s.maxStreamReceiveBuffer(); limit > 0 && !s.flowControlled() && stream.buffered()+len(f.data) > limit {
+			// the stream is not read, reset it before it takes
+			// the buffer of the others
+			sh.Unlock()
+			atomic.AddUint64(&s.stats.dataDropped, uint64(len(f.data)))
+			s.segmentPool.Put(f.data[:0])
+			s.log(LevelWarn, "stream receive buffer exceeded", "sid", f.sid, "limit", limit)
+			stream.reset(ResetBufferExceeded, "receive buffer exceeded")
+			return true
+		}
+		if fc := s.config.FlowControl; fc != nil && !fc.Receive(stream, len(f.data)) {
+			sh.Unlock()
+			atomic.AddUint64(&s.stats.dataDropped, uint64(len(f.data)))
+			s.segmentPool.Put(f.data[:0])
+			s.log(LevelDebug, "data refused by flow control", "sid", f.sid)
+			stream.reset(ResetBufferExceeded, "refused by flow control")
+			return true
+		}
+		if s.overBufferQuota(len(f.data)) {
+			sh.Unlock()
+			atomic.AddUint64(&s.stats.dataDropped, uint64(len(f.data)))
+			s.segmentPool.Put(f.data[:0])
+			s.log(LevelWarn, "client buffer quota exceeded", "sid", f.sid)
+			stream.reset(ResetBufferExceeded, "buffer quota exceeded")
+			return true
+		}
+		atomic.AddInt32(&s.bucket, -int32(len(f.data)))
+		stream.pushSegment(f.data)
+		stream.notifyReadEvent()
+	} else if !s.isLocalID(f.sid) && f.sid > atomic.LoadUint32(&s.peerMaxSID) {
+		// the peer sends on a stream it did not open yet, the SYN
+		// always comes first
+		sh.Unlock()
+		atomic.AddUint64(&s.stats.dataDropped, uint64(len(f.data)))
+		s.segmentPool.Put(f.data[:0])
+		s.resetStream(f.sid, ResetProtocolError, "data before SYN")
+		return s.idViolation(f.sid)
+	} else {
+		// the stream is closed, the peer sent before it learned
+		atomic.AddUint64(&s.stats.dataDropped, uint64(len(f.data)))
+		s.segmentPool.Put(f.data[:0])
+	}
+	sh.Unlock()
+	return true
+}
+
+// keepAliveTimers drives keep-alive from sendLoop: a ping is sent
+// every interval, and the pong of the previous one, or any other
+// frame, must have arrived by the next. The ticker is created on
+// demand and is nil while keep-alive is disabled.
+type keepAliveTimers struct {
+	ping    *time.Ticker
+	started bool // the first ping was sent
+	missed  int  // intervals in a row that received nothing
+}
+
+// channel returns the ticker channel for the given interval, nil
+// when keep-alive is disabled
+func (t *keepAliveTimers) channel(interval time.Duration) <-chan time.Time {
+	if interval <= 0 {
+		return nil
+	}
+	if t.ping == nil {
+		t.ping = time.NewTicker(interval)
+	}
+	return t.ping.C
+}
+
+func (t *keepAliveTimers) stop() {
+	if t.ping != nil {
+		t.ping.Stop()
+		t.ping = nil
+	}
+	t.started, t.missed = false, 0
+}
+
+// keepAliveExpired counts a tick of keep-alive, it reports whether
+// too many pings in a row went unanswered
+func (s *Session) keepAliveExpired(t *keepAliveTimers) bool {
+	if atomic.SwapInt32(&s.dataReady, 0) == 1 || !t.started {
+		t.started, t.missed = true, 0
+		s.setMissedPings(0)
+		return false
+	}
+	t.missed++
+	s.setMissedPings(t.missed)
+	return t.missed >= s.maxMissedPings()
+}
+
+// maxMissedPings returns how many pings in a row may go unanswered,
+// by default those the keep-alive timeout leaves a full interval to
+func (s *Session) maxMissedPings() int {
+	if n := s.config.KeepAliveMaxMissed; n > 0 {
+		return n
+	}
+	interval, timeout := s.keepAliveSettings()
+	if n := int(timeout/interval) - 1; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// SetKeepAlive changes the keep-alive interval and timeout of the
+// session, an interval of zero disables keep-alive
+func (s *Session) SetKeepAlive(interval, timeout time.Duration) error {
+	if err := checkKeepAlive(interval, timeout); err != nil {
+		return err
+	}
+	s.keepAliveLock.Lock()
+	s.keepAliveInterval = interval
+	s.keepAliveTimeout = timeout
+	s.keepAliveLock.Unlock()
+
+	select {
+	case s.chKeepAlive <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// checkKeepAlive validates the settings of SetKeepAlive
+func checkKeepAlive(interval, timeout time.Duration) error {
+	if interval < 0 {
+		return errors.New("keep-alive interval must not be negative")
+	}
+	if interval > 0 && timeout <= interval {
+		return errors.New("keep-alive timeout must be larger than keep-alive interval")
+	}
+	return nil
+}
+
+// keepAliveSettings returns the current keep-alive interval and
+// timeout, the interval is zero when keep-alive is disabled
+func (s *Session) keepAliveSettings() (interval, timeout time.Duration) {
+	s.keepAliveLock.Lock()
+	defer s.keepAliveLock.Unlock()
+	return s.keepAliveInterval, s.keepAliveTimeout
+}
+
+// exchangeKeys builds the KXR frame opening the key exchange of a
+// client, it is the first frame sendLoop writes
+func (s *Session) exchangeKeys() (Frame, error) {
 	pubKey, privKey, err := newKeyPair()
 	if err != nil {
-		s.Close()
-		return
+		return Frame{}, err
 	}
 	secret := newSecret(privKey, &s.config.ServerPublicKey)
-	data, err := sealSecret(secret, pubKey)
+	suites := preferredSuites()
+	if identity := s.config.ClientIdentity; identity != nil {
+		suites = appendIdentity(suites, identity, pubKey[:])
+	}
+	data, err := sealSecret(secret, pubKey, suites)
 	if err != nil {
-		s.Close()
-		return
+		return Frame{}, err
 	}
 
-	s.setEncryptionStream(secret)
+	// the cipher is set up once KXS tells the suite
+	s.cryptStreamLock.Lock()
+	s.encryptionKey = secret
+	s.kxrSize = len(data)
+	s.cryptStreamLock.Unlock()
+	s.setPeerPublicKey(s.config.ServerPublicKey[:])
+	return newKXRFrame(data), nil
+}
 
-	s.writeFrame(newKXRFrame(data))
-	s.bucketCond.Signal() // force a signal to the recvLoop
+// setCipher sets up the encryption of stream data
+func (s *Session) setCipher(suite byte, key *[32]byte, kxKey []byte) error {
+	c, err := newFrameCipher(suite, key, kxKey, s.client)
+	if err != nil {
+		return err
+	}
+	s.cryptStreamLock.Lock()
+	defer s.cryptStreamLock.Unlock()
+	s.crypt = c
+	s.encryptionKey = key
+	s.keyEstablished = time.Now()
+	return nil
 }
 
-func (s *Session) setEncryptionStream(key *[32]byte) error {
+// fallBackToPlaintext ends the key exchange of an encrypted session
+// with Config.EncryptionOptional in plaintext, it returns false when
+// the session must stop receiving
+func (s *Session) fallBackToPlaintext(reason string) bool {
+	if !s.client {
+		if refused := s.identityRefused([32]byte{}); refused != "" {
+			s.log(LevelWarn, "client refused without a key exchange", "reason", refused)
+			s.CloseWithError(ResetUnauthorized, refused)
+			return false
+		}
+	}
+	if err := s.setCipher(suitePlaintext, nil, nil); err != nil {
+		s.keyExchangeFailed(err)
+		return false
+	}
+	s.log(LevelWarn, "encryption negotiated away, stream data in plaintext", "reason", reason)
+	s.setQuota()
+	s.markEncryptionReady()
+	return true
+}
+
+// frameCipher returns the cipher of stream data, nil until the key
+// exchange settled it
+func (s *Session) frameCipher() *frameCipher {
 	s.cryptStreamLock.Lock()
 	defer s.cryptStreamLock.Unlock()
-	block, err := aes.NewCipher(key[:])
+	return s.crypt
+}
+
+// streamFrameSize is the largest stream data carried by a frame,
+// leaving room for the cipher overhead within MaxFrameSize, and
+// for the header within TargetSegmentSize
+func (s *Session) streamFrameSize() int {
+	overhead := 0
+	if c := s.frameCipher(); c != nil {
+		overhead = c.overhead()
+	}
+	size := s.config.MaxFrameSize - overhead
+	hdrSize := s.frameHeaderSize()
+	if target := s.config.TargetSegmentSize; target > 0 && target-hdrSize-overhead < size {
+		size = target - hdrSize - overhead
+	}
+	return size
+}
+
+func (s *Session) setPeerPublicKey(key []byte) {
+	s.cryptStreamLock.Lock()
+	copy(s.peerPublicKey[:], key)
+	s.cryptStreamLock.Unlock()
+}
+
+// sendKeyExchange writes the key exchange of a client, buf is reused
+// for the encoding and returned, nil when the exchange failed
+func (s *Session) sendKeyExchange(buf []byte) []byte {
+	f, err := s.exchangeKeys()
 	if err != nil {
-		return err
+		s.keyExchangeFailed(err)
+		return nil
 	}
+	buf = s.writeControl(buf, f)
+	s.bucketCond.Signal() // force a signal to the recvLoop
+	return buf
+}
 
-	// If the key is unique for each ciphertext, then it's ok to use a zero IV.
-	var iv [aes.BlockSize]byte
-	stream := cipher.NewOFB(block, iv[:])
-	s.cryptStream = &stream
-	s.encryptionKey = key
-	return nil
+// markEncryptionReady flags the end of the key exchange
+func (s *Session) markEncryptionReady() {
+	s.encryptionOnce.Do(func() {
+		s.endHandshakeSpan(nil)
+		close(s.chEncryptionReady)
+	})
 }
 
+// sendLoop writes the queued frames and runs keep-alive, an encrypted
+// client starts with the key exchange, or sends it at its first
+// OpenStream with LazyKeyExchange
 func (s *Session) sendLoop() {
-	for {
-		select {
-		case <-s.die:
+	var batch []*writeRequest
+	var buf []byte
+
+	var chKeyExchange <-chan struct{}
+	if s.client && s.encrypted {
+		if s.config.LazyKeyExchange {
+			chKeyExchange = s.chKeyExchange
+		} else if buf = s.sendKeyExchange(buf); buf == nil {
 			return
-		case request, ok := <-s.writes:
-			if !ok {
+		}
+	}
+
+	var keepAlive keepAliveTimers
+	defer keepAlive.stop()
+	var stalls stallDetector
+	defer stalls.stop()
+	chStall := stalls.channel(s.config.StallTimeout)
+	var reaper idleReaper
+	defer reaper.stop()
+	chIdle := reaper.channel(s.config.StreamIdleTimeout)
+	var revocations revocationChecker
+	defer revocations.stop()
+	chRevoke := revocations.channel(s)
+
+	// a packet transport gets writes no larger than its segments
+	hdrSize := s.frameHeaderSize()
+	limit := sendBatchSize
+	if s.config.TargetSegmentSize > 0 {
+		limit = s.config.TargetSegmentSize
+	}
+
+	var next *writeRequest // request left over from the previous batch
+	for {
+		if next != nil {
+			batch = append(batch[:0], next)
+			next = nil
+		} else {
+			interval, _ := s.keepAliveSettings()
+			chPing := keepAlive.channel(interval)
+			select {
+			case <-s.die:
+				return
+			case request := <-s.writes:
+				if !s.sealRequest(request) {
+					continue
+				}
+				batch = append(batch[:0], request)
+			case <-chPing:
+				if s.keepAliveExpired(&keepAlive) {
+					s.log(LevelWarn, "keep-alive timeout", "missed", keepAlive.missed, "interval", interval)
+					s.closeWithError(ErrKeepAliveTimeout)
+					return
+				}
+				if atomic.LoadInt32(&s.version) == 0 {
+					// the version is unknown until the client spoke
+					continue
+				}
+				buf = s.writeControl(buf, s.newPing(nil))
+				s.bucketCond.Signal() // force a signal to the recvLoop
+				continue
+			case seq := <-s.chPong:
+				buf = s.writeControl(buf, newNOPFrame(nopPong, seq))
+				continue
+			case <-chKeyExchange:
+				chKeyExchange = nil
+				if buf = s.sendKeyExchange(buf); buf == nil {
+					return
+				}
+				continue
+			case <-chStall:
+				s.checkStalls(&stalls)
+				continue
+			case <-chIdle:
+				s.reapIdle()
+				continue
+			case <-chRevoke:
+				s.checkRevoked()
 				continue
+			case <-s.chKeepAlive:
+				// restart the ticker with the new settings
+				keepAlive.stop()
+				atomic.StoreInt32(&s.dataReady, 0)
+				continue
+			}
+		}
+
+		// drain the requests already queued into the same write
+		size := hdrSize + len(batch[0].frame.data)
+	DRAIN:
+		for size < limit {
+			select {
+			case request := <-s.writes:
+				if !s.sealRequest(request) {
+					continue
+				}
+				frameLen := hdrSize + len(request.frame.data)
+				if size+frameLen > limit {
+					next = request
+					break DRAIN
+				}
+				batch = append(batch, request)
+				size += frameLen
+			default:
+				break DRAIN
+			}
+		}
+
+		buf = buf[:0]
+		ver := s.protoVersion()
+		if s.faults != nil {
+			if batch = s.injectSendFaults(batch, ver); len(batch) == 0 {
+				continue
+			}
+		}
+		for k := range batch {
+			batch[k].frame.ver = ver
+			buf = s.encodeFrame(buf, batch[k].frame)
+		}
+
+		if !s.throttle(len(buf)) {
+			for k := range batch {
+				s.finish(batch[k], writeResult{err: s.dieError()})
+				batch[k] = nil
 			}
-			buf := s.xmitPool.Get().([]byte)
-			buf[0] = request.frame.ver
-			buf[1] = request.frame.cmd
-			binary.LittleEndian.PutUint16(buf[2:], uint16(len(request.frame.data)))
-			binary.LittleEndian.PutUint32(buf[4:], request.frame.sid)
-			copy(buf[headerSize:], request.frame.data)
-
-			s.writeLock.Lock()
-			n, err := s.conn.Write(buf[:headerSize+len(request.frame.data)])
-			s.writeLock.Unlock()
-			s.xmitPool.Put(buf)
-
-			n -= headerSize
-			if n < 0 {
+			return
+		}
+		n, err := s.writeRaw(buf)
+		s.sendRate.add(n)
+
+		// credit each request with its part of the written bytes
+		for k := range batch {
+			var result writeResult
+			frameLen := hdrSize + len(batch[k].frame.data)
+			if n >= frameLen {
+				result.n = len(batch[k].plain)
+				n -= frameLen
+				s.stats.frameSent(batch[k].frame.cmd)
+				s.tap(Outbound, batch[k].frame, batch[k].plain)
+			} else {
+				// a sealed frame partially sent delivers no data
+				if result.n = n - hdrSize; result.n < 0 || batch[k].sealed != nil {
+					result.n = 0
+				}
 				n = 0
+				if result.err = err; result.err == nil {
+					result.err = io.ErrShortWrite
+				}
 			}
+			s.finish(batch[k], result)
+			batch[k] = nil
+		}
+	}
+}
+
+// sealRequest encrypts the stream data of a request about to be
+// sent, and the auth token of a SYN, here so that the nonces follow
+// the order of the connection. The request fails and false is
+// returned when they cannot be sealed.
+func (s *Session) sealRequest(req *writeRequest) bool {
+	if !s.encrypted {
+		return true
+	}
+	f := &req.frame
+	switch f.cmd {
+	case cmdSYN:
+		s.sealAuthToken(*f)
+	case cmdPSH:
+		c := s.frameCipher()
+		if c == nil {
+			s.finish(req, writeResult{err: errors.New(errNoEncryptionKey)})
+			return false
+		}
+		buf := s.xmitPool.Get().([]byte)
+		if cap(buf) < len(f.data)+c.overhead() {
+			buf = make([]byte, 0, len(f.data)+c.overhead())
+		}
+		sealed, err := c.seal(buf, f.data, f.cmd, f.sid)
+		if err != nil {
+			s.xmitPool.Put(buf[:0])
+			s.finish(req, writeResult{err: err})
+			return false
+		}
+		f.data, req.sealed = sealed, sealed
+	}
+	return true
+}
+
+// finish hands a request its result, the buffer its data was sealed
+// into goes back to the pool first
+func (s *Session) finish(req *writeRequest, result writeResult) {
+	if req.sealed != nil {
+		s.xmitPool.Put(req.sealed[:0])
+		req.sealed = nil
+	}
+	req.result <- result
+}
+
+// acceptNonce checks the nonce of encrypted stream data received
+// follows those accepted before, it returns false when the session
+// must stop receiving
+func (s *Session) acceptNonce(f Frame) bool {
+	if !s.encrypted || f.cmd != cmdPSH || len(f.data) == 0 {
+		return true
+	}
+	c := s.frameCipher()
+	if c == nil {
+		return true // deliver fails on the missing key
+	}
+	if err := c.acceptNonce(f.data); err != nil {
+		s.protocolViolation("decryption failed", "sid", f.sid, "err", err)
+		return false
+	}
+	return true
+}
 
-			result := writeResult{
-				n:   n,
-				err: err,
+// writeControl writes a frame of the session itself straight away,
+// buf is reused for the encoding and returned
+func (s *Session) writeControl(buf []byte, f Frame) []byte {
+	f.ver = s.protoVersion()
+	if s.injectFault(Outbound, f) {
+		return buf
+	}
+	buf = s.encodeFrame(buf[:0], f)
+	if n, err := s.writeRaw(buf); err == nil {
+		s.sendRate.add(n)
+		s.stats.frameSent(f.cmd)
+		s.tap(Outbound, f, f.data)
+	}
+	return buf
+}
+
+// writeRaw writes encoded frames straight to the connection. A write
+// blocked longer than WriteTimeout or failing closes the session, the
+// connection is of no use after either, unless ReplaceConn interrupted
+// it.
+func (s *Session) writeRaw(buf []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if atomic.LoadInt32(&s.replacing) == 1 {
+		return 0, ErrConnReplaced
+	}
+	n, err := s.writeConn(buf)
+	if err != nil && atomic.LoadInt32(&s.replacing) == 1 {
+		return n, ErrConnReplaced
+	}
+	if err != nil && err != ErrPeerStalled {
+		if s.IsClosed() {
+			return n, err // the connection was closed with the session
+		}
+		s.log(LevelWarn, "connection write failed", "err", err)
+		err = &WriteError{Err: err}
+		s.closeWithError(err)
+	}
+	return n, err
+}
+
+// writeConn writes to the connection within WriteTimeout, writeLock
+// must be held
+func (s *Session) writeConn(buf []byte) (int, error) {
+	timeout := s.config.WriteTimeout
+	if timeout <= 0 {
+		return s.writeAll(buf)
+	}
+
+	if conn, ok := s.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err == nil {
+			n, err := s.writeAll(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && atomic.LoadInt32(&s.replacing) == 0 {
+				s.log(LevelWarn, "peer stalled", "timeout", timeout)
+				s.closeWithError(ErrPeerStalled)
+				return n, ErrPeerStalled
 			}
+			return n, err
+		}
+	}
 
-			request.result <- result
-			close(request.result)
+	// closing the connection unblocks the write
+	timer := time.AfterFunc(timeout, func() {
+		s.log(LevelWarn, "peer stalled", "timeout", timeout)
+		s.closeWithError(ErrPeerStalled)
+	})
+	n, err := s.writeAll(buf)
+	if !timer.Stop() {
+		return n, ErrPeerStalled
+	}
+	return n, err
+}
+
+// writeAll writes buf whole to the connection. A short write without
+// an error is followed by the rest, frames cut short would corrupt
+// the framing, and a write making no progress fails with
+// io.ErrShortWrite. writeLock must be held.
+func (s *Session) writeAll(buf []byte) (n int, err error) {
+	for n < len(buf) {
+		m, err := s.conn.Write(buf[n:])
+		if m < 0 || m > len(buf)-n {
+			return n, errors.Errorf("invalid write count %d", m)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
 		}
 	}
+	return n, nil
+}
+
+// appendFrame encodes f at the end of buf
+func appendFrame(buf []byte, f Frame) []byte {
+	var hdr [headerSize]byte
+	hdr[0] = f.ver
+	hdr[1] = f.cmd
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(f.data)))
+	binary.LittleEndian.PutUint32(hdr[4:], f.sid)
+	buf = append(buf, hdr[:]...)
+	return append(buf, f.data...)
 }
 
 // writeFrame writes the frame to the underlying connection
 // and returns the number of bytes written if successful
 func (s *Session) writeFrame(f Frame) (n int, err error) {
-	req := writeRequest{
-		frame:  f,
-		result: make(chan writeResult, 1),
-	}
-	if s.encrypted && req.frame.cmd == cmdPSH {
-		if err := encrypt(s, req.frame.data, req.frame.data); err != nil {
-			return 0, err
-		}
-	}
+	return s.writeFrameTimeout(f, nil)
+}
 
+// writeFrameTimeout is writeFrame giving up once deadline is closed
+func (s *Session) writeFrameTimeout(f Frame, deadline <-chan struct{}) (n int, err error) {
+	req := newWriteRequest(f)
+	req.plain = f.data
+	atomic.AddInt64(&s.stats.sendQueueDepth, 1)
 	select {
 	case <-s.die:
-		return 0, errors.New(errBrokenPipe)
+		atomic.AddInt64(&s.stats.sendQueueDepth, -1)
+		req.release()
+		return 0, s.dieError()
 	case s.writes <- req:
+		atomic.AddInt64(&s.stats.sendQueueDepth, -1)
+	case <-deadline:
+		atomic.AddInt64(&s.stats.sendQueueDepth, -1)
+		req.release()
+		return 0, errTimeout
 	}
 
-	result := <-req.result
-	return result.n, result.err
+	select {
+	case result := <-req.result:
+		req.release()
+		return result.n, result.err
+	case <-deadline:
+		return 0, errTimeout
+	}
 }
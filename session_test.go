@@ -1,19 +1,31 @@
 package smux
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pkg/errors"
 )
 
 func init() {
@@ -619,3 +631,3305 @@ func getSmuxStreamPair() (*Stream, *Stream, error) {
 
 	return cs, ss, nil
 }
+
+func TestSessionAddr(t *testing.T) {
+	cli, err := net.Dial("tcp", "127.0.0.1:19999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _ := Client(cli, nil)
+	defer session.Close()
+	if session.LocalAddr().String() != cli.LocalAddr().String() {
+		t.Fatal("wrong local address", session.LocalAddr())
+	}
+	if session.RemoteAddr().String() != cli.RemoteAddr().String() {
+		t.Fatal("wrong remote address", session.RemoteAddr())
+	}
+
+	var bts buffer
+	session, _ = Client(&bts, nil)
+	defer session.Close()
+	if session.LocalAddr() != nil || session.RemoteAddr() != nil {
+		t.Fatal("address reported for a connection without one")
+	}
+}
+
+func TestStreamAccessors(t *testing.T) {
+	cli, err := net.Dial("tcp", "127.0.0.1:19999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _ := Client(cli, nil)
+	defer session.Close()
+	s1, _ := session.OpenStream()
+	s2, _ := session.OpenStream()
+	if s1.Session() != session || s2.Session() != session {
+		t.Fatal("stream does not report its session")
+	}
+	if s1.ID() == s2.ID() || s1.ID()%2 != 1 || s2.ID()%2 != 1 {
+		t.Fatal("unexpected client stream ids", s1.ID(), s2.ID())
+	}
+}
+
+type fixedAllocator struct {
+	ids []uint32
+}
+
+func (a *fixedAllocator) NextStreamID() (uint32, error) {
+	id := a.ids[0]
+	a.ids = a.ids[1:]
+	return id, nil
+}
+
+func TestStreamIDAllocator(t *testing.T) {
+	cli, err := net.Dial("tcp", "127.0.0.1:19999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := &fixedAllocator{ids: []uint32{101, 101, 102}}
+	session, _ := Client(cli, WithStreamIDAllocator(func(client bool) StreamIDAllocator {
+		return alloc
+	}))
+	defer session.Close()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() != 101 {
+		t.Fatal("allocator not used", stream.ID())
+	}
+	if _, err := session.OpenStream(); err == nil {
+		t.Fatal("opened a stream with an id in use")
+	}
+	if _, err := session.OpenStream(); err == nil {
+		t.Fatal("opened a stream with the peer's parity")
+	}
+}
+
+func TestStreamIDExhaustion(t *testing.T) {
+	for _, client := range []bool{true, false} {
+		a := newSequentialAllocator(client)
+		a.next = math.MaxUint32 - 4
+		if !client {
+			a.next--
+		}
+		var ids []uint32
+		for {
+			id, err := a.NextStreamID()
+			if err == ErrStreamIDExhausted {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) != 2 || ids[1] < ids[0] {
+			t.Fatal("unexpected ids before exhaustion", client, ids)
+		}
+		if _, err := a.NextStreamID(); err != ErrStreamIDExhausted {
+			t.Fatal("exhaustion is not sticky", err)
+		}
+	}
+
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Session().Close()
+	defer ss.Session().Close()
+	cs.Session().idAllocator.(*sequentialAllocator).next = math.MaxUint32
+	if _, err := cs.Session().OpenStream(); err != ErrStreamIDExhausted {
+		t.Fatal("expected exhaustion", err)
+	}
+	// streams already open are not affected
+	cs.Write([]byte("hello"))
+	if _, err := io.ReadFull(ss, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSYNParity(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	session, _ := Server(c2, nil)
+	defer session.Close()
+
+	buf := make([]byte, headerSize)
+	for _, sid := range []uint32{2, 3, 3} {
+		buf[0] = version
+		buf[1] = cmdSYN
+		binary.LittleEndian.PutUint16(buf[2:], 0)
+		binary.LittleEndian.PutUint32(buf[4:], sid)
+		if _, err := c1.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// wrong parity and the duplicate SYN are both answered with a RST
+	// telling the protocol error
+	var resets []uint32
+	for len(resets) < 2 {
+		f, err := readRawFrameCmd(c1, cmdRST)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if se := decodeSessionError(f.data); se.Code != ResetProtocolError {
+			t.Fatal("unexpected reset code", se.Code)
+		}
+		resets = append(resets, f.sid)
+	}
+	if resets[0] != 2 || resets[1] != 3 {
+		t.Fatal("unexpected resets", resets)
+	}
+}
+
+func TestDataBeforeSYN(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	session, _ := Server(c2, nil)
+	defer session.Close()
+
+	// data on a stream never opened is refused, data on a closed
+	// one is dropped
+	c1.Write(appendFrame(nil, newFrame(cmdSYN, 3)))
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	for _, sid := range []uint32{3, 5} {
+		f := newFrame(cmdPSH, sid)
+		f.data = []byte("early")
+		c1.Write(appendFrame(nil, f))
+	}
+	for {
+		f, err := readRawFrameCmd(c1, cmdRST)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.sid == 3 {
+			continue // the close of the accepted stream
+		}
+		if se := decodeSessionError(f.data); f.sid != 5 || se.Code != ResetProtocolError {
+			t.Fatal("unexpected reset", f.sid, se.Code)
+		}
+		break
+	}
+	if session.NumStreams() != 0 {
+		t.Fatal("stream opened by data", session.NumStreams())
+	}
+}
+
+func TestIDViolations(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	session, _ := Server(c2, WithMaxIDViolations(2))
+	defer session.Close()
+
+	c1.Write(appendFrame(nil, newFrame(cmdSYN, 3)))
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the duplicate resets the stream, and reads tell why
+	c1.Write(appendFrame(nil, newFrame(cmdSYN, 3)))
+	_, err = stream.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetProtocolError || se.Remote {
+		t.Fatal("expected a stream error, got", err)
+	}
+	if session.IsClosed() {
+		t.Fatal("session closed before reaching MaxIDViolations")
+	}
+
+	c1.Write(appendFrame(nil, newFrame(cmdSYN, 4)))
+	for !session.IsClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := session.OpenStream(); err == nil {
+		t.Fatal("session open after too many id violations")
+	} else if _, ok := err.(*ProtocolError); !ok {
+		t.Fatal("expected a protocol error, got", err)
+	}
+}
+
+func TestStreamErrorFromPeer(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	session, _ := Server(c2, nil)
+	defer session.Close()
+
+	c1.Write(appendFrame(nil, newFrame(cmdSYN, 1)))
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFrame(cmdPSH, 1)
+	f.data = []byte("data")
+	c1.Write(appendFrame(nil, f))
+	f = newFrame(cmdRST, 1)
+	f.data = encodeSessionError(ResetProtocolError, "bad", maxControlSize)
+	c1.Write(appendFrame(nil, f))
+
+	// the data comes before the reason of the reset
+	data, err := ioutil.ReadAll(stream)
+	if string(data) != "data" {
+		t.Fatal("unexpected data", string(data))
+	}
+	if se, ok := err.(*StreamError); !ok || !se.Remote || se.Message != "bad" {
+		t.Fatal("expected a stream error, got", err)
+	}
+}
+
+func TestStreamCopy(t *testing.T) {
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const N = 1<<20 + 123
+	data := make([]byte, N)
+	io.ReadFull(crand.Reader, data)
+
+	done := make(chan []byte)
+	go func() {
+		var received bytes.Buffer
+		if _, err := io.Copy(&received, ss); err != nil {
+			t.Error(err)
+		}
+		done <- received.Bytes()
+	}()
+
+	// hide bytes.Reader's WriterTo so that io.Copy uses Stream.ReadFrom
+	n, err := io.Copy(cs, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != N {
+		t.Fatal(n, err)
+	}
+	cs.Close()
+	if received := <-done; !bytes.Equal(received, data) {
+		t.Fatal("data mismatch", len(received))
+	}
+}
+
+// readRawFrame reads one frame from a connection not driven by a session
+func readRawFrame(conn io.Reader) (Frame, error) {
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return Frame{}, err
+	}
+	h := rawHeader(buf)
+	f := Frame{ver: h.Version(), cmd: h.Cmd(), sid: h.StreamID()}
+	f.data = make([]byte, h.Length())
+	_, err := io.ReadFull(conn, f.data)
+	return f, err
+}
+
+// readRawFrameCmd skips frames until one with cmd is read
+func readRawFrameCmd(conn io.Reader, cmd byte) (Frame, error) {
+	for {
+		f, err := readRawFrame(conn)
+		if err != nil || f.cmd == cmd {
+			return f, err
+		}
+	}
+}
+
+func TestWriteCoalesce(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	session, _ := Client(c1, WithWriteCoalesce(time.Hour))
+	defer session.Close()
+	stream, _ := session.OpenStream()
+	for _, msg := range []string{"a", "b", "c"} {
+		if n, err := stream.Write([]byte(msg)); n != 1 || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readRawFrameCmd(c2, cmdPSH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.data) != "abc" {
+		t.Fatalf("writes not coalesced into one frame: %q", f.data)
+	}
+
+	session.config.WriteCoalesceDelay = 10 * time.Millisecond
+	stream.Write([]byte("d"))
+	stream.Write([]byte("e"))
+	if f, err = readRawFrameCmd(c2, cmdPSH); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.data) != "de" {
+		t.Fatalf("delayed flush sent %q", f.data)
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	session, _ := Client(c1, WithMaxFrameSize(16))
+	defer session.Close()
+	stream, _ := session.OpenStream()
+
+	large := bytes.Repeat([]byte("x"), 40)
+	v := net.Buffers{[]byte("head "), []byte("er\n"), large, []byte("tail")}
+	if n, err := stream.WriteBuffers(v); n != 52 || err != nil {
+		t.Fatal(n, err)
+	}
+	// the small buffers share frames, the large one fills them
+	var frames []string
+	for _, want := range []string{"head er\nxxxxxxxx", "xxxxxxxxxxxxxxxx", "xxxxxxxxxxxxxxxx", "tail"} {
+		f, err := readRawFrameCmd(c2, cmdPSH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, string(f.data))
+		if string(f.data) != want {
+			t.Fatalf("unexpected frames %q", frames)
+		}
+	}
+
+	if n, err := stream.Writev([]byte("a"), nil, []byte("b")); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	if f, err := readRawFrameCmd(c2, cmdPSH); err != nil || string(f.data) != "ab" {
+		t.Fatal("unexpected frame", err)
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := ss.Read(make([]byte, 10))
+		errCh <- err
+	}()
+	go func() {
+		_, err := ss.Session().AcceptStream()
+		errCh <- err
+	}()
+
+	if err := cs.Session().CloseErr(); err != nil {
+		t.Fatal("open session with a close error", err)
+	}
+	if err := cs.Session().CloseWithError(42, "server restarting"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err := <-errCh
+		se, ok := err.(*SessionError)
+		if !ok {
+			t.Fatal("unexpected error", err)
+		}
+		if se.Code != 42 || se.Message != "server restarting" || !se.Remote {
+			t.Fatal("wrong session error", se)
+		}
+	}
+	<-cs.Session().Done()
+	if err := cs.Session().CloseErr(); err == nil || err.(*SessionError).Remote {
+		t.Fatal("unexpected close error", err)
+	}
+	if err := ss.Session().CloseErr(); err == nil || !err.(*SessionError).Remote {
+		t.Fatal("unexpected peer close error", err)
+	}
+	if _, err := cs.Write([]byte("x")); err == nil {
+		t.Fatal("write on a closed session succeeded")
+	} else if se, ok := err.(*SessionError); !ok || se.Remote {
+		t.Fatal("unexpected local error", err)
+	}
+}
+
+func TestSessionDone(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	select {
+	case <-client.Done():
+		t.Fatal("open session done")
+	default:
+	}
+	server.CloseWithError(ResetUnauthorized, "key revoked")
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session closed by the peer not done")
+	}
+	err = client.CloseErr()
+	if se, ok := err.(*SessionError); !ok || se.Code != ResetUnauthorized || !se.Remote {
+		t.Fatal("unexpected close error", err)
+	}
+	if err := server.CloseErr(); err == nil || err.(*SessionError).Remote {
+		t.Fatal("unexpected local close error", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ss.Session()
+	client := cs.Session()
+
+	done := make(chan error)
+	go func() {
+		done <- server.Shutdown(context.Background())
+	}()
+
+	// existing streams keep working
+	if _, err := cs.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ss, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := client.OpenStream(); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := server.OpenStream(); err == nil {
+		t.Fatal("opened a stream while shutting down")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with open streams")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ss.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !server.IsClosed() {
+		t.Fatal("session still open after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	_, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ss.Session().Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("unexpected error", err)
+	}
+	if !ss.Session().IsClosed() {
+		t.Fatal("session still open after shutdown timeout")
+	}
+}
+
+func TestCloseLinger(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithCloseLinger(5*time.Second))
+	server, _ := Server(c2, WithMaxReceiveBuffer(65536))
+	defer client.Close()
+	defer server.Close()
+
+	cs, _ := client.OpenStream()
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill the receive buffer of the transport so that the write stalls
+	msg := make([]byte, 4<<20)
+	written := make(chan error)
+	go func() {
+		_, err := cs.Write(msg)
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		cs.Close()
+		close(closed)
+	}()
+	n, err := io.Copy(ioutil.Discard, ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(msg)) {
+		t.Fatal("close truncated the data", n)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	<-closed
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	config := DefaultConfig()
+	config.KeepAliveDisabled = true
+	config.KeepAliveInterval = 0
+	session, err := Client(c1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.SetKeepAlive(100*time.Millisecond, 50*time.Millisecond); err == nil {
+		t.Fatal("accepted timeout shorter than interval")
+	}
+
+	<-time.After(300 * time.Millisecond)
+	if session.IsClosed() {
+		t.Fatal("session closed with keep-alive disabled")
+	}
+
+	// the silent peer is detected once keep-alive is turned on
+	if err := session.SetKeepAlive(100*time.Millisecond, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(time.Second)
+	if !session.IsClosed() {
+		t.Fatal("keep-alive enabled at runtime did not time out")
+	}
+}
+
+func TestActiveStreams(t *testing.T) {
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Session().Close()
+	defer ss.Session().Close()
+	cs.Write([]byte("hello"))
+	for ss.buffered() != 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	infos := ss.Session().ActiveStreams()
+	if len(infos) != 1 {
+		t.Fatal("unexpected streams", infos)
+	}
+	if infos[0].ID != ss.ID() || infos[0].Local || infos[0].Buffered != 5 || infos[0].Reset {
+		t.Fatal("unexpected stream info", infos[0])
+	}
+	if infos := cs.Session().ActiveStreams(); len(infos) != 1 || !infos[0].Local {
+		t.Fatal("unexpected client streams", infos)
+	}
+
+	if err := ss.Session().ResetStream(ss.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Session().ResetStream(ss.ID()); err == nil {
+		t.Fatal("reset an unknown stream")
+	}
+	if n := ss.Session().NumStreams(); n != 0 {
+		t.Fatal("stream still open after reset", n)
+	}
+	if _, err := cs.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("peer did not see the reset", err)
+	}
+}
+
+// countingConn counts the writes to the underlying connection,
+// each write takes at least delay
+type countingConn struct {
+	net.Conn
+	writes int32
+	delay  time.Duration
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func TestSendBatching(t *testing.T) {
+	cli, err := net.Dial("tcp", "127.0.0.1:19999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a slow connection lets the writers queue up
+	conn := &countingConn{Conn: cli, delay: time.Millisecond}
+	session, _ := Client(conn, nil)
+	defer session.Close()
+
+	const par, messages = 100, 50
+	var wg sync.WaitGroup
+	wg.Add(par)
+	for i := 0; i < par; i++ {
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(s *Stream) {
+			defer wg.Done()
+			buf := make([]byte, 10)
+			for j := 0; j < messages; j++ {
+				if _, err := s.Write([]byte("ping")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			for nrecv := 0; nrecv < 4*messages; {
+				n, err := s.Read(buf)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				nrecv += n
+			}
+		}(stream)
+	}
+	wg.Wait()
+
+	frames := int32(par + par*messages)
+	if writes := atomic.LoadInt32(&conn.writes); writes >= frames {
+		t.Fatal("frames were not batched", writes, frames)
+	} else {
+		t.Log(writes, "writes for", frames, "frames")
+	}
+}
+
+func TestConcurrentOpenClose(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, nil)
+	server, _ := Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 5)
+			for j := 0; j < rounds; j++ {
+				stream, err := client.OpenStream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				stream.Write([]byte("hello"))
+				if _, err := io.ReadFull(stream, buf); err != nil {
+					t.Error(err)
+					return
+				}
+				stream.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := client.NumStreams(); n != 0 {
+		t.Fatal("streams left open", n, client.ActiveStreams())
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	session, _ := Server(c2, WithMaxFrameSize(1024))
+	defer session.Close()
+
+	frame := make([]byte, headerSize+2048)
+	frame[0] = version
+	frame[1] = cmdSYN
+	binary.LittleEndian.PutUint32(frame[4:], 1)
+	c1.Write(frame[:headerSize])
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame[1] = cmdPSH
+	binary.LittleEndian.PutUint16(frame[2:], 2048)
+	c1.Write(frame)
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("oversized frame accepted")
+	}
+	if !session.IsClosed() {
+		t.Fatal("session not closed on an oversized frame")
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Session().Close()
+	defer ss.Session().Close()
+
+	cs.Write([]byte("hello"))
+	buf, release, err := ss.ReadBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatal("unexpected data", string(buf))
+	}
+	release()
+
+	ss.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := ss.ReadBuffer(); err != errTimeout {
+		t.Fatal("expected timeout", err)
+	}
+	ss.SetReadDeadline(time.Time{})
+
+	cs.Close()
+	if _, _, err := ss.ReadBuffer(); err != io.EOF {
+		t.Fatal("expected EOF", err)
+	}
+}
+
+func TestPipelinedReceive(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithPipelinedReceive())
+	server, _ := Server(c2, WithPipelinedReceive())
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	io.ReadFull(crand.Reader, data)
+	go func() {
+		stream.Write(data)
+	}()
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestSessionGoroutines(t *testing.T) {
+	pub, priv, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	before := runtime.NumGoroutine()
+	client, err := EncryptedClient(c1, WithEncryption(pub, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := EncryptedServer(c2, WithEncryption(pub, priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if n := runtime.NumGoroutine() - before; n > 4 {
+		t.Fatal("sessions run", n, "goroutines, want 2 each")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// the second connection hides SetWriteDeadline
+	for _, deadline := range []bool{true, false} {
+		c1, c2 := net.Pipe()
+		var conn io.ReadWriteCloser = c1
+		if !deadline {
+			conn = struct{ io.ReadWriteCloser }{c1}
+		}
+		session, _ := Client(conn, WithWriteTimeout(50*time.Millisecond))
+
+		// the peer never reads, the SYN blocks
+		start := time.Now()
+		if _, err := session.OpenStream(); errors.Cause(err) != ErrPeerStalled {
+			t.Fatal("expected a stalled peer", deadline, err)
+		}
+		if !session.IsClosed() {
+			t.Fatal("session still open")
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatal("stall detected late", d)
+		}
+		c2.Close()
+	}
+}
+
+// readCountingConn counts the reads from the underlying connection
+type readCountingConn struct {
+	net.Conn
+	reads int32
+}
+
+func (c *readCountingConn) Read(b []byte) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+func TestBufferedConnReads(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	conn := &readCountingConn{Conn: c2}
+	session, _ := Server(conn, WithReadBufferSize(4096))
+	defer session.Close()
+
+	// a SYN followed by many small frames in a single write
+	const frames = 100
+	var buf []byte
+	buf = appendFrame(buf, newFrame(cmdSYN, 1))
+	for i := 0; i < frames; i++ {
+		f := newFrame(cmdPSH, 1)
+		f.data = []byte("0123456789")
+		buf = appendFrame(buf, f)
+	}
+	c1.Write(buf)
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 10*frames)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&conn.reads); n > 10 {
+		t.Fatal("frames were not read in batches", n)
+	}
+}
+
+// maxWriteConn records the largest write to the underlying connection
+type maxWriteConn struct {
+	net.Conn
+	max int32
+}
+
+func (c *maxWriteConn) Write(b []byte) (int, error) {
+	if n := int32(len(b)); n > atomic.LoadInt32(&c.max) {
+		atomic.StoreInt32(&c.max, n)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTargetSegmentSize(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &maxWriteConn{Conn: c1}
+	client, _ := Client(conn, WithTargetSegmentSize(1200))
+	server, _ := Server(c2, nil)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	crand.Read(data)
+	go func() {
+		for i := 0; i < 4; i++ {
+			go stream.Write(data[i*25000 : (i+1)*25000])
+		}
+	}()
+
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ss, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if max := atomic.LoadInt32(&conn.max); max > 1200 {
+		t.Fatal("write larger than the segment size", max)
+	}
+
+	if _, err := Client(c1, WithTargetSegmentSize(50)); err == nil {
+		t.Fatal("accepted a segment size leaving no room for data")
+	}
+}
+
+func TestStats(t *testing.T) {
+	PublishExpvar("smux_test_totals")
+
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Session().Close()
+	cs.Write([]byte("hello"))
+	io.ReadFull(ss, make([]byte, 5))
+	cs.Close()
+	if _, err := ss.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(err)
+	}
+
+	st := cs.Session().Stats()
+	if st.FramesSent < 3 || st.ResetsSent != 1 || st.SendQueueDepth != 0 {
+		t.Fatal("unexpected client stats", st)
+	}
+	if st := ss.Session().Stats(); st.FramesReceived < 3 || st.ResetsReceived != 1 {
+		t.Fatal("unexpected server stats", st)
+	}
+	if st.FramesSentByCmd["SYN"] != 1 || st.FramesSentByCmd["RST"] != 1 || st.FramesSentByCmd["PSH"] < 1 {
+		t.Fatal("unexpected frames by command", st.FramesSentByCmd)
+	}
+
+	var published Stats
+	if err := json.Unmarshal([]byte(cs.Session().Expvar().String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.FramesSent != st.FramesSent {
+		t.Fatal("expvar does not report the session stats", published)
+	}
+
+	cs.Session().Close()
+	var totals Stats
+	if err := json.Unmarshal([]byte(expvar.Get("smux_test_totals").String()), &totals); err != nil {
+		t.Fatal(err)
+	}
+	if totals.FramesSent < st.FramesSent || totals.ResetsReceived < 1 {
+		t.Fatal("totals miss the sessions", totals)
+	}
+}
+
+func TestProtocolAnomalies(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	session, _ := Server(c2, nil)
+	defer session.Close()
+
+	var buf []byte
+	for i := 0; i < resetStormThreshold; i++ {
+		buf = appendFrame(buf, newFrame(cmdRST, 3))
+	}
+	buf = appendFrame(buf, newFrame(0xff, 0))
+	c1.Write(buf)
+	if _, err := session.AcceptStream(); err == nil {
+		t.Fatal("unknown command accepted")
+	}
+	st := session.Stats()
+	if st.ResetStorms != 1 || st.UnknownCommands != 1 || st.FramesReceivedByCmd["RST"] != resetStormThreshold {
+		t.Fatal("unexpected anomalies", st)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	entries := make(chan string, 8)
+	logger := LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		entries <- fmt.Sprint(level, " ", msg, keyvals)
+	})
+	session, _ := Server(c2, WithLogger(logger))
+	defer session.Close()
+
+	frame := make([]byte, headerSize)
+	frame[0] = version
+	frame[1] = 0xff
+	c1.Write(frame)
+
+	select {
+	case entry := <-entries:
+		if !strings.HasPrefix(entry, "warn protocol violation") || !strings.Contains(entry, "unknown command") {
+			t.Fatal("unexpected entry", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol violation not logged")
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+	logger.Log(LevelDebug, "hidden")
+	logger.Log(LevelWarn, "keep-alive timeout", "timeout", time.Second, "odd")
+	if got := buf.String(); got != "smux warn: keep-alive timeout timeout=1s odd=?\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+type traceKey struct{}
+
+// testTracer propagates a trace name and records the spans
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name, trace string
+	events      []string
+	ended       bool
+	err         error
+}
+
+func (s *testSpan) AddEvent(name string, keyvals ...interface{}) { s.events = append(s.events, name) }
+func (s *testSpan) End(err error)                                { s.ended, s.err = true, err }
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	trace, _ := ctx.Value(traceKey{}).(string)
+	span := &testSpan{name: name, trace: trace}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return ctx, span
+}
+
+func (t *testTracer) Inject(ctx context.Context) []byte {
+	trace, _ := ctx.Value(traceKey{}).(string)
+	return []byte(trace)
+}
+
+func (t *testTracer) Extract(ctx context.Context, data []byte) context.Context {
+	return context.WithValue(ctx, traceKey{}, string(data))
+}
+
+func TestTracer(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := &testTracer{}
+	client, _ := Client(c1, WithTracer(tracer))
+	server, _ := Server(c2, WithTracer(tracer))
+	defer client.Close()
+	defer server.Close()
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "request-42")
+	cs, err := client.OpenStreamContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace := ss.TraceContext().Value(traceKey{}); trace != "request-42" {
+		t.Fatal("trace context not propagated", trace)
+	}
+
+	cs.Close()
+	if _, err := ss.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(err)
+	}
+	ss.Close()
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.spans) != 2 {
+		t.Fatal("unexpected spans", len(tracer.spans))
+	}
+	open, accept := tracer.spans[0], tracer.spans[1]
+	if open.name != spanStreamOpen || accept.name != spanStreamAccept || accept.trace != "request-42" {
+		t.Fatal("unexpected spans", open, accept)
+	}
+	if !open.ended || !accept.ended || open.err != nil {
+		t.Fatal("spans not ended", open, accept)
+	}
+	if len(accept.events) != 2 || accept.events[1] != "reset by peer" {
+		t.Fatal("reset not recorded", accept.events)
+	}
+}
+
+func TestKeepAliveStats(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithKeepAlive(20*time.Millisecond, time.Second))
+	server, _ := Server(c2)
+	defer client.Close()
+	defer server.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); len(client.KeepAliveStats().RTTHistory) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("no round trip measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := client.KeepAliveStats()
+	if st.LastPingSent.IsZero() || st.RTTHistory[1] <= 0 || st.RTT <= 0 || st.MaxMissedPings != 49 {
+		t.Fatal("unexpected keep-alive stats", st)
+	}
+	if st := server.KeepAliveStats(); st.LastPingReceived.IsZero() {
+		t.Fatal("pings not recorded", st)
+	}
+
+	// a peer saying nothing misses the pings
+	c1, c2, err = getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	silent, _ := Client(c1, WithKeepAlive(20*time.Millisecond, time.Second))
+	defer silent.Close()
+	for deadline := time.Now().Add(5 * time.Second); silent.KeepAliveStats().MissedPings < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("missed pings not counted", silent.KeepAliveStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepAlivePayload(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 16)
+	client, _ := Client(c1, WithKeepAlive(20*time.Millisecond, time.Second),
+		WithKeepAlivePayload(func() []byte { return []byte("load=0.5") }, nil))
+	server, _ := Server(c2, WithKeepAlivePayload(nil, func(payload []byte) {
+		select {
+		case received <- payload:
+		default:
+		}
+	}))
+	defer client.Close()
+	defer server.Close()
+
+	select {
+	case payload := <-received:
+		if string(payload) != "load=0.5" {
+			t.Fatalf("unexpected payload %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no payload received")
+	}
+	for deadline := time.Now().Add(5 * time.Second); client.RTT() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("pings with a payload not answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRTTAndBandwidth(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithKeepAlive(20*time.Millisecond, time.Second))
+	server, _ := Server(c2)
+	defer client.Close()
+	defer server.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); client.RTT() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no round trip measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s, err := server.AcceptStream()
+		if err == nil {
+			io.Copy(ioutil.Discard, s)
+		}
+	}()
+	if _, err := stream.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if send, _ := client.Bandwidth(); send < 1<<19 {
+		t.Fatal("send bandwidth not estimated", send)
+	}
+	if _, recv := server.Bandwidth(); recv <= 0 {
+		t.Fatal("receive bandwidth not estimated", recv)
+	}
+}
+
+func TestStallDetection(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan StallEvent, 8)
+	client, _ := Client(c1)
+	server, _ := Server(c2, WithMaxReceiveBuffer(64<<10),
+		WithStallDetection(100*time.Millisecond, 1024, func(ev StallEvent) {
+			events <- ev
+		}))
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stream.Write(make([]byte, 128<<10))
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[StallKind]StallEvent)
+	for len(seen) < 2 {
+		select {
+		case ev := <-events:
+			if _, ok := seen[ev.Kind]; ok {
+				t.Fatal("stall reported twice", ev)
+			}
+			seen[ev.Kind] = ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("stalls not reported", seen)
+		}
+	}
+	if ev := seen[StallStream]; ev.StreamID != stream.ID() || ev.Buffered < 1024 || ev.Duration < 100*time.Millisecond {
+		t.Fatal("unexpected stream stall", ev)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithoutKeepAlive())
+	server, _ := Server(c2, WithoutKeepAlive())
+	defer client.Close()
+
+	// idle for longer than the recent data window, a ping is needed
+	time.Sleep(1100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Healthy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if client.RTT() == 0 {
+		t.Fatal("health check did not ping")
+	}
+
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := client.Healthy(ctx); err == nil {
+		t.Fatal("closed peer reported healthy")
+	}
+}
+
+func TestUpstreamCompat(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	client, _ := Client(c1, WithUpstreamCompat(), WithKeepAlive(20*time.Millisecond, time.Second),
+		WithTracer(&testTracer{}))
+	defer client.Close()
+
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	hdr := make([]byte, headerSize)
+	for _, cmd := range []byte{cmdSYN, cmdNOP} {
+		if _, err := io.ReadFull(c2, hdr); err != nil {
+			t.Fatal(err)
+		}
+		if rawHeader(hdr).Cmd() != cmd || rawHeader(hdr).Length() != 0 {
+			t.Fatal("unexpected frame for a stock peer", rawHeader(hdr))
+		}
+	}
+
+	// commands unknown upstream are protocol violations
+	bye := make([]byte, headerSize)
+	bye[0], bye[1] = version, cmdBYE
+	c2.Write(bye)
+	for deadline := time.Now().Add(5 * time.Second); !client.IsClosed(); {
+		if time.Now().After(deadline) {
+			t.Fatal("BYE accepted in upstream compatibility mode")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := Client(c1, WithUpstreamCompat(), WithEncryption(&[32]byte{1}, nil)); err == nil {
+		t.Fatal("encryption accepted in upstream compatibility mode")
+	}
+}
+
+func TestProtocolV2FlowControl(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithProtocolVersion(2), WithMaxStreamBuffer(32<<10))
+	server, _ := Server(c2, WithProtocolVersion(2), WithMaxStreamBuffer(32<<10))
+	defer client.Close()
+	defer server.Close()
+
+	cs, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	crand.Read(data)
+	written := make(chan error, 1)
+	go func() {
+		_, err := cs.Write(data)
+		written <- err
+	}()
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer stops at the window while nothing is read
+	time.Sleep(200 * time.Millisecond)
+	if n := ss.buffered(); n == 0 || n > initialPeerWindow {
+		t.Fatal("window not enforced, buffered", n)
+	}
+	select {
+	case err := <-written:
+		t.Fatal("write completed beyond the window", err)
+	default:
+	}
+
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(ss, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data mismatch")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if server.protoVersion() != 2 {
+		t.Fatal("unexpected version", server.protoVersion())
+	}
+}
+
+func TestProtocolV2Upstream(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	client, _ := Client(c1, WithProtocolVersion(2), WithMaxStreamBuffer(32<<10),
+		WithKeepAlive(20*time.Millisecond, time.Second), WithTracer(&testTracer{}),
+		WithKeepAlivePayload(func() []byte { return []byte("load") }, nil))
+	defer client.Close()
+
+	// c2 is a stock xtaci/smux v2 peer, which reads the body of PSH
+	// and UPD frames only
+	frames := make(chan Frame, 1024)
+	go func() {
+		defer close(frames)
+		for {
+			f, err := readRawFrame(c2)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	send := func(cmd byte, sid uint32, data []byte) {
+		b := make([]byte, headerSize, headerSize+len(data))
+		b[0], b[1] = 2, cmd
+		binary.LittleEndian.PutUint16(b[2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(b[4:], sid)
+		c2.Write(append(b, data...))
+	}
+
+	cs, err := client.OpenStreamContext(WithPeerInfo(WithProtocol(context.Background(), "ssh"),
+		&PeerInfo{IP: net.IPv4(10, 0, 0, 1), Port: 22}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upd := make([]byte, 8)
+	binary.LittleEndian.PutUint32(upd[4:], 256<<10)
+	send(cmdSYN, 2, nil)
+	send(cmdUPD, cs.ID(), upd)
+	send(cmdPSH, 2, []byte("hi"))
+	send(cmdNOP, 0, nil)
+	ss, err := client.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ss, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	cs.Write([]byte("hello"))
+	cs.CloseWithError(ResetProtocolError)
+	time.Sleep(100 * time.Millisecond) // a few keep-alives
+	if client.IsClosed() {
+		t.Fatal("session closed by stock frames", client.CloseErr())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go client.Shutdown(ctx)
+	time.Sleep(20 * time.Millisecond)
+	client.CloseWithError(1, "going down")
+
+	seen := make(map[byte]bool)
+	for f := range frames {
+		seen[f.cmd] = true
+		switch {
+		case f.ver != 2:
+			t.Fatal("unexpected version", f.ver)
+		case f.cmd == cmdPSH:
+		case f.cmd == cmdUPD:
+			if len(f.data) != 8 {
+				t.Fatal("unexpected window update", f.data)
+			}
+		case f.cmd > cmdNOP:
+			t.Fatal("command unknown upstream", f.cmd)
+		case len(f.data) != 0:
+			t.Fatalf("%s frame with a payload %q", cmdName(f.cmd), f.data)
+		}
+	}
+	for _, cmd := range []byte{cmdSYN, cmdPSH, cmdNOP, cmdUPD, cmdRST} {
+		if !seen[cmd] {
+			t.Fatal("no frame sent", cmdName(cmd))
+		}
+	}
+}
+
+func TestProtocolVersionNegotiation(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1)
+	server, _ := Server(c2, WithProtocolVersion(2))
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err == nil {
+			io.Copy(stream, stream)
+		}
+	}()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("hello"))
+	if _, err := io.ReadFull(stream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if server.protoVersion() != 1 {
+		t.Fatal("server did not follow its client", server.protoVersion())
+	}
+
+	if _, err := Client(c1, WithProtocolVersion(3)); err == nil {
+		t.Fatal("unknown protocol version accepted")
+	}
+}
+
+// yamuxConfig returns the configuration of a hashicorp/yamux peer
+func yamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	return config
+}
+
+// readAfterClose reads n bytes from a hashicorp/yamux stream closed
+// on our side: its reads return io.EOF rather than wait for the
+// data still to come
+func readAfterClose(stream *yamux.Stream, n int) ([]byte, error) {
+	var data []byte
+	buf := make([]byte, 32<<10)
+	for deadline := time.Now().Add(5 * time.Second); len(data) < n; {
+		m, err := stream.Read(buf)
+		data = append(data, buf[:m]...)
+		if err == io.EOF && m == 0 {
+			if time.Now().After(deadline) {
+				return data, errTimeout
+			}
+			time.Sleep(time.Millisecond)
+		} else if err != nil && err != io.EOF {
+			return data, err
+		}
+	}
+	return data, nil
+}
+
+func TestYamuxToHashicorp(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, WithYamux())
+	server, err := yamux.Server(c2, yamuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// more than the initial window of a yamux stream
+	data := make([]byte, 1<<20)
+	crand.Read(data)
+	errs := make(chan error, 2)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			errs <- err
+			return
+		}
+		request := make([]byte, len(data))
+		if _, err := io.ReadFull(stream, request); err != nil {
+			errs <- err
+			return
+		}
+		// reply, then half-close the stream: the client may
+		// still write
+		stream.Write(request)
+		stream.Close()
+		rest, err := readAfterClose(stream, 3)
+		if err == nil && string(rest) != "bye" {
+			err = fmt.Errorf("unexpected data after the reply: %q", rest)
+		}
+		errs <- err
+
+		stream, err = server.AcceptStream()
+		if err == nil {
+			_, err = stream.Read(make([]byte, 1))
+		}
+		errs <- err
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stream.Write(data)
+	reply, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, data) {
+		t.Fatal("data mismatch")
+	}
+	if _, err := stream.Write([]byte("bye")); err != nil {
+		t.Fatal("write after the peer half-closed:", err)
+	}
+	stream.Close()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// an error close is a reset for the peer
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseWithError(ResetInternalError)
+	if err := <-errs; err != yamux.ErrConnectionReset {
+		t.Fatal("unexpected error after a reset", err)
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("session closed")
+	}
+}
+
+func TestYamuxFromHashicorp(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := yamux.Client(c1, yamuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := Server(c2, WithYamux())
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			errs <- err
+			return
+		}
+		// the request ends when the client closes its side, the
+		// reply still goes through
+		request, err := ioutil.ReadAll(stream)
+		if err == nil {
+			_, err = stream.Write(request)
+		}
+		stream.Close()
+		errs <- err
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	crand.Read(data)
+	if _, err := stream.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	reply, err := readAfterClose(stream, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, data) {
+		t.Fatal("data mismatch")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("session closed")
+	}
+}
+
+func TestYamuxFraming(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	client, _ := Client(c1, WithYamux())
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("hi"))
+
+	hdr := make([]byte, yamuxHeaderSize)
+	io.ReadFull(c2, hdr)
+	if hdr[1] != yamuxTypeWindowUpdate || binary.BigEndian.Uint16(hdr[2:]) != yamuxFlagSYN ||
+		binary.BigEndian.Uint32(hdr[4:]) != stream.ID() {
+		t.Fatal("unexpected stream open", hdr)
+	}
+	io.ReadFull(c2, hdr)
+	if hdr[1] != yamuxTypeData || binary.BigEndian.Uint32(hdr[8:]) != 2 {
+		t.Fatal("unexpected data frame", hdr)
+	}
+	io.ReadFull(c2, hdr[:2])
+
+	// a ping of the peer is answered with the same value
+	ping := make([]byte, yamuxHeaderSize)
+	ping[1] = yamuxTypePing
+	binary.BigEndian.PutUint16(ping[2:], yamuxFlagSYN)
+	binary.BigEndian.PutUint32(ping[8:], 42)
+	c2.Write(ping)
+	io.ReadFull(c2, hdr)
+	if hdr[1] != yamuxTypePing || binary.BigEndian.Uint16(hdr[2:]) != yamuxFlagACK ||
+		binary.BigEndian.Uint32(hdr[8:]) != 42 {
+		t.Fatal("unexpected ping reply", hdr)
+	}
+}
+
+func TestReplaceConn(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, nil)
+	defer client.Close()
+	server, _ := Server(c2, nil)
+	defer server.Close()
+
+	local, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Write([]byte("ping"))
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("unexpected read", string(buf), err)
+	}
+
+	n1, n2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ReplaceConn(n1); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReplaceConn(n2); err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c2.Close()
+
+	// the streams carry on over the new connection
+	remote.Write([]byte("pong"))
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "pong" {
+		t.Fatal("unexpected read", string(buf), err)
+	}
+	local.Write([]byte("ping"))
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("unexpected read", string(buf), err)
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("session closed by the replacement")
+	}
+	if client.RemoteAddr().String() != n1.RemoteAddr().String() {
+		t.Fatal("unexpected remote address", client.RemoteAddr())
+	}
+
+	client.Close()
+	if err := client.ReplaceConn(c1); err == nil {
+		t.Fatal("replaced the connection of a closed session")
+	}
+}
+
+func TestReplaceConnStalled(t *testing.T) {
+	c1, c2 := NewPipeConn(0)
+	stalled := &stalledConn{Conn: c1, blocked: make(chan struct{}), interrupted: make(chan struct{})}
+	client, _ := Client(stalled, nil)
+	defer client.Close()
+	server, _ := Server(c2, nil)
+	defer server.Close()
+
+	local, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Write([]byte("ping"))
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("unexpected read", string(buf), err)
+	}
+
+	// the link dies with a write blocked on it
+	atomic.StoreInt32(&stalled.stalled, 1)
+	lost := make(chan error, 1)
+	go func() {
+		_, err := local.Write([]byte("lost"))
+		lost <- err
+	}()
+	<-stalled.blocked
+
+	n1, n2 := NewPipeConn(0)
+	replaced := make(chan error, 1)
+	go func() { replaced <- client.ReplaceConn(n1) }()
+	select {
+	case err := <-replaced:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReplaceConn blocked behind the stalled write")
+	}
+	if err := server.ReplaceConn(n2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-lost; err != ErrConnReplaced {
+		t.Fatal("expected ErrConnReplaced, got", err)
+	}
+
+	remote.Write([]byte("pong"))
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "pong" {
+		t.Fatal("unexpected read", string(buf), err)
+	}
+	local.Write([]byte("ping"))
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("unexpected read", string(buf), err)
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("session closed by the replacement")
+	}
+}
+
+// stalledConn blocks the writes made once stalled until a past write
+// deadline interrupts them, as a dead link would
+type stalledConn struct {
+	net.Conn
+	stalled     int32
+	blocked     chan struct{} // closed once a write blocks
+	interrupted chan struct{}
+	blockOnce   sync.Once
+	once        sync.Once
+}
+
+func (c *stalledConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.stalled) == 0 {
+		return c.Conn.Write(b)
+	}
+	c.blockOnce.Do(func() { close(c.blocked) })
+	<-c.interrupted
+	return 0, errTimeout
+}
+
+func (c *stalledConn) SetWriteDeadline(t time.Time) error {
+	if !t.IsZero() && !t.After(time.Now()) {
+		c.once.Do(func() { close(c.interrupted) })
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestListener(t *testing.T) {
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := Client(c1, nil)
+	defer client.Close()
+	server, _ := Server(c2, nil)
+	defer server.Close()
+
+	// any server written against net.Listener runs over the session
+	ln := server.Listen()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return client.DialContext(ctx, addr)
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get("http://smux/world")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello /world" {
+			t.Fatal("unexpected body", string(body))
+		}
+	}
+
+	if ln.Addr().String() != server.LocalAddr().String() {
+		t.Fatal("unexpected listener address", ln.Addr())
+	}
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("accepted on a closed listener")
+	}
+	if server.IsClosed() {
+		t.Fatal("closing the listener closed the session")
+	}
+}
+
+func TestStreamDeadlinePending(t *testing.T) {
+	local, remote, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	defer remote.Close()
+
+	// a deadline set while a read is blocked interrupts it
+	errs := make(chan error, 1)
+	go func() {
+		_, err := local.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	local.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-errs:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatal("expected a timeout, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending read ignored the deadline")
+	}
+
+	// clearing the deadline lets reads wait again
+	local.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := local.Read(make([]byte, 1))
+		errs <- err
+	}()
+	remote.Write([]byte("x"))
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// data written before Close is read before io.EOF
+	remote.Write([]byte("bye"))
+	remote.Close()
+	data, err := ioutil.ReadAll(local)
+	if err != nil || string(data) != "bye" {
+		t.Fatal("unexpected read", string(data), err)
+	}
+}
+
+func TestPeerInfo(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	for _, info := range []*PeerInfo{
+		{IP: net.ParseIP("203.0.113.7"), Port: 51234, ServerName: "app.example.com"},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		nil,
+	} {
+		ctx := context.Background()
+		if info != nil {
+			ctx = WithPeerInfo(ctx, info)
+		}
+		local, err := client.OpenStreamContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := remote.PeerInfo()
+		if info == nil {
+			if got != nil {
+				t.Fatal("unexpected peer info", got)
+			}
+			continue
+		}
+		if got == nil || !got.IP.Equal(info.IP) || got.Port != info.Port || got.ServerName != info.ServerName {
+			t.Fatal("unexpected peer info", got)
+		}
+		if local.PeerInfo() != info {
+			t.Fatal("peer info not kept by the opener")
+		}
+	}
+
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	if info := NewPeerInfo(c2); info.String() != c1.LocalAddr().String() {
+		t.Fatal("unexpected peer info of a connection", info)
+	}
+}
+
+func TestStreamProtocol(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	ctx := WithPeerInfo(context.Background(), &PeerInfo{IP: net.ParseIP("192.0.2.1"), Port: 80})
+	for _, proto := range []string{"http/1.1", "postgres", ""} {
+		local, err := client.OpenStreamContext(WithProtocol(ctx, proto))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local.Protocol() != proto || remote.Protocol() != proto {
+			t.Fatal("unexpected protocol", local.Protocol(), remote.Protocol())
+		}
+		if remote.PeerInfo() == nil || remote.PeerInfo().Port != 80 {
+			t.Fatal("peer info lost along the protocol", remote.PeerInfo())
+		}
+	}
+}
+
+func TestWriteErrorClosesSession(t *testing.T) {
+	c1, c2 := NewPipeConn(0)
+	conn := NewFaultConn(c1, Faults{})
+	client, _ := Client(conn, WithoutKeepAlive())
+	defer client.Close()
+	server, _ := Server(c2, WithoutKeepAlive())
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetFaults(Faults{WriteError: errors.New("link down")})
+	if _, err := stream.Write([]byte("hello")); err == nil {
+		t.Fatal("write succeeded on a broken connection")
+	} else if _, ok := err.(*WriteError); !ok {
+		t.Fatal("expected a *WriteError, got", err)
+	}
+
+	// the session died with the connection
+	if !client.IsClosed() {
+		t.Fatal("session open after a failed write")
+	}
+	_, err = client.OpenStream()
+	if we, ok := err.(*WriteError); !ok || we.Err.Error() != "link down" {
+		t.Fatal("expected the write error, got", err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a stream of a dead session")
+	}
+}
+
+// shortWriteConn writes at most max bytes a call without telling of
+// the rest, as broken writers do
+type shortWriteConn struct {
+	net.Conn
+	max int32
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if max := int(atomic.LoadInt32(&c.max)); len(b) > max {
+		b = b[:max]
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestShortWrites(t *testing.T) {
+	c1, c2 := NewPipeConn(0)
+	conn := &shortWriteConn{Conn: c1, max: 3}
+	client, _ := Client(conn, WithoutKeepAlive())
+	defer client.Close()
+	server, _ := Server(c2, WithoutKeepAlive())
+	defer server.Close()
+
+	// the rest of short writes is written, frames stay whole
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 65536)
+	crand.Read(data)
+	go stream.Write(data)
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(accepted, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data mismatch")
+	}
+
+	// a connection accepting nothing kills the session
+	atomic.StoreInt32(&conn.max, 0)
+	_, err = stream.Write([]byte("hello"))
+	if we, ok := err.(*WriteError); !ok || we.Err != io.ErrShortWrite {
+		t.Fatal("expected a short write error, got", err)
+	}
+	if !client.IsClosed() {
+		t.Fatal("session open after a write made no progress")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	// a data frame larger than MaxFrameSize
+	c1, c2, err := getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	server, _ := Server(c2, WithMaxFrameSize(1024))
+	defer server.Close()
+	f := newFrame(cmdSYN, 1)
+	c1.Write(appendFrame(nil, f))
+	f = newFrame(cmdPSH, 1)
+	f.data = make([]byte, 2048)
+	c1.Write(appendFrame(nil, f))
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	for !server.IsClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = server.OpenStream()
+	if pe, ok := err.(*ProtocolError); !ok || pe.Reason != errFrameTooLarge {
+		t.Fatal("expected a protocol error, got", err)
+	}
+
+	// a version 2 stream going over its window
+	c1, c2, err = getTCPConnectionPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	server, _ = Server(c2, WithProtocolVersion(2))
+	defer server.Close()
+	f = Frame{ver: 2, cmd: cmdSYN, sid: 1}
+	c1.Write(appendFrame(nil, f))
+	f.cmd = cmdPSH
+	f.data = make([]byte, 4096)
+	for k := 0; k <= initialPeerWindow/len(f.data); k++ {
+		if _, err := c1.Write(appendFrame(nil, f)); err != nil {
+			break
+		}
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	for !server.IsClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = server.OpenStream()
+	if pe, ok := err.(*ProtocolError); !ok || pe.Reason != "stream window exceeded" {
+		t.Fatal("expected a protocol error, got", err)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	for _, policy := range []BacklogPolicy{BacklogReset, BacklogDropOldest} {
+		client, server, err := Pipe(0, WithAcceptBacklog(1, policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, _ := client.OpenStream()
+		second, _ := client.OpenStream()
+
+		// one of the streams is refused, the other accepted
+		refused, kept := second, first
+		if policy == BacklogDropOldest {
+			refused, kept = first, second
+		}
+		_, err = refused.Read(make([]byte, 1))
+		if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused || !se.Remote {
+			t.Fatal("expected a refused stream, got", err, "policy", policy)
+		}
+		stream, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.ID() != kept.ID() {
+			t.Fatal("accepted the wrong stream, policy", policy)
+		}
+		if server.NumStreams() != 1 {
+			t.Fatal("refused stream left open", server.NumStreams())
+		}
+		client.Close()
+		server.Close()
+	}
+
+	config := DefaultConfig()
+	config.BacklogPolicy = 7
+	if err := VerifyConfig(config); err == nil {
+		t.Fatal("accepted an unknown backlog policy")
+	}
+}
+
+func TestStopAccepting(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	expectRefused := func(stream *Stream) {
+		t.Helper()
+		_, err := stream.Read(make([]byte, 1))
+		if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused || !se.Remote {
+			t.Fatal("expected a refused stream, got", err)
+		}
+	}
+
+	open, _ := client.OpenStream()
+	open.Write([]byte("x"))
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := client.OpenStream()
+	queued.Write([]byte("x"))
+	for server.NumStreams() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	server.StopAccepting()
+	expectRefused(queued)
+	late, _ := client.OpenStream()
+	expectRefused(late)
+	if _, err := server.AcceptStream(); err != ErrNotAccepting {
+		t.Fatal("expected ErrNotAccepting, got", err)
+	}
+
+	// the open streams and OpenStream keep working
+	buf := make([]byte, 2)
+	accepted.Write([]byte("ok"))
+	if _, err := io.ReadFull(open, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("open stream broken %q: %v", buf, err)
+	}
+	if _, err := server.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopAcceptingDataInFlight(t *testing.T) {
+	client, server, err := Pipe(0, WithMaxIDViolations(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// the data sent right behind refused SYNs is not data before SYN
+	server.StopAccepting()
+	for i := 0; i < 4; i++ {
+		stream, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write([]byte("in flight"))
+		_, err = stream.Read(make([]byte, 1))
+		if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused {
+			t.Fatal("expected a refused stream, got", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Healthy(ctx); err != nil || server.IsClosed() {
+		t.Fatal("session closed for the data of refused streams", err, server.CloseErr())
+	}
+}
+
+func TestAcceptFilters(t *testing.T) {
+	var filtered []string
+	client, server, err := Pipe(0, WithAcceptFilters(
+		func(stream *Stream) error {
+			filtered = append(filtered, stream.Protocol())
+			if stream.Protocol() == "denied" {
+				return errors.New("denied")
+			}
+			return nil
+		},
+		func(stream *Stream) error {
+			if stream.Protocol() == "secret" {
+				return &StreamError{Code: 42, Message: "unauthorized"}
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	open := func(proto string) *Stream {
+		stream, err := client.OpenStreamContext(WithProtocol(context.Background(), proto))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	denied, secret, allowed := open("denied"), open("secret"), open("allowed")
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() != allowed.ID() {
+		t.Fatal("accepted a refused stream")
+	}
+	if len(filtered) != 3 {
+		t.Fatal("unexpected streams filtered", filtered)
+	}
+	_, err = denied.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused || se.Message != "denied" {
+		t.Fatal("expected a refused stream, got", err)
+	}
+	_, err = secret.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != 42 || se.Message != "unauthorized" {
+		t.Fatal("expected the code of the filter, got", err)
+	}
+
+	// so does a listener
+	open("denied")
+	allowed = open("allowed")
+	conn, err := server.Listen().Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.(*Stream).ID() != allowed.ID() {
+		t.Fatal("listener accepted a refused stream")
+	}
+	if server.NumStreams() != 2 {
+		t.Fatal("refused streams left open", server.NumStreams())
+	}
+
+	if _, err := Server(nil, WithAcceptFilters(nil)); err == nil {
+		t.Fatal("accepted a nil filter")
+	}
+}
+
+func TestStreamAuthenticator(t *testing.T) {
+	var tokens []string
+	c1, c2 := NewPipeConn(0)
+	wire := &recordingConn{Conn: c1}
+	client, err := EncryptedClient(wire, WithEncryption(testServerPubKey, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey), WithStreamAuthenticator(func(stream *Stream, token []byte) error {
+		tokens = append(tokens, string(token))
+		if string(token) != "secret" {
+			return errors.New("bad token")
+		}
+		return nil
+	}), WithAcceptFilters(func(stream *Stream) error {
+		if stream.authToken != nil {
+			return errors.New("token kept past the check")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	bad, err := client.OpenStreamContext(WithAuthToken(context.Background(), []byte("guess")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, _ := client.OpenStream()
+	ctx := WithProtocol(WithAuthToken(context.Background(), []byte("secret")), "http/1.1")
+	good, err := client.OpenStreamContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() != good.ID() || stream.Protocol() != "http/1.1" {
+		t.Fatal("accepted the wrong stream")
+	}
+	if strings.Join(tokens, ",") != "guess,,secret" {
+		t.Fatal("unexpected tokens checked", tokens)
+	}
+	for _, refused := range []*Stream{bad, none} {
+		_, err = refused.Read(make([]byte, 1))
+		if se, ok := err.(*StreamError); !ok || se.Code != ResetUnauthorized || se.Message != "unauthorized" {
+			t.Fatal("expected an unauthorized stream, got", err)
+		}
+	}
+
+	// tokens are sealed on encrypted sessions, never in the clear
+	if wire.contains([]byte("secret")) || wire.contains([]byte("guess")) {
+		t.Fatal("auth token sent in the clear")
+	}
+	if _, err := client.OpenStreamContext(WithAuthToken(context.Background(), make([]byte, 228))); err != ErrAuthTokenTooLarge {
+		t.Fatal("expected ErrAuthTokenTooLarge, got", err)
+	}
+
+	// a sealed token seen on the wire opens nothing once replayed,
+	// even in the SYN of the stream it was sealed for
+	good.Close()
+	stream.Close()
+	for server.NumStreams() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	wire.mu.Lock()
+	captured := bytes.NewReader(append([]byte{}, wire.written...))
+	wire.mu.Unlock()
+	syn, err := readRawFrameCmd(captured, cmdSYN)
+	for err == nil && syn.sid != good.ID() {
+		syn, err = readRawFrameCmd(captured, cmdSYN)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c1.Write(appendFrame(nil, syn)); err != nil {
+		t.Fatal(err)
+	}
+	server.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := server.AcceptStream(); err != errTimeout {
+		t.Fatal("replayed stream accepted", err)
+	}
+	if strings.Join(tokens, ",") != "guess,,secret," {
+		t.Fatal("replayed token opened", tokens)
+	}
+
+	plain, plainServer, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	defer plainServer.Close()
+	if _, err := plain.OpenStreamContext(WithAuthToken(context.Background(), []byte("secret"))); err != ErrAuthTokenInsecure {
+		t.Fatal("expected ErrAuthTokenInsecure, got", err)
+	}
+}
+
+// recordingConn keeps a copy of the data written to the connection
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written []byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written = append(c.written, b...)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// contains reports whether b was written to the connection
+func (c *recordingConn) contains(b []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Contains(c.written, b)
+}
+
+func TestApplyConfig(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	interval, timeout := 20*time.Millisecond, time.Second
+	maxStreams, rate := 1, int64(1<<20)
+	err = client.ApplyConfig(ConfigUpdate{
+		KeepAliveInterval: &interval,
+		KeepAliveTimeout:  &timeout,
+		MaxOpenStreams:    &maxStreams,
+		MaxSendRate:       &rate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, to := client.keepAliveSettings(); i != interval || to != timeout {
+		t.Fatal("keep-alive not applied", i, to)
+	}
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.OpenStream(); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams, got", err)
+	}
+
+	// an invalid update changes nothing
+	negative, big := -1, 1<<30
+	if err := client.ApplyConfig(ConfigUpdate{MaxOpenStreams: &negative}); err == nil {
+		t.Fatal("negative max open streams applied")
+	}
+	if err := client.ApplyConfig(ConfigUpdate{KeepAliveTimeout: &interval, MaxStreamReceiveBuffer: &big}); err == nil {
+		t.Fatal("invalid update applied")
+	}
+	if client.maxOpenStreams() != 1 || client.maxStreamReceiveBuffer() != 0 {
+		t.Fatal("invalid update partly applied")
+	}
+	if _, to := client.keepAliveSettings(); to != timeout {
+		t.Fatal("invalid keep-alive applied", to)
+	}
+}
+
+func TestMaxOpenStreams(t *testing.T) {
+	c, s := NewPipeConn(0)
+	client, err := Client(c, WithMaxOpenStreams(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := Server(s, WithMaxOpenStreams(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	first, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.OpenStream(); err != ErrTooManyStreams {
+		t.Fatal("expected ErrTooManyStreams, got", err)
+	}
+
+	// the server only takes one of the streams
+	_, err = second.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetRefused || !se.Remote {
+		t.Fatal("expected a refused stream, got", err)
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() != first.ID() {
+		t.Fatal("accepted the wrong stream")
+	}
+
+	// closed streams make room for new ones
+	second.Close()
+	third, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Close()
+
+	config := DefaultConfig()
+	config.MaxOpenStreams = -1
+	if err := VerifyConfig(config); err == nil {
+		t.Fatal("accepted a negative stream limit")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	expectRefused := func(stream *Stream, code uint32) {
+		t.Helper()
+		_, err := stream.Read(make([]byte, 1))
+		if se, ok := err.(*StreamError); !ok || se.Code != code || !se.Remote {
+			t.Fatal("expected a reset stream, got", err)
+		}
+	}
+	quota := Quota{MaxStreams: 1}
+	quotas := &Quotas{Quota: func(session *Session) Quota { return quota }}
+	client, server, err := Pipe(0, WithQuotas(quotas))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := client.OpenStream()
+	second, _ := client.OpenStream()
+	expectRefused(second, ResetRefused)
+	accepted, err := server.AcceptStream()
+	if err != nil || accepted.ID() != first.ID() {
+		t.Fatal("accepted the wrong stream", err)
+	}
+	accepted.Close()
+	third, _ := client.OpenStream()
+	if accepted, err := server.AcceptStream(); err != nil || accepted.ID() != third.ID() {
+		t.Fatal("stream refused once under the quota", err)
+	}
+	client.Close()
+	server.Close()
+
+	quota = Quota{MaxOpenRate: 1, MaxBuffered: 8192}
+	client, server, err = Pipe(0, WithQuotas(quotas))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ = client.OpenStream()
+	second, _ = client.OpenStream()
+	expectRefused(second, ResetRefused)
+	first.Write(make([]byte, 16384))
+	expectRefused(first, ResetBufferExceeded)
+	client.Close()
+	server.Close()
+
+	// encrypted clients are known by their identity, across sessions
+	_, identity, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys [][32]byte
+	quota = Quota{MaxStreams: 1}
+	quotas = &Quotas{Quota: func(session *Session) Quota {
+		keys = append(keys, session.EncryptionState().PeerIdentity)
+		return quota
+	}}
+	connect := func() (*Session, *Session) {
+		c1, c2 := NewPipeConn(0)
+		client, _ := EncryptedClient(c1, WithEncryption(testServerPubKey, nil), WithClientIdentity(identity))
+		server, _ := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey), WithQuotas(quotas))
+		return client, server
+	}
+	client, server = connect()
+	defer client.Close()
+	defer server.Close()
+	client.OpenStream()
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] == ([32]byte{}) {
+		t.Fatal("quota set before the key exchange")
+	}
+	again, againServer := connect()
+	defer again.Close()
+	defer againServer.Close()
+	refused, _ := again.OpenStream()
+	expectRefused(refused, ResetRefused)
+
+	server.Close()
+	opened, _ := again.OpenStream()
+	if stream, err := againServer.AcceptStream(); err != nil || stream.ID() != opened.ID() {
+		t.Fatal("stream refused once the other session closed", err)
+	}
+}
+
+func TestKeyRevocation(t *testing.T) {
+	var revoked RevocationList
+	pub, identity, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func(opts ...Option) (*Session, *Session) {
+		c1, c2 := NewPipeConn(0)
+		client, _ := EncryptedClient(c1, append([]Option{WithEncryption(testServerPubKey, nil)}, opts...)...)
+		server, _ := EncryptedServer(c2, WithEncryption(testServerPubKey, testServerPrivKey),
+			WithKeyRevocation(revoked.Revoked, 20*time.Millisecond))
+		return client, server
+	}
+	expectRefused := func(client *Session, reason string) {
+		t.Helper()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := client.AcceptStream()
+			errCh <- err
+		}()
+		var err error
+		select {
+		case err = <-errCh:
+		case <-time.After(time.Second):
+			t.Fatal("session of a revoked key not closed")
+		}
+		if se, ok := err.(*SessionError); !ok || se.Code != ResetUnauthorized || !se.Remote || se.Message != reason {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	client, server := connect(WithClientIdentity(identity))
+	defer client.Close()
+	defer server.Close()
+	stream, _ := client.OpenStream()
+	stream.Write([]byte("x"))
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	key := server.EncryptionState().PeerIdentity
+	if !bytes.Equal(key[:], pub) {
+		t.Fatal("unexpected client identity", key)
+	}
+	revoked.Revoke(key)
+	if !revoked.Revoked(key) {
+		t.Fatal("key not revoked")
+	}
+	expectRefused(client, keyRevokedMessage)
+
+	// the key of the exchange changes, the identity stays
+	client, server = connect(WithClientIdentity(identity))
+	defer client.Close()
+	defer server.Close()
+	expectRefused(client, keyRevokedMessage)
+
+	revoked.Restore(key)
+	if revoked.Revoked(key) {
+		t.Fatal("key still revoked")
+	}
+	client, server = connect(WithClientIdentity(identity))
+	defer client.Close()
+	defer server.Close()
+	client.OpenStream()
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal("restored key refused", err)
+	}
+
+	// clients without an identity cannot be told apart
+	client, server = connect()
+	defer client.Close()
+	defer server.Close()
+	expectRefused(client, identityRequiredMessage)
+}
+
+func TestMaxStreamReceiveBuffer(t *testing.T) {
+	client, server, err := Pipe(0, WithMaxStreamReceiveBuffer(8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stalled, _ := client.OpenStream()
+	if _, err := stalled.Write(make([]byte, 16384)); err != nil {
+		t.Fatal(err)
+	}
+	stalledServer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stalled.Read(make([]byte, 1))
+	if se, ok := err.(*StreamError); !ok || se.Code != ResetBufferExceeded || !se.Remote {
+		t.Fatal("expected a reset stream, got", err)
+	}
+	buf := make([]byte, 16384)
+	if _, err := stalledServer.Read(buf); err == nil {
+		t.Fatal("read from a reset stream")
+	}
+	if server.NumStreams() != 0 {
+		t.Fatal("reset stream left open", server.NumStreams())
+	}
+
+	// other streams go on
+	stream, _ := client.OpenStream()
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(accepted, buf[:5]); err != nil || string(buf[:5]) != "hello" {
+		t.Fatal("stream did not survive the reset of another", err)
+	}
+}
+
+func TestRecordMode(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.OpenStream()
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.SetRecordMode(true)
+	stream.Write([]byte("abc"))
+	stream.Write([]byte("defgh"))
+	for accepted.buffered() != 8 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 64)
+	for _, expected := range []string{"abc", "defgh"} {
+		n, err := accepted.Read(buf)
+		if err != nil || string(buf[:n]) != expected {
+			t.Fatal("unexpected record", string(buf[:n]), err)
+		}
+	}
+
+	accepted.SetRecordMode(false)
+	stream.Write([]byte("abc"))
+	stream.Write([]byte("defgh"))
+	if _, err := io.ReadFull(accepted, buf[:8]); err != nil || string(buf[:8]) != "abcdefgh" {
+		t.Fatal("unexpected data", string(buf[:8]), err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.OpenStream()
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stream.Write([]byte("GET "))
+		time.Sleep(20 * time.Millisecond)
+		stream.Write([]byte("/ HTTP/1.1"))
+	}()
+	b, err := accepted.Peek(8)
+	if err != nil || string(b) != "GET / HT" {
+		t.Fatal("unexpected peek", string(b), err)
+	}
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "GET / HTTP/1.1" {
+		t.Fatal("peeked data consumed", string(buf), err)
+	}
+
+	accepted.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	stream.Write([]byte("ab"))
+	if b, err := accepted.Peek(3); err != errTimeout || string(b) != "ab" {
+		t.Fatal("expected a timeout with the data buffered, got", string(b), err)
+	}
+	if _, err := accepted.Peek(server.config.MaxReceiveBuffer + 1); err == nil {
+		t.Fatal("peeked more than can be buffered")
+	}
+	if _, err := accepted.Peek(-1); err == nil {
+		t.Fatal("negative peek accepted")
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	client, server, err := Pipe(0, WithDeadlinePropagation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.OpenStream()
+	client.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 1)); err != errTimeout {
+		t.Fatal("expected a timeout, got", err)
+	}
+	client.SetDeadline(time.Time{})
+
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal("deadline not cleared", err)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	expectCanceled := func(ctx context.Context) {
+		t.Helper()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("context not canceled")
+		}
+	}
+
+	stream, _ := client.OpenStream()
+	stream.Write([]byte("x"))
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := accepted.Context()
+	if ctx.Err() != nil || accepted.Context() != ctx {
+		t.Fatal("context of an open stream canceled")
+	}
+	stream.Close()
+	expectCanceled(ctx)
+	expectCanceled(stream.Context())
+
+	// contexts made once the stream is gone are canceled already
+	stream, _ = client.OpenStream()
+	stream.Write([]byte("x"))
+	accepted, err = server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = stream.Context()
+	server.Close()
+	expectCanceled(ctx)
+	expectCanceled(accepted.Context())
+}
+
+func TestStreamCloseWithError(t *testing.T) {
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.OpenStream()
+	stream.Write([]byte("hello"))
+	if err := stream.CloseWithError(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseWithError(7); err == nil {
+		t.Fatal("closed twice")
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("data sent before lost", string(buf), err)
+	}
+	_, err = accepted.Read(buf)
+	if se, ok := err.(*StreamError); !ok || se.Code != 7 || !se.Remote {
+		t.Fatal("expected the code of the close, got", err)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	client, server, err := Pipe(0, WithStreamIdleTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	idle, _ := client.OpenStream()
+	busy, _ := client.OpenStream()
+	for i := 0; i < 6; i++ {
+		if _, err := busy.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := idle.Write([]byte("x")); err == nil {
+		t.Fatal("idle stream not reset")
+	}
+	if client.NumStreams() != 1 {
+		t.Fatal("expected the busy stream only, got", client.NumStreams())
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	// blocked calls learn why the session closed
+	blocked := func(session *Session, stream *Stream) (acceptErr, readErr chan error) {
+		acceptErr, readErr = make(chan error, 1), make(chan error, 1)
+		go func() {
+			_, err := session.AcceptStream()
+			acceptErr <- err
+		}()
+		go func() {
+			_, err := stream.Read(make([]byte, 1))
+			readErr <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		return acceptErr, readErr
+	}
+
+	client, server, err := Pipe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := client.OpenStream()
+	serverStream, _ := server.AcceptStream()
+	acceptErr, readErr := blocked(client, stream)
+	serverAcceptErr, serverReadErr := blocked(server, serverStream)
+	client.Close()
+	if err := <-acceptErr; err != ErrSessionClosed {
+		t.Fatal("expected ErrSessionClosed from AcceptStream, got", err)
+	}
+	if err := <-readErr; err != ErrSessionClosed {
+		t.Fatal("expected ErrSessionClosed from Read, got", err)
+	}
+	if err := <-serverAcceptErr; !isReadError(err) {
+		t.Fatal("expected a ReadError from AcceptStream, got", err)
+	}
+	if err := <-serverReadErr; !isReadError(err) {
+		t.Fatal("expected a ReadError from Read, got", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != ErrSessionClosed {
+		t.Fatal("expected ErrSessionClosed from Write, got", err)
+	}
+
+	c, s := NewPipeConn(0)
+	defer s.Close()
+	client, err = Client(c, WithKeepAlive(50*time.Millisecond, 200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ = client.OpenStream()
+	acceptErr, readErr = blocked(client, stream)
+	if err := <-acceptErr; err != ErrKeepAliveTimeout {
+		t.Fatal("expected ErrKeepAliveTimeout from AcceptStream, got", err)
+	}
+	if err := <-readErr; err != ErrKeepAliveTimeout {
+		t.Fatal("expected ErrKeepAliveTimeout from Read, got", err)
+	}
+}
+
+func isReadError(err error) bool {
+	_, ok := err.(*ReadError)
+	return ok
+}
+
+func TestKeepAlivePongs(t *testing.T) {
+	// an idle peer without keep-alive of its own answers the pings
+	c, s := NewPipeConn(0)
+	client, err := Client(c, WithKeepAlive(50*time.Millisecond, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := Server(s, WithoutKeepAlive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if client.IsClosed() {
+		t.Fatal("closed a session whose peer answers pings:", client.dieError())
+	}
+
+	// a peer gone silent misses the pings
+	server.Close()
+	c, s = NewPipeConn(0)
+	defer s.Close()
+	client, err = Client(c, WithKeepAlive(50*time.Millisecond, 100*time.Millisecond), WithKeepAliveMaxMissed(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	<-client.die
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("closed before missing 3 pings", elapsed)
+	}
+	if client.dieError() != ErrKeepAliveTimeout {
+		t.Fatal("expected ErrKeepAliveTimeout, got", client.dieError())
+	}
+}
+
+func TestTokenAccounting(t *testing.T) {
+	client, server, err := Pipe(0, WithMaxReceiveBuffer(65536))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 8192)
+	var accepted []*Stream
+	for i := 0; i < 4; i++ {
+		stream, _ := client.OpenStream()
+		stream.Write(data)
+		defer stream.Close()
+		s, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted = append(accepted, s)
+	}
+
+	// read some streams fully, one partly, and close the others
+	// with data unread
+	io.ReadFull(accepted[0], make([]byte, len(data)))
+	io.ReadFull(accepted[1], make([]byte, 100))
+	buf, release, _ := accepted[2].ReadBuffer()
+	if len(buf) == 0 {
+		t.Fatal("no data")
+	}
+	release()
+	accepted[1].Close()
+	accepted[2].Close()
+	accepted[3].Close()
+
+	// data sent to the closed streams is dropped
+	for _, id := range []uint32{accepted[1].ID(), accepted[3].ID()} {
+		f := newFrame(cmdPSH, id)
+		f.data = data[:4096]
+		if _, err := client.writeFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.Stats().DataDropped < 2*4096 {
+		if time.Now().After(deadline) {
+			t.Fatal("dropped data not counted", server.Stats().DataDropped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&server.bucket); n != 65536 {
+		t.Fatal("tokens leaked or credited twice, bucket", n)
+	}
+}
+
+func TestMaxSendRate(t *testing.T) {
+	const rate = 1 << 20
+	client, server, err := Pipe(0, WithMaxSendRate(rate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.OpenStream()
+	go func() {
+		s, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, s)
+	}()
+
+	msg := make([]byte, rate/4)
+	start := time.Now()
+	if _, err := stream.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	// the burst lets rate/20 through at once
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal("unexpected duration at the send rate", elapsed)
+	}
+
+	// lifting the limit releases a throttled write
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, 4*rate))
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := client.SetMaxSendRate(0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write still throttled")
+	}
+	if err := client.SetMaxSendRate(-1); err == nil {
+		t.Fatal("negative rate accepted")
+	}
+}
+
+func TestQoSClasses(t *testing.T) {
+	client, server, err := Pipe(0, WithMaxSendRate(2<<20), WithQoSClasses(
+		QoSClass{Name: "interactive", Weight: 3},
+		QoSClass{Name: "bulk", Weight: 1},
+		QoSClass{Name: "capped", MaxRate: 256 << 10},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, s)
+		}
+	}()
+
+	// the streams of both classes send as fast as they can for a while
+	var sent [2]int64
+	var wg sync.WaitGroup
+	stop := time.Now().Add(time.Second)
+	for k, class := range []string{"interactive", "bulk"} {
+		for i := 0; i < 4; i++ {
+			s, err := client.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetQoSClass(class); err != nil {
+				t.Fatal(err)
+			}
+			wg.Add(1)
+			go func(s *Stream, sent *int64) {
+				defer wg.Done()
+				defer s.Close()
+				buf := make([]byte, 4096)
+				for time.Now().Before(stop) {
+					n, err := s.Write(buf)
+					atomic.AddInt64(sent, int64(n))
+					if err != nil {
+						return
+					}
+				}
+			}(s, &sent[k])
+		}
+	}
+	wg.Wait()
+	if ratio := float64(sent[0]) / float64(sent[1]); ratio < 2 || ratio > 4.5 {
+		t.Fatal("expected a 3:1 share, got", sent[0], sent[1])
+	}
+
+	stream, _ := client.OpenStream()
+	if err := stream.SetQoSClass("unknown"); err == nil {
+		t.Fatal("unknown class accepted")
+	}
+
+	// a capped class is held to its rate even with bandwidth left
+	if err := client.SetMaxSendRate(0); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetQoSClass("capped")
+	start := time.Now()
+	stream.Write(make([]byte, 128<<10))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatal("capped class not held to its rate", elapsed)
+	}
+
+	// so is a stream with its own cap
+	limited, _ := client.OpenStream()
+	limited.SetMaxSendRate(256 << 10)
+	start = time.Now()
+	limited.Write(make([]byte, 128<<10))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatal("stream not held to its rate", elapsed)
+	}
+}
@@ -0,0 +1,238 @@
+// Package smuxdebug serves the live state of smux sessions over HTTP,
+// for a quick look at a process in production: the sessions
+// registered, their streams, buffer levels and recent errors.
+//
+// Like net/http/pprof, importing the package registers its handler
+// on http.DefaultServeMux, under /debug/smux/:
+//
+//	import _ "github.com/superfly/smux/smuxdebug"
+//
+// Sessions show up once registered, and leave when they close:
+//
+//	session, err := smux.Server(conn, smux.WithLogger(smuxdebug.Logger(nil)))
+//	smuxdebug.Register("edge "+conn.RemoteAddr().String(), session)
+//
+// The page is HTML, or JSON with ?format=json or an Accept header
+// of application/json.
+package smuxdebug
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superfly/smux"
+)
+
+// maxErrors is the number of recent errors kept
+const maxErrors = 64
+
+func init() {
+	http.Handle("/debug/smux/", Handler())
+}
+
+// registry holds the sessions registered and the recent errors
+var registry struct {
+	sync.Mutex
+	sessions map[*smux.Session]*entry
+	errors   []Error // ring of the last maxErrors errors
+	next     int     // slot of the next error once the ring is full
+}
+
+type entry struct {
+	name       string
+	registered time.Time
+}
+
+// Register lists session under name until it closes, its close
+// error is then kept among the recent errors. Registering a session
+// again renames it.
+func Register(name string, session *smux.Session) {
+	registry.Lock()
+	if registry.sessions == nil {
+		registry.sessions = make(map[*smux.Session]*entry)
+	}
+	if e, ok := registry.sessions[session]; ok {
+		e.name = name
+		registry.Unlock()
+		return
+	}
+	registry.sessions[session] = &entry{name: name, registered: time.Now()}
+	registry.Unlock()
+
+	go func() {
+		<-session.Done()
+		registry.Lock()
+		e, ok := registry.sessions[session]
+		delete(registry.sessions, session)
+		registry.Unlock()
+		if err := session.CloseErr(); ok && err != smux.ErrSessionClosed {
+			record(Error{Time: time.Now(), Session: e.name, Level: smux.LevelError.String(), Message: err.Error()})
+		}
+	}()
+}
+
+// Unregister removes session from the list
+func Unregister(session *smux.Session) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.sessions, session)
+}
+
+// Error is a recent error, a session closed on failure or an entry
+// of a Logger
+type Error struct {
+	Time    time.Time
+	Session string `json:",omitempty"` // name of the session, when known
+	Level   string
+	Message string
+}
+
+func record(e Error) {
+	registry.Lock()
+	defer registry.Unlock()
+	if len(registry.errors) < maxErrors {
+		registry.errors = append(registry.errors, e)
+		return
+	}
+	registry.errors[registry.next] = e
+	registry.next = (registry.next + 1) % maxErrors
+}
+
+// recentErrors returns the errors kept, the latest first
+func recentErrors() []Error {
+	registry.Lock()
+	defer registry.Unlock()
+	errs := make([]Error, 0, len(registry.errors))
+	for i := len(registry.errors) - 1; i >= 0; i-- {
+		errs = append(errs, registry.errors[(registry.next+i)%len(registry.errors)])
+	}
+	return errs
+}
+
+// Logger returns a smux.Logger keeping the warnings and errors of the
+// sessions among the recent errors, and passing every entry on to
+// next, if not nil
+func Logger(next smux.Logger) smux.Logger {
+	return smux.LoggerFunc(func(level smux.LogLevel, msg string, keyvals ...interface{}) {
+		if level >= smux.LevelWarn {
+			var buf strings.Builder
+			buf.WriteString(msg)
+			for k := 0; k < len(keyvals); k += 2 {
+				if k+1 < len(keyvals) {
+					fmt.Fprintf(&buf, " %v=%v", keyvals[k], keyvals[k+1])
+				}
+			}
+			record(Error{Time: time.Now(), Level: level.String(), Message: buf.String()})
+		}
+		if next != nil {
+			next.Log(level, msg, keyvals...)
+		}
+	})
+}
+
+// Session is the state of a registered session
+type Session struct {
+	Name       string
+	Registered time.Time
+	LocalAddr  string
+	RemoteAddr string
+	RTT        time.Duration
+	Encryption smux.EncryptionState
+	Stats      smux.Stats
+	Streams    []smux.StreamInfo
+}
+
+// State is the state served by the handler
+type State struct {
+	Sessions []Session
+	Errors   []Error
+}
+
+// Snapshot returns the state of the registered sessions, sorted by
+// name, and the recent errors
+func Snapshot() State {
+	registry.Lock()
+	sessions := make([]Session, 0, len(registry.sessions))
+	live := make([]*smux.Session, 0, len(registry.sessions))
+	for session, e := range registry.sessions {
+		sessions = append(sessions, Session{Name: e.name, Registered: e.registered})
+		live = append(live, session)
+	}
+	registry.Unlock()
+
+	for i, session := range live {
+		st := &sessions[i]
+		st.LocalAddr = addr(session.LocalAddr())
+		st.RemoteAddr = addr(session.RemoteAddr())
+		st.RTT = session.RTT()
+		st.Encryption = session.EncryptionState()
+		st.Stats = session.Stats()
+		st.Streams = session.ActiveStreams()
+		sort.Slice(st.Streams, func(i, j int) bool { return st.Streams[i].ID < st.Streams[j].ID })
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	return State{Sessions: sessions, Errors: recentErrors()}
+}
+
+func addr(a fmt.Stringer) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// Handler returns the handler serving Snapshot, to mount on a mux of
+// your own
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	state := Snapshot()
+	if r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(state)
+		return
+	}
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+var page = template.Must(template.New("smux").Parse(`<!DOCTYPE html>
+<html>
+<head><title>smux</title></head>
+<body>
+<h1>{{len .Sessions}} sessions</h1>
+{{range .Sessions}}
+<h2>{{.Name}}</h2>
+<p>{{.LocalAddr}} &rarr; {{.RemoteAddr}}, registered {{.Registered.Format "2006-01-02 15:04:05"}},
+rtt {{.RTT}}{{if .Encryption.Enabled}}, cipher {{.Encryption.Cipher}}{{end}}</p>
+<p>{{.Stats.FramesSent}} frames sent, {{.Stats.FramesReceived}} received,
+{{.Stats.ReceiveBuffered}} bytes buffered, {{.Stats.SendQueueDepth}} writes queued,
+{{.Stats.ResetsSent}} resets sent, {{.Stats.ResetsReceived}} received</p>
+<table>
+<tr><th>stream</th><th>opened by</th><th>buffered</th><th>reset</th></tr>
+{{range .Streams}}<tr><td>{{.ID}}</td><td>{{if .Local}}local{{else}}peer{{end}}</td><td>{{.Buffered}}</td><td>{{.Reset}}</td></tr>
+{{end}}</table>
+{{end}}
+<h1>Recent errors</h1>
+<table>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Level}}</td><td>{{.Session}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,96 @@
+package smuxdebug
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/smux"
+)
+
+func TestHandler(t *testing.T) {
+	client, server, err := smux.Pipe(0, smux.WithLogger(Logger(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	Register("client", client)
+	Register("server", server)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("hello"))
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+	get := func(query string) string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/debug/smux/" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(resp.Status, string(body))
+		}
+		return string(body)
+	}
+
+	var state State
+	if err := json.Unmarshal([]byte(get("?format=json")), &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Sessions) != 2 || state.Sessions[0].Name != "client" || state.Sessions[1].Name != "server" {
+		t.Fatalf("unexpected sessions %+v", state.Sessions)
+	}
+	if len(state.Sessions[0].Streams) != 1 || !state.Sessions[0].Streams[0].Local {
+		t.Fatalf("unexpected client streams %+v", state.Sessions[0].Streams)
+	}
+	if page := get(""); !strings.Contains(page, "<h2>server</h2>") {
+		t.Fatal("session missing from the page", page)
+	}
+
+	client.CloseWithError(smux.ResetInternalError, "boom")
+	<-server.Done()
+	deadline := time.Now().Add(time.Second)
+	for len(Snapshot().Sessions) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed sessions still listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	errs := Snapshot().Errors
+	found := false
+	for _, e := range errs {
+		if e.Session == "server" && strings.Contains(e.Message, "boom") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("close error of the server not kept %+v", errs)
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	logger := Logger(nil)
+	for i := 0; i < maxErrors+10; i++ {
+		logger.Log(smux.LevelWarn, "warning", "n", i)
+	}
+	logger.Log(smux.LevelDebug, "debug")
+	errs := recentErrors()
+	if len(errs) != maxErrors {
+		t.Fatal("unexpected number of errors kept", len(errs))
+	}
+	if errs[0].Message != "warning n=73" || errs[maxErrors-1].Message != "warning n=10" {
+		t.Fatal("unexpected order of errors", errs[0].Message, errs[maxErrors-1].Message)
+	}
+}
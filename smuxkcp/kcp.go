@@ -0,0 +1,213 @@
+// Package smuxkcp runs smux sessions over KCP, a reliable transport
+// on top of UDP, with settings suited to the pair.
+//
+// KCP is run in stream mode with a checksum on every packet, smux
+// frames are sized so that one fits in a single KCP segment and the
+// keep-alive is relaxed, since KCP already retransmits and gives up
+// on dead links by itself.
+package smuxkcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/superfly/smux"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// packet overheads within the MTU
+const (
+	kcpOverhead   = 24 // KCP segment header
+	cryptOverhead = 20 // nonce and checksum of BlockCrypt
+	fecOverhead   = 8  // forward error correction header
+	smuxOverhead  = 8  // smux frame header
+)
+
+// Config tunes the KCP connection under a session
+type Config struct {
+	// Block encrypts the packets, nil only checksums them. Sessions
+	// set up with smux.WithEncryption need no block encryption.
+	Block kcp.BlockCrypt
+
+	// forward error correction, DataShards 0 disables it
+	DataShards   int
+	ParityShards int
+
+	MTU        int // bytes of a UDP packet
+	SendWindow int // packets in flight
+	RecvWindow int // packets buffered out of order
+
+	// NoDelay favours latency over bandwidth: a 10ms internal clock,
+	// fast resend and no congestion control
+	NoDelay bool
+
+	SocketBuffer int // size of the socket buffers
+}
+
+// DefaultConfig returns the settings used when Config is nil
+func DefaultConfig() *Config {
+	return &Config{
+		MTU:          1350,
+		SendWindow:   1024,
+		RecvWindow:   1024,
+		NoDelay:      true,
+		SocketBuffer: 4194304,
+	}
+}
+
+// block returns the packet encryption of c, a checksum only when
+// none is set
+func (c *Config) block() (kcp.BlockCrypt, error) {
+	if c.Block != nil {
+		return c.Block, nil
+	}
+	return kcp.NewNoneBlockCrypt(nil)
+}
+
+// FrameSize returns the MaxFrameSize fitting a smux frame in a
+// single KCP segment
+func (c *Config) FrameSize() int {
+	size := c.MTU - kcpOverhead - cryptOverhead - smuxOverhead
+	if c.DataShards > 0 && c.ParityShards > 0 {
+		size -= fecOverhead
+	}
+	return size
+}
+
+// SessionOptions returns the smux options suited to KCP, opts are
+// applied after them
+func (c *Config) SessionOptions(opts ...smux.Option) []smux.Option {
+	return append([]smux.Option{
+		smux.WithMaxFrameSize(c.FrameSize()),
+		smux.WithKeepAlive(10*time.Second, 60*time.Second),
+	}, opts...)
+}
+
+// tune applies c to a KCP connection
+func (c *Config) tune(conn *kcp.UDPSession) {
+	conn.SetStreamMode(true)
+	conn.SetWriteDelay(false)
+	conn.SetMtu(c.MTU)
+	conn.SetWindowSize(c.SendWindow, c.RecvWindow)
+	if c.NoDelay {
+		conn.SetNoDelay(1, 10, 2, 1)
+	} else {
+		conn.SetNoDelay(0, 40, 0, 0)
+	}
+	conn.SetACKNoDelay(c.NoDelay)
+}
+
+// Dial connects to a Listener at addr and starts the client side of
+// a session over it
+func Dial(addr string, config *Config, opts ...smux.Option) (*smux.Session, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	block, err := config.block()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := kcp.DialWithOptions(addr, block, config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(config.SocketBuffer)
+	conn.SetWriteBuffer(config.SocketBuffer)
+	return client(conn, config, opts)
+}
+
+// Client starts the client side of a session with the peer at addr,
+// over packets of conn. conn may be any net.PacketConn, not only a
+// UDP socket, and is left open when the session closes.
+func Client(conn net.PacketConn, addr string, config *Config, opts ...smux.Option) (*smux.Session, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	block, err := config.block()
+	if err != nil {
+		return nil, err
+	}
+	kconn, err := kcp.NewConn(addr, block, config.DataShards, config.ParityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	return client(kconn, config, opts)
+}
+
+func client(conn *kcp.UDPSession, config *Config, opts []smux.Option) (*smux.Session, error) {
+	config.tune(conn)
+	session, err := smux.Client(conn, config.SessionOptions(opts...)...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// Listener accepts the sessions of KCP clients
+type Listener struct {
+	ln     *kcp.Listener
+	config *Config
+	opts   []smux.Option
+}
+
+// Listen listens for KCP clients on the UDP address addr
+func Listen(addr string, config *Config, opts ...smux.Option) (*Listener, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	block, err := config.block()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := kcp.ListenWithOptions(addr, block, config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	ln.SetReadBuffer(config.SocketBuffer)
+	ln.SetWriteBuffer(config.SocketBuffer)
+	return &Listener{ln: ln, config: config, opts: opts}, nil
+}
+
+// Serve listens for KCP clients on the packets of conn, which may be
+// any net.PacketConn
+func Serve(conn net.PacketConn, config *Config, opts ...smux.Option) (*Listener, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	block, err := config.block()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := kcp.ServeConn(block, config.DataShards, config.ParityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, config: config, opts: opts}, nil
+}
+
+// Accept waits for the next client and starts the server side of its
+// session
+func (l *Listener) Accept() (*smux.Session, error) {
+	conn, err := l.ln.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.config.tune(conn)
+	session, err := smux.Server(conn, l.config.SessionOptions(l.opts...)...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// Close stops listening, the sessions accepted are left open
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// Addr returns the local address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
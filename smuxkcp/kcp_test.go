@@ -0,0 +1,129 @@
+package smuxkcp
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/superfly/smux"
+)
+
+func echo(t *testing.T, client, server *smux.Session) {
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	msg := make([]byte, 100000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go stream.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := range buf {
+		if buf[i] != msg[i] {
+			t.Fatal("corrupted echo at", i)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan *smux.Session, 1)
+	go func() {
+		session, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- session
+	}()
+
+	client, err := Dial(ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the server learns of the client with its first packet
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	echo(t, client, server)
+}
+
+func TestPacketConn(t *testing.T) {
+	config := DefaultConfig()
+	config.DataShards, config.ParityShards = 10, 3
+	config.NoDelay = false
+
+	sconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	ln, err := Serve(sconn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	client, err := Client(cconn, ln.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	echo(t, client, server)
+}
+
+func TestFrameSize(t *testing.T) {
+	config := DefaultConfig()
+	if size := config.FrameSize(); size != 1350-24-20-8 {
+		t.Fatal("unexpected frame size", size)
+	}
+	config.DataShards, config.ParityShards = 10, 3
+	if size := config.FrameSize(); size != 1350-24-20-8-8 {
+		t.Fatal("unexpected frame size with fec", size)
+	}
+}
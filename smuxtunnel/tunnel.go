@@ -0,0 +1,111 @@
+// Package smuxtunnel exposes a service behind a NAT or a firewall
+// through a server it can reach, over a smux session.
+//
+// The side of the service dials the server out and gets a
+// net.Listener, the connections it accepts are streams opened by the
+// server:
+//
+//	ln, err := smuxtunnel.Dial(ctx, "relay.example.com:7000", nil)
+//	http.Serve(ln, handler)
+//
+// The server accepts the session and forwards the connections of its
+// public listener to it:
+//
+//	session, err := smux.Server(conn)
+//	smuxtunnel.Forward(public, session)
+package smuxtunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/superfly/smux"
+)
+
+// Listener hands out the streams the server opens as connections,
+// its lifetime is that of the session
+type Listener struct {
+	session *smux.Session
+	ln      *smux.Listener
+}
+
+// Dial connects to the server at addr through d, nil for a direct
+// connection, and starts the session of the tunnel
+func Dial(ctx context.Context, addr string, d *smux.Dialer, opts ...smux.Option) (*Listener, error) {
+	if d == nil {
+		d = &smux.Dialer{}
+	}
+	session, err := d.Dial(ctx, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{session: session, ln: session.Listen()}, nil
+}
+
+// NewListener starts the session of the tunnel over conn, connected
+// to the server
+func NewListener(conn io.ReadWriteCloser, opts ...smux.Option) (*Listener, error) {
+	session, err := smux.Client(conn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{session: session, ln: session.Listen()}, nil
+}
+
+// Accept waits for the next connection forwarded by the server, it
+// fails once the session is closed
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.ln.Accept()
+}
+
+// Close closes the session of the tunnel
+func (l *Listener) Close() error {
+	return l.session.Close()
+}
+
+// Addr returns the local address of the session
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Session returns the session of the tunnel
+func (l *Listener) Session() *smux.Session {
+	return l.session
+}
+
+// Forward forwards each connection accepted on ln to a stream of
+// session, until ln fails or a connection finds session closed. ln
+// is left open. Streams carry the address of their client, see
+// smux.Stream.PeerInfo.
+func Forward(ln net.Listener, session *smux.Session) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		ctx := smux.WithPeerInfo(context.Background(), smux.NewPeerInfo(conn))
+		stream, err := session.OpenStreamContext(ctx)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		go join(conn, stream)
+	}
+}
+
+// join copies between a and b until either ends, then closes both
+func join(a, b io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	io.Copy(b, a)
+	once.Do(closeBoth)
+}
@@ -0,0 +1,113 @@
+package smuxtunnel
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/superfly/smux"
+)
+
+func TestTunnel(t *testing.T) {
+	// the relay server, reachable by the service
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	forwarding := make(chan error, 1)
+	go func() {
+		conn, err := relay.Accept()
+		if err != nil {
+			forwarding <- err
+			return
+		}
+		session, _ := smux.Server(conn)
+		defer session.Close()
+		forwarding <- Forward(public, session)
+	}()
+
+	// the service, which only dials out
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ln, err := Dial(ctx, relay.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("behind the nat"))
+	}))
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get("http://" + public.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "behind the nat" {
+			t.Fatal("unexpected body", string(body))
+		}
+	}
+
+	// once the service is gone the server stops forwarding, which it
+	// notices with the next connection
+	ln.Close()
+	deadline := time.After(5 * time.Second)
+	for {
+		if conn, err := net.Dial("tcp", public.Addr().String()); err == nil {
+			conn.Close()
+		}
+		select {
+		case err := <-forwarding:
+			if err == nil {
+				t.Fatal("forwarding ended without an error")
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("forwarding outlived the session")
+		}
+	}
+}
+
+func TestForwardPeerInfo(t *testing.T) {
+	c1, c2 := smux.NewPipeConn(0)
+	ln, err := NewListener(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	session, _ := smux.Server(c2)
+	defer session.Close()
+
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	go Forward(public, session)
+
+	conn, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	info := stream.(*smux.Stream).PeerInfo()
+	if info == nil || info.String() != conn.LocalAddr().String() {
+		t.Fatal("unexpected peer info", info)
+	}
+}
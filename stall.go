@@ -0,0 +1,116 @@
+package smux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// StallKind tells what stalled
+type StallKind int
+
+// stall kinds
+const (
+	// StallReceiveBuffer is a session whose receive buffer stayed
+	// exhausted, no frame is read until streams are read from
+	StallReceiveBuffer StallKind = iota
+	// StallStream is a stream whose unread data stayed above
+	// Config.StallThreshold, its reader is not keeping up
+	StallStream
+)
+
+func (k StallKind) String() string {
+	if k == StallStream {
+		return "stream"
+	}
+	return "receive buffer"
+}
+
+// StallEvent is passed to Config.OnStall once a stall lasted for
+// Config.StallTimeout
+type StallEvent struct {
+	Kind     StallKind
+	StreamID uint32        // the stalled stream for StallStream
+	Buffered int           // unread bytes of the session or the stream
+	Duration time.Duration // how long the stall lasted so far
+}
+
+// stallDetector samples the receive buffer and the streams of a
+// session from sendLoop, each stall is reported once
+type stallDetector struct {
+	ticker        *time.Ticker
+	bucketSince   time.Time // when the bucket was found exhausted
+	bucketStalled bool      // the bucket stall was reported
+}
+
+// channel returns the ticker channel of the checks, nil when stall
+// detection is disabled
+func (d *stallDetector) channel(timeout time.Duration) <-chan time.Time {
+	if timeout <= 0 {
+		return nil
+	}
+	if d.ticker == nil {
+		d.ticker = time.NewTicker(timeout / 4)
+	}
+	return d.ticker.C
+}
+
+func (d *stallDetector) stop() {
+	if d.ticker != nil {
+		d.ticker.Stop()
+	}
+}
+
+// checkStalls reports the stalls that lasted for StallTimeout
+func (s *Session) checkStalls(d *stallDetector) {
+	now := time.Now()
+	timeout := s.config.StallTimeout
+
+	if s.config.FlowControl != nil || atomic.LoadInt32(&s.bucket) > 0 {
+		// a FlowControl policy may buffer more than the bucket
+		d.bucketSince, d.bucketStalled = time.Time{}, false
+	} else if d.bucketSince.IsZero() {
+		d.bucketSince = now
+	} else if elapsed := now.Sub(d.bucketSince); elapsed >= timeout && !d.bucketStalled {
+		d.bucketStalled = true
+		s.stalled(StallEvent{
+			Kind:     StallReceiveBuffer,
+			Buffered: s.config.MaxReceiveBuffer - int(atomic.LoadInt32(&s.bucket)),
+			Duration: elapsed,
+		})
+	}
+
+	threshold := s.config.StallThreshold
+	if threshold <= 0 {
+		return
+	}
+	var events []StallEvent
+	s.streams.each(func(stream *Stream) {
+		// only sendLoop touches the stall fields of streams
+		buffered := stream.buffered()
+		if buffered <= threshold {
+			stream.stallSince, stream.stalled = time.Time{}, false
+		} else if stream.stallSince.IsZero() {
+			stream.stallSince = now
+		} else if elapsed := now.Sub(stream.stallSince); elapsed >= timeout && !stream.stalled {
+			stream.stalled = true
+			events = append(events, StallEvent{
+				Kind:     StallStream,
+				StreamID: stream.id,
+				Buffered: buffered,
+				Duration: elapsed,
+			})
+		}
+	})
+	for _, ev := range events {
+		s.stalled(ev)
+	}
+}
+
+// stalled logs a stall and passes it to OnStall
+func (s *Session) stalled(ev StallEvent) {
+	s.log(LevelWarn, "stalled", "kind", ev.Kind, "sid", ev.StreamID,
+		"buffered", ev.Buffered, "duration", ev.Duration)
+	if s.config.OnStall != nil {
+		s.config.OnStall(ev)
+	}
+}
@@ -0,0 +1,222 @@
+package smux
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a reset storm is resetStormThreshold RSTs received within
+// resetStormWindow
+const (
+	resetStormThreshold = 100
+	resetStormWindow    = time.Second
+)
+
+// Stats is a snapshot of the counters of a session
+type Stats struct {
+	FramesSent      uint64
+	FramesReceived  uint64
+	ResetsSent      uint64
+	ResetsReceived  uint64
+	BucketExhausted uint64 // times receiving paused for lack of buffer space
+	DataDropped     uint64 // bytes received for streams closed or unknown
+	SendQueueDepth  int64  // writes waiting for the send loop
+	ReceiveBuffered int64  // bytes received and not read yet
+
+	// frames by command name, commands never seen are left out
+	FramesSentByCmd     map[string]uint64
+	FramesReceivedByCmd map[string]uint64
+
+	// protocol anomalies of the peer
+	UnknownCommands uint64 // frames of a command not spoken
+	BadVersions     uint64 // frames of another protocol version
+	OversizedFrames uint64 // frames over the size limit
+	ResetStorms     uint64 // bursts of resets from the peer
+}
+
+// sessionStats holds the counters of a session, it is the first field
+// of Session so that the 64-bit atomics stay aligned on 32-bit platforms
+type sessionStats struct {
+	framesSent      uint64
+	framesReceived  uint64
+	resetsSent      uint64
+	resetsReceived  uint64
+	bucketExhausted uint64
+	dataDropped     uint64
+	sendQueueDepth  int64
+
+	sentByCmd       [len(cmdNames)]uint64
+	receivedByCmd   [len(cmdNames)]uint64
+	unknownCommands uint64
+	badVersions     uint64
+	oversizedFrames uint64
+	resetStorms     uint64
+}
+
+// frameSent counts a frame written
+func (st *sessionStats) frameSent(cmd byte) {
+	atomic.AddUint64(&st.framesSent, 1)
+	if cmd == cmdRST {
+		atomic.AddUint64(&st.resetsSent, 1)
+	}
+	if int(cmd) < len(st.sentByCmd) {
+		atomic.AddUint64(&st.sentByCmd[cmd], 1)
+	}
+}
+
+// frameReceived counts a frame read
+func (st *sessionStats) frameReceived(cmd byte) {
+	atomic.AddUint64(&st.framesReceived, 1)
+	if cmd == cmdRST {
+		atomic.AddUint64(&st.resetsReceived, 1)
+	}
+	if int(cmd) < len(st.receivedByCmd) {
+		atomic.AddUint64(&st.receivedByCmd[cmd], 1)
+	}
+}
+
+// byCmd maps the counters of commands seen to their names
+func byCmd(counters *[len(cmdNames)]uint64) map[string]uint64 {
+	m := make(map[string]uint64)
+	for cmd := range counters {
+		if n := atomic.LoadUint64(&counters[cmd]); n > 0 {
+			m[cmdNames[cmd]] = n
+		}
+	}
+	return m
+}
+
+// resetStorm spots bursts of RSTs received, it is only used by
+// recvLoop
+type resetStorm struct {
+	start time.Time // start of the current window
+	n     int       // RSTs within the window
+}
+
+// add counts a RST received now, it reports true once per window
+// when the RSTs reach resetStormThreshold
+func (r *resetStorm) add(now time.Time) bool {
+	if now.Sub(r.start) > resetStormWindow {
+		r.start, r.n = now, 0
+	}
+	r.n++
+	return r.n == resetStormThreshold
+}
+
+func (st *sessionStats) snapshot() Stats {
+	return Stats{
+		FramesSent:      atomic.LoadUint64(&st.framesSent),
+		FramesReceived:  atomic.LoadUint64(&st.framesReceived),
+		ResetsSent:      atomic.LoadUint64(&st.resetsSent),
+		ResetsReceived:  atomic.LoadUint64(&st.resetsReceived),
+		BucketExhausted: atomic.LoadUint64(&st.bucketExhausted),
+		DataDropped:     atomic.LoadUint64(&st.dataDropped),
+		SendQueueDepth:  atomic.LoadInt64(&st.sendQueueDepth),
+
+		FramesSentByCmd:     byCmd(&st.sentByCmd),
+		FramesReceivedByCmd: byCmd(&st.receivedByCmd),
+		UnknownCommands:     atomic.LoadUint64(&st.unknownCommands),
+		BadVersions:         atomic.LoadUint64(&st.badVersions),
+		OversizedFrames:     atomic.LoadUint64(&st.oversizedFrames),
+		ResetStorms:         atomic.LoadUint64(&st.resetStorms),
+	}
+}
+
+func (a *Stats) add(b Stats) {
+	a.FramesSent += b.FramesSent
+	a.FramesReceived += b.FramesReceived
+	a.ResetsSent += b.ResetsSent
+	a.ResetsReceived += b.ResetsReceived
+	a.BucketExhausted += b.BucketExhausted
+	a.DataDropped += b.DataDropped
+	a.SendQueueDepth += b.SendQueueDepth
+	a.ReceiveBuffered += b.ReceiveBuffered
+	a.FramesSentByCmd = addByCmd(a.FramesSentByCmd, b.FramesSentByCmd)
+	a.FramesReceivedByCmd = addByCmd(a.FramesReceivedByCmd, b.FramesReceivedByCmd)
+	a.UnknownCommands += b.UnknownCommands
+	a.BadVersions += b.BadVersions
+	a.OversizedFrames += b.OversizedFrames
+	a.ResetStorms += b.ResetStorms
+}
+
+// addByCmd adds the counters of b to a, a is allocated when nil
+func addByCmd(a, b map[string]uint64) map[string]uint64 {
+	if a == nil {
+		a = make(map[string]uint64, len(b))
+	}
+	for name, n := range b {
+		a[name] += n
+	}
+	return a
+}
+
+// Stats returns a snapshot of the session counters
+func (s *Session) Stats() Stats {
+	st := s.stats.snapshot()
+	st.ReceiveBuffered = int64(s.config.MaxReceiveBuffer) - int64(atomic.LoadInt32(&s.bucket))
+	return st
+}
+
+// Expvar returns a variable reporting the session counters,
+// to be published with expvar.Publish under a name of your choice
+func (s *Session) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		return s.Stats()
+	})
+}
+
+// expvarTotals aggregates the counters of all sessions once
+// PublishExpvar was called
+var expvarTotals struct {
+	sync.Mutex
+	enabled  bool
+	closed   Stats // counters of the sessions closed since
+	sessions map[*Session]struct{}
+}
+
+// PublishExpvar publishes under name the counters summed over every
+// session created afterwards, closed sessions included. Like
+// expvar.Publish it panics when the name is already in use.
+func PublishExpvar(name string) {
+	expvarTotals.Lock()
+	expvarTotals.enabled = true
+	if expvarTotals.sessions == nil {
+		expvarTotals.sessions = make(map[*Session]struct{})
+	}
+	expvarTotals.Unlock()
+
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		expvarTotals.Lock()
+		defer expvarTotals.Unlock()
+		total := expvarTotals.closed
+		for s := range expvarTotals.sessions {
+			total.add(s.Stats())
+		}
+		return total
+	}))
+}
+
+// trackSession adds a new session to the published totals
+func trackSession(s *Session) {
+	expvarTotals.Lock()
+	if expvarTotals.enabled {
+		expvarTotals.sessions[s] = struct{}{}
+	}
+	expvarTotals.Unlock()
+}
+
+// untrackSession folds the counters of a closed session into the
+// published totals
+func untrackSession(s *Session) {
+	expvarTotals.Lock()
+	if _, ok := expvarTotals.sessions[s]; ok {
+		delete(expvarTotals.sessions, s)
+		st := s.Stats()
+		st.SendQueueDepth = 0 // no more writes are queued
+		st.ReceiveBuffered = 0
+		expvarTotals.closed.add(st)
+	}
+	expvarTotals.Unlock()
+}
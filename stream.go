@@ -1,7 +1,7 @@
 package smux
 
 import (
-	"bytes"
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -13,17 +13,67 @@ import (
 
 // Stream implements io.ReadWriteCloser
 type Stream struct {
+	lastActive    int64 // unix nanoseconds of the last read or write, first for atomic alignment
 	id            uint32
 	rstflag       int32
+	finflag       int32 // the yamux peer half-closed the stream
+	rstErr        error // reason of the reset, guarded by bufferLock
 	sess          *Session
-	buffer        bytes.Buffer
+	buffer        segmentRing
 	bufferLock    sync.Mutex
 	frameSize     int
 	chReadEvent   chan struct{} // notify a read event
 	die           chan struct{} // flag the stream has closed
 	dieLock       sync.Mutex
-	readDeadline  atomic.Value
-	writeDeadline atomic.Value
+	life          context.Context    // canceled once the stream closed, made by Context
+	lifeCancel    context.CancelFunc // cancels life, guarded by dieLock
+	readDeadline  deadline
+	writeDeadline deadline
+
+	wbuf      []byte      // coalesced writes waiting for a flush
+	wbufErr   error       // error of the last delayed flush
+	wbufTimer *time.Timer // flushes wbuf once the coalesce delay elapsed
+	wbufLock  sync.Mutex
+
+	inflight    int32         // writes being sent
+	chWriteDone chan struct{} // notify an inflight write completed
+	linger      int64         // time Close waits for inflight writes
+	records     int32         // flag a Read returns the data of one frame at most
+
+	// flow control of protocol version 2
+	numRead      uint32        // bytes read, guarded by bufferLock
+	incr         uint32        // bytes read since the last update, guarded by bufferLock
+	numWritten   uint32        // bytes sent
+	peerConsumed uint32        // bytes the peer read
+	peerWindow   uint32        // receive window of the peer
+	chUpdate     chan struct{} // notify a window update
+
+	stallSince time.Time // when the unread data went over StallThreshold
+	stalled    bool      // the stall was reported
+
+	peer  *PeerInfo // original client of the stream
+	proto string    // application protocol of the stream
+
+	authToken []byte // auth token sent by the opener, until checked
+
+	qosClass  int32       // index of the QoS class in the scheduler, 0 for best effort
+	sendLimit sendLimiter // rate cap of the data sent
+
+	rw        io.ReadWriter // interceptors of the stream, nil without
+	rwClosers []io.Closer   // interceptors to close with the stream
+	rwClosed  int32         // flag the interceptors were closed
+
+	// messages of WriteMsg and ReadMsg
+	msgWriteLock sync.Mutex
+	msgReadLock  sync.Mutex
+	msgHdr       [msgHeaderSize]byte // length of the message read
+	msgHdrN      int                 // bytes of msgHdr read
+	msgBuf       []byte              // message read, nil until its length is known
+	msgN         int                 // bytes of msgBuf read
+
+	ctx      context.Context // trace context of the stream
+	span     Span            // lifetime of the stream when a Tracer is set
+	spanOnce sync.Once
 }
 
 // newStream initiates a Stream struct
@@ -33,7 +83,14 @@ func newStream(id uint32, frameSize int, sess *Session) *Stream {
 	s.chReadEvent = make(chan struct{}, 1)
 	s.frameSize = frameSize
 	s.sess = sess
+	s.buffer = newSegmentRing(&sess.segmentPool)
 	s.die = make(chan struct{})
+	s.chWriteDone = make(chan struct{}, 1)
+	s.chUpdate = make(chan struct{}, 1)
+	s.peerWindow = initialPeerWindow
+	s.linger = int64(sess.config.CloseLinger)
+	s.ctx = context.Background()
+	s.touch()
 	return s
 }
 
@@ -42,33 +99,86 @@ func (s *Stream) ID() uint32 {
 	return s.id
 }
 
+// Session returns the session the stream is multiplexed on.
+func (s *Stream) Session() *Session {
+	return s.sess
+}
+
+// Context returns a context canceled once the stream is closed or
+// reset by either end, or its session dies, for the calls made on
+// behalf of the stream. It carries the values of TraceContext.
+func (s *Stream) Context() context.Context {
+	s.dieLock.Lock()
+	defer s.dieLock.Unlock()
+	if s.life == nil {
+		s.life, s.lifeCancel = context.WithCancel(s.ctx)
+		select {
+		case <-s.die:
+			s.lifeCancel()
+		default:
+			if atomic.LoadInt32(&s.rstflag) == 1 {
+				s.lifeCancel()
+			}
+		}
+	}
+	return s.life
+}
+
+// markDead closes die, the caller holds dieLock
+func (s *Stream) markDead() {
+	close(s.die)
+	s.cancelContext()
+}
+
+// cancelContext cancels the context of Context, the caller holds
+// dieLock
+func (s *Stream) cancelContext() {
+	if s.lifeCancel != nil {
+		s.lifeCancel()
+	}
+}
+
 // Read implements io.ReadWriteCloser
 func (s *Stream) Read(b []byte) (n int, err error) {
-	var deadline <-chan time.Time
-	if d, ok := s.readDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer := time.NewTimer(d.Sub(time.Now()))
-		defer timer.Stop()
-		deadline = timer.C
+	if s.rw != nil {
+		return s.rw.Read(b)
 	}
+	return s.read(b)
+}
+
+// read reads the data received, under the interceptors
+func (s *Stream) read(b []byte) (n int, err error) {
+	deadline := s.readDeadline.wait()
 
 READ:
 	select {
 	case <-s.die:
-		return 0, errors.New(errBrokenPipe)
+		return 0, s.dieError()
 	case <-deadline:
 		return n, errTimeout
 	default:
 	}
 
 	s.bufferLock.Lock()
-	n, err = s.buffer.Read(b)
+	if atomic.LoadInt32(&s.records) == 1 {
+		n = s.buffer.ReadRecord(b)
+	} else {
+		n = s.buffer.Read(b)
+	}
+	upd, update := s.accountRead(n)
 	s.bufferLock.Unlock()
 
 	if n > 0 {
-		s.sess.returnTokens(n)
+		s.touch()
+		s.sess.returnTokens(s, n)
+		if update {
+			s.sendWindowUpdate(upd)
+		}
 		return n, nil
 	} else if atomic.LoadInt32(&s.rstflag) == 1 {
 		_ = s.Close()
+		return 0, s.resetError()
+	} else if atomic.LoadInt32(&s.finflag) == 1 {
 		return 0, io.EOF
 	}
 
@@ -78,54 +188,271 @@ READ:
 	case <-deadline:
 		return n, errTimeout
 	case <-s.die:
-		return 0, errors.New(errBrokenPipe)
+		return 0, s.dieError()
+	}
+}
+
+// Peek returns a copy of the next n bytes received without consuming
+// them, blocking until that many are buffered or the read deadline.
+// It returns the bytes buffered along with the error when fewer are,
+// such as once the stream is closed. Peek sees the data as received,
+// ahead of the interceptors. n may neither be negative nor larger
+// than the data the stream can buffer.
+func (s *Stream) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.New(errNegativePeek)
+	}
+	if n > s.sess.peekLimit() {
+		return nil, errors.New(errPeekTooLarge)
+	}
+	deadline := s.readDeadline.wait()
+
+	buf := make([]byte, n)
+	for {
+		s.bufferLock.Lock()
+		b := buf[:s.buffer.Peek(buf)]
+		s.bufferLock.Unlock()
+
+		if len(b) == n {
+			// a Read waiting along may have missed the event
+			s.notifyReadEvent()
+			return b, nil
+		} else if atomic.LoadInt32(&s.rstflag) == 1 {
+			return b, s.resetError()
+		} else if atomic.LoadInt32(&s.finflag) == 1 {
+			return b, io.EOF
+		}
+
+		select {
+		case <-s.chReadEvent:
+		case <-deadline:
+			return b, errTimeout
+		case <-s.die:
+			return b, s.dieError()
+		}
+	}
+}
+
+// peekLimit returns the most data a stream can buffer
+func (s *Session) peekLimit() int {
+	if s.flowControlled() {
+		return s.config.MaxStreamBuffer
+	}
+	if limit := s.maxStreamReceiveBuffer(); limit > 0 {
+		return limit
+	}
+	return s.config.MaxReceiveBuffer
+}
+
+// ReadBuffer returns received data without copying it, blocking like
+// Read until some is available. The buffer belongs to the stream and
+// must not be used after calling release.
+func (s *Stream) ReadBuffer() (buf []byte, release func(), err error) {
+	if s.rw != nil {
+		// the data is copied out of the interceptors
+		buf = make([]byte, s.frameSize)
+		n, err := s.rw.Read(buf)
+		if n == 0 && err != nil {
+			return nil, nil, err
+		}
+		return buf[:n], func() {}, nil
+	}
+	deadline := s.readDeadline.wait()
+
+	for {
+		select {
+		case <-s.die:
+			return nil, nil, s.dieError()
+		case <-deadline:
+			return nil, nil, errTimeout
+		default:
+		}
+
+		s.bufferLock.Lock()
+		seg, ok := s.buffer.ReadSegment()
+		upd, update := s.accountRead(seg.end - seg.off)
+		s.bufferLock.Unlock()
+
+		if ok {
+			s.touch()
+			s.sess.returnTokens(s, seg.end-seg.off)
+			if update {
+				s.sendWindowUpdate(upd)
+			}
+			release = func() { s.sess.segmentPool.Put(seg.buf[:0]) }
+			return seg.buf[seg.off:seg.end], release, nil
+		} else if atomic.LoadInt32(&s.rstflag) == 1 {
+			_ = s.Close()
+			return nil, nil, s.resetError()
+		} else if atomic.LoadInt32(&s.finflag) == 1 {
+			return nil, nil, io.EOF
+		}
+
+		select {
+		case <-s.chReadEvent:
+		case <-deadline:
+			return nil, nil, errTimeout
+		case <-s.die:
+			return nil, nil, s.dieError()
+		}
 	}
 }
 
 // Write implements io.ReadWriteCloser
 func (s *Stream) Write(b []byte) (n int, err error) {
-	var deadline <-chan time.Time
-	if d, ok := s.writeDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer := time.NewTimer(d.Sub(time.Now()))
-		defer timer.Stop()
-		deadline = timer.C
+	if s.rw != nil {
+		return s.rw.Write(b)
+	}
+	return s.send(b)
+}
+
+// send writes b under the interceptors, coalesced with the next
+// writes when WriteCoalesceDelay is set
+func (s *Stream) send(b []byte) (n int, err error) {
+	s.touch()
+	delay := s.sess.config.WriteCoalesceDelay
+	if delay <= 0 {
+		return s.write(b)
 	}
 
+	s.wbufLock.Lock()
+	defer s.wbufLock.Unlock()
+	if err := s.wbufErr; err != nil {
+		s.wbufErr = nil
+		return 0, err
+	}
 	select {
 	case <-s.die:
-		return 0, errors.New(errBrokenPipe)
+		return 0, s.dieError()
 	default:
 	}
 
-	frames := s.split(b, cmdPSH, s.id)
-	sent := 0
-	for k := range frames {
-		req := writeRequest{
-			frame:  frames[k],
-			result: make(chan writeResult, 1),
+	s.wbuf = append(s.wbuf, b...)
+	if len(s.wbuf) < s.frameSize {
+		if s.wbufTimer == nil {
+			s.wbufTimer = time.AfterFunc(delay, s.delayedFlush)
 		}
-		if s.sess.encrypted && req.frame.cmd == cmdPSH {
-			if err := encrypt(s.sess, req.frame.data, req.frame.data); err != nil {
-				return 0, err
+		return len(b), nil
+	}
+
+	pending := len(s.wbuf) - len(b)
+	sent, err := s.flushLocked()
+	if sent -= pending; sent < 0 {
+		sent = 0
+	}
+	return sent, err
+}
+
+// Flush sends the data coalesced by previous writes
+func (s *Stream) Flush() error {
+	s.wbufLock.Lock()
+	defer s.wbufLock.Unlock()
+	if err := s.wbufErr; err != nil {
+		s.wbufErr = nil
+		return err
+	}
+	_, err := s.flushLocked()
+	return err
+}
+
+// delayedFlush runs when the coalesce delay elapsed, its error
+// is reported by the next Write or Flush
+func (s *Stream) delayedFlush() {
+	s.wbufLock.Lock()
+	defer s.wbufLock.Unlock()
+	s.wbufTimer = nil
+	if _, err := s.flushLocked(); err != nil {
+		s.wbufErr = err
+	}
+}
+
+// flushLocked writes out wbuf, wbufLock must be held
+func (s *Stream) flushLocked() (int, error) {
+	if s.wbufTimer != nil {
+		s.wbufTimer.Stop()
+		s.wbufTimer = nil
+	}
+	if len(s.wbuf) == 0 {
+		return 0, nil
+	}
+	n, err := s.write(s.wbuf)
+	if err != nil {
+		// a queued request may still reference the buffer
+		s.wbuf = nil
+		return n, err
+	}
+	s.wbuf = s.wbuf[:0]
+	return n, nil
+}
+
+// write splits b into frames and waits for them to be sent
+func (s *Stream) write(b []byte) (n int, err error) {
+	atomic.AddInt32(&s.inflight, 1)
+	defer s.writeDone()
+
+	deadline := s.writeDeadline.wait()
+
+	select {
+	case <-s.die:
+		return 0, s.dieError()
+	default:
+	}
+
+	sent := 0
+	for len(b) > 0 {
+		size := s.frameSize
+		if win := s.sendWindow(); win <= 0 {
+			if err := s.waitWindow(deadline); err != nil {
+				return sent, err
 			}
+			continue
+		} else if win < size {
+			size = win
 		}
 
+		frame := newFrame(cmdPSH, s.id)
+		frame.data = b
+		if len(b) > size {
+			frame.data = b[:size]
+		}
+		b = b[len(frame.data):]
+
+		ticket, err := s.schedule(len(frame.data), deadline)
+		if err != nil {
+			return sent, err
+		}
+
+		req := newWriteRequest(frame)
+		req.plain = frame.data
+		atomic.AddInt64(&s.sess.stats.sendQueueDepth, 1)
 		select {
 		case s.sess.writes <- req:
+			atomic.AddInt64(&s.sess.stats.sendQueueDepth, -1)
+			s.endTurn(ticket)
 		case <-s.die:
-			return sent, errors.New(errBrokenPipe)
+			atomic.AddInt64(&s.sess.stats.sendQueueDepth, -1)
+			s.endTurn(ticket)
+			req.release()
+			return sent, s.dieError()
 		case <-deadline:
+			atomic.AddInt64(&s.sess.stats.sendQueueDepth, -1)
+			s.endTurn(ticket)
+			req.release()
 			return sent, errTimeout
 		}
 
 		select {
 		case result := <-req.result:
+			req.release()
 			sent += result.n
+			if !result.dropped {
+				atomic.AddUint32(&s.numWritten, uint32(result.n))
+			}
 			if result.err != nil {
 				return sent, result.err
 			}
 		case <-s.die:
-			return sent, errors.New(errBrokenPipe)
+			return sent, s.dieError()
 		case <-deadline:
 			return sent, errTimeout
 		}
@@ -133,8 +460,185 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 	return sent, nil
 }
 
-// Close implements io.ReadWriteCloser
+// WriteBuffers writes the buffers of v as one write of their
+// concatenation, without the caller concatenating them: the small
+// buffers are packed together into pooled frame buffers of the
+// session, the whole frames of the large ones are sent in place.
+func (s *Stream) WriteBuffers(v net.Buffers) (n int64, err error) {
+	if s.rw != nil || s.sess.config.WriteCoalesceDelay > 0 {
+		// the interceptors and the coalescing see each buffer
+		for _, b := range v {
+			nw, ew := s.Write(b)
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+		}
+		return n, nil
+	}
+
+	s.touch()
+	buf := s.sess.xmitPool.Get().([]byte)[:0]
+	for _, b := range v {
+		for len(b) > 0 {
+			if len(buf) == 0 && len(b) >= s.frameSize {
+				size := len(b) - len(b)%s.frameSize
+				nw, ew := s.write(b[:size])
+				n += int64(nw)
+				if ew != nil {
+					s.sess.xmitPool.Put(buf)
+					return n, ew
+				}
+				b = b[size:]
+				continue
+			}
+			c := copy(buf[len(buf):s.frameSize], b)
+			buf, b = buf[:len(buf)+c], b[c:]
+			if len(buf) == s.frameSize {
+				nw, ew := s.write(buf)
+				n += int64(nw)
+				if ew != nil {
+					// the buffer may still be referenced by a queued request
+					return n, ew
+				}
+				buf = buf[:0]
+			}
+		}
+	}
+	if len(buf) > 0 {
+		nw, ew := s.write(buf)
+		n += int64(nw)
+		if ew != nil {
+			return n, ew
+		}
+	}
+	s.sess.xmitPool.Put(buf)
+	return n, nil
+}
+
+// Writev writes the buffers of v as WriteBuffers does
+func (s *Stream) Writev(v ...[]byte) (n int64, err error) {
+	return s.WriteBuffers(v)
+}
+
+// ReadFrom implements io.ReaderFrom, r is read directly into
+// pooled frame buffers of the session
+func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
+	if s.rw != nil {
+		return io.Copy(struct{ io.Writer }{s.rw}, r)
+	}
+	for {
+		buf := s.sess.xmitPool.Get().([]byte)
+		nr, er := r.Read(buf[:s.frameSize])
+		if nr > 0 {
+			nw, ew := s.Write(buf[:nr])
+			n += int64(nw)
+			if ew != nil {
+				// the buffer may still be referenced by a queued request
+				return n, ew
+			}
+		}
+		s.sess.xmitPool.Put(buf)
+		if er == io.EOF {
+			return n, nil
+		} else if er != nil {
+			return n, er
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, received frame buffers are
+// handed to w without copying
+func (s *Stream) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		buf, release, er := s.ReadBuffer()
+		if er == io.EOF {
+			return n, nil
+		} else if er != nil {
+			return n, er
+		}
+		nw, ew := w.Write(buf)
+		release()
+		n += int64(nw)
+		if ew != nil {
+			return n, ew
+		}
+		if nw < len(buf) {
+			return n, io.ErrShortWrite
+		}
+	}
+}
+
+// writeDone marks the end of an inflight write
+func (s *Stream) writeDone() {
+	atomic.AddInt32(&s.inflight, -1)
+	select {
+	case s.chWriteDone <- struct{}{}:
+	default:
+	}
+}
+
+// SetLinger sets how long Close waits for writes still in progress
+// on other goroutines to be sent before resetting the stream.
+// Zero makes Close abort them.
+func (s *Stream) SetLinger(d time.Duration) {
+	atomic.StoreInt64(&s.linger, int64(d))
+}
+
+// SetRecordMode makes each Read return the data of a single frame
+// received, or the rest of it when b is shorter, rather than the data
+// of as many frames as fit. A peer writing no more than a frame at a
+// time, without WriteCoalesceDelay, gets the boundaries of its writes
+// kept. Frames buffered before the mode was set may already be joined.
+func (s *Stream) SetRecordMode(on bool) {
+	var flag int32
+	if on {
+		flag = 1
+	}
+	atomic.StoreInt32(&s.records, flag)
+}
+
+// waitInflight waits up to the linger time for inflight writes
+func (s *Stream) waitInflight() {
+	linger := time.Duration(atomic.LoadInt64(&s.linger))
+	if linger <= 0 || atomic.LoadInt32(&s.inflight) == 0 {
+		return
+	}
+	timer := time.NewTimer(linger)
+	defer timer.Stop()
+	for atomic.LoadInt32(&s.inflight) > 0 {
+		select {
+		case <-s.chWriteDone:
+		case <-timer.C:
+			return
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// Close implements io.ReadWriteCloser, data written before is sent
+// ahead of the reset, writes in progress get the linger time to finish
 func (s *Stream) Close() error {
+	return s.closeWith(s.sess.closeFrame(s.id))
+}
+
+// CloseWithError closes the stream like Close, telling the peer why
+// with an application defined code: its reads return a *StreamError
+// of that code once the data sent before was read. Peers speaking
+// upstream smux see a plain close, peers speaking yamux a reset.
+func (s *Stream) CloseWithError(code uint32) error {
+	return s.closeWith(s.sess.resetFrame(s.id, code, "closed with error"))
+}
+
+// closeWith closes the stream with f, the RST frame to send
+func (s *Stream) closeWith(f Frame) error {
+	s.closeInterceptors()
+	if s.sess.config.WriteCoalesceDelay > 0 {
+		s.Flush()
+	}
+	s.waitInflight()
+
 	s.dieLock.Lock()
 
 	select {
@@ -142,19 +646,37 @@ func (s *Stream) Close() error {
 		s.dieLock.Unlock()
 		return errors.New(errBrokenPipe)
 	default:
-		close(s.die)
+		s.markDead()
 		s.dieLock.Unlock()
 		s.sess.streamClosed(s.id)
-		_, err := s.sess.writeFrame(newFrame(cmdRST, s.id))
+		_, err := s.sess.writeFrame(f)
+		s.endSpan(err)
 		return err
 	}
 }
 
+// reset closes the stream telling the peer why
+func (s *Stream) reset(code uint32, msg string) {
+	err := &StreamError{Code: code, Message: msg}
+	s.markRST(err)
+	s.dieLock.Lock()
+	select {
+	case <-s.die:
+		s.dieLock.Unlock()
+	default:
+		s.markDead()
+		s.dieLock.Unlock()
+		s.sess.streamClosed(s.id)
+		s.sess.resetStream(s.id, code, msg)
+		s.endSpan(err)
+	}
+}
+
 // SetReadDeadline sets the read deadline as defined by
 // net.Conn.SetReadDeadline.
 // A zero time value disables the deadline.
 func (s *Stream) SetReadDeadline(t time.Time) error {
-	s.readDeadline.Store(t)
+	s.readDeadline.set(t)
 	return nil
 }
 
@@ -162,7 +684,7 @@ func (s *Stream) SetReadDeadline(t time.Time) error {
 // net.Conn.SetWriteDeadline.
 // A zero time value disables the deadline.
 func (s *Stream) SetWriteDeadline(t time.Time) error {
-	s.writeDeadline.Store(t)
+	s.writeDeadline.set(t)
 	return nil
 }
 
@@ -187,63 +709,48 @@ func (s *Stream) sessionClose() {
 	select {
 	case <-s.die:
 	default:
-		close(s.die)
+		s.markDead()
+		s.endSpan(s.sess.dieError())
 	}
 }
 
 // LocalAddr satisfies net.Conn interface
 func (s *Stream) LocalAddr() net.Addr {
-	if ts, ok := s.sess.conn.(interface {
-		LocalAddr() net.Addr
-	}); ok {
-		return ts.LocalAddr()
-	}
-	return nil
+	return s.sess.LocalAddr()
 }
 
 // RemoteAddr satisfies net.Conn interface
 func (s *Stream) RemoteAddr() net.Addr {
-	if ts, ok := s.sess.conn.(interface {
-		RemoteAddr() net.Addr
-	}); ok {
-		return ts.RemoteAddr()
-	}
-	return nil
+	return s.sess.RemoteAddr()
 }
 
-// pushBytes a slice into buffer
-func (s *Stream) pushBytes(p []byte) {
+// pushSegment queues a buffer of the session segmentPool, the stream
+// takes ownership of it
+func (s *Stream) pushSegment(p []byte) {
 	s.bufferLock.Lock()
-	s.buffer.Write(p)
+	if atomic.LoadInt32(&s.records) == 1 {
+		s.buffer.WriteRecord(p)
+	} else {
+		s.buffer.WriteSegment(p)
+	}
 	s.bufferLock.Unlock()
 }
 
+// buffered returns the number of bytes waiting to be read
+func (s *Stream) buffered() int {
+	s.bufferLock.Lock()
+	defer s.bufferLock.Unlock()
+	return s.buffer.Len()
+}
+
 // recycleTokens transform remaining bytes to tokens(will truncate buffer)
 func (s *Stream) recycleTokens() (n int) {
 	s.bufferLock.Lock()
-	n = s.buffer.Len()
-	s.buffer.Reset()
+	n = s.buffer.Reset()
 	s.bufferLock.Unlock()
 	return
 }
 
-// split large byte buffer into smaller frames, reference only
-func (s *Stream) split(bts []byte, cmd byte, sid uint32) []Frame {
-	var frames []Frame
-	for len(bts) > s.frameSize {
-		frame := newFrame(cmd, sid)
-		frame.data = bts[:s.frameSize]
-		bts = bts[s.frameSize:]
-		frames = append(frames, frame)
-	}
-	if len(bts) > 0 {
-		frame := newFrame(cmd, sid)
-		frame.data = bts
-		frames = append(frames, frame)
-	}
-	return frames
-}
-
 // notify read event
 func (s *Stream) notifyReadEvent() {
 	select {
@@ -253,8 +760,44 @@ func (s *Stream) notifyReadEvent() {
 }
 
 // mark this stream has been reset
-func (s *Stream) markRST() {
+func (s *Stream) markRST(err error) {
+	s.bufferLock.Lock()
+	if s.rstErr == nil {
+		s.rstErr = err
+	}
+	s.bufferLock.Unlock()
 	atomic.StoreInt32(&s.rstflag, 1)
+
+	s.dieLock.Lock()
+	s.cancelContext()
+	s.dieLock.Unlock()
+}
+
+// dieError returns the error for calls failing on a closed stream:
+// the reason of its reset, the reason the session closed, or a
+// broken pipe once closed by the application
+func (s *Stream) dieError() error {
+	s.bufferLock.Lock()
+	err := s.rstErr
+	s.bufferLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.sess.IsClosed() {
+		return s.sess.dieError()
+	}
+	return errors.New(errBrokenPipe)
+}
+
+// resetError returns the error of reads once the data received
+// before the reset was read, io.EOF for a plain close
+func (s *Stream) resetError() error {
+	s.bufferLock.Lock()
+	defer s.bufferLock.Unlock()
+	if s.rstErr != nil {
+		return s.rstErr
+	}
+	return io.EOF
 }
 
 var errTimeout error = &timeoutError{}
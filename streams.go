@@ -0,0 +1,100 @@
+package smux
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const streamShards = 32
+
+// streamTable holds the open streams of a session, sharded by stream
+// identifier so that streams do not all contend on a single lock
+type streamTable struct {
+	shards [streamShards]streamShard
+	count  int32 // streams inserted or reserved to be
+}
+
+type streamShard struct {
+	sync.Mutex
+	streams map[uint32]*Stream
+}
+
+func (t *streamTable) init() {
+	for k := range t.shards {
+		t.shards[k].streams = make(map[uint32]*Stream)
+	}
+}
+
+// shard returns the shard holding sid, identifiers of one side
+// differ by two so the parity bit is skipped
+func (t *streamTable) shard(sid uint32) *streamShard {
+	return &t.shards[(sid>>1)%streamShards]
+}
+
+// get returns the stream with identifier sid
+func (t *streamTable) get(sid uint32) (*Stream, bool) {
+	sh := t.shard(sid)
+	sh.Lock()
+	stream, ok := sh.streams[sid]
+	sh.Unlock()
+	return stream, ok
+}
+
+// reserve counts a stream about to be inserted, it fails when max
+// streams are counted already, 0 is no limit
+func (t *streamTable) reserve(max int) bool {
+	for {
+		n := atomic.LoadInt32(&t.count)
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&t.count, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release uncounts a stream deleted or never inserted
+func (t *streamTable) release() {
+	atomic.AddInt32(&t.count, -1)
+}
+
+// insert adds a reserved stream unless its identifier is already in use
+func (t *streamTable) insert(stream *Stream) bool {
+	sh := t.shard(stream.id)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.streams[stream.id]; ok {
+		return false
+	}
+	sh.streams[stream.id] = stream
+	return true
+}
+
+// remove deletes the stream with identifier sid
+func (t *streamTable) remove(sid uint32) {
+	sh := t.shard(sid)
+	sh.Lock()
+	if _, ok := sh.streams[sid]; ok {
+		delete(sh.streams, sid)
+		t.release()
+	}
+	sh.Unlock()
+}
+
+// len returns the number of streams
+func (t *streamTable) len() int {
+	return int(atomic.LoadInt32(&t.count))
+}
+
+// each calls fn for every stream, shard by shard with the shard locked
+func (t *streamTable) each(fn func(*Stream)) {
+	for k := range t.shards {
+		sh := &t.shards[k]
+		sh.Lock()
+		for _, stream := range sh.streams {
+			fn(stream)
+		}
+		sh.Unlock()
+	}
+}
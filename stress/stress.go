@@ -0,0 +1,330 @@
+// Package stress runs thousands of concurrent streams of random sizes
+// over a session pair, cancelling and resetting some of them, then
+// checks the sessions came back to rest: no stream left open, every
+// receive token returned and no goroutine left behind.
+package stress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/superfly/smux"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// settleTimeout bounds the wait for the sessions to come back to rest
+const settleTimeout = 10 * time.Second
+
+// Options describes one stress run
+type Options struct {
+	Duration  time.Duration // how long streams are opened
+	Streams   int           // concurrent streams
+	MaxSize   int           // largest payload of a stream
+	Encrypted bool          // use an encrypted session pair
+	Seed      int64         // seed of the random actions, zero seeds from the clock
+}
+
+// DefaultOptions returns the options used for unset fields
+func DefaultOptions() Options {
+	return Options{
+		Duration: 10 * time.Second,
+		Streams:  64,
+		MaxSize:  64 << 10,
+	}
+}
+
+// Result counts the streams of a run by outcome
+type Result struct {
+	Options Options
+
+	Streams   int64 // streams opened
+	Echoed    int64 // streams whose payload came back whole
+	Cancelled int64 // streams abandoned on a deadline
+	Closed    int64 // streams closed early by either end
+	Bytes     int64 // payload bytes echoed
+}
+
+// actions of a stream, sent in its header
+const (
+	actionEcho        byte = iota // the server echoes the payload
+	actionCancel                  // as echo, under a short deadline
+	actionClientClose             // the client closes halfway through the payload
+	actionServerClose             // the server closes halfway through the payload
+	numActions
+)
+
+// headerSize is the size of a stream header: payload size and action
+const headerSize = 5
+
+// Run opens streams on a session pair for Duration and checks the
+// invariants once they are done
+func Run(opts Options) (*Result, error) {
+	def := DefaultOptions()
+	if opts.Duration <= 0 {
+		opts.Duration = def.Duration
+	}
+	if opts.Streams <= 0 {
+		opts.Streams = def.Streams
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = def.MaxSize
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+
+	goroutines := runtime.NumGoroutine()
+	client, server, err := newPair(opts.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &runner{opts: opts, res: &Result{Options: opts}, errs: make(chan error, opts.Streams+1)}
+	go r.serve(server)
+
+	deadline := time.Now().Add(opts.Duration)
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Streams; i++ {
+		workers.Add(1)
+		go func(seed int64) {
+			defer workers.Done()
+			rnd := mrand.New(mrand.NewSource(seed))
+			for time.Now().Before(deadline) && r.ok() {
+				if err := r.stream(client, rnd); err != nil {
+					r.fail(err)
+				}
+			}
+		}(opts.Seed + int64(i))
+	}
+	workers.Wait()
+
+	err = r.firstError()
+	if err == nil {
+		err = r.settle(client, server)
+	}
+	client.Close()
+	server.Close()
+	r.handlers.Wait()
+	if err == nil {
+		err = settleGoroutines(goroutines)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.res, nil
+}
+
+func newPair(encrypted bool) (client, server *smux.Session, err error) {
+	if !encrypted {
+		return smux.Pipe(0)
+	}
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	c1, c2 := smux.NewPipeConn(0)
+	if client, err = smux.Client(c1, smux.WithEncryption(pub, nil)); err != nil {
+		return nil, nil, err
+	}
+	if server, err = smux.Server(c2, smux.WithEncryption(nil, priv)); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// runner holds the state shared by the streams of a run
+type runner struct {
+	opts     Options
+	res      *Result
+	errs     chan error
+	failed   int32
+	handlers sync.WaitGroup // server side streams
+}
+
+func (r *runner) fail(err error) {
+	if atomic.CompareAndSwapInt32(&r.failed, 0, 1) {
+		r.errs <- err
+	}
+}
+
+func (r *runner) ok() bool {
+	return atomic.LoadInt32(&r.failed) == 0
+}
+
+func (r *runner) firstError() error {
+	select {
+	case err := <-r.errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// serve handles the streams of the server until the session closes
+func (r *runner) serve(server *smux.Session) {
+	for {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		r.handlers.Add(1)
+		go func() {
+			defer r.handlers.Done()
+			defer stream.Close()
+			var hdr [headerSize]byte
+			if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+				return
+			}
+			size := int64(binary.LittleEndian.Uint32(hdr[:]))
+			switch hdr[4] {
+			case actionEcho, actionCancel:
+				io.CopyN(stream, stream, size)
+			case actionClientClose:
+				io.Copy(ioutil.Discard, stream)
+			case actionServerClose:
+				io.CopyN(ioutil.Discard, stream, size/2)
+			}
+		}()
+	}
+}
+
+// stream runs one stream with a random size and action, the errors
+// returned are broken invariants
+func (r *runner) stream(client *smux.Session, rnd *mrand.Rand) error {
+	stream, err := client.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	atomic.AddInt64(&r.res.Streams, 1)
+
+	size := rnd.Intn(r.opts.MaxSize) + 1
+	action := byte(rnd.Intn(int(numActions)))
+	payload := make([]byte, headerSize+size)
+	binary.LittleEndian.PutUint32(payload, uint32(size))
+	payload[4] = action
+	rnd.Read(payload[headerSize:])
+
+	switch action {
+	case actionEcho:
+		if err := echo(stream, payload); err != nil {
+			return err
+		}
+		atomic.AddInt64(&r.res.Echoed, 1)
+		atomic.AddInt64(&r.res.Bytes, int64(size))
+	case actionCancel:
+		stream.SetDeadline(time.Now().Add(time.Duration(rnd.Intn(5000)) * time.Microsecond))
+		switch err := echo(stream, payload); {
+		case err == nil:
+			atomic.AddInt64(&r.res.Echoed, 1)
+			atomic.AddInt64(&r.res.Bytes, int64(size))
+		case isTimeout(err):
+			atomic.AddInt64(&r.res.Cancelled, 1)
+		default:
+			return err
+		}
+	case actionClientClose:
+		if _, err := stream.Write(payload[:headerSize+size/2]); err != nil {
+			return err
+		}
+		atomic.AddInt64(&r.res.Closed, 1)
+	case actionServerClose:
+		// the server may close before the payload is written
+		stream.Write(payload)
+		io.Copy(ioutil.Discard, stream)
+		atomic.AddInt64(&r.res.Closed, 1)
+	}
+	return nil
+}
+
+// echo writes the payload while reading it back
+func echo(stream *smux.Stream, payload []byte) error {
+	werr := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(payload)
+		werr <- err
+	}()
+	reply := make([]byte, len(payload)-headerSize)
+	_, err := io.ReadFull(stream, reply)
+	if err != nil {
+		// unblock the writer
+		stream.Close()
+	}
+	if e := <-werr; err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reply, payload[headerSize:]) {
+		return errors.New("stress: echo mismatch")
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// settle waits for the streams to be gone on both ends and their
+// receive tokens returned
+func (r *runner) settle(client, server *smux.Session) error {
+	done := make(chan struct{})
+	go func() {
+		r.handlers.Wait()
+		close(done)
+	}()
+	timeout := time.After(settleTimeout)
+	select {
+	case <-done:
+	case <-timeout:
+		return errors.New("stress: server streams stuck")
+	}
+
+	for {
+		cs, ss := client.Stats(), server.Stats()
+		n := client.NumStreams() + server.NumStreams()
+		if n == 0 && cs.ReceiveBuffered == 0 && ss.ReceiveBuffered == 0 {
+			return nil
+		}
+		select {
+		case <-timeout:
+			if n > 0 {
+				return fmt.Errorf("stress: %d streams stuck", n)
+			}
+			return fmt.Errorf("stress: receive tokens lost: client %d, server %d", cs.ReceiveBuffered, ss.ReceiveBuffered)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// settleGoroutines waits for the goroutines of the run to exit
+func settleGoroutines(before int) error {
+	timeout := time.After(settleTimeout)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= before {
+			return nil
+		}
+		select {
+		case <-timeout:
+			return fmt.Errorf("stress: %d goroutines leaked", n-before)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
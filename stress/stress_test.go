@@ -0,0 +1,34 @@
+package stress
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+var soak = flag.Duration("soak", 0, "duration of the stress runs, a short run when zero")
+
+func TestRun(t *testing.T) {
+	duration := *soak
+	if duration <= 0 {
+		duration = time.Second
+	}
+	for _, encrypted := range []bool{false, true} {
+		res, err := Run(Options{
+			Duration:  duration,
+			Streams:   64,
+			MaxSize:   32 << 10,
+			Encrypted: encrypted,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Streams == 0 || res.Echoed == 0 {
+			t.Fatal("no streams echoed", res)
+		}
+		if res.Streams != res.Echoed+res.Cancelled+res.Closed {
+			t.Fatal("streams unaccounted for", res)
+		}
+		t.Logf("encrypted=%v: %+v", encrypted, *res)
+	}
+}
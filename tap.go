@@ -0,0 +1,49 @@
+package smux
+
+// Direction tells whether a tapped frame was sent or received
+type Direction int
+
+// frame directions
+const (
+	Outbound Direction = iota // sent to the peer
+	Inbound                   // received from the peer
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "in"
+	}
+	return "out"
+}
+
+// FrameInfo describes a frame passed to Config.FrameTap
+type FrameInfo struct {
+	Version  byte
+	Cmd      byte
+	StreamID uint32
+	Length   int    // payload size on the wire, cipher overhead included
+	Data     []byte // payload with stream data decrypted, only valid during the call
+}
+
+// CmdName returns the name of the command of the frame, such as "PSH"
+func (f FrameInfo) CmdName() string {
+	if f.Version == 2 && f.Cmd == cmdUPD {
+		return "UPD"
+	}
+	return cmdName(f.Cmd)
+}
+
+// tap passes a frame sent or received to the FrameTap, data is its
+// payload before encryption or after decryption
+func (s *Session) tap(dir Direction, f Frame, data []byte) {
+	if s.config.FrameTap == nil {
+		return
+	}
+	s.config.FrameTap(dir, FrameInfo{
+		Version:  f.ver,
+		Cmd:      f.cmd,
+		StreamID: f.sid,
+		Length:   len(f.data),
+		Data:     data,
+	})
+}
@@ -0,0 +1,106 @@
+package smux
+
+import (
+	"context"
+)
+
+// Span is an operation of a trace started by a Tracer
+type Span interface {
+	// AddEvent records something that happened during the span
+	AddEvent(name string, keyvals ...interface{})
+	// End finishes the span, err tells why it failed if not nil
+	End(err error)
+}
+
+// Tracer connects sessions to a distributed tracing system such as
+// OpenTelemetry. Sessions start a span for the key exchange and one
+// for the lifetime of each stream. The trace context of a stream
+// opened with OpenStreamContext travels in its SYN frame, so that
+// the span of the accepted stream joins the same trace.
+type Tracer interface {
+	// Start begins a span named name, child of the span in ctx
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject encodes the trace context of ctx, nil if there is none
+	Inject(ctx context.Context) []byte
+	// Extract returns ctx carrying the trace context encoded in
+	// data, data is only valid during the call
+	Extract(ctx context.Context, data []byte) context.Context
+}
+
+// span names
+const (
+	spanHandshake    = "smux.handshake"
+	spanStreamOpen   = "smux.stream.open"
+	spanStreamAccept = "smux.stream.accept"
+)
+
+// traceOpen starts the span of a stream opened in ctx and appends
+// its trace context to the SYN metadata
+func (s *Session) traceOpen(ctx context.Context, stream *Stream, meta []byte) []byte {
+	tracer := s.config.Tracer
+	if tracer == nil {
+		stream.ctx = ctx
+		return meta
+	}
+	stream.ctx, stream.span = tracer.Start(ctx, spanStreamOpen)
+	stream.span.AddEvent("open", "sid", stream.id)
+	if s.upstream() {
+		return meta // stock peers expect no SYN payload
+	}
+	if tc := tracer.Inject(stream.ctx); len(tc) > 0 && len(tc) <= 255 && len(meta)+2+len(tc) <= maxControlSize {
+		return appendMeta(meta, metaTrace, tc)
+	}
+	return meta
+}
+
+// traceAccept starts the span of a stream opened by the peer, within
+// the trace found in the SYN metadata
+func (s *Session) traceAccept(stream *Stream, meta []byte) {
+	tracer := s.config.Tracer
+	if tracer == nil {
+		return
+	}
+	ctx := context.Background()
+	if tc := findMeta(meta, metaTrace); tc != nil {
+		ctx = tracer.Extract(ctx, tc)
+	}
+	stream.ctx, stream.span = tracer.Start(ctx, spanStreamAccept)
+	stream.span.AddEvent("accept", "sid", stream.id)
+}
+
+// startHandshakeSpan traces the key exchange of an encrypted session
+func (s *Session) startHandshakeSpan() {
+	if s.config.Tracer != nil && s.encrypted {
+		_, s.handshakeSpan = s.config.Tracer.Start(context.Background(), spanHandshake)
+	}
+}
+
+// endHandshakeSpan finishes the span of the key exchange, once
+func (s *Session) endHandshakeSpan(err error) {
+	if s.handshakeSpan == nil {
+		return
+	}
+	s.handshakeSpanOnce.Do(func() {
+		if c := s.frameCipher(); err == nil && c != nil {
+			s.handshakeSpan.AddEvent("key established", "cipher", c.name())
+		}
+		s.handshakeSpan.End(err)
+	})
+}
+
+// endSpan finishes the span of the stream, once
+func (s *Stream) endSpan(err error) {
+	if s.span == nil {
+		return
+	}
+	s.spanOnce.Do(func() {
+		s.span.End(err)
+	})
+}
+
+// TraceContext returns the context carrying the trace of the stream:
+// the one given to OpenStreamContext, or for an accepted stream the
+// trace context sent by the opener when a Tracer is configured
+func (s *Stream) TraceContext() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,186 @@
+package smux
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer establishes the connection under a client session, through
+// an HTTP proxy and wrapped in TLS as configured
+type Dialer struct {
+	// Proxy is the HTTP proxy the connection is tunneled through with
+	// CONNECT, nil connects directly. Its scheme is http or https,
+	// user info is sent as basic proxy authorization.
+	Proxy *url.URL
+
+	// ProxyHeader holds extra headers of the CONNECT request
+	ProxyHeader http.Header
+
+	// TLSConfig wraps the connection to the server in TLS when set,
+	// the server name defaults to the host of the address dialed
+	TLSConfig *tls.Config
+
+	// NetDialer opens the TCP connection, nil uses a zero net.Dialer
+	NetDialer *net.Dialer
+}
+
+// Dial connects to addr and starts the client side of a session over
+// the connection
+func (d *Dialer) Dial(ctx context.Context, addr string, opts ...Option) (*Session, error) {
+	conn, err := d.DialConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := Client(conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// DialConn returns the connection to addr a session would run over.
+// ctx bounds the whole setup, proxy and TLS handshakes included.
+func (d *Dialer) DialConn(ctx context.Context, addr string) (net.Conn, error) {
+	netDialer := d.NetDialer
+	if netDialer == nil {
+		netDialer = &net.Dialer{}
+	}
+
+	target := addr
+	if d.Proxy != nil {
+		target = proxyAddr(d.Proxy)
+	}
+	raw, err := netDialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+
+	// handshakes are bound by the deadline and cancellation of ctx,
+	// set on the raw connection the handshakes run over
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.SetDeadline(time.Now())
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	conn, err := d.handshake(raw, addr)
+	close(done)
+	if <-interrupted && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake goes through the proxy and TLS handshakes over conn, the
+// connection returned is to be closed whatever the error
+func (d *Dialer) handshake(conn net.Conn, addr string) (net.Conn, error) {
+	if d.Proxy != nil {
+		if d.Proxy.Scheme == "https" {
+			tconn := tls.Client(conn, &tls.Config{ServerName: d.Proxy.Hostname()})
+			if err := tconn.Handshake(); err != nil {
+				return tconn, errors.Wrap(err, "proxy tls handshake")
+			}
+			conn = tconn
+		}
+		var err error
+		if conn, err = connect(conn, addr, d.Proxy, d.ProxyHeader); err != nil {
+			return conn, err
+		}
+	}
+
+	if d.TLSConfig != nil {
+		config := d.TLSConfig
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return conn, err
+			}
+			config = config.Clone()
+			config.ServerName = host
+		}
+		tconn := tls.Client(conn, config)
+		if err := tconn.Handshake(); err != nil {
+			return tconn, errors.Wrap(err, "tls handshake")
+		}
+		conn = tconn
+	}
+	return conn, nil
+}
+
+// proxyAddr returns the host and port of a proxy URL
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	if proxy.Scheme == "https" {
+		return net.JoinHostPort(proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// connect asks the proxy behind conn for a tunnel to addr
+func connect(conn net.Conn, addr string, proxy *url.URL, header http.Header) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.SetBasicAuth(u.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, errors.Wrap(err, "proxy connect")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, errors.Wrap(err, "proxy connect")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return conn, errors.Errorf("proxy connect: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// the server spoke first, its bytes were read with the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads through the buffer that read ahead of its data
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
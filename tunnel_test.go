@@ -0,0 +1,142 @@
+package smux
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// connectProxy serves CONNECT requests authorized as user:secret
+func connectProxy() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "connect only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+func TestDialerProxyTLS(t *testing.T) {
+	// borrow the certificate of a TLS test server
+	certServer := httptest.NewTLSServer(nil)
+	serverConfig := certServer.TLS
+	clientConfig := certServer.Client().Transport.(*http.Transport).TLSClientConfig
+	certServer.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				session, _ := Server(conn, nil)
+				defer session.Close()
+				stream, err := session.AcceptStream()
+				if err != nil {
+					return
+				}
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	proxy := connectProxy()
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	d := &Dialer{Proxy: proxyURL, TLSConfig: clientConfig}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the server name defaults to the host dialed, the test
+	// certificate is issued to 127.0.0.1 and not localhost
+	session, err := d.Dial(ctx, net.JoinHostPort("localhost", port))
+	if err == nil {
+		session.Close()
+		t.Fatal("accepted a certificate for another name")
+	}
+	session, err = d.Dial(ctx, net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("unexpected echo", string(buf), err)
+	}
+}
+
+func TestDialerProxyRefused(t *testing.T) {
+	proxy := connectProxy()
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	d := &Dialer{Proxy: proxyURL}
+	if _, err := d.DialConn(context.Background(), "127.0.0.1:1"); err == nil {
+		t.Fatal("dialed without proxy authorization")
+	}
+
+	// a proxy that never answers is bounded by the context
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	d.Proxy, _ = url.Parse("http://" + ln.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.DialConn(ctx, "127.0.0.1:1"); err == nil {
+		t.Fatal("dialed through a silent proxy")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("dial outlived its context")
+	}
+}
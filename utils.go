@@ -1,8 +1,6 @@
 package smux
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"errors"
 
@@ -31,25 +29,30 @@ func newSecret(privateKey, peersPublicKey *[32]byte) *[32]byte {
 	return &secret
 }
 
-func sealSecret(secret, publicKey *[32]byte) ([]byte, error) {
+// sealSecret seals the shared key followed by the cipher suites
+// offered, servers unaware of suites ignore the extra bytes
+func sealSecret(secret, publicKey *[32]byte, suites []byte) ([]byte, error) {
 	var nonce [24]byte
 	_, err := rand.Read(nonce[:])
 	if err != nil {
 		return nil, err
 	}
 
-	encrypted := box.SealAfterPrecomputation(nonce[:], secret[:], &nonce, secret)
+	plaintext := append(secret[:len(secret):len(secret)], suites...)
+	encrypted := box.SealAfterPrecomputation(nonce[:], plaintext, &nonce, secret)
 	msg := make([]byte, len(encrypted)+32)
 	copy(msg[:32], publicKey[:])
 	copy(msg[32:], encrypted)
 	return msg, nil
 }
 
-func verifyKeyExchange(privKey *[32]byte, data []byte) (*[32]byte, error) {
+// verifyKeyExchange opens a KXR payload, it returns the shared key
+// and the cipher suites offered by the client
+func verifyKeyExchange(privKey *[32]byte, data []byte) (*[32]byte, []byte, error) {
 	// msg must include:
 	// nonce (24 bytes), session public key (32 bytes), encrypted shared key (at least 32 bytes)
 	if len(data) < 24+32+32 {
-		return nil, errors.New(errBadKeyExchange)
+		return nil, nil, errors.New(errBadKeyExchange)
 	}
 
 	var nonce [24]byte
@@ -58,43 +61,9 @@ func verifyKeyExchange(privKey *[32]byte, data []byte) (*[32]byte, error) {
 	copy(nonce[:], data[32:24+32])
 	decrypted, ok := box.Open([]byte{}, data[24+32:], &nonce, &sessionPublicKey, privKey)
 	if !ok || len(decrypted) < 32 {
-		return nil, errors.New(errBadKey)
+		return nil, nil, errors.New(errBadKey)
 	}
 	var sharedKey [32]byte
 	copy(sharedKey[:], decrypted)
-	return &sharedKey, nil
-}
-
-func decrypt(s *Session, dst []byte, src []byte) error {
-	/*tmp := make([]byte, len(src))
-	s.cryptStreamLock.Lock()
-	defer s.cryptStreamLock.Unlock()
-	if s.cryptStream == nil {
-		return errors.New(errNoEncryptionKey)
-	}
-	*/
-	s.cryptStreamLock.Lock()
-	defer s.cryptStreamLock.Unlock()
-	stream, err := newCipherStream(s.encryptionKey)
-	if err != nil {
-		return err
-	}
-	stream.XORKeyStream(dst, src)
-	return nil
-}
-
-func encrypt(s *Session, dst []byte, src []byte) error {
-	// encrypt and decrypt are symmetric
-	return decrypt(s, dst, src)
-}
-
-func newCipherStream(key *[32]byte) (cipher.Stream, error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-
-	// If the key is unique for each ciphertext, then it's ok to use a zero IV.
-	var iv [aes.BlockSize]byte
-	return cipher.NewOFB(block, iv[:]), nil
+	return &sharedKey, decrypted[32:], nil
 }
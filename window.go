@@ -0,0 +1,189 @@
+package smux
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superfly/smux/frame"
+)
+
+// protocol version 2 of xtaci/smux adds per-stream flow control: the
+// receiver of a stream tells how much it read and the size of its
+// window in UPD frames, the sender keeps the data in flight within
+// the window. UPD reuses the value of KXS, which version 2 lacks.
+const (
+	cmdUPD = frame.CmdUPD // window update
+
+	updSize           = frame.UpdateSize // consumed and window
+	initialPeerWindow = 262144           // window assumed until the first UPD
+
+	// windowProbeInterval is how long a write waits for a UPD
+	// before probing the window with an empty PSH, which the peer
+	// answers with a UPD, in case one was lost
+	windowProbeInterval = 100 * time.Millisecond
+)
+
+// protoVersion returns the protocol version spoken on the session,
+// the configured one until a negotiating server heard its peer
+func (s *Session) protoVersion() byte {
+	if v := atomic.LoadInt32(&s.version); v != 0 {
+		return byte(v)
+	}
+	return byte(s.config.Version)
+}
+
+// upstream reports whether the peer speaks a protocol of xtaci/smux,
+// with UpstreamCompat or version 2, which reads no payload but those
+// of PSH and UPD frames and knows no BYE or GOA
+func (s *Session) upstream() bool {
+	return s.config.UpstreamCompat || s.protoVersion() == 2
+}
+
+// checkVersion accepts the version of a received frame. A server
+// configured for version 2 follows the version of its client.
+func (s *Session) checkVersion(ver byte) bool {
+	expected := atomic.LoadInt32(&s.version)
+	if expected != 0 {
+		return int32(ver) == expected
+	}
+	if ver != 1 && ver != 2 {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&s.version, 0, int32(ver)) {
+		s.log(LevelDebug, "protocol version negotiated", "version", ver)
+	}
+	return int32(ver) == atomic.LoadInt32(&s.version)
+}
+
+// windowUpdate handles a UPD frame, it returns false when the frame
+// is malformed
+func (s *Session) windowUpdate(f Frame) bool {
+	if len(f.data) != updSize {
+		s.protocolViolation("malformed window update", "sid", f.sid)
+		return false
+	}
+	if stream, ok := s.streams.get(f.sid); ok {
+		atomic.StoreUint32(&stream.peerConsumed, binary.LittleEndian.Uint32(f.data))
+		atomic.StoreUint32(&stream.peerWindow, binary.LittleEndian.Uint32(f.data[4:]))
+		stream.notifyUpdate()
+	}
+	return true
+}
+
+// notifyUpdate wakes a write waiting for the window
+func (s *Stream) notifyUpdate() {
+	select {
+	case s.chUpdate <- struct{}{}:
+	default:
+	}
+}
+
+// flowControlled reports whether streams have their own window, with
+// protocol version 2 and yamux
+func (s *Session) flowControlled() bool {
+	return s.config.Yamux || s.protoVersion() == 2
+}
+
+// streamWindowLimit returns the most data a stream may have unread
+// under flow control, the window granted to the peer, or 0 without
+// flow control. The peer may use the initial window before the first
+// update.
+func (s *Session) streamWindowLimit() int {
+	if !s.flowControlled() {
+		return 0
+	}
+	if s.config.MaxStreamBuffer > initialPeerWindow {
+		return s.config.MaxStreamBuffer
+	}
+	return initialPeerWindow
+}
+
+// windowUpdate is a pending update of the window of a stream
+type windowUpdate struct {
+	consumed uint32 // bytes read in total
+	delta    uint32 // bytes read since the last update
+}
+
+// accountRead counts n bytes read by the application and returns
+// the window update to send to the peer, if one is due. The
+// bufferLock must be held.
+func (s *Stream) accountRead(n int) (upd windowUpdate, due bool) {
+	if n <= 0 || !s.sess.flowControlled() {
+		return upd, false
+	}
+	s.numRead += uint32(n)
+	s.incr += uint32(n)
+	// the first read opens the window, later ones once half of it
+	// was consumed
+	if s.incr >= uint32(s.sess.config.MaxStreamBuffer/2) || s.numRead == uint32(n) {
+		upd = windowUpdate{consumed: s.numRead, delta: s.incr}
+		s.incr = 0
+		return upd, true
+	}
+	return upd, false
+}
+
+// sendWindowUpdate tells the peer how much of the stream was read, as
+// a total with version 2 and as a delta with yamux
+func (s *Stream) sendWindowUpdate(upd windowUpdate) error {
+	var f Frame
+	if s.sess.config.Yamux {
+		f = newFrame(cmdWND, s.id)
+		f.data = make([]byte, 4)
+		binary.LittleEndian.PutUint32(f.data, upd.delta)
+	} else {
+		f = newFrame(cmdUPD, s.id)
+		f.data = make([]byte, updSize)
+		binary.LittleEndian.PutUint32(f.data, upd.consumed)
+		binary.LittleEndian.PutUint32(f.data[4:], uint32(s.sess.config.MaxStreamBuffer))
+	}
+	_, err := s.sess.writeFrame(f)
+	return err
+}
+
+// sendWindow returns how many bytes may be sent before the peer's
+// window is full, a frame at a time without flow control
+func (s *Stream) sendWindow() int {
+	if !s.sess.flowControlled() {
+		return s.frameSize
+	}
+	inflight := atomic.LoadUint32(&s.numWritten) - atomic.LoadUint32(&s.peerConsumed)
+	return int(int32(atomic.LoadUint32(&s.peerWindow) - inflight))
+}
+
+// answerProbe sends the peer probing the window of the stream its
+// current state again
+func (s *Stream) answerProbe() {
+	s.bufferLock.Lock()
+	upd := windowUpdate{consumed: s.numRead}
+	s.bufferLock.Unlock()
+	s.sendWindowUpdate(upd)
+}
+
+// waitWindow blocks until the peer opens its window, a stream reset
+// by the peer never gets it opened. With version 2 the window is
+// probed when no UPD comes, the caller checks it again.
+func (s *Stream) waitWindow(deadline <-chan struct{}) error {
+	var probe <-chan time.Time
+	if s.sess.protoVersion() == 2 {
+		timer := time.NewTimer(windowProbeInterval)
+		defer timer.Stop()
+		probe = timer.C
+	}
+	select {
+	case <-s.chUpdate:
+		if atomic.LoadInt32(&s.rstflag) == 1 {
+			return errors.New(errBrokenPipe)
+		}
+		return nil
+	case <-probe:
+		_, err := s.sess.writeFrame(newFrame(cmdPSH, s.id))
+		return err
+	case <-s.die:
+		return s.dieError()
+	case <-deadline:
+		return errTimeout
+	}
+}
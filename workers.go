@@ -0,0 +1,41 @@
+package smux
+
+// cryptoQueueSize is the number of frames waiting for each crypto
+// worker, frames queued there are not charged to the receive buffer
+const cryptoQueueSize = 16
+
+// startCryptoWorkers starts n goroutines decrypting received stream
+// data, the frames of a stream all go to the same worker so that
+// they are delivered in order
+func (s *Session) startCryptoWorkers(n int) {
+	s.cryptoWorkers = make([]chan Frame, n)
+	for k := range s.cryptoWorkers {
+		s.cryptoWorkers[k] = make(chan Frame, cryptoQueueSize)
+		go s.cryptoWorker(s.cryptoWorkers[k])
+	}
+}
+
+// queueCrypto passes a RST or PSH frame to the worker of its stream,
+// resets follow the same path to stay behind the data
+func (s *Session) queueCrypto(f Frame) bool {
+	select {
+	case s.cryptoWorkers[f.sid%uint32(len(s.cryptoWorkers))] <- f:
+		return true
+	case <-s.die:
+		return false
+	}
+}
+
+func (s *Session) cryptoWorker(frames <-chan Frame) {
+	for {
+		select {
+		case f := <-frames:
+			if !s.deliver(f) {
+				s.Close()
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package smux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// yamux framing, as spoken by hashicorp/yamux: a 12 bytes header of
+// version, type, flags, stream id and length, big-endian. Only data
+// frames have a payload, the length of the others is a window delta,
+// a ping value or a go away code.
+const (
+	yamuxVersion    = 0
+	yamuxHeaderSize = 12
+
+	yamuxTypeData         = 0
+	yamuxTypeWindowUpdate = 1
+	yamuxTypePing         = 2
+	yamuxTypeGoAway       = 3
+
+	yamuxFlagSYN = 1
+	yamuxFlagACK = 2
+	yamuxFlagFIN = 4
+	yamuxFlagRST = 8
+)
+
+// commands that only exist within a yamux session, on top of those
+// of the smux protocol
+const (
+	cmdACK byte = 0xf0 // acknowledge a stream opened by the peer
+	cmdWND byte = 0xf1 // window delta granted by the peer
+	cmdFIN byte = 0xf2 // the peer is done writing, the stream stays open
+)
+
+// yamuxReader splits the yamux frames read from the connection into
+// the frames of the session, handed out one at a time
+type yamuxReader struct {
+	before   []Frame // frames preceding the data, such as a SYN
+	dataSid  uint32  // stream of the data being read
+	dataLeft int     // bytes of the data frame still unread
+	after    []Frame // frames following the data, such as a FIN
+}
+
+// frameHeaderSize returns the size of frame headers on the wire
+func (s *Session) frameHeaderSize() int {
+	if s.config.Yamux {
+		return yamuxHeaderSize
+	}
+	return headerSize
+}
+
+// encodeFrame appends the wire encoding of f to buf
+func (s *Session) encodeFrame(buf []byte, f Frame) []byte {
+	if s.config.Yamux {
+		return appendYamuxFrame(buf, f)
+	}
+	return appendFrame(buf, f)
+}
+
+// readYamuxFrame returns the next frame of a yamux session, data is
+// read in pieces of at most MaxFrameSize
+func (s *Session) readYamuxFrame() (f Frame, err error) {
+	r := &s.yamux
+	for {
+		if len(r.before) > 0 {
+			f, r.before = r.before[0], r.before[1:]
+			return f, nil
+		}
+		if r.dataLeft > 0 {
+			f = newFrame(cmdPSH, r.dataSid)
+			n := r.dataLeft
+			if n > s.config.MaxFrameSize {
+				n = s.config.MaxFrameSize
+			}
+			f.data = s.segmentPool.Get().([]byte)[:n]
+			if _, err := io.ReadFull(s.reader, f.data); err != nil {
+				return f, errors.Wrap(err, "readFrame")
+			}
+			r.dataLeft -= n
+			s.recvRate.add(n)
+			return f, nil
+		}
+		if len(r.after) > 0 {
+			f, r.after = r.after[0], r.after[1:]
+			return f, nil
+		}
+		if err := s.readYamuxHeader(); err != nil {
+			return f, err
+		}
+	}
+}
+
+// readYamuxHeader reads a yamux header and queues the frames it
+// stands for
+func (s *Session) readYamuxHeader() error {
+	var hdr [yamuxHeaderSize]byte
+	if _, err := io.ReadFull(s.reader, hdr[:]); err != nil {
+		return errors.Wrap(err, "readFrame")
+	}
+	s.recvRate.add(yamuxHeaderSize)
+	if hdr[0] != yamuxVersion {
+		return s.protocolViolation(errInvalidProtocol, "version", hdr[0])
+	}
+	typ := hdr[1]
+	flags := binary.BigEndian.Uint16(hdr[2:])
+	sid := binary.BigEndian.Uint32(hdr[4:])
+	length := binary.BigEndian.Uint32(hdr[8:])
+
+	r := &s.yamux
+	switch typ {
+	case yamuxTypeData, yamuxTypeWindowUpdate:
+		if flags&yamuxFlagSYN != 0 {
+			r.before = append(r.before, newFrame(cmdSYN, sid))
+		}
+		if typ == yamuxTypeData {
+			if limit := s.streamWindowLimit(); int64(length) > int64(limit) {
+				return s.protocolViolation(errFrameTooLarge, "sid", sid, "length", length, "limit", limit)
+			}
+			r.dataSid, r.dataLeft = sid, int(length)
+		} else if length > 0 {
+			f := newFrame(cmdWND, sid)
+			f.data = make([]byte, 4)
+			binary.LittleEndian.PutUint32(f.data, length)
+			r.before = append(r.before, f)
+		}
+		if flags&yamuxFlagRST != 0 {
+			r.after = append(r.after, newFrame(cmdRST, sid))
+		} else if flags&yamuxFlagFIN != 0 {
+			r.after = append(r.after, newFrame(cmdFIN, sid))
+		}
+	case yamuxTypePing:
+		kind := nopPing
+		if flags&yamuxFlagACK != 0 {
+			kind = nopPong
+		}
+		r.before = append(r.before, newNOPFrame(kind, length))
+	case yamuxTypeGoAway:
+		if length == 0 {
+			r.before = append(r.before, newFrame(cmdGOA, 0))
+		} else {
+			f := newFrame(cmdBYE, 0)
+			f.data = encodeSessionError(length, "go away", maxControlSize)
+			r.before = append(r.before, f)
+		}
+	default:
+		return s.protocolViolation("unknown yamux type", "type", typ)
+	}
+	return nil
+}
+
+// appendYamuxFrame encodes f as a yamux frame at the end of buf
+func appendYamuxFrame(buf []byte, f Frame) []byte {
+	var typ byte
+	var flags uint16
+	var length uint32
+	var data []byte
+	switch f.cmd {
+	case cmdSYN:
+		typ, flags = yamuxTypeWindowUpdate, yamuxFlagSYN
+	case cmdACK:
+		typ, flags = yamuxTypeWindowUpdate, yamuxFlagACK
+	case cmdWND:
+		typ, length = yamuxTypeWindowUpdate, binary.LittleEndian.Uint32(f.data)
+	case cmdFIN:
+		typ, flags = yamuxTypeWindowUpdate, yamuxFlagFIN
+	case cmdRST:
+		typ, flags = yamuxTypeWindowUpdate, yamuxFlagRST
+	case cmdPSH:
+		typ, length, data = yamuxTypeData, uint32(len(f.data)), f.data
+	case cmdNOP:
+		typ, flags = yamuxTypePing, yamuxFlagSYN
+		if len(f.data) >= nopPayloadSize {
+			if f.data[0] == nopPong {
+				flags = yamuxFlagACK
+			}
+			length = binary.LittleEndian.Uint32(f.data[1:])
+		}
+	case cmdGOA:
+		typ = yamuxTypeGoAway
+	case cmdBYE:
+		typ = yamuxTypeGoAway
+		length = decodeSessionError(f.data).Code
+	}
+
+	var hdr [yamuxHeaderSize]byte
+	hdr[0] = yamuxVersion
+	hdr[1] = typ
+	binary.BigEndian.PutUint16(hdr[2:], flags)
+	binary.BigEndian.PutUint32(hdr[4:], f.sid)
+	binary.BigEndian.PutUint32(hdr[8:], length)
+	buf = append(buf, hdr[:]...)
+	return append(buf, data...)
+}
+
+// windowDelta handles the window granted by a yamux peer
+func (s *Session) windowDelta(f Frame) {
+	if stream, ok := s.streams.get(f.sid); ok {
+		atomic.AddUint32(&stream.peerWindow, binary.LittleEndian.Uint32(f.data))
+		stream.notifyUpdate()
+	}
+}
+
+// closeFrame returns the frame a plain Close of stream sid sends:
+// yamux half-closes the stream with a FIN, the peer may still write
+// until it closes its own side
+func (s *Session) closeFrame(sid uint32) Frame {
+	if s.config.Yamux {
+		return newFrame(cmdFIN, sid)
+	}
+	return newFrame(cmdRST, sid)
+}
+
+// halfClose handles the FIN of a yamux peer, the reads of the stream
+// return io.EOF once the data received was read, its writes go on
+func (s *Session) halfClose(f Frame) {
+	if stream, ok := s.streams.get(f.sid); ok {
+		atomic.StoreInt32(&stream.finflag, 1)
+		stream.notifyReadEvent()
+	}
+}